@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+
+	"github.com/tendant/filededup/pkg/agent"
+	"github.com/tendant/filededup/pkg/archive"
+)
+
+// runArchive scans with the agent and writes the records to a signed archive
+func runArchive(a *agent.Agent, path, keyFile string) error {
+	if keyFile == "" {
+		return errors.New("-archive requires -archive-key")
+	}
+	key, err := archive.LoadPrivateKey(keyFile)
+	if err != nil {
+		return err
+	}
+
+	w, err := archive.Create(path, key)
+	if err != nil {
+		return err
+	}
+	if err := a.WithArchive(w).Run(); err != nil {
+		w.Abort()
+		return err
+	}
+	if a.Stats.SendErrors > 0 {
+		w.Abort()
+		return fmt.Errorf("failed to write %d batches to the archive", a.Stats.SendErrors)
+	}
+
+	// Files the scan could not read or skipped would count as deleted
+	if err := w.Close(a.ArchiveManifest(a.Stats.Complete())); err != nil {
+		return fmt.Errorf("failed to write archive: %w", err)
+	}
+	slog.Info("Scan archive written", "path", path, "files", a.Stats.Files)
+	return nil
+}
+
+// runKeygen creates an archive signing key pair
+func runKeygen(args []string) error {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	out := fs.String("out", "filededup-archive.key", "Private key file; the public key is written to <out>.pub")
+	fs.Parse(args)
+
+	pub, err := archive.GenerateKey(*out)
+	if err != nil {
+		return err
+	}
+	slog.Info("Archive signing key created", "private", *out, "public", *out+".pub", "keyID", archive.KeyID(pub))
+	return nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+
+	"github.com/tendant/filededup/pkg/agent"
+)
+
+// connFlags are the flags every command that talks to the server accepts
+type connFlags struct {
+	server     *string
+	machineID  *string
+	tokenFile  *string
+	caCert     *string
+	clientCert *string
+	clientKey  *string
+}
+
+func addConnFlags(fs *flag.FlagSet) connFlags {
+	return connFlags{
+		server:     fs.String("server", "http://localhost:8080", "Server URL"),
+		machineID:  fs.String("machine-id", "default", "Unique machine identifier"),
+		tokenFile:  fs.String("token-file", "", "File containing the machine token (default $FILEDEDUP_TOKEN)"),
+		caCert:     fs.String("ca-cert", "", "CA certificate (PEM) used to verify the server"),
+		clientCert: fs.String("client-cert", "", "Client certificate (PEM) for mutual TLS"),
+		clientKey:  fs.String("client-key", "", "Client private key (PEM) for mutual TLS"),
+	}
+}
+
+// token loads the machine token from the token file or environment
+func (c connFlags) token() (string, error) {
+	return agent.LoadToken(*c.tokenFile)
+}
+
+// httpClient builds an HTTP client honoring the TLS flags
+func (c connFlags) httpClient() (*http.Client, error) {
+	return agent.NewHTTPClient(agent.TLSOptions{
+		CAFile:   *c.caCert,
+		CertFile: *c.clientCert,
+		KeyFile:  *c.clientKey,
+	})
+}
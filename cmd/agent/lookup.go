@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/tendant/filededup/pkg/agent"
+)
+
+// runLookup hashes local files and lists the copies of their content the
+// server knows about
+func runLookup(args []string) error {
+	fs := flag.NewFlagSet("lookup", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: agent lookup [flags] file...\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	conn := addConnFlags(fs)
+	asJSON := fs.Bool("json", false, "Print the results as JSON")
+	verbose := fs.Bool("verbose", false, "Enable verbose logging")
+
+	// Allow flags after the files, e.g. "agent lookup report.pdf -json"
+	var files []string
+	for {
+		fs.Parse(args)
+		if fs.NArg() == 0 {
+			break
+		}
+		files = append(files, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	if len(files) == 0 {
+		fs.Usage()
+		return errors.New("no files given")
+	}
+
+	// The results go to stdout, so keep logs on stderr
+	setupLogging(os.Stderr, *verbose)
+
+	token, err := conn.token()
+	if err != nil {
+		return err
+	}
+	httpClient, err := conn.httpClient()
+	if err != nil {
+		return err
+	}
+	l := agent.NewLookup(*conn.server, *conn.machineID).
+		WithToken(token).
+		WithHTTPClient(httpClient)
+
+	results := make([]agent.LookupResult, 0, len(files))
+	failed := 0
+	for _, file := range files {
+		result, err := l.File(file)
+		if err != nil {
+			slog.Error("Lookup failed", "file", file, "error", err)
+			failed++
+			continue
+		}
+		results = append(results, result)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(results); err != nil {
+			return err
+		}
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		for _, r := range results {
+			note := ""
+			if r.Sampled {
+				note = ", sampled hash"
+			}
+			fmt.Fprintf(w, "%s (%s, %s%s): %d copies elsewhere\n", r.Path, formatBytes(r.Size), r.Hash, note, len(r.Copies))
+			for _, c := range r.Copies {
+				state := c.QuarantineState
+				if c.Alias {
+					state += " (same file as another copy)"
+				}
+				fmt.Fprintf(w, "  %s\t%s\t%s\t%s\t%s\n", c.MachineID, c.Path, c.Filename,
+					c.MTime.Format(time.DateTime), state)
+			}
+			if r.Truncated {
+				fmt.Fprintln(w, "  ...\tmore copies not listed")
+			}
+		}
+		w.Flush()
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("failed to look up %d of %d files", failed, len(files))
+	}
+	return nil
+}
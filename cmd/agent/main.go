@@ -4,8 +4,10 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
+	"strings"
 
 	"github.com/tendant/filededup/pkg/agent"
 )
@@ -24,51 +26,124 @@ func formatBytes(bytes int64) string {
 	return fmt.Sprintf("%.1f %cB", float64(bytes)/float64(div), "KMGTPE"[exp])
 }
 
-func main() {
-	// Set up structured logging
-	logHandler := slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
-		Level: slog.LevelDebug,
+// setupLogging installs the default structured logger writing to w
+func setupLogging(w io.Writer, verbose bool) {
+	level := slog.LevelInfo
+	if verbose {
+		level = slog.LevelDebug
+	}
+	logHandler := slog.NewTextHandler(w, &slog.HandlerOptions{
+		Level: level,
 	})
 	slog.SetDefault(slog.New(logHandler))
-	
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: agent [command] [flags]
+
+Commands:
+  run          Scan a directory and upload file records (default)
+  scan         Scan directories offline and report duplicates without a server
+  keygen       Create a key pair for signing scan archives
+  quarantine   Move non-keeper copies of duplicates into a quarantine directory
+  purge        Remove quarantined files older than the retention period
+  restore      Move quarantined files back to their original location
+  lookup       List where else the content of local files exists
+
+Run "agent <command> -h" for command flags.
+`)
+}
+
+func main() {
+	// Set up structured logging
+	setupLogging(os.Stdout, true)
+
+	// The scan is the default command so existing invocations keep working
+	cmd, args := "run", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+
+	var err error
+	switch cmd {
+	case "run":
+		err = runScan(args)
+	case "scan":
+		err = runOffline(args)
+	case "keygen":
+		err = runKeygen(args)
+	case "quarantine":
+		err = runQuarantine(args)
+	case "purge":
+		err = runPurge(args)
+	case "restore":
+		err = runRestore(args)
+	case "lookup":
+		err = runLookup(args)
+	case "help":
+		usage()
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", cmd)
+		usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		slog.Error("Agent failed", "command", cmd, "error", err)
+		os.Exit(1)
+	}
+}
+
+func runScan(args []string) error {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+
 	// Basic configuration
-	dir := flag.String("dir", ".", "Directory to scan")
-	server := flag.String("server", "http://localhost:8080", "Server URL")
-	machineID := flag.String("machine-id", "default", "Unique machine identifier")
-	batchSize := flag.Int("batch", 1000, "Number of files per batch")
-	
+	dir := fs.String("dir", ".", "Directory to scan")
+	conn := addConnFlags(fs)
+	batchSize := fs.Int("batch", 1000, "Number of files per batch")
+	exclude := fs.String("exclude", "", "Comma-separated directories to skip (e.g. the quarantine directory)")
+	archivePath := fs.String("archive", "", "Write a signed scan archive to this file instead of uploading")
+	archiveKey := fs.String("archive-key", "", "Private key used to sign the archive (see agent keygen)")
+
 	// Performance tuning options
-	workers := flag.Int("workers", 0, "Number of parallel workers (0 = auto)")
-	queueSize := flag.Int("queue-size", 0, "Size of processing queues (0 = auto)")
-	verbose := flag.Bool("verbose", false, "Enable verbose logging")
-	skipLarge := flag.Bool("skip-large", false, "Skip files larger than the size limit")
-	maxSize := flag.Int64("max-size", 1024*1024*1024, "Maximum file size to process in bytes (default 1GB)")
-	
-	flag.Parse()
-	
+	workers := fs.Int("workers", 0, "Number of parallel workers (0 = auto)")
+	queueSize := fs.Int("queue-size", 0, "Size of processing queues (0 = auto)")
+	verbose := fs.Bool("verbose", false, "Enable verbose logging")
+	skipLarge := fs.Bool("skip-large", false, "Skip files larger than the size limit")
+	maxSize := fs.Int64("max-size", 1024*1024*1024, "Maximum file size to process in bytes (default 1GB)")
+	scrub := fs.Bool("scrub", false, "Also hash large files completely to find corruption and read errors the sampled hash would skip")
+	metricsOpts := addMetricsFlags(fs)
+
+	fs.Parse(args)
+
 	// Set log level based on verbose flag
-	if *verbose {
-		logHandler = slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
-			Level: slog.LevelDebug,
-		})
-	} else {
-		logHandler = slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
-			Level: slog.LevelInfo,
-		})
-	}
-	slog.SetDefault(slog.New(logHandler))
-	
-	slog.Info("Starting file deduplication agent", 
+	setupLogging(os.Stdout, *verbose)
+
+	slog.Info("Starting file deduplication agent",
 		"dir", *dir,
-		"server", *server,
-		"machineID", *machineID,
+		"server", *conn.server,
+		"machineID", *conn.machineID,
 		"batchSize", *batchSize,
 		"skipLarge", *skipLarge,
-		"maxSize", formatBytes(*maxSize))
+		"maxSize", formatBytes(*maxSize),
+		"scrub", *scrub)
+
+	token, err := conn.token()
+	if err != nil {
+		return err
+	}
+	httpClient, err := conn.httpClient()
+	if err != nil {
+		return err
+	}
 
 	// Create agent with configuration
-	a := agent.New(*dir, *server, *machineID, *batchSize)
-	
+	a := agent.New(*dir, *conn.server, *conn.machineID, *batchSize).
+		WithToken(token).
+		WithHTTPClient(httpClient).
+		WithScrub(*scrub)
+
 	// Apply performance tuning if specified
 	if *workers > 0 {
 		a.WithWorkers(*workers)
@@ -76,17 +151,28 @@ func main() {
 	if *queueSize > 0 {
 		a.WithQueueSize(*queueSize)
 	}
-	
+
 	// Configure file size limits
 	if *skipLarge {
 		a.WithMaxFileSize(*maxSize)
 	}
-	
+
+	if *exclude != "" {
+		a.WithExclude(strings.Split(*exclude, ",")...)
+	}
+
+	stopMetrics := metricsOpts.start(a)
+	defer stopMetrics()
+
+	if *archivePath != "" {
+		return runArchive(a, *archivePath, *archiveKey)
+	}
+
 	// Run the agent
 	if err := a.Run(); err != nil {
-		slog.Error("Agent failed", "error", err)
-		os.Exit(1)
+		return err
 	}
-	
+
 	slog.Info("Agent completed successfully")
+	return nil
 }
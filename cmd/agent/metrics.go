@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/tendant/filededup/pkg/agent"
+)
+
+// pushInterval is how often metrics are pushed while a scan is running
+const pushInterval = 15 * time.Second
+
+// metricsFlags are the flags that expose agent metrics
+type metricsFlags struct {
+	listen *string
+	push   *string
+}
+
+func addMetricsFlags(fs *flag.FlagSet) metricsFlags {
+	return metricsFlags{
+		listen: fs.String("metrics-listen", "", "Serve Prometheus metrics on this address while scanning (e.g. :9101)"),
+		push:   fs.String("metrics-push", "", "Push Prometheus metrics to this pushgateway URL during and after the scan"),
+	}
+}
+
+// start enables metrics on the agent if requested. The returned function
+// stops the listener and sends a final push once the scan is done.
+func (f metricsFlags) start(a *agent.Agent) func() {
+	if *f.listen == "" && *f.push == "" {
+		return func() {}
+	}
+	m := agent.NewMetrics()
+	a.WithMetrics(m)
+
+	var srv *http.Server
+	if *f.listen != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", m.Handler())
+		srv = &http.Server{Addr: *f.listen, Handler: mux}
+		go func() {
+			slog.Info("Serving metrics", "addr", *f.listen)
+			if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				slog.Warn("Metrics listener failed", "error", err)
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	pushed := make(chan struct{})
+	go func() {
+		defer close(pushed)
+		if *f.push == "" {
+			return
+		}
+		ticker := time.NewTicker(pushInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := m.Push(*f.push, a.MachineID); err != nil {
+					slog.Debug("Failed to push metrics", "error", err)
+				}
+			case <-done:
+				if err := m.Push(*f.push, a.MachineID); err != nil {
+					slog.Warn("Failed to push metrics", "gateway", *f.push, "error", err)
+				}
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-pushed
+		if srv != nil {
+			srv.Close()
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/tendant/filededup/pkg/agent"
+)
+
+// quarantineFlags are shared by the quarantine, purge and restore commands
+type quarantineFlags struct {
+	conn    connFlags
+	dir     *string
+	dryRun  *bool
+	verbose *bool
+}
+
+func addQuarantineFlags(fs *flag.FlagSet) quarantineFlags {
+	return quarantineFlags{
+		conn:    addConnFlags(fs),
+		dir:     fs.String("quarantine-dir", "", "Quarantine directory (required)"),
+		dryRun:  fs.Bool("dry-run", false, "Only log what would be done"),
+		verbose: fs.Bool("verbose", false, "Enable verbose logging"),
+	}
+}
+
+func (f quarantineFlags) quarantine() (*agent.Quarantine, error) {
+	setupLogging(os.Stdout, *f.verbose)
+	if *f.dir == "" {
+		return nil, errors.New("-quarantine-dir is required")
+	}
+	token, err := f.conn.token()
+	if err != nil {
+		return nil, err
+	}
+	httpClient, err := f.conn.httpClient()
+	if err != nil {
+		return nil, err
+	}
+	return agent.NewQuarantine(*f.dir, *f.conn.server, *f.conn.machineID).
+		WithToken(token).
+		WithHTTPClient(httpClient).
+		WithDryRun(*f.dryRun), nil
+}
+
+func runQuarantine(args []string) error {
+	fs := flag.NewFlagSet("quarantine", flag.ExitOnError)
+	qf := addQuarantineFlags(fs)
+	root := fs.String("dir", "", "Only quarantine copies under this directory (default: anywhere)")
+	fs.Parse(args)
+
+	q, err := qf.quarantine()
+	if err != nil {
+		return err
+	}
+	q.WithRoot(*root)
+
+	slog.Info("Quarantining duplicate files", "quarantineDir", q.Dir, "root", q.RootDir, "machineID", q.MachineID, "dryRun", q.DryRun)
+	return q.Run()
+}
+
+func runPurge(args []string) error {
+	fs := flag.NewFlagSet("purge", flag.ExitOnError)
+	qf := addQuarantineFlags(fs)
+	retention := fs.Duration("retention", 30*24*time.Hour, "Keep quarantined files at least this long")
+	fs.Parse(args)
+
+	q, err := qf.quarantine()
+	if err != nil {
+		return err
+	}
+	q.WithRetention(*retention)
+
+	slog.Info("Purging quarantine", "quarantineDir", q.Dir, "retention", q.Retention, "dryRun", q.DryRun)
+	return q.Purge()
+}
+
+func runRestore(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	qf := addQuarantineFlags(fs)
+	batch := fs.String("batch", "", "Only restore from this quarantine batch")
+	fs.Parse(args)
+
+	q, err := qf.quarantine()
+	if err != nil {
+		return err
+	}
+
+	slog.Info("Restoring quarantined files", "quarantineDir", q.Dir, "batch", *batch, "paths", fs.NArg(), "dryRun", q.DryRun)
+	return q.Restore(*batch, fs.Args())
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/tendant/filededup/pkg/agent"
+)
+
+// runOffline scans directories without a server and prints the duplicate report
+func runOffline(args []string) error {
+	fs := flag.NewFlagSet("scan", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: agent scan [flags] [dir...]\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	format := fs.String("format", agent.FormatText, "Report format: text, json or csv")
+	output := fs.String("output", "", "Write the report to this file (default stdout)")
+	exclude := fs.String("exclude", "", "Comma-separated directories to skip")
+	workers := fs.Int("workers", 0, "Number of parallel workers (0 = auto)")
+	verbose := fs.Bool("verbose", false, "Enable verbose logging")
+	skipLarge := fs.Bool("skip-large", false, "Skip files larger than the size limit")
+	maxSize := fs.Int64("max-size", 1024*1024*1024, "Maximum file size to process in bytes (default 1GB)")
+
+	// Allow flags after the directories, e.g. "agent scan /data -format json"
+	var dirs []string
+	for {
+		fs.Parse(args)
+		if fs.NArg() == 0 {
+			break
+		}
+		dirs = append(dirs, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	if len(dirs) == 0 {
+		dirs = []string{"."}
+	}
+
+	switch *format {
+	case agent.FormatText, agent.FormatJSON, agent.FormatCSV:
+	default:
+		return fmt.Errorf("unknown format %q", *format)
+	}
+
+	// The report goes to stdout, so keep logs on stderr
+	setupLogging(os.Stderr, *verbose)
+
+	collector := agent.NewCollector()
+	for _, dir := range dirs {
+		a := agent.New(dir, "", "", 1000).WithSink(collector.Add)
+		if *workers > 0 {
+			a.WithWorkers(*workers)
+		}
+		if *skipLarge {
+			a.WithMaxFileSize(*maxSize)
+		}
+		if *exclude != "" {
+			a.WithExclude(strings.Split(*exclude, ",")...)
+		}
+		if err := a.Run(); err != nil {
+			return err
+		}
+	}
+
+	out := os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	w := bufio.NewWriter(out)
+	sets := collector.DuplicateSets()
+	if err := agent.WriteReport(w, *format, sets); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if *output != "" {
+		slog.Info("Report written", "path", *output, "sets", len(sets))
+	}
+	return nil
+}
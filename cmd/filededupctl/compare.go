@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/tendant/filededup/pkg/record"
+	"github.com/tendant/filededup/pkg/record/recorddb"
+)
+
+// compareCategories are the comparison categories in report order
+var compareCategories = []string{
+	recorddb.CompareOnlyLeft,
+	recorddb.CompareOnlyRight,
+	recorddb.CompareDifferentPath,
+	recorddb.CompareSamePath,
+}
+
+// runCompare compares two machines or roots by content, e.g. to find what a
+// machine holds that its replacement does not before it is decommissioned
+func runCompare(args []string) int {
+	var leftArg, rightArg, list string
+	var asJSON bool
+	ctx := context.Background()
+	dbConn, code := connect(ctx, "compare", args, func(fs *flag.FlagSet) {
+		fs.StringVar(&leftArg, "left", "", "Left side as machine:/root or machine (required)")
+		fs.StringVar(&rightArg, "right", "", "Right side as machine:/root or machine (required)")
+		fs.StringVar(&list, "list", recorddb.CompareOnlyLeft, "Comma-separated categories to list: "+strings.Join(compareCategories, ", ")+", all or none")
+		fs.BoolVar(&asJSON, "json", false, "Print the complete comparison as JSON")
+	})
+	if dbConn == nil {
+		return code
+	}
+	defer dbConn.Close()
+
+	left, err := record.ParseCompareSide(leftArg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -left: %v\n", err)
+		return 2
+	}
+	right, err := record.ParseCompareSide(rightArg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -right: %v\n", err)
+		return 2
+	}
+	listed := make(map[string]bool)
+	for _, c := range strings.Split(list, ",") {
+		switch c = strings.TrimSpace(c); c {
+		case "all":
+			for _, c := range compareCategories {
+				listed[c] = true
+			}
+		case "none", "":
+		case recorddb.CompareOnlyLeft, recorddb.CompareOnlyRight, recorddb.CompareSamePath, recorddb.CompareDifferentPath:
+			listed[c] = true
+		default:
+			fmt.Fprintf(os.Stderr, "Unknown category %q\n", c)
+			return 2
+		}
+	}
+
+	result, err := record.Compare(ctx, recorddb.New(dbConn), left, right, 0)
+	if err != nil {
+		slog.Error("Failed to compare", "left", left, "right", right, "error", err)
+		return 1
+	}
+
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(result); err != nil {
+			slog.Error("Failed to write comparison", "error", err)
+			return 1
+		}
+		return 0
+	}
+
+	sets := map[string]record.CompareSet{
+		recorddb.CompareOnlyLeft:      result.OnlyLeft,
+		recorddb.CompareOnlyRight:     result.OnlyRight,
+		recorddb.CompareSamePath:      result.SamePath,
+		recorddb.CompareDifferentPath: result.DifferentPath,
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CATEGORY\tNAME\tSIZE\tRIGHT NAMES")
+	for _, c := range compareCategories {
+		if !listed[c] {
+			continue
+		}
+		for _, f := range sets[c].Files {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", c, f.Name, formatBytes(f.Size), strings.Join(f.OtherNames, ", "))
+		}
+	}
+	w.Flush()
+
+	fmt.Fprintf(os.Stderr, "Comparing %s with %s by content:\n", left, right)
+	for _, c := range compareCategories {
+		fmt.Fprintf(os.Stderr, "  %-15s %d files (%s)\n", c, sets[c].FileCount, formatBytes(sets[c].Bytes))
+	}
+	return 0
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/tendant/filededup/pkg/migrate"
+	"github.com/tendant/filededup/pkg/record/recorddb"
+)
+
+// expectedIndexes are the indexes created by the embedded migrations
+var expectedIndexes = []string{
+	"anomaly_alerts_pkey",
+	"anomaly_alerts_session_id_key",
+	"anomaly_alerts_created_idx",
+	"anomaly_alerts_machine_idx",
+	"contents_pkey",
+	"contents_algorithm_hash_key",
+	"contents_duplicates_idx",
+	"duplicate_groups_pkey",
+	"duplicate_groups_content_id_key",
+	"duplicate_groups_active_idx",
+	"duplicate_groups_changed_idx",
+	"file_history_pkey",
+	"file_history_location_idx",
+	"file_history_previous_idx",
+	"file_history_session_idx",
+	"file_instances_pkey",
+	"file_instances_machine_id_path_filename_key",
+	"file_instances_content_idx",
+	"file_instances_session_idx",
+	"file_instances_machine_seen_idx",
+	"file_instances_inode_idx",
+	"keepers_file_idx",
+	"integrity_events_pkey",
+	"integrity_events_detected_idx",
+	"integrity_events_machine_idx",
+	"keepers_pkey",
+	"machines_pkey",
+	"machine_tokens_pkey",
+	"machine_tokens_token_hash_key",
+	"scan_sessions_pkey",
+	"scan_sessions_archive_id_key",
+	"scan_sessions_machine_idx",
+	"scan_sessions_finished_idx",
+	"mv_stats_machines_key",
+	"mv_stats_directories_key",
+	"mv_stats_directories_wasted_idx",
+	"mv_stats_size_buckets_key",
+	"mv_stats_extensions_key",
+	"stats_snapshots_pkey",
+}
+
+// Doctor results, in increasing severity
+const (
+	statusOK   = "ok"
+	statusWarn = "warn"
+	statusFail = "fail"
+)
+
+// finding is the outcome of one doctor check
+type finding struct {
+	check  string
+	status string
+	detail string
+}
+
+// runDoctor checks the schema version, the indexes and orphaned rows. It
+// exits 1 if a check fails; warnings do not change the exit code.
+func runDoctor(args []string) int {
+	var sessionAge time.Duration
+	ctx := context.Background()
+	dbConn, code := connect(ctx, "doctor", args, func(fs *flag.FlagSet) {
+		fs.DurationVar(&sessionAge, "session-age", 24*time.Hour, "Report scan sessions still running after this long")
+	})
+	if dbConn == nil {
+		return code
+	}
+	defer dbConn.Close()
+	q := recorddb.New(dbConn)
+
+	var findings []finding
+	add := func(check, status, format string, a ...any) {
+		findings = append(findings, finding{check: check, status: status, detail: fmt.Sprintf(format, a...)})
+	}
+
+	// Schema version
+	if m, err := migrate.New(dbConn); err != nil {
+		add("schema", statusFail, "failed to load migrations: %v", err)
+	} else if status, err := m.Status(ctx); err != nil {
+		add("schema", statusFail, "failed to read migration status: %v", err)
+	} else {
+		var current int64
+		var pending int
+		for _, s := range status {
+			if s.Applied {
+				current = s.Version
+			} else {
+				pending++
+			}
+		}
+		if unknown := migrate.Unknown(status, m.Latest()); len(unknown) > 0 {
+			add("schema", statusFail, "version %d is newer than this build (latest %d); upgrade filededupctl", current, m.Latest())
+		} else if pending > 0 {
+			add("schema", statusFail, "version %d, %d pending migrations (latest %d); run server migrate up", current, pending, m.Latest())
+		} else {
+			add("schema", statusOK, "version %d", current)
+		}
+	}
+
+	// Indexes
+	if indexes, err := q.ListIndexes(ctx); err != nil {
+		add("indexes", statusFail, "failed to list indexes: %v", err)
+	} else {
+		present := make(map[string]bool, len(indexes))
+		for _, name := range indexes {
+			present[name] = true
+		}
+		var missing []string
+		for _, name := range expectedIndexes {
+			if !present[name] {
+				missing = append(missing, name)
+			}
+		}
+		if len(missing) > 0 {
+			add("indexes", statusFail, "missing %v", missing)
+		} else {
+			add("indexes", statusOK, "%d expected indexes present", len(expectedIndexes))
+		}
+	}
+
+	// Orphaned rows
+	orphans := []struct {
+		check string
+		count func(context.Context) (int64, error)
+		what  string
+	}{
+		{"unregistered machines", q.CountUnregisteredMachineFiles, "files from machines that never registered"},
+		{"dangling sessions", q.CountDanglingFileSessions, "files referencing a missing scan session"},
+		{"dangling keepers", q.CountDanglingKeepers, "keepers whose file no longer exists; run filededupctl vacuum"},
+		{"stale keepers", q.CountStaleKeepers, "keepers whose file no longer has the set's content"},
+		{"aliases", q.CountAliasDrift, "files shared by volume and inode not counted exactly once; run filededupctl vacuum"},
+		{"instance counts", q.CountInstanceCountDrift, "contents with a wrong instance count; run filededupctl vacuum"},
+		{"duplicate groups", q.CountDuplicateGroupDrift, "contents whose duplicate group is out of date; run filededupctl vacuum"},
+		{"unreferenced contents", q.CountUnreferencedContents, "contents without file instances; run filededupctl vacuum"},
+		{"unfinished sessions", func(ctx context.Context) (int64, error) {
+			return q.CountUnfinishedSessions(ctx, int64(sessionAge/time.Second))
+		}, fmt.Sprintf("scan sessions running for more than %s", sessionAge)},
+	}
+	for _, o := range orphans {
+		n, err := o.count(ctx)
+		switch {
+		case err != nil:
+			add(o.check, statusFail, "query failed: %v", err)
+		case n > 0:
+			add(o.check, statusWarn, "%d %s", n, o.what)
+		default:
+			add(o.check, statusOK, "none")
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CHECK\tSTATUS\tDETAIL")
+	failed := false
+	for _, f := range findings {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", f.check, f.status, f.detail)
+		failed = failed || f.status == statusFail
+	}
+	w.Flush()
+
+	if failed {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,138 @@
+// cmd/filededupctl/main.go
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/tendant/filededup/pkg/config"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: filededupctl <command> [flags]
+
+Commands:
+  doctor          Check schema version, indexes and orphaned rows
+  stats           Show record counts and table sizes
+  vacuum          Vacuum and analyze the tables
+  prune           Remove records a machine has not reported for a while
+  rehash-report   List duplicate sets that rely on sampled hashes
+  rebalance       Show or change the partitioning of the file records
+  compare         Compare two machines or roots by content
+
+Every command accepts the server's database flags and environment
+variables, e.g. -config and -database-url. Run "filededupctl <command> -h"
+for command flags.
+`)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	cmd, args := os.Args[1], os.Args[2:]
+	var run func([]string) int
+	switch cmd {
+	case "doctor":
+		run = runDoctor
+	case "stats":
+		run = runStats
+	case "vacuum":
+		run = runVacuum
+	case "prune":
+		run = runPrune
+	case "rehash-report":
+		run = runRehashReport
+	case "rebalance":
+		run = runRebalance
+	case "compare":
+		run = runCompare
+	case "help", "-h", "-help", "--help":
+		usage()
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", cmd)
+		usage()
+		os.Exit(2)
+	}
+	os.Exit(run(args))
+}
+
+// connect loads the configuration for a command and opens the database. It
+// returns a non-zero exit code if the command cannot continue.
+func connect(ctx context.Context, name string, args []string, register ...func(*flag.FlagSet)) (*pgxpool.Pool, int) {
+	cfg, err := config.Load("filededupctl "+name, args, register...)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil, 0
+		}
+		fmt.Fprintf(os.Stderr, "Invalid configuration: %v\n", err)
+		return nil, 2
+	}
+	// Reports go to stdout, so keep logs on stderr
+	level, _ := cfg.Log.SlogLevel()
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+	if kind, _, _ := config.ParseStore(cfg.Store); kind != config.StorePostgres {
+		fmt.Fprintln(os.Stderr, "filededupctl requires the postgres store")
+		return nil, 2
+	}
+
+	dbConn, err := cfg.Database.Connect(ctx)
+	if err != nil {
+		slog.Error("Failed to connect to database", "error", err)
+		return nil, 1
+	}
+	return dbConn, 0
+}
+
+// age is a duration flag that also accepts whole days, e.g. 30d
+type age time.Duration
+
+func (a *age) String() string {
+	d := time.Duration(*a)
+	if d > 0 && d%(24*time.Hour) == 0 {
+		return strconv.FormatInt(int64(d/(24*time.Hour)), 10) + "d"
+	}
+	return d.String()
+}
+
+func (a *age) Set(s string) error {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid number of days %q", s)
+		}
+		*a = age(time.Duration(n) * 24 * time.Hour)
+		return nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*a = age(d)
+	return nil
+}
+
+// formatBytes converts bytes to a human-readable string (KB, MB, GB, etc.)
+func formatBytes(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/tendant/filededup/pkg/record/recorddb"
+)
+
+// runPrune removes the records of files a machine has not reported within
+// the given age, e.g. after a disk was retired. Quarantined files are kept.
+func runPrune(args []string) int {
+	var machine string
+	var dryRun bool
+	olderThan := age(30 * 24 * time.Hour)
+	ctx := context.Background()
+	dbConn, code := connect(ctx, "prune", args, func(fs *flag.FlagSet) {
+		fs.StringVar(&machine, "machine", "", "Machine whose records are pruned (required)")
+		fs.Var(&olderThan, "older-than", "Remove records not reported for this long, e.g. 30d or 12h")
+		fs.BoolVar(&dryRun, "dry-run", false, "Only count the records that would be removed")
+	})
+	if dbConn == nil {
+		return code
+	}
+	defer dbConn.Close()
+
+	if machine == "" {
+		fmt.Fprintln(os.Stderr, "prune requires -machine")
+		return 2
+	}
+	if olderThan <= 0 {
+		fmt.Fprintln(os.Stderr, "-older-than must be positive")
+		return 2
+	}
+	q := recorddb.New(dbConn)
+	secs := int64(time.Duration(olderThan) / time.Second)
+
+	if dryRun {
+		n, err := q.CountStaleFiles(ctx, recorddb.CountStaleFilesParams{MachineID: machine, OlderThanSecs: secs})
+		if err != nil {
+			slog.Error("Failed to count stale records", "error", err)
+			return 1
+		}
+		slog.Info("Dry run, nothing removed", "machineID", machine, "olderThan", olderThan.String(), "records", n)
+		return 0
+	}
+
+	n, err := q.PruneStaleFiles(ctx, recorddb.PruneStaleFilesParams{MachineID: machine, OlderThanSecs: secs})
+	if err != nil {
+		slog.Error("Prune failed", "error", err)
+		return 1
+	}
+	slog.Info("Stale records removed", "machineID", machine, "olderThan", olderThan.String(), "records", n)
+	return 0
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/tendant/filededup/pkg/record/recorddb"
+)
+
+// runRebalance shows how file records are spread over the partitions of
+// file_instances and, with -partitions, redistributes them over a new number
+// of partitions. Rows are hashed by machine, so one large machine can still
+// dominate a partition; more partitions spread the remaining machines.
+func runRebalance(args []string) int {
+	var partitions int
+	ctx := context.Background()
+	dbConn, code := connect(ctx, "rebalance", args, func(fs *flag.FlagSet) {
+		fs.IntVar(&partitions, "partitions", 0, "Redistribute the records over this many partitions (locks file_instances while running)")
+	})
+	if dbConn == nil {
+		return code
+	}
+	defer dbConn.Close()
+
+	if partitions < 0 {
+		fmt.Fprintln(os.Stderr, "-partitions must be positive")
+		return 2
+	}
+	q := recorddb.New(dbConn)
+
+	if partitions > 0 {
+		start := time.Now()
+		if err := q.RebalanceFilePartitions(ctx, partitions); err != nil {
+			slog.Error("Rebalance failed", "error", err)
+			return 1
+		}
+		slog.Info("Rebalance completed", "partitions", partitions, "duration", time.Since(start).Round(time.Millisecond))
+	}
+
+	parts, err := q.ListFilePartitions(ctx)
+	if err != nil {
+		slog.Error("Failed to list partitions", "error", err)
+		return 1
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PARTITION\tREMAINDER\tROWS\tSIZE")
+	var total, largest int64
+	for _, p := range parts {
+		fmt.Fprintf(w, "%s\t%d/%d\t%d\t%s\n", p.Name, p.Remainder, p.Modulus, p.EstimatedRows, formatBytes(p.TotalBytes))
+		total += p.EstimatedRows
+		largest = max(largest, p.EstimatedRows)
+	}
+	w.Flush()
+
+	// Skew is the largest partition relative to an even spread
+	if len(parts) > 0 && total > 0 {
+		skew := float64(largest) / (float64(total) / float64(len(parts)))
+		fmt.Fprintf(os.Stderr, "%d partitions, about %d rows, largest partition %.1fx the average\n", len(parts), total, skew)
+	}
+	return 0
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"text/tabwriter"
+
+	"github.com/tendant/filededup/pkg/agent"
+	"github.com/tendant/filededup/pkg/record/recorddb"
+)
+
+// runRehashReport lists duplicate sets of files large enough to have been
+// hashed by sampling. Their copies may differ outside the sampled ranges, so
+// they should be compared in full before copies are removed.
+func runRehashReport(args []string) int {
+	ctx := context.Background()
+	dbConn, code := connect(ctx, "rehash-report", args)
+	if dbConn == nil {
+		return code
+	}
+	defer dbConn.Close()
+
+	sets, err := recorddb.New(dbConn).ListSampledDuplicateSets(ctx, agent.SampledHashThreshold)
+	if err != nil {
+		slog.Error("Failed to list duplicate sets", "error", err)
+		return 1
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "HASH\tSIZE\tCOPIES\tMACHINES\tWASTED")
+	var wasted int64
+	for _, s := range sets {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\n", s.Hash, formatBytes(s.Size), s.Copies, s.Machines, formatBytes(s.WastedBytes))
+		wasted += s.WastedBytes
+	}
+	w.Flush()
+	fmt.Fprintf(os.Stderr, "%d duplicate sets (%s wasted) rely on sampled hashes\n", len(sets), formatBytes(wasted))
+	return 0
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/tendant/filededup/pkg/record/recorddb"
+)
+
+// runStats prints record counts per machine, the duplicate summary and table sizes
+func runStats(args []string) int {
+	ctx := context.Background()
+	dbConn, code := connect(ctx, "stats", args)
+	if dbConn == nil {
+		return code
+	}
+	defer dbConn.Close()
+	q := recorddb.New(dbConn)
+
+	summary, err := q.GetDuplicateSummary(ctx)
+	if err != nil {
+		slog.Error("Failed to read duplicate summary", "error", err)
+		return 1
+	}
+	machines, err := q.CountFilesByMachine(ctx)
+	if err != nil {
+		slog.Error("Failed to count files by machine", "error", err)
+		return 1
+	}
+	tables, err := q.ListTableStats(ctx)
+	if err != nil {
+		slog.Error("Failed to read table statistics", "error", err)
+		return 1
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Active files\t%d\n", summary.TotalFiles)
+	fmt.Fprintf(w, "Active bytes\t%s\n", formatBytes(summary.TotalBytes))
+	fmt.Fprintf(w, "Duplicate sets\t%d\n", summary.DuplicateSets)
+	fmt.Fprintf(w, "Duplicate files\t%d\n", summary.DuplicateFiles)
+	fmt.Fprintf(w, "Wasted bytes\t%s\n", formatBytes(summary.WastedBytes))
+	w.Flush()
+
+	sort.Slice(machines, func(i, j int) bool { return machines[i].MachineID < machines[j].MachineID })
+	fmt.Println()
+	fmt.Fprintln(w, "MACHINE\tFILES")
+	for _, m := range machines {
+		fmt.Fprintf(w, "%s\t%d\n", m.MachineID, m.Files)
+	}
+	w.Flush()
+
+	fmt.Println()
+	fmt.Fprintln(w, "TABLE\tROWS\tDEAD ROWS\tSIZE")
+	for _, t := range tables {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\n", t.TableName, t.LiveRows, t.DeadRows, formatBytes(t.TotalBytes))
+	}
+	w.Flush()
+	return 0
+}
+
+// runVacuum repairs aliases, instance counts and duplicate groups, removes
+// dangling keepers and unreferenced contents, reclaims dead rows and refreshes
+// planner statistics
+func runVacuum(args []string) int {
+	var full bool
+	ctx := context.Background()
+	dbConn, code := connect(ctx, "vacuum", args, func(fs *flag.FlagSet) {
+		fs.BoolVar(&full, "full", false, "Rewrite the tables to return space to the OS (locks them while running)")
+	})
+	if dbConn == nil {
+		return code
+	}
+	defer dbConn.Close()
+	q := recorddb.New(dbConn)
+
+	start := time.Now()
+	aliases, err := q.SyncAliases(ctx)
+	if err != nil {
+		slog.Error("Failed to sync aliases", "error", err)
+		return 1
+	}
+	recounted, err := q.RecountInstances(ctx)
+	if err != nil {
+		slog.Error("Failed to recount instances", "error", err)
+		return 1
+	}
+	synced, err := q.SyncDuplicateGroups(ctx)
+	if err != nil {
+		slog.Error("Failed to sync duplicate groups", "error", err)
+		return 1
+	}
+	keepers, err := q.DeleteDanglingKeepers(ctx)
+	if err != nil {
+		slog.Error("Failed to delete dangling keepers", "error", err)
+		return 1
+	}
+	deleted, err := q.DeleteUnreferencedContents(ctx)
+	if err != nil {
+		slog.Error("Failed to delete unreferenced contents", "error", err)
+		return 1
+	}
+	if full {
+		err = q.VacuumFull(ctx)
+	} else {
+		err = q.VacuumAnalyze(ctx)
+	}
+	if err != nil {
+		slog.Error("Vacuum failed", "error", err)
+		return 1
+	}
+	slog.Info("Vacuum completed", "full", full, "aliases_synced", aliases, "recounted", recounted, "groups_synced", synced, "keepers_deleted", keepers, "contents_deleted", deleted, "duration", time.Since(start).Round(time.Millisecond))
+	return 0
+}
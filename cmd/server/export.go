@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/tendant/filededup/pkg/config"
+	"github.com/tendant/filededup/pkg/record"
+	"github.com/tendant/filededup/pkg/record/recorddb"
+)
+
+// runExport implements the export subcommand, streaming duplicate files from
+// the database to a file or stdout
+func runExport(args []string) int {
+	var format, output, machine, pathPrefix string
+	cfg, err := config.Load("server export", args, func(fs *flag.FlagSet) {
+		fs.StringVar(&format, "format", record.ExportCSV, "Export format: csv, ndjson or html")
+		fs.StringVar(&output, "output", "", "Write the export to this file (default stdout)")
+		fs.StringVar(&machine, "machine", "", "Only export duplicate sets with a copy on this machine")
+		fs.StringVar(&pathPrefix, "path-prefix", "", "Only export duplicate sets with a copy under this path")
+	})
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		fmt.Fprintf(os.Stderr, "Invalid configuration: %v\n", err)
+		return 2
+	}
+	// The export may go to stdout, so keep logs on stderr
+	level, _ := cfg.Log.SlogLevel()
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+	if kind, _, _ := config.ParseStore(cfg.Store); kind != config.StorePostgres {
+		fmt.Fprintln(os.Stderr, "Export requires the postgres store")
+		return 2
+	}
+
+	out := os.Stdout
+	if output != "" {
+		f, err := os.Create(output)
+		if err != nil {
+			slog.Error("Failed to create output file", "error", err)
+			return 1
+		}
+		defer f.Close()
+		out = f
+	}
+	bw := bufio.NewWriter(out)
+
+	ew, err := record.NewExportWriter(bw, format)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	ctx := context.Background()
+	dbConn, err := cfg.Database.Connect(ctx)
+	if err != nil {
+		slog.Error("Failed to connect to database", "error", err)
+		return 1
+	}
+	defer dbConn.Close()
+
+	n, err := record.Export(ctx, recorddb.New(dbConn), record.ExportFilter{
+		MachineID:  machine,
+		PathPrefix: pathPrefix,
+	}, ew)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		slog.Error("Export failed", "rows", n, "error", err)
+		return 1
+	}
+	slog.Info("Export completed", "format", format, "rows", n)
+	return 0
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/tendant/filededup/pkg/archive"
+	"github.com/tendant/filededup/pkg/config"
+	"github.com/tendant/filededup/pkg/record"
+	"github.com/tendant/filededup/pkg/record/recorddb"
+)
+
+// runIngest implements the ingest subcommand, loading scan archives written
+// by agents without a connection to the server
+func runIngest(args []string) int {
+	var fs *flag.FlagSet
+	cfg, err := config.Load("server ingest", args, func(f *flag.FlagSet) {
+		fs = f
+		f.Usage = func() {
+			fmt.Fprintf(f.Output(), "Usage: server ingest [flags] archive...\n\nFlags:\n")
+			f.PrintDefaults()
+		}
+	})
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		fmt.Fprintf(os.Stderr, "Invalid configuration: %v\n", err)
+		return 2
+	}
+	slog.SetDefault(cfg.Log.NewLogger())
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	if kind, _, _ := config.ParseStore(cfg.Store); kind != config.StorePostgres {
+		fmt.Fprintln(os.Stderr, "Ingesting archives requires the postgres store")
+		return 2
+	}
+	if cfg.Archive.TrustedKeys == "" {
+		fmt.Fprintln(os.Stderr, "No trusted keys configured; set -archive-trusted-keys")
+		return 2
+	}
+	trusted, err := archive.LoadTrustedKeys(cfg.Archive.TrustedKeys)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	ctx := context.Background()
+	dbConn, err := cfg.Database.Connect(ctx)
+	if err != nil {
+		slog.Error("Failed to connect to database", "error", err)
+		return 1
+	}
+	defer dbConn.Close()
+	q := recorddb.New(dbConn)
+
+	// Wait for webhook deliveries of alerts raised by the archives
+	anomalies := newAnomalies(cfg, q)
+	defer anomalies.Wait()
+
+	failed := 0
+	for _, path := range fs.Args() {
+		if err := ingestFile(ctx, q, trusted, anomalies, path); err != nil {
+			slog.Error("Failed to ingest archive", "path", path, "error", err)
+			failed++
+		}
+	}
+
+	// Running servers only refresh statistics after their own ingestion
+	if failed < fs.NArg() {
+		stats := record.NewStats(q, cfg.Stats.Materialized, cfg.Stats.RefreshInterval)
+		if err := stats.Refresh(ctx); err != nil {
+			slog.Warn("Failed to refresh statistics", "error", err)
+		}
+	}
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// ingestFile ingests one archive file
+func ingestFile(ctx context.Context, q *recorddb.Queries, trusted archive.TrustedKeys, anomalies *record.Anomalies, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	ar, err := archive.Open(f, trusted)
+	if err != nil {
+		return err
+	}
+	defer ar.Close()
+
+	result, err := record.IngestArchive(ctx, q, ar, anomalies)
+	if err != nil {
+		return err
+	}
+	slog.Info("Archive ingested", "path", path, "machineID", result.MachineID,
+		"records", result.Records, "filesDeleted", result.Session.FilesDeleted)
+	return nil
+}
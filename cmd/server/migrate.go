@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/tendant/filededup/pkg/config"
+	"github.com/tendant/filededup/pkg/migrate"
+)
+
+const migrateUsage = `Usage: server migrate <command> [flags]
+
+Commands:
+  up          Apply all pending migrations
+  down [N]    Revert the last N migrations (default 1)
+  status      List migrations and whether they are applied
+
+Flags are the same as for the server, e.g. -config and -database-url.
+`
+
+// runMigrate implements the migrate subcommand
+func runMigrate(args []string) int {
+	if len(args) == 0 || args[0] == "help" || args[0] == "-h" || args[0] == "-help" {
+		fmt.Fprint(os.Stderr, migrateUsage)
+		return 2
+	}
+	command, args := args[0], args[1:]
+
+	steps := 1
+	if command == "down" && len(args) > 0 {
+		if n, err := strconv.Atoi(args[0]); err == nil {
+			if n < 1 {
+				fmt.Fprintln(os.Stderr, "down requires a positive number of steps")
+				return 2
+			}
+			steps = n
+			args = args[1:]
+		}
+	}
+
+	cfg, err := config.Load("server migrate "+command, args)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		fmt.Fprintf(os.Stderr, "Invalid configuration: %v\n", err)
+		return 2
+	}
+	slog.SetDefault(cfg.Log.NewLogger())
+	if kind, _, _ := config.ParseStore(cfg.Store); kind != config.StorePostgres {
+		fmt.Fprintln(os.Stderr, "Migrations only apply to the postgres store; the sqlite store creates its schema on open")
+		return 2
+	}
+
+	ctx := context.Background()
+	dbConn, err := cfg.Database.Connect(ctx)
+	if err != nil {
+		slog.Error("Failed to connect to database", "error", err)
+		return 1
+	}
+	defer dbConn.Close()
+
+	m, err := migrate.New(dbConn)
+	if err != nil {
+		slog.Error("Failed to load migrations", "error", err)
+		return 1
+	}
+
+	switch command {
+	case "up":
+		n, err := m.Up(ctx)
+		if err != nil {
+			slog.Error("Migration failed", "applied", n, "error", err)
+			return 1
+		}
+		slog.Info("Migrations applied", "applied", n, "version", m.Latest())
+	case "down":
+		n, err := m.Down(ctx, steps)
+		if err != nil {
+			slog.Error("Migration failed", "reverted", n, "error", err)
+			return 1
+		}
+		slog.Info("Migrations reverted", "reverted", n)
+	case "status":
+		status, err := m.Status(ctx)
+		if err != nil {
+			slog.Error("Failed to read migration status", "error", err)
+			return 1
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "VERSION\tNAME\tAPPLIED")
+		for _, s := range status {
+			applied := "pending"
+			if s.Applied {
+				applied = s.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Fprintf(tw, "%04d\t%s\t%s\n", s.Version, s.Name, applied)
+		}
+		tw.Flush()
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown migrate command %q\n\n%s", command, migrateUsage)
+		return 2
+	}
+	return 0
+}
+
+// ensureSchema applies or checks migrations before the server starts serving
+func ensureSchema(ctx context.Context, m *migrate.Migrator, autoMigrate bool) error {
+	if autoMigrate {
+		n, err := m.Up(ctx)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			slog.Info("Migrations applied", "applied", n, "version", m.Latest())
+		}
+		return nil
+	}
+	if err := m.Check(ctx); err != nil {
+		if errors.Is(err, migrate.ErrSchemaOutdated) {
+			return fmt.Errorf("%w; run 'server migrate up' or enable auto_migrate", err)
+		}
+		return err
+	}
+	return nil
+}
@@ -27,17 +27,48 @@ type FileRecord struct {
 	Size      int64     `json:"size"`
 	MTime     time.Time `json:"mtime"`
 	Hash      string    `json:"hash"`
+	SessionID string    `json:"session_id,omitempty"`
+	Volume    string    `json:"volume,omitempty"`
+	VolumeID  string    `json:"volume_id,omitempty"` // Filesystem the file is stored on, shared by machines mounting it
+	Inode     uint64    `json:"inode,omitempty"`
+	FullHash  string    `json:"full_hash,omitempty"`  // SHA-256 of the whole file, sent by scrubs of sampled files
+	ReadError string    `json:"read_error,omitempty"` // Why a scrub could not read the file
+}
+
+// ScanStats summarizes a completed run
+type ScanStats struct {
+	StartedAt  time.Time
+	FinishedAt time.Time
+	Files      int64
+	Bytes      int64
+	Errors     int64 // Files that could not be read or hashed
+	Unsent     int64 // Files found but not sent: unreadable or skipped as too large
+	WalkErrors int64 // Files and directories the walk could not read
+	SendErrors int64 // Batches that could not be uploaded or handed to the sink
+}
+
+// Complete reports whether every file under the roots was sent, so that files
+// the server has no record of in the run were deleted
+func (s ScanStats) Complete() bool {
+	return s.Unsent == 0 && s.WalkErrors == 0 && s.SendErrors == 0
 }
 
 type Agent struct {
 	RootDir     string
 	ServerURL   string
+	Token       string // Machine token sent as a bearer token ("" = no authentication)
+	HTTPClient  *http.Client // Client used to talk to the server (nil = a client with a 5 minute timeout)
 	MachineID   string
 	BatchSize   int
 	NumWorkers  int  // Number of parallel workers for file processing
 	QueueSize   int  // Size of the internal processing queues
 	MaxFileSize int64 // Maximum file size to process (0 = no limit)
 	SkipLarge   bool // Whether to skip large files
+	Exclude     []string // Directories that are never scanned (e.g. the quarantine directory)
+	Sink        func([]FileRecord) error // Receives batches instead of the server (nil = upload)
+	Stats       ScanStats // Statistics of the last run
+	Metrics     *Metrics  // Prometheus metrics for the run (nil = disabled)
+	Scrub       bool      // Read sampled files completely to surface read errors
 }
 
 // New creates a new Agent with the specified parameters
@@ -93,14 +124,106 @@ func (a *Agent) WithMaxFileSize(maxSize int64) *Agent {
 	return a
 }
 
+// WithExclude adds directories that are skipped while scanning
+func (a *Agent) WithExclude(dirs ...string) *Agent {
+	for _, dir := range dirs {
+		if dir == "" {
+			continue
+		}
+		if abs, err := filepath.Abs(dir); err == nil {
+			dir = abs
+		}
+		a.Exclude = append(a.Exclude, filepath.Clean(dir))
+	}
+	return a
+}
+
+// WithToken sets the machine token used to authenticate with the server
+func (a *Agent) WithToken(token string) *Agent {
+	a.Token = token
+	return a
+}
+
+// WithHTTPClient sets the HTTP client used to talk to the server, e.g. one configured for TLS
+func (a *Agent) WithHTTPClient(c *http.Client) *Agent {
+	a.HTTPClient = c
+	return a
+}
+
+// WithSink makes the agent hand batches to sink instead of uploading them.
+// The agent then runs offline: it does not register or send heartbeats.
+func (a *Agent) WithSink(sink func([]FileRecord) error) *Agent {
+	a.Sink = sink
+	return a
+}
+
+// WithScrub makes the agent hash files hashed by sampling completely as well,
+// so the server can detect corruption and read errors in blocks the sampled
+// hash skips. The sampled hash is unchanged.
+func (a *Agent) WithScrub(scrub bool) *Agent {
+	a.Scrub = scrub
+	return a
+}
+
+// WithMetrics makes the agent record Prometheus metrics while it runs
+func (a *Agent) WithMetrics(m *Metrics) *Agent {
+	a.Metrics = m
+	return a
+}
+
+// client returns a client for the configured server
+func (a *Agent) client() *Client {
+	return &Client{ServerURL: a.ServerURL, Token: a.Token, HTTP: a.HTTPClient}
+}
+
+// excluded reports whether a directory should be skipped while scanning
+func (a *Agent) excluded(dir string) bool {
+	if len(a.Exclude) == 0 {
+		return false
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	for _, ex := range a.Exclude {
+		if abs == ex {
+			return true
+		}
+	}
+	return false
+}
+
 func (a *Agent) Run() error {
 	// Initialize progress tracking
-	var processedFiles, totalFiles, totalBytes, queuedFiles atomic.Int64
+	var processedFiles, totalFiles, totalBytes, queuedFiles, failedFiles, unsentFiles, walkErrors, sendErrors atomic.Int64
 	var startTime = time.Now()
 	
+	online := a.Sink == nil
+	
+	// Announce this agent to the server; older servers without a machine
+	// registry still accept uploads, so this is not fatal
+	var sessionID string
+	if online {
+		if err := a.register(); err != nil {
+			slog.Warn("Failed to register machine", "error", err)
+		} else if err := a.heartbeat(Heartbeat{ScanStartedAt: &startTime}); err != nil {
+			slog.Warn("Failed to send heartbeat", "error", err)
+		}
+
+		// Without a session the server cannot detect deleted files, but uploads still work
+		id, err := a.startSession()
+		if err != nil {
+			slog.Warn("Failed to start scan session, deleted files will not be detected", "error", err)
+		}
+		sessionID = id
+	}
+	
 	// First, count total files to process
 	slog.Info("Counting files to process...")
 	filepath.Walk(a.RootDir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() && a.excluded(path) {
+			return filepath.SkipDir
+		}
 		if err == nil && !info.IsDir() {
 			totalFiles.Add(1)
 			totalBytes.Add(info.Size())
@@ -147,10 +270,49 @@ func (a *Agent) Run() error {
 		}
 	}()
 
+	// Send heartbeats while the scan is running
+	go func() {
+		if !online {
+			return
+		}
+		ticker := time.NewTicker(heartbeatInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := a.heartbeat(Heartbeat{}); err != nil {
+					slog.Debug("Failed to send heartbeat", "error", err)
+				}
+			case <-progressDone:
+				return
+			}
+		}
+	}()
+
 	// Create channels for the worker pool with appropriate buffer sizes
 	fileQueue := make(chan string, a.QueueSize)
 	resultQueue := make(chan FileRecord, a.QueueSize)
 	batchQueue := make(chan []FileRecord, a.NumWorkers) // One batch per worker
+
+	// Sample the queue depths while the scan is running
+	go func() {
+		if a.Metrics == nil {
+			return
+		}
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				a.Metrics.setQueueDepths(len(fileQueue), len(resultQueue), len(batchQueue))
+			case <-progressDone:
+				a.Metrics.setQueueDepths(0, 0, 0)
+				return
+			}
+		}
+	}()
 	
 	// Create a WaitGroup to wait for all workers to finish
 	var wg sync.WaitGroup
@@ -161,6 +323,7 @@ func (a *Agent) Run() error {
 	// Create a semaphore to limit concurrent file operations
 	// This helps prevent overwhelming the file system with too many open files
 	fileSemaphore := make(chan struct{}, a.NumWorkers*2)
+	volumes := newVolumeCache(a.MachineID)
 	
 	for i := 0; i < a.NumWorkers; i++ {
 		wg.Add(1)
@@ -173,6 +336,13 @@ func (a *Agent) Run() error {
 				// Process the file
 				info, err := os.Stat(path)
 				if err != nil || info.IsDir() {
+					if err != nil {
+						failedFiles.Add(1)
+						unsentFiles.Add(1)
+						a.Metrics.fileFailed()
+					} else {
+						a.Metrics.fileProcessed()
+					}
 					processedFiles.Add(1)
 					<-fileSemaphore // Release semaphore
 					continue
@@ -181,22 +351,31 @@ func (a *Agent) Run() error {
 				// Check file size limit if enabled
 				if a.SkipLarge && a.MaxFileSize > 0 && info.Size() > a.MaxFileSize {
 					slog.Debug("Skipping large file", "path", path, "size", formatBytes(info.Size()), "limit", formatBytes(a.MaxFileSize))
+					unsentFiles.Add(1)
 					processedFiles.Add(1)
+					a.Metrics.fileProcessed()
 					<-fileSemaphore // Release semaphore
 					continue
 				}
 				
-				// Optimize for file size - use different strategies for small vs large files
-				var hash string
-				if info.Size() < 10*1024*1024 { // 10MB threshold
-					// For small files, hash the entire file
-					hash, err = hashFile(path)
-				} else {
-					// For large files, use a faster sampling approach
-					hash, err = hashLargeFile(path, info.Size())
+				hashStart := time.Now()
+				hash, err := hashPath(path, info.Size())
+				var fullHash, readError string
+				if err == nil && a.Scrub && info.Size() >= SampledHashThreshold {
+					// The record is still sent so the server reports the read error
+					if fullHash, err = hashFile(path); err != nil {
+						slog.Warn("Scrub failed to read file", "path", path, "error", err)
+						readError = err.Error()
+						err = nil
+						failedFiles.Add(1)
+						a.Metrics.fileFailed()
+					}
 				}
 				
 				if err != nil {
+					failedFiles.Add(1)
+					unsentFiles.Add(1)
+					a.Metrics.fileFailed()
 					processedFiles.Add(1)
 					<-fileSemaphore // Release semaphore
 					continue
@@ -210,6 +389,7 @@ func (a *Agent) Run() error {
 					absPath = dirPath // Fallback to the original path
 				}
 				filename := filepath.Base(path)
+				vol := volumes.lookup(absPath)
 				
 				// Create a file record and send it to the result queue
 				resultQueue <- FileRecord{
@@ -219,10 +399,18 @@ func (a *Agent) Run() error {
 					Size:      info.Size(),
 					MTime:     info.ModTime(),
 					Hash:      hash,
+					SessionID: sessionID,
+					Volume:    vol.mount,
+					VolumeID:  vol.id,
+					Inode:     inodeOf(info),
+					FullHash:  fullHash,
+					ReadError: readError,
 				}
 				
 				// Update progress
 				processedFiles.Add(1)
+				a.Metrics.fileHashed(info.Size(), time.Since(hashStart))
+				a.Metrics.fileProcessed()
 				
 				// Release semaphore after file operations
 				<-fileSemaphore
@@ -231,11 +419,19 @@ func (a *Agent) Run() error {
 	}
 	
 	// Start batch processing worker
+	send := a.sendBatch
+	if !online {
+		send = a.Sink
+	}
 	batchDone := make(chan struct{})
 	go func() {
 		defer close(batchDone)
 		for batch := range batchQueue {
-			if err := a.sendBatch(batch); err != nil {
+			sendStart := time.Now()
+			err := send(batch)
+			a.Metrics.batchSent(time.Since(sendStart), err)
+			if err != nil {
+				sendErrors.Add(1)
 				slog.Error("Failed to send batch", "error", err)
 			}
 		}
@@ -264,7 +460,17 @@ func (a *Agent) Run() error {
 	
 	// Walk the directory and queue files
 	err := filepath.Walk(a.RootDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil || info.IsDir() {
+		if err != nil {
+			// The files below an unreadable directory are unknown
+			slog.Warn("Failed to read path", "path", path, "error", err)
+			walkErrors.Add(1)
+			return nil
+		}
+		if info.IsDir() {
+			if a.excluded(path) {
+				slog.Debug("Skipping excluded directory", "path", path)
+				return filepath.SkipDir
+			}
 			return nil
 		}
 		
@@ -296,6 +502,18 @@ func (a *Agent) Run() error {
 	// Signal the progress goroutine to stop
 	close(progressDone)
 	
+	finishedAt := time.Now()
+	a.Stats = ScanStats{
+		StartedAt:  startTime,
+		FinishedAt: finishedAt,
+		Files:      processedFiles.Load(),
+		Bytes:      totalBytes.Load(),
+		Errors:     failedFiles.Load(),
+		Unsent:     unsentFiles.Load(),
+		WalkErrors: walkErrors.Load(),
+		SendErrors: sendErrors.Load(),
+	}
+
 	if err != nil {
 		return fmt.Errorf("walk error: %w", err)
 	}
@@ -306,6 +524,36 @@ func (a *Agent) Run() error {
 	filesPerSecond := float64(processedFiles.Load()) / elapsed.Seconds()
 	bytesPerSecond := float64(totalBytes.Load()) / elapsed.Seconds()
 	
+	scanFiles, scanBytes, scanErrors := a.Stats.Files, a.Stats.Bytes, a.Stats.Errors
+	if sessionID != "" {
+		// Files missing from a partial scan or upload must not be reported as deleted
+		if !a.Stats.Complete() {
+			slog.Warn("Scan was incomplete, deleted files will not be detected",
+				"unsent", a.Stats.Unsent, "walkErrors", a.Stats.WalkErrors, "sendErrors", a.Stats.SendErrors)
+		}
+		s, err := a.completeSession(sessionID, SessionComplete{
+			ScanBytes:     scanBytes,
+			ScanErrors:    scanErrors,
+			DeleteMissing: a.Stats.Complete(),
+		})
+		if err != nil {
+			slog.Warn("Failed to complete scan session", "error", err)
+		} else if s.FilesDeleted > 0 {
+			slog.Info("Server removed records of deleted files", "count", s.FilesDeleted)
+		}
+	}
+	if online {
+		if err := a.heartbeat(Heartbeat{
+			ScanStartedAt:  &startTime,
+			ScanFinishedAt: &finishedAt,
+			ScanFiles:      &scanFiles,
+			ScanBytes:      &scanBytes,
+			ScanErrors:     &scanErrors,
+		}); err != nil {
+			slog.Warn("Failed to report scan statistics", "error", err)
+		}
+	}
+
 	slog.Info("Scan completed", 
 		"totalFiles", processedFiles.Load(),
 		"totalBytes", formatBytes(totalBytes.Load()),
@@ -331,6 +579,21 @@ func formatBytes(bytes int64) string {
 	return fmt.Sprintf("%.1f %cB", float64(bytes)/float64(div), "KMGTPE"[exp])
 }
 
+// SampledHashThreshold is the size from which files are hashed by sampling
+// instead of reading them completely
+const SampledHashThreshold = 10 * 1024 * 1024
+
+// hashPath hashes a file using the strategy appropriate for its size
+func hashPath(path string, size int64) (string, error) {
+	// Optimize for file size - use different strategies for small vs large files
+	if size < SampledHashThreshold {
+		// For small files, hash the entire file
+		return hashFile(path)
+	}
+	// For large files, use a faster sampling approach
+	return hashLargeFile(path, size)
+}
+
 // hashLargeFile efficiently hashes large files by sampling portions of the file
 // rather than reading the entire file. This is much faster for large files
 // while still providing good uniqueness for deduplication purposes.
@@ -495,25 +758,21 @@ func (a *Agent) sendBatch(batch []FileRecord) error {
 	}
 	zw.Close()
 
-	req, err := http.NewRequest("POST", a.ServerURL+"/files", &buf)
+	c := a.client()
+	req, err := c.newRequest("POST", "/files", &buf)
 	if err != nil {
 		slog.Error("Failed to create request", "error", err)
-		return fmt.Errorf("request creation error: %w", err)
+		return err
 	}
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Content-Encoding", "gzip")
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := c.do(req, http.StatusNoContent)
 	if err != nil {
 		slog.Error("HTTP request failed", "error", err)
-		return fmt.Errorf("http error: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusNoContent {
-		slog.Error("Unexpected server response", "status", resp.Status)
-		return fmt.Errorf("server responded with: %s", resp.Status)
+		return err
 	}
+	resp.Body.Close()
 	slog.Info("Batch sent successfully")
 	return nil
 }
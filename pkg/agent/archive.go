@@ -0,0 +1,45 @@
+package agent
+
+import (
+	"log/slog"
+	"os"
+	"runtime"
+
+	"github.com/tendant/filededup/pkg/archive"
+)
+
+// WithArchive makes the agent write its records to a scan archive instead of
+// uploading them, for machines without a connection to the server
+func (a *Agent) WithArchive(w *archive.Writer) *Agent {
+	return a.WithSink(func(batch []FileRecord) error {
+		for _, r := range batch {
+			if err := w.Write(r); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ArchiveManifest describes the last run for a scan archive. complete must
+// only be set when the scan finished and every record was written.
+func (a *Agent) ArchiveManifest(complete bool) archive.Manifest {
+	hostname, err := os.Hostname()
+	if err != nil {
+		slog.Warn("Failed to determine hostname", "error", err)
+	}
+	return archive.Manifest{
+		MachineID:    a.MachineID,
+		Hostname:     hostname,
+		OS:           runtime.GOOS,
+		Arch:         runtime.GOARCH,
+		AgentVersion: Version,
+		Roots:        a.roots(),
+		RootVolumes:  a.rootVolumes(),
+		StartedAt:    a.Stats.StartedAt,
+		FinishedAt:   a.Stats.FinishedAt,
+		ScanBytes:    a.Stats.Bytes,
+		ScanErrors:   a.Stats.Errors,
+		Complete:     complete,
+	}
+}
@@ -0,0 +1,177 @@
+package agent
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// TokenEnv is the environment variable holding the machine token when no token file is given
+const TokenEnv = "FILEDEDUP_TOKEN"
+
+// LoadToken reads the machine token from a file, falling back to the
+// FILEDEDUP_TOKEN environment variable. An empty token disables authentication.
+func LoadToken(file string) (string, error) {
+	if file == "" {
+		return strings.TrimSpace(os.Getenv(TokenEnv)), nil
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to read token file: %w", err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// TLSOptions configures how the agent connects to an HTTPS server
+type TLSOptions struct {
+	CAFile   string // Additional CA certificates (PEM) trusted for the server certificate
+	CertFile string // Client certificate (PEM) for mutual TLS
+	KeyFile  string // Client private key (PEM) for mutual TLS
+}
+
+// clientTimeout bounds every request to the server, including uploads
+const clientTimeout = 5 * time.Minute
+
+// defaultHTTPClient is used when no HTTP client is configured
+var defaultHTTPClient = &http.Client{Timeout: clientTimeout}
+
+// NewHTTPClient returns an HTTP client using the given TLS options. Requests
+// time out after five minutes.
+func NewHTTPClient(o TLSOptions) (*http.Client, error) {
+	if o.CAFile == "" && o.CertFile == "" && o.KeyFile == "" {
+		return &http.Client{Timeout: clientTimeout}, nil
+	}
+
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if o.CAFile != "" {
+		pem, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", o.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if o.CertFile != "" || o.KeyFile != "" {
+		if o.CertFile == "" || o.KeyFile == "" {
+			return nil, errors.New("both a client certificate and key are required")
+		}
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client key pair: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = cfg
+	return &http.Client{Transport: transport, Timeout: clientTimeout}, nil
+}
+
+// Client sends requests to the filededup server
+type Client struct {
+	ServerURL string
+	Token     string
+	HTTP      *http.Client
+}
+
+// newRequest creates a request for a server path, adding the machine token if set
+func (c *Client) newRequest(method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, c.ServerURL+path, body)
+	if err != nil {
+		return nil, fmt.Errorf("request creation error: %w", err)
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	return req, nil
+}
+
+// errNotFound wraps the errors of requests answered with 404 Not Found
+var errNotFound = errors.New("not found")
+
+// do sends a request and checks the response status; the caller closes the body
+func (c *Client) do(req *http.Request, expected int) (*http.Response, error) {
+	httpClient := c.HTTP
+	if httpClient == nil {
+		httpClient = defaultHTTPClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("http error: %w", err)
+	}
+	if resp.StatusCode != expected {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, fmt.Errorf("server responded with: %s (%w)", resp.Status, errNotFound)
+		}
+		return nil, fmt.Errorf("server responded with: %s", resp.Status)
+	}
+	return resp, nil
+}
+
+// postJSON sends v as a JSON request body and checks the response status
+func (c *Client) postJSON(path string, v any, expected int) error {
+	return c.exchangeJSON(path, v, expected, nil)
+}
+
+// exchangeJSON posts v as JSON and decodes the JSON response into out, if not nil
+func (c *Client) exchangeJSON(path string, v any, expected int, out any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to encode request: %w", err)
+	}
+
+	req, err := c.newRequest(http.MethodPost, path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.do(req, expected)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return fmt.Errorf("failed to decode response: %w", err)
+		}
+	}
+	return nil
+}
+
+// getJSON fetches a server path and decodes the JSON response into v
+func (c *Client) getJSON(path string, v any) error {
+	req, err := c.newRequest(http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.do(req, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package agent
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Report formats for offline scans
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+	FormatCSV  = "csv"
+)
+
+// DuplicateSet is a group of files with the same content found by an offline scan
+type DuplicateSet struct {
+	Hash        string   `json:"hash"`
+	Size        int64    `json:"size"`
+	Copies      int      `json:"copies"`
+	WastedBytes int64    `json:"wasted_bytes"`
+	Paths       []string `json:"paths"`
+}
+
+// Collector aggregates scanned files in memory so duplicates can be reported
+// without a server. Its Add method is used as the agent's sink.
+type Collector struct {
+	mu     sync.Mutex
+	byHash map[string][]FileRecord
+	seen   map[string]bool // Paths already recorded, in case scanned directories overlap
+	files  map[fileID]bool // Physical files already recorded, so hardlinks count once
+}
+
+// fileID identifies a physical file by its volume and inode
+type fileID struct {
+	volume string
+	inode  uint64
+}
+
+// NewCollector creates an empty Collector
+func NewCollector() *Collector {
+	return &Collector{byHash: make(map[string][]FileRecord), seen: make(map[string]bool), files: make(map[fileID]bool)}
+}
+
+// Add records a batch of scanned files
+func (c *Collector) Add(batch []FileRecord) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, f := range batch {
+		path := filepath.Join(f.Path, f.Filename)
+		if c.seen[path] {
+			continue
+		}
+		c.seen[path] = true
+		if f.VolumeID != "" && f.Inode != 0 {
+			id := fileID{f.VolumeID, f.Inode}
+			if c.files[id] {
+				continue
+			}
+			c.files[id] = true
+		}
+		c.byHash[f.Hash] = append(c.byHash[f.Hash], f)
+	}
+	return nil
+}
+
+// DuplicateSets returns every hash seen more than once, largest waste first
+func (c *Collector) DuplicateSets() []DuplicateSet {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	sets := []DuplicateSet{}
+	for hash, files := range c.byHash {
+		if len(files) < 2 {
+			continue
+		}
+		paths := make([]string, 0, len(files))
+		for _, f := range files {
+			paths = append(paths, filepath.Join(f.Path, f.Filename))
+		}
+		sort.Strings(paths)
+
+		size := files[0].Size
+		sets = append(sets, DuplicateSet{
+			Hash:        hash,
+			Size:        size,
+			Copies:      len(files),
+			WastedBytes: size * int64(len(files)-1),
+			Paths:       paths,
+		})
+	}
+
+	sort.Slice(sets, func(i, j int) bool {
+		if sets[i].WastedBytes != sets[j].WastedBytes {
+			return sets[i].WastedBytes > sets[j].WastedBytes
+		}
+		return sets[i].Hash < sets[j].Hash
+	})
+	return sets
+}
+
+// WriteReport writes duplicate sets in the given format
+func WriteReport(w io.Writer, format string, sets []DuplicateSet) error {
+	switch format {
+	case FormatText:
+		return writeTextReport(w, sets)
+	case FormatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(sets)
+	case FormatCSV:
+		return writeCSVReport(w, sets)
+	}
+	return fmt.Errorf("unknown report format %q", format)
+}
+
+func writeTextReport(w io.Writer, sets []DuplicateSet) error {
+	var wasted int64
+	for _, s := range sets {
+		wasted += s.WastedBytes
+		if _, err := fmt.Fprintf(w, "%s  %d copies of %s, %s wasted\n",
+			s.Hash, s.Copies, formatBytes(s.Size), formatBytes(s.WastedBytes)); err != nil {
+			return err
+		}
+		for _, p := range s.Paths {
+			if _, err := fmt.Fprintf(w, "  %s\n", p); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintln(w); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "%d duplicate sets, %s wasted\n", len(sets), formatBytes(wasted))
+	return err
+}
+
+// writeCSVReport writes one row per file so the report loads cleanly into a spreadsheet
+func writeCSVReport(w io.Writer, sets []DuplicateSet) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"hash", "size", "copies", "wasted_bytes", "path"}); err != nil {
+		return err
+	}
+	for _, s := range sets {
+		for _, p := range s.Paths {
+			err := cw.Write([]string{
+				s.Hash,
+				strconv.FormatInt(s.Size, 10),
+				strconv.Itoa(s.Copies),
+				strconv.FormatInt(s.WastedBytes, 10),
+				p,
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
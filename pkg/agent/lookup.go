@@ -0,0 +1,121 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ContentCopy is a copy of a file's content known to the server
+type ContentCopy struct {
+	MachineID       string    `json:"machine_id"`
+	Volume          string    `json:"volume"`
+	VolumeID        string    `json:"volume_id,omitempty"`
+	Alias           bool      `json:"alias"` // Same physical file as another copy
+	Path            string    `json:"path"`
+	Filename        string    `json:"filename"`
+	Size            int64     `json:"size"`
+	MTime           time.Time `json:"mtime"`
+	QuarantineState string    `json:"quarantine_state"`
+	LastSeenAt      time.Time `json:"last_seen_at"`
+}
+
+// LookupResult lists where the content of a local file exists. Self is set
+// when the server holds the record of the file itself; it is not in Copies.
+type LookupResult struct {
+	Path      string        `json:"path"`
+	Hash      string        `json:"hash"`
+	Size      int64         `json:"size"`
+	Sampled   bool          `json:"sampled"` // Hashed by sampling like scans do for large files
+	Self      bool          `json:"self"`
+	Copies    []ContentCopy `json:"copies"`
+	Truncated bool          `json:"truncated"` // The server listed only part of the copies
+}
+
+// Lookup asks the server where else the content of local files exists
+type Lookup struct {
+	ServerURL  string
+	Token      string       // Reader or admin token sent as a bearer token ("" = no authentication)
+	HTTPClient *http.Client // Client used to talk to the server (nil = a client with a 5 minute timeout)
+	MachineID  string
+}
+
+// NewLookup creates a new Lookup with the specified parameters
+func NewLookup(server, machineID string) *Lookup {
+	return &Lookup{
+		ServerURL: strings.TrimRight(server, "/"),
+		MachineID: machineID,
+	}
+}
+
+// WithToken sets the token used to authenticate with the server. Lookups read
+// the catalog, so servers that require authentication expect the reader or
+// admin token rather than a machine token.
+func (l *Lookup) WithToken(token string) *Lookup {
+	l.Token = token
+	return l
+}
+
+// WithHTTPClient sets the HTTP client used to talk to the server
+func (l *Lookup) WithHTTPClient(c *http.Client) *Lookup {
+	l.HTTPClient = c
+	return l
+}
+
+func (l *Lookup) client() *Client {
+	return &Client{ServerURL: l.ServerURL, Token: l.Token, HTTP: l.HTTPClient}
+}
+
+// File hashes a local file the way scans do and lists the copies of its
+// content the server knows
+func (l *Lookup) File(path string) (LookupResult, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return LookupResult{}, err
+	}
+	info, err := os.Stat(abs)
+	if err != nil {
+		return LookupResult{}, err
+	}
+	if !info.Mode().IsRegular() {
+		return LookupResult{}, fmt.Errorf("%s is not a regular file", path)
+	}
+	hash, err := hashPath(abs, info.Size())
+	if err != nil {
+		return LookupResult{}, fmt.Errorf("failed to hash %s: %w", path, err)
+	}
+
+	result := LookupResult{
+		Path:    abs,
+		Hash:    hash,
+		Size:    info.Size(),
+		Sampled: info.Size() >= SampledHashThreshold,
+		Copies:  []ContentCopy{},
+	}
+	var found struct {
+		Instances []ContentCopy `json:"instances"`
+		Truncated bool          `json:"truncated"`
+	}
+	err = l.client().getJSON("/contents/"+url.PathEscape(hash), &found)
+	if errors.Is(err, errNotFound) {
+		return result, nil
+	}
+	if err != nil {
+		return result, fmt.Errorf("failed to look up %s: %w", path, err)
+	}
+	result.Truncated = found.Truncated
+	dir, name := filepath.Dir(abs), filepath.Base(abs)
+	for _, c := range found.Instances {
+		if c.MachineID == l.MachineID && c.Path == dir && c.Filename == name {
+			result.Self = true
+			continue
+		}
+		result.Copies = append(result.Copies, c)
+	}
+	return result, nil
+}
@@ -0,0 +1,110 @@
+package agent
+
+import (
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+)
+
+// Version is the agent version reported to the server.
+// It is set at build time with -ldflags "-X github.com/tendant/filededup/pkg/agent.Version=..."
+var Version = "dev"
+
+// heartbeatInterval is how often a running scan reports progress to the server
+const heartbeatInterval = 30 * time.Second
+
+// MachineRegistration announces the agent to the server
+type MachineRegistration struct {
+	MachineID string   `json:"machine_id"`
+	Hostname  string   `json:"hostname"`
+	OS        string   `json:"os"`
+	Arch      string   `json:"arch"`
+	Version   string   `json:"version"`
+	Roots     []string `json:"roots"`
+}
+
+// Heartbeat reports that the agent is alive, optionally with scan statistics
+type Heartbeat struct {
+	ScanStartedAt  *time.Time `json:"scan_started_at,omitempty"`
+	ScanFinishedAt *time.Time `json:"scan_finished_at,omitempty"`
+	ScanFiles      *int64     `json:"scan_files,omitempty"`
+	ScanBytes      *int64     `json:"scan_bytes,omitempty"`
+	ScanErrors     *int64     `json:"scan_errors,omitempty"`
+}
+
+// register announces this agent to the server
+func (a *Agent) register() error {
+	hostname, err := os.Hostname()
+	if err != nil {
+		slog.Warn("Failed to determine hostname", "error", err)
+	}
+
+	return a.client().postJSON("/machines", MachineRegistration{
+		MachineID: a.MachineID,
+		Hostname:  hostname,
+		OS:        runtime.GOOS,
+		Arch:      runtime.GOARCH,
+		Version:   Version,
+		Roots:     a.roots(),
+	}, http.StatusOK)
+}
+
+// heartbeat reports liveness and scan statistics to the server
+func (a *Agent) heartbeat(hb Heartbeat) error {
+	return a.client().postJSON("/machines/"+url.PathEscape(a.MachineID)+"/heartbeat", hb, http.StatusNoContent)
+}
+
+// SessionComplete finishes a scan session; DeleteMissing lets the server
+// remove records of files under the scanned roots that were not uploaded
+type SessionComplete struct {
+	ScanBytes     int64 `json:"scan_bytes"`
+	ScanErrors    int64 `json:"scan_errors"`
+	DeleteMissing bool  `json:"delete_missing"`
+}
+
+// ScanSession is the server's view of a scan session
+type ScanSession struct {
+	ID           string `json:"id"`
+	FilesSeen    int64  `json:"files_seen"`
+	FilesDeleted int64  `json:"files_deleted"`
+}
+
+// roots returns the absolute scan roots of the agent
+func (a *Agent) roots() []string {
+	root, err := filepath.Abs(a.RootDir)
+	if err != nil {
+		root = a.RootDir
+	}
+	return []string{root}
+}
+
+// rootVolumes returns the volume ID of each root
+func (a *Agent) rootVolumes() []string {
+	volumes := newVolumeCache(a.MachineID)
+	roots := a.roots()
+	ids := make([]string, len(roots))
+	for i, root := range roots {
+		ids[i] = volumes.lookup(root).id
+	}
+	return ids
+}
+
+// startSession opens a scan session on the server
+func (a *Agent) startSession() (string, error) {
+	var s ScanSession
+	err := a.client().exchangeJSON("/machines/"+url.PathEscape(a.MachineID)+"/sessions",
+		map[string][]string{"roots": a.roots(), "root_volumes": a.rootVolumes()}, http.StatusCreated, &s)
+	return s.ID, err
+}
+
+// completeSession finishes a scan session on the server
+func (a *Agent) completeSession(id string, done SessionComplete) (ScanSession, error) {
+	var s ScanSession
+	err := a.client().exchangeJSON("/machines/"+url.PathEscape(a.MachineID)+"/sessions/"+url.PathEscape(id)+"/complete",
+		done, http.StatusOK, &s)
+	return s, err
+}
@@ -0,0 +1,132 @@
+package agent
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+const metricsNamespace = "filededup_agent"
+
+// Metrics collects Prometheus metrics for agent runs. A nil *Metrics is
+// valid and records nothing.
+type Metrics struct {
+	Registry *prometheus.Registry
+
+	filesProcessed prometheus.Counter
+	filesFailed    prometheus.Counter
+	bytesHashed    prometheus.Counter
+	hashDuration   prometheus.Histogram
+	queueDepth     *prometheus.GaugeVec
+	batchesSent    prometheus.Counter
+	uploadFailures prometheus.Counter
+	uploadDuration prometheus.Histogram
+}
+
+// NewMetrics creates the agent metrics in their own registry
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		Registry: prometheus.NewRegistry(),
+		filesProcessed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "files_processed_total",
+			Help:      "Files examined, including skipped and failed files.",
+		}),
+		filesFailed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "files_failed_total",
+			Help:      "Files that could not be read or hashed.",
+		}),
+		bytesHashed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "bytes_hashed_total",
+			Help:      "Size of the files hashed.",
+		}),
+		hashDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "hash_duration_seconds",
+			Help:      "Time to hash one file.",
+			Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 10),
+		}),
+		queueDepth: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "queue_depth",
+			Help:      "Items waiting in the internal processing queues.",
+		}, []string{"queue"}),
+		batchesSent: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "batches_sent_total",
+			Help:      "Batches uploaded or handed to the sink.",
+		}),
+		uploadFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "upload_failures_total",
+			Help:      "Batches that could not be uploaded or handed to the sink.",
+		}),
+		uploadDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "upload_duration_seconds",
+			Help:      "Time to upload one batch.",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+		}),
+	}
+	m.Registry.MustRegister(m.filesProcessed, m.filesFailed, m.bytesHashed, m.hashDuration,
+		m.queueDepth, m.batchesSent, m.uploadFailures, m.uploadDuration)
+	return m
+}
+
+// Handler serves the metrics in the Prometheus text format
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.Registry, promhttp.HandlerOpts{})
+}
+
+// Push sends the current metrics to a Prometheus pushgateway, grouped by machine
+func (m *Metrics) Push(gateway, machineID string) error {
+	return push.New(gateway, metricsNamespace).
+		Gatherer(m.Registry).
+		Grouping("instance", machineID).
+		Push()
+}
+
+func (m *Metrics) fileProcessed() {
+	if m != nil {
+		m.filesProcessed.Inc()
+	}
+}
+
+func (m *Metrics) fileFailed() {
+	if m != nil {
+		m.filesProcessed.Inc()
+		m.filesFailed.Inc()
+	}
+}
+
+func (m *Metrics) fileHashed(size int64, d time.Duration) {
+	if m != nil {
+		m.bytesHashed.Add(float64(size))
+		m.hashDuration.Observe(d.Seconds())
+	}
+}
+
+func (m *Metrics) batchSent(d time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	m.uploadDuration.Observe(d.Seconds())
+	if err != nil {
+		m.uploadFailures.Inc()
+	} else {
+		m.batchesSent.Inc()
+	}
+}
+
+func (m *Metrics) setQueueDepths(files, results, batches int) {
+	if m != nil {
+		m.queueDepth.WithLabelValues("file").Set(float64(files))
+		m.queueDepth.WithLabelValues("result").Set(float64(results))
+		m.queueDepth.WithLabelValues("batch").Set(float64(batches))
+	}
+}
@@ -0,0 +1,582 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Quarantine states reported to the server
+const (
+	QuarantineStateActive      = "active"
+	QuarantineStateQuarantined = "quarantined"
+	QuarantineStatePurged      = "purged"
+)
+
+// manifestName is the name of the per-batch manifest inside the quarantine directory.
+// Each line is a JSON encoded QuarantineEntry so the manifest survives partial runs.
+const manifestName = "manifest.jsonl"
+
+// batchTimeFormat names quarantine batches by their creation time
+const batchTimeFormat = "20060102T150405Z"
+
+// Modes of the directories moveFile creates: quarantine batches are private,
+// and restores recreate missing directories with the mode recorded in the
+// manifest, or restoreDirMode for manifests written without one
+const (
+	quarantineDirMode = 0o700
+	restoreDirMode    = 0o755
+)
+
+// QuarantineEntry records where a quarantined file came from
+type QuarantineEntry struct {
+	Hash           string      `json:"hash"`
+	Size           int64       `json:"size"`
+	MTime          time.Time   `json:"mtime"`
+	Mode           os.FileMode `json:"mode"`
+	DirMode        os.FileMode `json:"dir_mode,omitempty"` // Mode of the original directory
+	OriginalPath   string      `json:"original_path"`
+	QuarantinePath string      `json:"quarantine_path"`
+	KeeperPath     string      `json:"keeper_path"`
+	QuarantinedAt  time.Time   `json:"quarantined_at"`
+}
+
+// QuarantineUpdate reports a change in the quarantine state of a file to the server
+type QuarantineUpdate struct {
+	MachineID      string `json:"machine_id"`
+	Path           string `json:"path"`
+	Filename       string `json:"filename"`
+	State          string `json:"state"`
+	QuarantinePath string `json:"quarantine_path,omitempty"`
+}
+
+// machineDuplicate mirrors the server's per-machine duplicate listing
+type machineDuplicate struct {
+	Hash     string    `json:"hash"`
+	Path     string    `json:"path"`
+	Filename string    `json:"filename"`
+	Size     int64     `json:"size"`
+	MTime    time.Time `json:"mtime"`
+	IsKeeper bool      `json:"is_keeper"` // Selected as keeper on the server
+}
+
+// Quarantine moves non-keeper copies of duplicate files into a quarantine
+// directory instead of deleting them, and can later purge or restore them.
+type Quarantine struct {
+	Dir        string // Quarantine directory
+	RootDir    string // Only copies under this directory are quarantined ("" = anywhere)
+	ServerURL  string
+	Token      string       // Machine token sent as a bearer token ("" = no authentication)
+	HTTPClient *http.Client // Client used to talk to the server (nil = a client with a 5 minute timeout)
+	MachineID  string
+	Retention  time.Duration // How long quarantined files are kept before purging
+	DryRun     bool          // Log what would happen without moving anything
+}
+
+// NewQuarantine creates a new Quarantine with the specified parameters
+func NewQuarantine(dir, server, machineID string) *Quarantine {
+	return &Quarantine{
+		Dir:       dir,
+		ServerURL: strings.TrimRight(server, "/"),
+		MachineID: machineID,
+		Retention: 30 * 24 * time.Hour,
+	}
+}
+
+// WithRoot limits quarantining to copies under the given directory
+func (q *Quarantine) WithRoot(root string) *Quarantine {
+	if root != "" {
+		if abs, err := filepath.Abs(root); err == nil {
+			root = abs
+		}
+		q.RootDir = filepath.Clean(root)
+	}
+	return q
+}
+
+// WithToken sets the machine token used to authenticate with the server
+func (q *Quarantine) WithToken(token string) *Quarantine {
+	q.Token = token
+	return q
+}
+
+// WithHTTPClient sets the HTTP client used to talk to the server
+func (q *Quarantine) WithHTTPClient(c *http.Client) *Quarantine {
+	q.HTTPClient = c
+	return q
+}
+
+// WithRetention sets how long quarantined files are kept before purging
+func (q *Quarantine) WithRetention(retention time.Duration) *Quarantine {
+	if retention > 0 {
+		q.Retention = retention
+	}
+	return q
+}
+
+// WithDryRun only logs the actions that would be taken
+func (q *Quarantine) WithDryRun(dryRun bool) *Quarantine {
+	q.DryRun = dryRun
+	return q
+}
+
+// Run quarantines every non-keeper copy of each duplicate set on this machine.
+// The keeper is the copy selected on the server or, if none was selected, the
+// oldest copy that still exists on disk with the expected content.
+func (q *Quarantine) Run() error {
+	dir, err := filepath.Abs(q.Dir)
+	if err != nil {
+		return fmt.Errorf("invalid quarantine directory: %w", err)
+	}
+	q.Dir = dir
+
+	dupes, err := q.fetchDuplicates()
+	if err != nil {
+		return err
+	}
+
+	groups := make(map[string][]machineDuplicate)
+	var hashes []string
+	for _, d := range dupes {
+		if _, ok := groups[d.Hash]; !ok {
+			hashes = append(hashes, d.Hash)
+		}
+		groups[d.Hash] = append(groups[d.Hash], d)
+	}
+	slog.Info("Found duplicate sets", "sets", len(hashes), "files", len(dupes))
+
+	batchID := time.Now().UTC().Format(batchTimeFormat)
+	batchDir := filepath.Join(q.Dir, batchID)
+
+	var updates []QuarantineUpdate
+	var movedBytes int64
+	for _, hash := range hashes {
+		files := groups[hash]
+		sort.SliceStable(files, func(i, j int) bool {
+			if files[i].IsKeeper != files[j].IsKeeper {
+				return files[i].IsKeeper
+			}
+			if !files[i].MTime.Equal(files[j].MTime) {
+				return files[i].MTime.Before(files[j].MTime)
+			}
+			return filepath.Join(files[i].Path, files[i].Filename) < filepath.Join(files[j].Path, files[j].Filename)
+		})
+
+		keeper := ""
+		for _, f := range files {
+			path := filepath.Join(f.Path, f.Filename)
+			if !verifyFile(path, f.Hash, f.Size) {
+				slog.Debug("Skipping copy that no longer matches", "path", path)
+				continue
+			}
+			if keeper == "" {
+				keeper = path
+				continue
+			}
+			if !q.inScope(path) {
+				continue
+			}
+
+			entry, err := q.quarantineFile(batchDir, keeper, path, f)
+			if err != nil {
+				slog.Error("Failed to quarantine file", "path", path, "error", err)
+				continue
+			}
+			if q.DryRun {
+				continue
+			}
+			movedBytes += f.Size
+			updates = append(updates, QuarantineUpdate{
+				MachineID:      q.MachineID,
+				Path:           f.Path,
+				Filename:       f.Filename,
+				State:          QuarantineStateQuarantined,
+				QuarantinePath: entry.QuarantinePath,
+			})
+		}
+	}
+
+	slog.Info("Quarantine completed", "batch", batchID, "files", len(updates), "bytes", formatBytes(movedBytes), "dryRun", q.DryRun)
+	return q.reportStates(updates)
+}
+
+// Purge permanently removes quarantine batches older than the retention period
+func (q *Quarantine) Purge() error {
+	batches, err := q.listBatches()
+	if err != nil {
+		return err
+	}
+
+	cutoff := time.Now().UTC().Add(-q.Retention)
+	var updates []QuarantineUpdate
+	for _, batchID := range batches {
+		created, err := time.Parse(batchTimeFormat, batchID)
+		if err != nil || created.After(cutoff) {
+			continue
+		}
+
+		batchDir := filepath.Join(q.Dir, batchID)
+		entries, err := readManifest(batchDir)
+		if err != nil {
+			slog.Error("Failed to read quarantine manifest", "batch", batchID, "error", err)
+			continue
+		}
+
+		slog.Info("Purging quarantine batch", "batch", batchID, "files", len(entries), "dryRun", q.DryRun)
+		if q.DryRun {
+			continue
+		}
+		if err := os.RemoveAll(batchDir); err != nil {
+			slog.Error("Failed to purge quarantine batch", "batch", batchID, "error", err)
+			continue
+		}
+		for _, e := range entries {
+			updates = append(updates, QuarantineUpdate{
+				MachineID:      q.MachineID,
+				Path:           filepath.Dir(e.OriginalPath),
+				Filename:       filepath.Base(e.OriginalPath),
+				State:          QuarantineStatePurged,
+				QuarantinePath: e.QuarantinePath,
+			})
+		}
+	}
+
+	return q.reportStates(updates)
+}
+
+// Restore moves quarantined files back to their original location.
+// If batchID is empty all batches are searched; if paths is empty every
+// file in the selected batches is restored.
+func (q *Quarantine) Restore(batchID string, paths []string) error {
+	batches, err := q.listBatches()
+	if err != nil {
+		return err
+	}
+
+	wanted := make(map[string]bool, len(paths))
+	for _, p := range paths {
+		if abs, err := filepath.Abs(p); err == nil {
+			p = abs
+		}
+		wanted[filepath.Clean(p)] = true
+	}
+
+	var updates []QuarantineUpdate
+	var failed int
+	for _, id := range batches {
+		if batchID != "" && id != batchID {
+			continue
+		}
+
+		batchDir := filepath.Join(q.Dir, id)
+		entries, err := readManifest(batchDir)
+		if err != nil {
+			slog.Error("Failed to read quarantine manifest", "batch", id, "error", err)
+			continue
+		}
+
+		var remaining []QuarantineEntry
+		for _, e := range entries {
+			if len(wanted) > 0 && !wanted[e.OriginalPath] {
+				remaining = append(remaining, e)
+				continue
+			}
+			if q.DryRun {
+				slog.Info("Would restore file", "path", e.OriginalPath, "from", e.QuarantinePath)
+				remaining = append(remaining, e)
+				continue
+			}
+			if err := restoreEntry(e); err != nil {
+				slog.Error("Failed to restore file", "path", e.OriginalPath, "error", err)
+				failed++
+				remaining = append(remaining, e)
+				continue
+			}
+			slog.Info("Restored file", "path", e.OriginalPath)
+			updates = append(updates, QuarantineUpdate{
+				MachineID: q.MachineID,
+				Path:      filepath.Dir(e.OriginalPath),
+				Filename:  filepath.Base(e.OriginalPath),
+				State:     QuarantineStateActive,
+			})
+		}
+
+		if q.DryRun || len(remaining) == len(entries) {
+			continue
+		}
+		if len(remaining) == 0 {
+			if err := os.RemoveAll(batchDir); err != nil {
+				slog.Warn("Failed to remove empty quarantine batch", "batch", id, "error", err)
+			}
+			continue
+		}
+		if err := writeManifest(batchDir, remaining); err != nil {
+			slog.Error("Failed to rewrite quarantine manifest", "batch", id, "error", err)
+		}
+	}
+
+	if err := q.reportStates(updates); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to restore %d files", failed)
+	}
+	return nil
+}
+
+// inScope reports whether a path may be quarantined
+func (q *Quarantine) inScope(path string) bool {
+	if isWithin(path, q.Dir) {
+		return false
+	}
+	return q.RootDir == "" || isWithin(path, q.RootDir)
+}
+
+// quarantineFile moves a single file into the batch directory and records it in the manifest
+func (q *Quarantine) quarantineFile(batchDir, keeper, path string, f machineDuplicate) (QuarantineEntry, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return QuarantineEntry{}, err
+	}
+	dir, err := os.Stat(filepath.Dir(path))
+	if err != nil {
+		return QuarantineEntry{}, err
+	}
+
+	entry := QuarantineEntry{
+		Hash:           f.Hash,
+		Size:           info.Size(),
+		MTime:          info.ModTime(),
+		Mode:           info.Mode().Perm(),
+		DirMode:        dir.Mode().Perm(),
+		OriginalPath:   path,
+		QuarantinePath: filepath.Join(batchDir, "files", quarantineRelPath(path)),
+		KeeperPath:     keeper,
+		QuarantinedAt:  time.Now().UTC(),
+	}
+
+	if q.DryRun {
+		slog.Info("Would quarantine file", "path", path, "keeper", keeper)
+		return entry, nil
+	}
+
+	if err := moveFile(path, entry.QuarantinePath, quarantineDirMode, entry.Mode, entry.MTime); err != nil {
+		return QuarantineEntry{}, err
+	}
+	if err := appendManifest(batchDir, entry); err != nil {
+		// Put the file back so nothing is left untracked in the quarantine
+		if rerr := moveFile(entry.QuarantinePath, path, entry.DirMode, entry.Mode, entry.MTime); rerr != nil {
+			slog.Error("Failed to roll back quarantined file", "path", path, "quarantinePath", entry.QuarantinePath, "error", rerr)
+		}
+		return QuarantineEntry{}, fmt.Errorf("failed to write manifest: %w", err)
+	}
+
+	slog.Debug("Quarantined file", "path", path, "keeper", keeper)
+	return entry, nil
+}
+
+// listBatches returns the quarantine batch IDs in chronological order
+func (q *Quarantine) listBatches() ([]string, error) {
+	entries, err := os.ReadDir(q.Dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read quarantine directory: %w", err)
+	}
+
+	var batches []string
+	for _, e := range entries {
+		if e.IsDir() {
+			batches = append(batches, e.Name())
+		}
+	}
+	sort.Strings(batches)
+	return batches, nil
+}
+
+func (q *Quarantine) client() *Client {
+	return &Client{ServerURL: q.ServerURL, Token: q.Token, HTTP: q.HTTPClient}
+}
+
+func (q *Quarantine) fetchDuplicates() ([]machineDuplicate, error) {
+	var dupes []machineDuplicate
+	if err := q.client().getJSON("/machines/"+url.PathEscape(q.MachineID)+"/duplicates", &dupes); err != nil {
+		return nil, fmt.Errorf("failed to fetch duplicates: %w", err)
+	}
+	return dupes, nil
+}
+
+// reportStates tells the server about quarantine state changes
+func (q *Quarantine) reportStates(updates []QuarantineUpdate) error {
+	if len(updates) == 0 {
+		return nil
+	}
+	return q.client().postJSON("/quarantine", updates, http.StatusNoContent)
+}
+
+// verifyFile checks that a file still exists with the expected size and content
+func verifyFile(path, hash string, size int64) bool {
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() || info.Size() != size {
+		return false
+	}
+	actual, err := hashPath(path, size)
+	return err == nil && actual == hash
+}
+
+// restoreEntry moves a quarantined file back to where it came from
+func restoreEntry(e QuarantineEntry) error {
+	if _, err := os.Lstat(e.OriginalPath); err == nil {
+		return fmt.Errorf("destination already exists")
+	}
+	if !verifyFile(e.QuarantinePath, e.Hash, e.Size) {
+		return fmt.Errorf("quarantined copy is missing or modified")
+	}
+	dirMode := e.DirMode
+	if dirMode == 0 {
+		dirMode = restoreDirMode
+	}
+	return moveFile(e.QuarantinePath, e.OriginalPath, dirMode, e.Mode, e.MTime)
+}
+
+// quarantineRelPath maps an absolute path to a relative path inside a quarantine batch
+func quarantineRelPath(path string) string {
+	vol := filepath.VolumeName(path)
+	rest := strings.TrimLeft(path[len(vol):], `/\`)
+	if vol == "" {
+		return rest
+	}
+	vol = strings.NewReplacer(":", "", `\`, "_", "/", "_").Replace(vol)
+	return filepath.Join(vol, rest)
+}
+
+// isWithin reports whether path is dir or inside it
+func isWithin(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// moveFile renames src to dst, falling back to copy and delete across
+// filesystems. Missing parent directories of dst are created with dirMode.
+func moveFile(src, dst string, dirMode, mode os.FileMode, mtime time.Time) error {
+	if err := os.MkdirAll(filepath.Dir(dst), dirMode); err != nil {
+		return err
+	}
+	err := os.Rename(src, dst)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	if err := copyFile(src, dst, mode); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	if err := os.Chtimes(dst, mtime, mtime); err != nil {
+		slog.Warn("Failed to preserve modification time", "path", dst, "error", err)
+	}
+	return os.Remove(src)
+}
+
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func appendManifest(batchDir string, entry QuarantineEntry) error {
+	if err := os.MkdirAll(batchDir, quarantineDirMode); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(batchDir, manifestName), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(f).Encode(entry); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func readManifest(batchDir string) ([]QuarantineEntry, error) {
+	f, err := os.Open(filepath.Join(batchDir, manifestName))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []QuarantineEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var e QuarantineEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("corrupt manifest entry: %w", err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+// writeManifest atomically replaces the manifest of a batch
+func writeManifest(batchDir string, entries []QuarantineEntry) error {
+	tmp := filepath.Join(batchDir, manifestName+".tmp")
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(batchDir, manifestName))
+}
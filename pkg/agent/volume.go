@@ -0,0 +1,55 @@
+package agent
+
+import (
+	"strings"
+	"sync"
+)
+
+// volume is where a directory is stored: the mount point, drive or share and
+// the ID of the filesystem behind it
+type volume struct {
+	mount string
+	id    string // Same for every machine sharing the filesystem, e.g. nfs://server/export ("" = unknown)
+}
+
+// volumeCache remembers the volume of each directory, since resolving a
+// mount point takes a stat call per parent directory
+type volumeCache struct {
+	mu        sync.Mutex
+	machineID string // Scopes IDs that are only unique on this machine
+	dirs      map[string]volume
+	ids       map[string]string // Volume IDs by mount point
+}
+
+func newVolumeCache(machineID string) *volumeCache {
+	return &volumeCache{machineID: machineID, dirs: make(map[string]volume), ids: make(map[string]string)}
+}
+
+// lookup returns the volume an absolute directory is stored on
+func (c *volumeCache) lookup(dir string) volume {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if v, ok := c.dirs[dir]; ok {
+		return v
+	}
+	v := volume{mount: volumeOf(dir)}
+	if v.mount != "" {
+		id, ok := c.ids[v.mount]
+		if !ok {
+			id = volumeID(v.mount, c.machineID)
+			c.ids[v.mount] = id
+		}
+		v.id = id
+	}
+	c.dirs[dir] = v
+	return v
+}
+
+// shareID returns the ID of an SMB share given as server/share
+func shareID(share string) string {
+	server, name, ok := strings.Cut(strings.Trim(share, "/"), "/")
+	if !ok || server == "" || name == "" {
+		return ""
+	}
+	return "smb://" + strings.ToLower(server) + "/" + strings.ToLower(name)
+}
@@ -0,0 +1,114 @@
+package agent
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// mountVolumeID identifies the filesystem mounted at mount by its source in
+// /proc/self/mountinfo: nfs://server/export for NFS and smb://server/share for
+// SMB, which every machine mounting them shares, and uuid:MACHINE:UUID for
+// disks with a filesystem UUID ("" = none of these). Disk IDs are scoped to
+// the machine since cloned disk images share the UUID and the inode numbers
+// of their files.
+func mountVolumeID(mount, machineID string) string {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	// Later entries mount over earlier ones, so the last match is in use
+	var root, fsType, source string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		// 36 35 98:0 /root /mount rw,noatime master:1 - ext4 /dev/sda1 rw
+		fields := strings.Fields(sc.Text())
+		sep := -1
+		for i, field := range fields {
+			if field == "-" {
+				sep = i
+				break
+			}
+		}
+		if sep < 5 || sep+2 >= len(fields) || unescapeMountinfo(fields[4]) != mount {
+			continue
+		}
+		root, fsType, source = unescapeMountinfo(fields[3]), fields[sep+1], unescapeMountinfo(fields[sep+2])
+	}
+
+	if id := networkVolumeID(fsType, source); id != "" {
+		return id
+	}
+	if !strings.HasPrefix(source, "/dev/") {
+		return ""
+	}
+	uuid := filesystemUUID(source)
+	if uuid == "" {
+		return ""
+	}
+	// Btrfs subvolumes share the UUID but number their inodes separately
+	if fsType == "btrfs" && root != "/" {
+		return "uuid:" + machineID + ":" + uuid + ":" + root
+	}
+	return "uuid:" + machineID + ":" + uuid
+}
+
+// networkVolumeID identifies an NFS or SMB mount by its source ("" = not a
+// network filesystem)
+func networkVolumeID(fsType, source string) string {
+	switch fsType {
+	case "nfs", "nfs4":
+		server, export, ok := strings.Cut(source, ":")
+		if !ok {
+			return ""
+		}
+		return "nfs://" + strings.ToLower(server) + "/" + strings.TrimLeft(export, "/")
+	case "cifs", "smb3":
+		return shareID(source)
+	}
+	return ""
+}
+
+// filesystemUUID returns the UUID of the filesystem on a block device using
+// the links udev maintains in /dev/disk/by-uuid
+func filesystemUUID(dev string) string {
+	target, err := filepath.EvalSymlinks(dev)
+	if err != nil {
+		return ""
+	}
+	entries, err := os.ReadDir("/dev/disk/by-uuid")
+	if err != nil {
+		return ""
+	}
+	for _, e := range entries {
+		if t, err := filepath.EvalSymlinks(filepath.Join("/dev/disk/by-uuid", e.Name())); err == nil && t == target {
+			return strings.ToLower(e.Name())
+		}
+	}
+	return ""
+}
+
+// unescapeMountinfo decodes the octal escapes mountinfo uses for spaces, tabs,
+// newlines and backslashes
+func unescapeMountinfo(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) && isOctal(s[i+1]) && isOctal(s[i+2]) && isOctal(s[i+3]) {
+			b.WriteByte((s[i+1]-'0')<<6 | (s[i+2]-'0')<<3 | (s[i+3] - '0'))
+			i += 3
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func isOctal(c byte) bool {
+	return c >= '0' && c <= '7'
+}
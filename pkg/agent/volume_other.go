@@ -0,0 +1,31 @@
+//go:build !unix
+
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// volumeOf returns the drive letter or UNC share of dir
+func volumeOf(dir string) string {
+	return filepath.VolumeName(dir)
+}
+
+// volumeID identifies UNC shares as smb://server/share; drive letters are not
+// identified
+func volumeID(mount, machineID string) string {
+	share, ok := strings.CutPrefix(filepath.ToSlash(mount), "//?/UNC/")
+	if !ok {
+		if share, ok = strings.CutPrefix(filepath.ToSlash(mount), "//"); !ok || strings.HasPrefix(share, "?/") || strings.HasPrefix(share, "./") {
+			return ""
+		}
+	}
+	return shareID(share)
+}
+
+// inodeOf returns 0, file IDs are not read on this platform
+func inodeOf(info os.FileInfo) uint64 {
+	return 0
+}
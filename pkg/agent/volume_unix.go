@@ -0,0 +1,64 @@
+//go:build unix
+
+package agent
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// volumeOf returns the mount point of dir: its topmost ancestor on the same device
+func volumeOf(dir string) string {
+	dev, ok := device(dir)
+	if !ok {
+		return ""
+	}
+	for {
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir
+		}
+		if d, ok := device(parent); !ok || d != dev {
+			return dir
+		}
+		dir = parent
+	}
+}
+
+// volumeID identifies the filesystem mounted at mount. Network shares get the
+// same ID on every machine; disks are identified by their filesystem UUID where
+// known and by the device number otherwise, both scoped to this machine.
+func volumeID(mount, machineID string) string {
+	if id := mountVolumeID(mount, machineID); id != "" {
+		return id
+	}
+	dev, ok := device(mount)
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("dev:%s:%d", machineID, dev)
+}
+
+// device returns the ID of the device a path is stored on
+func device(path string) (uint64, bool) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, false
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return uint64(st.Dev), true
+}
+
+// inodeOf returns the inode number of a file (0 = unknown)
+func inodeOf(info os.FileInfo) uint64 {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0
+	}
+	return uint64(st.Ino)
+}
@@ -0,0 +1,9 @@
+//go:build unix && !linux
+
+package agent
+
+// mountVolumeID returns "", volumes are identified by device number only on
+// this platform
+func mountVolumeID(mount, machineID string) string {
+	return ""
+}
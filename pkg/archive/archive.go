@@ -0,0 +1,303 @@
+// Package archive reads and writes signed scan archives, which carry the
+// results of an agent scan to the server without a network connection.
+//
+// An archive is a tar file with three entries, in order: manifest.json,
+// manifest.sig (the base64 ed25519 signature of manifest.json) and
+// files.ndjson.gz (one JSON record per line). The manifest holds the SHA-256
+// of the data entry, so the signature covers the whole archive.
+package archive
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// FormatVersion is the archive format written by this package
+const FormatVersion = 1
+
+// Entry names inside the tar file
+const (
+	manifestName  = "manifest.json"
+	signatureName = "manifest.sig"
+	dataName      = "files.ndjson.gz"
+)
+
+// Manifest describes the scan an archive contains
+type Manifest struct {
+	Version      int       `json:"version"`
+	ID           string    `json:"id"` // Random ID, used to reject archives that were already ingested
+	MachineID    string    `json:"machine_id"`
+	Hostname     string    `json:"hostname"`
+	OS           string    `json:"os"`
+	Arch         string    `json:"arch"`
+	AgentVersion string    `json:"agent_version"`
+	Roots        []string  `json:"roots"`
+	RootVolumes  []string  `json:"root_volumes,omitempty"` // Volume ID of each root
+	StartedAt    time.Time `json:"started_at"`
+	FinishedAt   time.Time `json:"finished_at"`
+	ScanBytes    int64     `json:"scan_bytes"`
+	ScanErrors   int64     `json:"scan_errors"`
+	Complete     bool      `json:"complete"` // Every scanned file is in the archive, so missing files were deleted
+	Records      int64     `json:"records"`
+	DataSHA256   string    `json:"data_sha256"`
+	KeyID        string    `json:"key_id"`
+}
+
+// Writer writes records to a new archive. Records are buffered in a
+// temporary file next to the archive until Close writes the archive.
+type Writer struct {
+	path    string
+	key     ed25519.PrivateKey
+	tmp     *os.File
+	buf     *bufio.Writer
+	gz      *gzip.Writer
+	enc     *json.Encoder
+	records int64
+}
+
+// Create starts an archive at path signed with key
+func Create(path string, key ed25519.PrivateKey) (*Writer, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".filededup-archive-*")
+	if err != nil {
+		return nil, err
+	}
+	buf := bufio.NewWriter(tmp)
+	gz := gzip.NewWriter(buf)
+	return &Writer{
+		path: path,
+		key:  key,
+		tmp:  tmp,
+		buf:  buf,
+		gz:   gz,
+		enc:  json.NewEncoder(gz),
+	}, nil
+}
+
+// Write appends one record; it is not safe for concurrent use
+func (w *Writer) Write(record any) error {
+	if err := w.enc.Encode(record); err != nil {
+		return err
+	}
+	w.records++
+	return nil
+}
+
+// Abort discards the archive
+func (w *Writer) Abort() {
+	w.tmp.Close()
+	os.Remove(w.tmp.Name())
+}
+
+// Close signs the manifest and writes the archive. The record count, data
+// hash, key ID, archive ID and format version of m are filled in.
+func (w *Writer) Close(m Manifest) error {
+	defer w.Abort()
+
+	if err := w.gz.Close(); err != nil {
+		return err
+	}
+	if err := w.buf.Flush(); err != nil {
+		return err
+	}
+
+	// Hash the compressed data
+	if _, err := w.tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	h := sha256.New()
+	size, err := io.Copy(h, w.tmp)
+	if err != nil {
+		return err
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	m.Version = FormatVersion
+	m.ID = hex.EncodeToString(id)
+	m.Records = w.records
+	m.DataSHA256 = hex.EncodeToString(h.Sum(nil))
+	m.KeyID = KeyID(w.key.Public().(ed25519.PublicKey))
+	manifest, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	signature := []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(w.key, manifest)))
+
+	out, err := os.CreateTemp(filepath.Dir(w.path), ".filededup-archive-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	tw := tar.NewWriter(out)
+	now := time.Now()
+	for _, entry := range []struct {
+		name string
+		data []byte
+	}{{manifestName, manifest}, {signatureName, signature}} {
+		if err := tw.WriteHeader(&tar.Header{Name: entry.name, Mode: 0o644, Size: int64(len(entry.data)), ModTime: now}); err != nil {
+			return err
+		}
+		if _, err := tw.Write(entry.data); err != nil {
+			return err
+		}
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: dataName, Mode: 0o644, Size: size, ModTime: now}); err != nil {
+		return err
+	}
+	if _, err := w.tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.Copy(tw, w.tmp); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(out.Name(), w.path)
+}
+
+// Errors returned while reading archives
+var (
+	ErrUntrustedKey     = errors.New("archive is signed by an untrusted key")
+	ErrInvalidSignature = errors.New("archive signature is invalid")
+	ErrCorrupt          = errors.New("archive data does not match its manifest")
+)
+
+// Reader reads the records of a verified archive
+type Reader struct {
+	Manifest Manifest
+
+	tmp     *os.File
+	gz      *gzip.Reader
+	dec     *json.Decoder
+	records int64
+}
+
+// Open reads and verifies an archive. The data is copied to a temporary file
+// and checked against the signed manifest before any record is returned, so a
+// tampered archive is rejected before it is used. Close removes the file.
+func Open(r io.Reader, trusted TrustedKeys) (*Reader, error) {
+	tr := tar.NewReader(r)
+
+	manifest, err := readEntry(tr, manifestName, 1<<20)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := readEntry(tr, signatureName, 1<<10)
+	if err != nil {
+		return nil, err
+	}
+
+	var m Manifest
+	if err := json.Unmarshal(manifest, &m); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+	if m.Version != FormatVersion {
+		return nil, fmt.Errorf("unsupported archive version %d", m.Version)
+	}
+
+	key, ok := trusted[m.KeyID]
+	if !ok || (key.MachineID != AnyMachine && key.MachineID != m.MachineID) {
+		return nil, ErrUntrustedKey
+	}
+	sig, err := base64.StdEncoding.DecodeString(string(signature))
+	if err != nil || !ed25519.Verify(key.Key, manifest, sig) {
+		return nil, ErrInvalidSignature
+	}
+
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read archive data: %w", err)
+	}
+	if hdr.Name != dataName {
+		return nil, fmt.Errorf("unexpected archive entry %s", hdr.Name)
+	}
+
+	tmp, err := os.CreateTemp("", "filededup-ingest-*")
+	if err != nil {
+		return nil, err
+	}
+	ar := &Reader{Manifest: m, tmp: tmp}
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, h), tr); err != nil {
+		ar.Close()
+		return nil, fmt.Errorf("failed to read archive data: %w", err)
+	}
+	if hex.EncodeToString(h.Sum(nil)) != m.DataSHA256 {
+		ar.Close()
+		return nil, ErrCorrupt
+	}
+
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		ar.Close()
+		return nil, err
+	}
+	ar.gz, err = gzip.NewReader(bufio.NewReader(tmp))
+	if err != nil {
+		ar.Close()
+		return nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	ar.dec = json.NewDecoder(ar.gz)
+	return ar, nil
+}
+
+// Next decodes the next record into v and returns io.EOF after the last one
+func (r *Reader) Next(v any) error {
+	err := r.dec.Decode(v)
+	if err == io.EOF {
+		if r.records != r.Manifest.Records {
+			return ErrCorrupt
+		}
+		return io.EOF
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	r.records++
+	return nil
+}
+
+// Close removes the temporary copy of the archive data
+func (r *Reader) Close() error {
+	r.tmp.Close()
+	return os.Remove(r.tmp.Name())
+}
+
+// readEntry reads the next tar entry, which must have the given name
+func readEntry(tr *tar.Reader, name string, limit int64) ([]byte, error) {
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read archive: %w", err)
+	}
+	if hdr.Name != name {
+		return nil, fmt.Errorf("expected %s in archive, found %s", name, hdr.Name)
+	}
+	if hdr.Size > limit {
+		return nil, fmt.Errorf("%s is too large", name)
+	}
+	return io.ReadAll(tr)
+}
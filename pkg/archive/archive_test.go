@@ -0,0 +1,262 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type testRecord struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+var testRecords = []testRecord{{"/a/one.txt", 1}, {"/a/two.txt", 2}, {"/b/three.txt", 3}}
+
+func newKey(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pub, priv
+}
+
+// writeArchive writes testRecords for machine-a to an archive signed with key
+// and returns its contents
+func writeArchive(t *testing.T, key ed25519.PrivateKey) []byte {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "scan.fdda")
+	w, err := Create(path, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range testRecords {
+		if err := w.Write(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(Manifest{MachineID: "machine-a", Hostname: "host-a", Complete: true}); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+type tarEntry struct {
+	name string
+	data []byte
+}
+
+// rewrite passes the entries of an archive through edit and writes them back
+func rewrite(t *testing.T, archive []byte, edit func([]tarEntry)) []byte {
+	t.Helper()
+	var entries []tarEntry
+	tr := tar.NewReader(bytes.NewReader(archive))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, tarEntry{hdr.Name, data})
+	}
+	edit(entries)
+
+	var out bytes.Buffer
+	tw := tar.NewWriter(&out)
+	for _, e := range entries {
+		if err := tw.WriteHeader(&tar.Header{Name: e.name, Mode: 0o644, Size: int64(len(e.data))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(e.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+// editManifest changes the manifest and, with key, signs it again
+func editManifest(t *testing.T, entries []tarEntry, key ed25519.PrivateKey, edit func(*Manifest)) {
+	t.Helper()
+	var m Manifest
+	if err := json.Unmarshal(entries[0].data, &m); err != nil {
+		t.Fatal(err)
+	}
+	edit(&m)
+	manifest, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries[0].data = manifest
+	if key != nil {
+		entries[1].data = []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(key, manifest)))
+	}
+}
+
+func readAll(r *Reader) ([]testRecord, error) {
+	var records []testRecord
+	for {
+		var rec testRecord
+		err := r.Next(&rec)
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return records, err
+		}
+		records = append(records, rec)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	pub, priv := newKey(t)
+	data := writeArchive(t, priv)
+
+	for _, machineID := range []string{"machine-a", AnyMachine} {
+		r, err := Open(bytes.NewReader(data), TrustedKeys{KeyID(pub): {MachineID: machineID, Key: pub}})
+		if err != nil {
+			t.Fatalf("key for %s: %v", machineID, err)
+		}
+		records, err := readAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("key for %s: %v", machineID, err)
+		}
+		if len(records) != len(testRecords) {
+			t.Fatalf("key for %s: read %d records, want %d", machineID, len(records), len(testRecords))
+		}
+		for i := range records {
+			if records[i] != testRecords[i] {
+				t.Errorf("record %d = %+v, want %+v", i, records[i], testRecords[i])
+			}
+		}
+		if r.Manifest.MachineID != "machine-a" || r.Manifest.Records != int64(len(testRecords)) || !r.Manifest.Complete {
+			t.Errorf("unexpected manifest %+v", r.Manifest)
+		}
+	}
+}
+
+func TestOpenRejectsUntrustedKeys(t *testing.T) {
+	pub, priv := newKey(t)
+	otherPub, _ := newKey(t)
+	data := writeArchive(t, priv)
+
+	tests := []struct {
+		name    string
+		trusted TrustedKeys
+	}{
+		{"no keys", nil},
+		{"other key", TrustedKeys{KeyID(otherPub): {MachineID: AnyMachine, Key: otherPub}}},
+		{"other machine", TrustedKeys{KeyID(pub): {MachineID: "machine-b", Key: pub}}},
+		// A trusted key ID whose key did not sign the manifest
+		{"key ID of other key", TrustedKeys{KeyID(pub): {MachineID: AnyMachine, Key: otherPub}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Open(bytes.NewReader(data), tt.trusted)
+			if !errors.Is(err, ErrUntrustedKey) && !errors.Is(err, ErrInvalidSignature) {
+				t.Fatalf("Open() error = %v, want an untrusted key or invalid signature", err)
+			}
+		})
+	}
+}
+
+func TestOpenRejectsTamperedManifest(t *testing.T) {
+	pub, priv := newKey(t)
+	trusted := TrustedKeys{KeyID(pub): {MachineID: AnyMachine, Key: pub}}
+	data := writeArchive(t, priv)
+
+	tests := []struct {
+		name string
+		edit func(*Manifest)
+	}{
+		{"machine", func(m *Manifest) { m.MachineID = "machine-b" }},
+		{"complete", func(m *Manifest) { m.Complete = false }},
+		{"records", func(m *Manifest) { m.Records++ }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tampered := rewrite(t, data, func(entries []tarEntry) { editManifest(t, entries, nil, tt.edit) })
+			if _, err := Open(bytes.NewReader(tampered), trusted); !errors.Is(err, ErrInvalidSignature) {
+				t.Fatalf("Open() error = %v, want %v", err, ErrInvalidSignature)
+			}
+		})
+	}
+}
+
+func TestOpenRejectsTamperedData(t *testing.T) {
+	pub, priv := newKey(t)
+	trusted := TrustedKeys{KeyID(pub): {MachineID: AnyMachine, Key: pub}}
+	data := writeArchive(t, priv)
+
+	tampered := rewrite(t, data, func(entries []tarEntry) {
+		entries[2].data = append([]byte(nil), entries[2].data...)
+		entries[2].data[len(entries[2].data)/2] ^= 0xff
+	})
+	if _, err := Open(bytes.NewReader(tampered), trusted); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("Open() error = %v, want %v", err, ErrCorrupt)
+	}
+}
+
+func TestNextRejectsMissingRecords(t *testing.T) {
+	pub, priv := newKey(t)
+	trusted := TrustedKeys{KeyID(pub): {MachineID: AnyMachine, Key: pub}}
+
+	// Signed by the trusted key, but the data holds fewer records than claimed
+	data := rewrite(t, writeArchive(t, priv), func(entries []tarEntry) {
+		editManifest(t, entries, priv, func(m *Manifest) { m.Records++ })
+	})
+	r, err := Open(bytes.NewReader(data), trusted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, err := readAll(r); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("Next() error = %v, want %v", err, ErrCorrupt)
+	}
+}
+
+func TestLoadTrustedKeys(t *testing.T) {
+	pub, _ := newKey(t)
+	path := filepath.Join(t.TempDir(), "trusted")
+	content := "# scanners\n\nmachine-a " + base64.StdEncoding.EncodeToString(pub) + " laptop\n"
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := LoadTrustedKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, ok := keys[KeyID(pub)]
+	if len(keys) != 1 || !ok || key.MachineID != "machine-a" || !key.Key.Equal(pub) {
+		t.Fatalf("LoadTrustedKeys() = %+v", keys)
+	}
+
+	if err := os.WriteFile(path, []byte("machine-a not-a-key\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadTrustedKeys(path); err == nil {
+		t.Fatal("LoadTrustedKeys() accepted an invalid key")
+	}
+}
@@ -0,0 +1,90 @@
+package archive
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// AnyMachine in a trusted keys file allows a key to sign archives for every machine
+const AnyMachine = "*"
+
+// GenerateKey creates a signing key pair and writes the private key to path
+// and the public key to path + ".pub"
+func GenerateKey(path string) (ed25519.PublicKey, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(priv)+"\n"), 0o600); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path+".pub", []byte(base64.StdEncoding.EncodeToString(pub)+"\n"), 0o644); err != nil {
+		return nil, err
+	}
+	return pub, nil
+}
+
+// LoadPrivateKey reads a private key written by GenerateKey
+func LoadPrivateKey(path string) (ed25519.PrivateKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signing key: %w", err)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil || len(key) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("invalid signing key in %s", path)
+	}
+	return ed25519.PrivateKey(key), nil
+}
+
+// KeyID returns a short fingerprint identifying a public key
+func KeyID(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
+
+// TrustedKeys maps key IDs to the keys the server accepts archives from
+type TrustedKeys map[string]TrustedKey
+
+// TrustedKey is a public key and the machine it may sign archives for
+type TrustedKey struct {
+	MachineID string // AnyMachine allows every machine
+	Key       ed25519.PublicKey
+}
+
+// LoadTrustedKeys reads a trusted keys file. Each line holds a machine ID
+// (or * for any machine) and a base64 public key, optionally followed by a
+// comment; blank lines and lines starting with # are ignored.
+func LoadTrustedKeys(path string) (TrustedKeys, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read trusted keys: %w", err)
+	}
+	defer f.Close()
+
+	keys := make(TrustedKeys)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: expected a machine ID and a public key", path, line)
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("%s:%d: invalid public key", path, line)
+		}
+		keys[KeyID(key)] = TrustedKey{MachineID: fields[0], Key: key}
+	}
+	return keys, scanner.Err()
+}
@@ -0,0 +1,157 @@
+// Package auth authenticates agents with per-machine bearer tokens
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/tendant/filededup/pkg/record/recorddb"
+)
+
+// tokenPrefix makes tokens easy to recognize in config files and secret scanners
+const tokenPrefix = "fdd_"
+
+type contextKey struct{}
+
+// GenerateToken returns a new random bearer token
+func GenerateToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return tokenPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// HashToken returns the value stored in the database for a token
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// WithMachineID returns a context carrying the authenticated machine ID
+func WithMachineID(ctx context.Context, machineID string) context.Context {
+	return context.WithValue(ctx, contextKey{}, machineID)
+}
+
+// MachineIDFromContext returns the authenticated machine ID, if any
+func MachineIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(contextKey{}).(string)
+	return id, ok
+}
+
+// Allowed reports whether the request may act on behalf of machineID.
+// Requests without an authenticated machine (authentication disabled) are always allowed.
+func Allowed(r *http.Request, machineID string) bool {
+	id, ok := MachineIDFromContext(r.Context())
+	return !ok || id == machineID
+}
+
+// bearerToken extracts the token from an Authorization header
+func bearerToken(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if len(h) < 7 || !strings.EqualFold(h[:7], "bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(h[7:])
+}
+
+// requestToken extracts the token from an Authorization header, as a bearer
+// token or as the password of HTTP basic authentication, which browsers send
+func requestToken(r *http.Request) string {
+	if token := bearerToken(r); token != "" {
+		return token
+	}
+	_, password, _ := r.BasicAuth()
+	return password
+}
+
+// RequireMachineToken rejects requests without a valid, unrevoked machine token
+// and binds the token's machine ID to the request context. Requests already
+// identified by a client certificate only need a token if they send one, in
+// which case it must belong to the same machine.
+func RequireMachineToken(q *recorddb.Queries) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			certID, hasCert := MachineIDFromContext(r.Context())
+			token := bearerToken(r)
+			if token == "" && hasCert {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if token == "" {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="filededup"`)
+				http.Error(w, "Missing bearer token", http.StatusUnauthorized)
+				return
+			}
+
+			t, err := q.GetActiveMachineToken(r.Context(), HashToken(token))
+			if err != nil {
+				if errors.Is(err, pgx.ErrNoRows) {
+					w.Header().Set("WWW-Authenticate", `Bearer realm="filededup", error="invalid_token"`)
+					http.Error(w, "Invalid or revoked token", http.StatusUnauthorized)
+					return
+				}
+				slog.Error("Error looking up machine token", "error", err)
+				http.Error(w, "Failed to authenticate", http.StatusInternalServerError)
+				return
+			}
+
+			if hasCert && certID != t.MachineID {
+				http.Error(w, "Token does not match client certificate", http.StatusForbidden)
+				return
+			}
+
+			if err := q.TouchMachineToken(r.Context(), t.ID); err != nil {
+				slog.Warn("Failed to update token usage", "machineID", t.MachineID, "error", err)
+			}
+
+			next.ServeHTTP(w, r.WithContext(WithMachineID(r.Context(), t.MachineID)))
+		})
+	}
+}
+
+// RequireReadToken rejects requests that carry none of the given tokens,
+// empty ones ignored. Browsers can send a token as the password of HTTP basic
+// authentication, with any user name.
+func RequireReadToken(tokens ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token := requestToken(r)
+			for _, t := range tokens {
+				if token != "" && t != "" && subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+			w.Header().Add("WWW-Authenticate", `Bearer realm="filededup"`)
+			w.Header().Add("WWW-Authenticate", `Basic realm="filededup"`)
+			http.Error(w, "Invalid reader token", http.StatusUnauthorized)
+		})
+	}
+}
+
+// RequireAdminToken rejects requests that do not carry the admin token, as a
+// bearer token or a basic authentication password
+func RequireAdminToken(adminToken string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token := requestToken(r)
+			if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+				w.Header().Add("WWW-Authenticate", `Bearer realm="filededup-admin"`)
+				w.Header().Add("WWW-Authenticate", `Basic realm="filededup-admin"`)
+				http.Error(w, "Invalid admin token", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
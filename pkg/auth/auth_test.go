@@ -0,0 +1,143 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGenerateToken(t *testing.T) {
+	a, err := GenerateToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := GenerateToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(a, tokenPrefix) || a == b {
+		t.Fatalf("GenerateToken() = %q, %q", a, b)
+	}
+	if HashToken(a) != HashToken(a) || HashToken(a) == HashToken(b) || len(HashToken(a)) != 64 {
+		t.Fatalf("HashToken() = %q, %q", HashToken(a), HashToken(b))
+	}
+}
+
+// serve sends a request with the given Authorization header or basic
+// authentication password through a middleware
+func serve(mw func(http.Handler) http.Handler, authorization, basicPassword string) int {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) })
+	r := httptest.NewRequest(http.MethodGet, "/stats", nil)
+	if authorization != "" {
+		r.Header.Set("Authorization", authorization)
+	}
+	if basicPassword != "" {
+		r.SetBasicAuth("anyone", basicPassword)
+	}
+	w := httptest.NewRecorder()
+	mw(next).ServeHTTP(w, r)
+	return w.Code
+}
+
+func TestRequireReadToken(t *testing.T) {
+	mw := RequireReadToken("reader-secret", "admin-secret")
+	tests := []struct {
+		name          string
+		authorization string
+		basicPassword string
+		want          int
+	}{
+		{"no token", "", "", http.StatusUnauthorized},
+		{"reader bearer", "Bearer reader-secret", "", http.StatusNoContent},
+		{"admin bearer", "bearer admin-secret", "", http.StatusNoContent},
+		{"reader basic", "", "reader-secret", http.StatusNoContent},
+		{"admin basic", "", "admin-secret", http.StatusNoContent},
+		{"wrong bearer", "Bearer reader-secre", "", http.StatusUnauthorized},
+		{"wrong basic", "", "nope", http.StatusUnauthorized},
+		{"other scheme", "Token reader-secret", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := serve(mw, tt.authorization, tt.basicPassword); got != tt.want {
+				t.Fatalf("status = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequireReadTokenIgnoresEmptyTokens(t *testing.T) {
+	// An unset reader token must not let requests without a token through
+	mw := RequireReadToken("", "admin-secret")
+	if got := serve(mw, "", ""); got != http.StatusUnauthorized {
+		t.Fatalf("no token: status = %d, want %d", got, http.StatusUnauthorized)
+	}
+	if got := serve(mw, "", " "); got != http.StatusUnauthorized {
+		t.Fatalf("blank password: status = %d, want %d", got, http.StatusUnauthorized)
+	}
+	if got := serve(RequireReadToken("", ""), "Bearer ", ""); got != http.StatusUnauthorized {
+		t.Fatalf("no tokens configured: status = %d, want %d", got, http.StatusUnauthorized)
+	}
+}
+
+func TestRequireAdminToken(t *testing.T) {
+	mw := RequireAdminToken("admin-secret")
+	tests := []struct {
+		name          string
+		authorization string
+		basicPassword string
+		want          int
+	}{
+		{"no token", "", "", http.StatusUnauthorized},
+		{"bearer", "Bearer admin-secret", "", http.StatusNoContent},
+		{"basic", "", "admin-secret", http.StatusNoContent},
+		{"reader token", "Bearer reader-secret", "", http.StatusUnauthorized},
+		{"prefix", "Bearer admin-secretx", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := serve(mw, tt.authorization, tt.basicPassword); got != tt.want {
+				t.Fatalf("status = %d, want %d", got, tt.want)
+			}
+		})
+	}
+
+	if got := serve(RequireAdminToken(""), "", ""); got != http.StatusUnauthorized {
+		t.Fatalf("empty admin token: status = %d, want %d", got, http.StatusUnauthorized)
+	}
+}
+
+func TestRequireMachineTokenAcceptsClientCertificate(t *testing.T) {
+	// A request identified by a client certificate needs no token, so the
+	// database is never consulted
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id, _ := MachineIDFromContext(r.Context()); id != "machine-a" {
+			t.Errorf("machine ID = %q, want machine-a", id)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	r := httptest.NewRequest(http.MethodPost, "/files", nil)
+	r = r.WithContext(WithMachineID(r.Context(), "machine-a"))
+	w := httptest.NewRecorder()
+	RequireMachineToken(nil)(next).ServeHTTP(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusNoContent)
+	}
+
+	w = httptest.NewRecorder()
+	RequireMachineToken(nil)(next).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/files", nil))
+	if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+		t.Fatalf("no token: status = %d, want %d with a challenge", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/files", nil)
+	if !Allowed(r, "machine-a") {
+		t.Fatal("unauthenticated request not allowed")
+	}
+	r = r.WithContext(WithMachineID(r.Context(), "machine-a"))
+	if !Allowed(r, "machine-a") || Allowed(r, "machine-b") {
+		t.Fatal("authenticated request allowed for the wrong machine")
+	}
+}
@@ -0,0 +1,91 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// TLSOptions configures the server's TLS listener
+type TLSOptions struct {
+	CertFile string // Server certificate (PEM)
+	KeyFile  string // Server private key (PEM)
+	// ClientCAFile enables mutual TLS: client certificates signed by these CAs
+	// are accepted and their common name is used as the machine ID.
+	ClientCAFile string
+	// RequireClientCert rejects connections without a valid client certificate
+	RequireClientCert bool
+}
+
+// Enabled reports whether TLS is configured
+func (o TLSOptions) Enabled() bool {
+	return o.CertFile != "" || o.KeyFile != ""
+}
+
+// ServerTLSConfig builds the TLS configuration for the server
+func ServerTLSConfig(o TLSOptions) (*tls.Config, error) {
+	if o.CertFile == "" || o.KeyFile == "" {
+		return nil, errors.New("both a TLS certificate and key are required")
+	}
+
+	cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS key pair: %w", err)
+	}
+
+	cfg := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+
+	if o.ClientCAFile != "" {
+		pool, err := LoadCertPool(o.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+		if o.RequireClientCert {
+			cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	} else if o.RequireClientCert {
+		return nil, errors.New("requiring client certificates needs a client CA")
+	}
+
+	return cfg, nil
+}
+
+// LoadCertPool reads PEM encoded CA certificates from a file
+func LoadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+	return pool, nil
+}
+
+// CertMachineID returns the machine ID from a verified client certificate.
+// The machine ID is the certificate's common name.
+func CertMachineID(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName
+}
+
+// ClientCertIdentity binds the machine ID of a verified client certificate to the request context
+func ClientCertIdentity(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id := CertMachineID(r); id != "" {
+			r = r.WithContext(WithMachineID(r.Context(), id))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,144 @@
+package auth
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/tendant/filededup/pkg/record/recorddb"
+)
+
+// TokenRequest asks the server to issue a token for a machine
+type TokenRequest struct {
+	MachineID   string `json:"machine_id"`
+	Description string `json:"description"`
+}
+
+// IssuedToken is returned once when a token is created; the token itself is not stored
+type IssuedToken struct {
+	ID          pgtype.UUID `json:"id"`
+	MachineID   string      `json:"machine_id"`
+	Description string      `json:"description"`
+	Token       string      `json:"token"`
+	CreatedAt   time.Time   `json:"created_at"`
+}
+
+// TokenInfo describes an issued token without revealing it
+type TokenInfo struct {
+	ID          pgtype.UUID `json:"id"`
+	MachineID   string      `json:"machine_id"`
+	Description string      `json:"description"`
+	CreatedAt   time.Time   `json:"created_at"`
+	LastUsedAt  *time.Time  `json:"last_used_at,omitempty"`
+	RevokedAt   *time.Time  `json:"revoked_at,omitempty"`
+}
+
+func timePtr(t pgtype.Timestamp) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+// CreateTokenHandler handles admin HTTP requests to issue a machine token
+func CreateTokenHandler(q *recorddb.Queries) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req TokenRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if req.MachineID == "" {
+			http.Error(w, "machine_id is required", http.StatusBadRequest)
+			return
+		}
+
+		token, err := GenerateToken()
+		if err != nil {
+			slog.Error("Error generating token", "error", err)
+			http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+			return
+		}
+
+		row, err := q.CreateMachineToken(r.Context(), recorddb.CreateMachineTokenParams{
+			MachineID:   req.MachineID,
+			TokenHash:   HashToken(token),
+			Description: req.Description,
+		})
+		if err != nil {
+			slog.Error("Error storing token", "machineID", req.MachineID, "error", err)
+			http.Error(w, "Failed to store token", http.StatusInternalServerError)
+			return
+		}
+		slog.Info("Machine token issued", "machineID", row.MachineID, "description", row.Description)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(w).Encode(IssuedToken{
+			ID:          row.ID,
+			MachineID:   row.MachineID,
+			Description: row.Description,
+			Token:       token,
+			CreatedAt:   row.CreatedAt.Time,
+		}); err != nil {
+			slog.Error("Error encoding JSON response", "error", err)
+		}
+	}
+}
+
+// ListTokensHandler handles admin HTTP requests listing issued tokens
+func ListTokensHandler(q *recorddb.Queries) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rows, err := q.ListMachineTokens(r.Context())
+		if err != nil {
+			slog.Error("Error listing tokens", "error", err)
+			http.Error(w, "Failed to list tokens", http.StatusInternalServerError)
+			return
+		}
+
+		result := make([]TokenInfo, 0, len(rows))
+		for _, row := range rows {
+			result = append(result, TokenInfo{
+				ID:          row.ID,
+				MachineID:   row.MachineID,
+				Description: row.Description,
+				CreatedAt:   row.CreatedAt.Time,
+				LastUsedAt:  timePtr(row.LastUsedAt),
+				RevokedAt:   timePtr(row.RevokedAt),
+			})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(result); err != nil {
+			slog.Error("Error encoding JSON response", "error", err)
+		}
+	}
+}
+
+// RevokeTokenHandler handles admin HTTP requests to revoke a token
+func RevokeTokenHandler(q *recorddb.Queries) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var id pgtype.UUID
+		if err := id.Scan(chi.URLParam(r, "tokenID")); err != nil {
+			http.Error(w, "Invalid token ID", http.StatusBadRequest)
+			return
+		}
+
+		n, err := q.RevokeMachineToken(r.Context(), id)
+		if err != nil {
+			slog.Error("Error revoking token", "error", err)
+			http.Error(w, "Failed to revoke token", http.StatusInternalServerError)
+			return
+		}
+		if n == 0 {
+			http.Error(w, "Token not found or already revoked", http.StatusNotFound)
+			return
+		}
+		slog.Info("Machine token revoked", "tokenID", chi.URLParam(r, "tokenID"))
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,227 @@
+package config
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// clearEnv unsets the variables Load reads for the duration of the test
+func clearEnv(t *testing.T) {
+	t.Helper()
+	for _, kv := range os.Environ() {
+		key, _, _ := strings.Cut(kv, "=")
+		if strings.HasPrefix(key, "FILEDEDUP_") || key == "DATABASE_URL" {
+			t.Setenv(key, "")
+			os.Unsetenv(key)
+		}
+	}
+}
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "server.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadDefaults(t *testing.T) {
+	clearEnv(t)
+	cfg, err := Load("server", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	def := Default()
+	if cfg.Listen != def.Listen || cfg.Database.URL != def.Database.URL || cfg.Stats.RefreshInterval != def.Stats.RefreshInterval {
+		t.Fatalf("Load() = %+v, want the defaults", cfg)
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	clearEnv(t)
+	path := writeConfig(t, `
+listen: 127.0.0.1:1000
+database:
+  max_conns: 20
+  min_conns: 2
+log:
+  level: warn
+stats:
+  refresh_interval: 5m
+anomaly:
+  changed_ratio: 0.2
+  deleted_ratio: 0.3
+`)
+	// The environment overrides the file, flags override both
+	t.Setenv("FILEDEDUP_CONFIG", path)
+	t.Setenv("FILEDEDUP_LISTEN", "127.0.0.1:2000")
+	t.Setenv("FILEDEDUP_DB_MAX_CONNS", "30")
+	t.Setenv("FILEDEDUP_ANOMALY_CHANGED_RATIO", "0.5")
+	t.Setenv("FILEDEDUP_STATS_REFRESH_INTERVAL", "1m")
+
+	cfg, err := Load("server", []string{"-listen", "127.0.0.1:3000", "-stats-refresh-interval", "30s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		got, want any
+	}{
+		{"listen from flag", cfg.Listen, "127.0.0.1:3000"},
+		{"refresh interval from flag", cfg.Stats.RefreshInterval, 30 * time.Second},
+		{"max conns from env", cfg.Database.MaxConns, int32(30)},
+		{"changed ratio from env", cfg.Anomaly.ChangedRatio, 0.5},
+		{"min conns from file", cfg.Database.MinConns, int32(2)},
+		{"log level from file", cfg.Log.Level, "warn"},
+		{"deleted ratio from file", cfg.Anomaly.DeletedRatio, 0.3},
+		{"renamed ratio from defaults", cfg.Anomaly.RenamedRatio, 0.4},
+		{"log format from defaults", cfg.Log.Format, "text"},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestLoadFlagsOnlyOverrideWhenGiven(t *testing.T) {
+	clearEnv(t)
+	// A flag left at its zero default must not reset the environment's value
+	t.Setenv("FILEDEDUP_AUTO_MIGRATE", "true")
+	t.Setenv("FILEDEDUP_MAX_BATCH_RECORDS", "50")
+	cfg, err := Load("server", []string{"-log-level", "debug"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.Database.AutoMigrate || cfg.Limits.MaxBatchRecords != 50 || cfg.Log.Level != "debug" {
+		t.Fatalf("Load() = %+v", cfg)
+	}
+}
+
+func TestLoadStoreURLIsDatabaseURL(t *testing.T) {
+	clearEnv(t)
+	t.Setenv("DATABASE_URL", "postgres://env@db/filededup")
+	cfg, err := Load("server", []string{"-store", "postgres://flag@db/filededup"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Database.URL != "postgres://flag@db/filededup" {
+		t.Fatalf("database URL = %q", cfg.Database.URL)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		file string
+		args []string
+	}{
+		{"invalid env boolean", map[string]string{"FILEDEDUP_AUTO_MIGRATE": "maybe"}, "", nil},
+		{"invalid env duration", map[string]string{"FILEDEDUP_STATS_REFRESH_INTERVAL": "soon"}, "", nil},
+		{"invalid env integer", map[string]string{"FILEDEDUP_DB_MAX_CONNS": "many"}, "", nil},
+		{"unknown file field", nil, "listne: 127.0.0.1:1000\n", nil},
+		{"unknown flag", nil, "", []string{"-no-such-flag"}},
+		{"invalid value", nil, "", []string{"-log-format", "xml"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearEnv(t)
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			args := tt.args
+			if tt.file != "" {
+				args = append([]string{"-config", writeConfig(t, tt.file)}, args...)
+			}
+			if _, err := Load("server", args); err == nil {
+				t.Fatal("Load() succeeded")
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		edit  func(*Config)
+		valid bool
+	}{
+		{"defaults", func(c *Config) {}, true},
+		{"sqlite", func(c *Config) { c.Store = "sqlite:///tmp/filededup.db" }, true},
+		{"sqlite without path", func(c *Config) { c.Store = "sqlite://" }, false},
+		{"unknown store", func(c *Config) { c.Store = "mysql://db" }, false},
+		{"no database URL", func(c *Config) { c.Database.URL = "" }, false},
+		{"sqlite with tokens", func(c *Config) { c.Store = "sqlite:///tmp/f.db"; c.Auth.AdminToken = "secret" }, false},
+		{"auth without tokens", func(c *Config) { c.Auth.Required = true }, false},
+		{"auth with reader token", func(c *Config) { c.Auth.Required = true; c.Auth.ReaderToken = "secret" }, true},
+		{"min conns above max", func(c *Config) { c.Database.MinConns = 20 }, false},
+		{"unknown log level", func(c *Config) { c.Log.Level = "loud" }, false},
+		{"tls cert without key", func(c *Config) { c.TLS.Cert = "cert.pem" }, false},
+		{"client CA without cert", func(c *Config) { c.TLS.ClientCA = "ca.pem" }, false},
+		{"client cert without CA", func(c *Config) { c.TLS.RequireClientCert = true }, false},
+		{"negative limit", func(c *Config) { c.Limits.MaxBatchRecords = -1 }, false},
+		{"zero refresh interval", func(c *Config) { c.Stats.RefreshInterval = 0 }, false},
+		{"ratio above 1", func(c *Config) { c.Anomaly.RenamedRatio = 1.5 }, false},
+		{"negative extension ratio", func(c *Config) { c.Anomaly.ExtensionRatio = -0.1 }, false},
+		{"negative baseline", func(c *Config) { c.Anomaly.BaselineSessions = -1 }, false},
+		{"no replication volumes", func(c *Config) { c.Replication.MinVolumes = 0 }, false},
+		{"policy without prefix", func(c *Config) {
+			c.Replication.Policies = []ReplicationPolicy{{MinMachines: 2}}
+		}, false},
+		{"policy", func(c *Config) {
+			c.Replication.Policies = []ReplicationPolicy{{PathPrefix: "/projects", MinMachines: 2}}
+		}, true},
+		{"webhook without scheme", func(c *Config) { c.Anomaly.WebhookURL = "hooks.example.com/x" }, false},
+		{"webhook", func(c *Config) { c.Integrity.WebhookURL = "https://hooks.example.com/x" }, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Default()
+			tt.edit(&c)
+			if err := c.Validate(); (err == nil) != tt.valid {
+				t.Fatalf("Validate() = %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestLogValueRedactsSecrets(t *testing.T) {
+	c := Default()
+	c.Database.URL = "postgres://filededup:db-secret@db/filededup"
+	c.Auth.AdminToken = "admin-secret"
+	c.Auth.ReaderToken = "reader-secret"
+	c.Anomaly.WebhookURL = "https://hooks.example.com/anomaly-secret"
+	c.Integrity.WebhookURL = "https://hooks.example.com/integrity-secret"
+
+	var buf bytes.Buffer
+	slog.New(slog.NewTextHandler(&buf, nil)).Info("config", "config", c)
+	for _, secret := range []string{"db-secret", "admin-secret", "reader-secret", "anomaly-secret", "integrity-secret"} {
+		if strings.Contains(buf.String(), secret) {
+			t.Errorf("log output contains %s: %s", secret, buf.String())
+		}
+	}
+}
+
+func TestRedactURL(t *testing.T) {
+	tests := []struct {
+		raw, want string
+	}{
+		{"postgres://user:pw@db/filededup", "postgres://user:xxxxx@db/filededup"},
+		{"postgres://user@db/filededup?password=pw", "postgres://user@db/filededup?password=xxxxx"},
+		{"host=db password=pw dbname=filededup", "host=db password=xxxxx dbname=filededup"},
+		{"host=db password='p w' dbname=filededup", "host=db password=xxxxx dbname=filededup"},
+		{"postgres://db/filededup", "postgres://db/filededup"},
+	}
+	for _, tt := range tests {
+		if got := RedactURL(tt.raw); got != tt.want {
+			t.Errorf("RedactURL(%q) = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Connect opens the connection pool and checks that the database is reachable
+func (c DatabaseConfig) Connect(ctx context.Context) (*pgxpool.Pool, error) {
+	poolConfig, err := pgxpool.ParseConfig(c.URL)
+	if err != nil {
+		// The parse error may echo the connection string, so do not wrap it
+		return nil, fmt.Errorf("invalid database URL %s", RedactURL(c.URL))
+	}
+	if c.MaxConns > 0 {
+		poolConfig.MaxConns = c.MaxConns
+	}
+	poolConfig.MinConns = c.MinConns
+	if c.MaxConnLifetime > 0 {
+		poolConfig.MaxConnLifetime = c.MaxConnLifetime
+	}
+	if c.MaxConnIdleTime > 0 {
+		poolConfig.MaxConnIdleTime = c.MaxConnIdleTime
+	}
+
+	slog.Info("Connecting to database", "url", RedactURL(c.URL), "maxConns", poolConfig.MaxConns)
+
+	// Connect using pgx
+	dbConn, err := pgxpool.NewWithConfig(ctx, poolConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	// Test database connection
+	if err := dbConn.Ping(ctx); err != nil {
+		dbConn.Close()
+		return nil, fmt.Errorf("failed to ping database: %w", err)
+	}
+	return dbConn, nil
+}
@@ -0,0 +1,102 @@
+// Package health serves the liveness, readiness and build information endpoints
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"time"
+)
+
+// checkTimeout bounds each readiness check so a hung database fails the probe
+const checkTimeout = 3 * time.Second
+
+// Check is one readiness condition
+type Check struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+// LiveHandler reports that the process is up. It never touches dependencies.
+func LiveHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte("ok\n"))
+	}
+}
+
+// readiness is the /readyz response
+type readiness struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// ReadyHandler runs every check and responds 503 if any of them fails
+func ReadyHandler(checks ...Check) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		result := readiness{Status: "ready", Checks: make(map[string]string, len(checks))}
+		status := http.StatusOK
+		for _, c := range checks {
+			ctx, cancel := context.WithTimeout(r.Context(), checkTimeout)
+			err := c.Check(ctx)
+			cancel()
+			if err != nil {
+				slog.Warn("Readiness check failed", "check", c.Name, "error", err)
+				result.Checks[c.Name] = err.Error()
+				result.Status = "not ready"
+				status = http.StatusServiceUnavailable
+				continue
+			}
+			result.Checks[c.Name] = "ok"
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+// BuildInfo describes the running binary
+type BuildInfo struct {
+	Path      string `json:"path"`
+	Version   string `json:"version"`
+	GoVersion string `json:"go_version"`
+	Revision  string `json:"revision,omitempty"`
+	Time      string `json:"time,omitempty"`
+	Modified  bool   `json:"modified,omitempty"`
+}
+
+// ReadBuildInfo returns the module and VCS information embedded by the Go toolchain
+func ReadBuildInfo() BuildInfo {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return BuildInfo{Version: "unknown"}
+	}
+	info := BuildInfo{
+		Path:      bi.Main.Path,
+		Version:   bi.Main.Version,
+		GoVersion: bi.GoVersion,
+	}
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			info.Revision = s.Value
+		case "vcs.time":
+			info.Time = s.Value
+		case "vcs.modified":
+			info.Modified = s.Value == "true"
+		}
+	}
+	return info
+}
+
+// VersionHandler serves the build information as JSON
+func VersionHandler() http.HandlerFunc {
+	info := ReadBuildInfo()
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(info)
+	}
+}
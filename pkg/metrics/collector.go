@@ -0,0 +1,90 @@
+package metrics
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tendant/filededup/pkg/record/recorddb"
+)
+
+// statsTTL bounds how often the aggregate queries run, whatever the scrape interval
+const statsTTL = time.Minute
+
+var (
+	filesDesc = prometheus.NewDesc(namespace+"_files",
+		"Active file records, by machine.", []string{"machine_id"}, nil)
+	duplicateSetsDesc = prometheus.NewDesc(namespace+"_duplicate_sets",
+		"Hashes shared by more than one active file.", nil, nil)
+	duplicateFilesDesc = prometheus.NewDesc(namespace+"_duplicate_files",
+		"Active files that belong to a duplicate set.", nil, nil)
+	wastedBytesDesc = prometheus.NewDesc(namespace+"_wasted_bytes",
+		"Bytes that could be reclaimed by keeping one copy per duplicate set.", nil, nil)
+)
+
+// statsCollector reports file and duplicate totals from the database
+type statsCollector struct {
+	q *recorddb.Queries
+
+	mu        sync.Mutex
+	updated   time.Time
+	byMachine []recorddb.CountFilesByMachineRow
+	summary   recorddb.GetDuplicateSummaryRow
+}
+
+// RegisterDBCollectors registers metrics computed from the database and the
+// connection pool
+func RegisterDBCollectors(q *recorddb.Queries, pool *pgxpool.Pool) {
+	prometheus.MustRegister(&statsCollector{q: q})
+
+	gauge := func(name, help string, f func(*pgxpool.Stat) float64) {
+		prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      name,
+			Help:      help,
+		}, func() float64 { return f(pool.Stat()) }))
+	}
+	gauge("db_pool_connections", "Open database connections.",
+		func(s *pgxpool.Stat) float64 { return float64(s.TotalConns()) })
+	gauge("db_pool_acquired_connections", "Database connections in use.",
+		func(s *pgxpool.Stat) float64 { return float64(s.AcquiredConns()) })
+}
+
+func (c *statsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- filesDesc
+	ch <- duplicateSetsDesc
+	ch <- duplicateFilesDesc
+	ch <- wastedBytesDesc
+}
+
+func (c *statsCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Since(c.updated) > statsTTL {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		byMachine, err := c.q.CountFilesByMachine(ctx)
+		if err == nil {
+			var summary recorddb.GetDuplicateSummaryRow
+			summary, err = c.q.GetDuplicateSummary(ctx)
+			if err == nil {
+				c.byMachine, c.summary, c.updated = byMachine, summary, time.Now()
+			}
+		}
+		if err != nil {
+			// Report the previous values rather than failing the scrape
+			slog.Warn("Failed to update file metrics", "error", err)
+		}
+	}
+
+	for _, m := range c.byMachine {
+		ch <- prometheus.MustNewConstMetric(filesDesc, prometheus.GaugeValue, float64(m.Files), m.MachineID)
+	}
+	ch <- prometheus.MustNewConstMetric(duplicateSetsDesc, prometheus.GaugeValue, float64(c.summary.DuplicateSets))
+	ch <- prometheus.MustNewConstMetric(duplicateFilesDesc, prometheus.GaugeValue, float64(c.summary.DuplicateFiles))
+	ch <- prometheus.MustNewConstMetric(wastedBytesDesc, prometheus.GaugeValue, float64(c.summary.WastedBytes))
+}
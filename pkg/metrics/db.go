@@ -0,0 +1,102 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/tendant/filededup/pkg/record/recorddb"
+)
+
+// DB wraps a database handle and records query latency and errors. Queries
+// are labelled with their sqlc name.
+type DB struct {
+	db recorddb.DBTX
+}
+
+// InstrumentDB returns db wrapped with query metrics
+func InstrumentDB(db recorddb.DBTX) *DB {
+	return &DB{db: db}
+}
+
+func (d *DB) Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error) {
+	start := time.Now()
+	tag, err := d.db.Exec(ctx, sql, args...)
+	observe(sql, start, err)
+	return tag, err
+}
+
+func (d *DB) Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
+	start := time.Now()
+	rows, err := d.db.Query(ctx, sql, args...)
+	if err != nil {
+		observe(sql, start, err)
+		return rows, err
+	}
+	return &instrumentedRows{Rows: rows, sql: sql, start: start}, nil
+}
+
+func (d *DB) QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+	return &instrumentedRow{row: d.db.QueryRow(ctx, sql, args...), sql: sql, start: time.Now()}
+}
+
+// Begin starts a transaction if the wrapped handle supports it; statements in
+// the transaction are not instrumented
+func (d *DB) Begin(ctx context.Context) (pgx.Tx, error) {
+	b, ok := d.db.(interface {
+		Begin(context.Context) (pgx.Tx, error)
+	})
+	if !ok {
+		return nil, errors.New("database does not support transactions")
+	}
+	return b.Begin(ctx)
+}
+
+type instrumentedRows struct {
+	pgx.Rows
+	sql   string
+	start time.Time
+	done  bool
+}
+
+func (r *instrumentedRows) Close() {
+	r.Rows.Close()
+	if !r.done {
+		r.done = true
+		observe(r.sql, r.start, r.Rows.Err())
+	}
+}
+
+type instrumentedRow struct {
+	row   pgx.Row
+	sql   string
+	start time.Time
+}
+
+func (r *instrumentedRow) Scan(dest ...any) error {
+	err := r.row.Scan(dest...)
+	observe(r.sql, r.start, err)
+	return err
+}
+
+// observe records one query; a missing row is a result, not an error
+func observe(sql string, start time.Time, err error) {
+	name := queryName(sql)
+	dbQueryDuration.WithLabelValues(name).Observe(time.Since(start).Seconds())
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		dbErrors.WithLabelValues(name).Inc()
+	}
+}
+
+// queryName extracts the name from a "-- name: Foo :one" sqlc header
+func queryName(sql string) string {
+	rest, ok := strings.CutPrefix(strings.TrimSpace(sql), "-- name: ")
+	if !ok {
+		return "other"
+	}
+	name, _, _ := strings.Cut(rest, " ")
+	return name
+}
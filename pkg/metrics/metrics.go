@@ -0,0 +1,133 @@
+// Package metrics exposes Prometheus metrics for the server
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "filededup"
+
+var (
+	// RecordsIngested counts file records stored, by source (upload or archive)
+	RecordsIngested = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "records_ingested_total",
+		Help:      "File records stored, by source.",
+	}, []string{"source"})
+
+	// RecordsFailed counts file records that could not be stored
+	RecordsFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "records_failed_total",
+		Help:      "File records that could not be stored, by source.",
+	}, []string{"source"})
+
+	// IntegrityEvents counts files whose hash changed while size and mtime
+	// stayed the same, or that a scrub could not read, by machine
+	IntegrityEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "integrity_events_total",
+		Help:      "Files whose hash changed without a change of size or mtime, or that a scrub could not read, by machine.",
+	}, []string{"machine_id"})
+
+	// IntegrityWebhookFailures counts integrity events the webhook did not accept,
+	// including those dropped because too many were waiting
+	IntegrityWebhookFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "integrity_webhook_failures_total",
+		Help:      "Integrity events that could not be delivered to the webhook.",
+	})
+
+	// AnomalyAlerts counts scan sessions that changed, deleted or renamed an
+	// unusual share of files, by machine
+	AnomalyAlerts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "anomaly_alerts_total",
+		Help:      "Scan sessions that raised a mass-change alert, by machine.",
+	}, []string{"machine_id"})
+
+	// AnomalyWebhookFailures counts anomaly alerts the webhook did not accept,
+	// including those dropped because too many were waiting
+	AnomalyWebhookFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "anomaly_webhook_failures_total",
+		Help:      "Anomaly alerts that could not be delivered to the webhook.",
+	})
+
+	// BatchDuration observes how long it takes to store an uploaded batch
+	BatchDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "ingest_batch_duration_seconds",
+		Help:      "Time to decode and store one uploaded batch.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+	})
+
+	// BatchSize observes the number of records per uploaded batch
+	BatchSize = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "ingest_batch_records",
+		Help:      "Records per uploaded batch.",
+		Buckets:   prometheus.ExponentialBuckets(10, 4, 8),
+	})
+
+	dbQueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "db_query_duration_seconds",
+		Help:      "Database query latency, by query.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 4, 10),
+	}, []string{"query"})
+
+	dbErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "db_errors_total",
+		Help:      "Failed database queries, by query.",
+	}, []string{"query"})
+
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests, by route, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency, by route and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+)
+
+// Handler serves the metrics in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Middleware records the count and latency of HTTP requests by route pattern
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		defer func() {
+			// The pattern is only known after routing; unmatched paths share one label
+			route := "unmatched"
+			if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+				route = rctx.RoutePattern()
+			}
+			status := ww.Status()
+			if status == 0 {
+				status = http.StatusOK
+			}
+			httpRequests.WithLabelValues(route, r.Method, strconv.Itoa(status)).Inc()
+			httpDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+		}()
+		next.ServeHTTP(ww, r)
+	})
+}
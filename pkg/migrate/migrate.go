@@ -0,0 +1,369 @@
+// Package migrate applies the embedded, versioned database migrations
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/tendant/filededup/pkg/record/migrations"
+)
+
+// lockID is the advisory lock held while migrations run so that several
+// servers starting at once do not migrate concurrently
+const lockID = 0x66646475 // "fddu"
+
+// Migration is one versioned schema change
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Status describes whether a migration has been applied
+type Status struct {
+	Version   int64
+	Name      string
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// Migrator applies migrations to a database
+type Migrator struct {
+	pool       *pgxpool.Pool
+	migrations []Migration
+}
+
+// New creates a Migrator for the embedded migrations
+func New(pool *pgxpool.Pool) (*Migrator, error) {
+	ms, err := Load(migrations.FS)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{pool: pool, migrations: ms}, nil
+}
+
+// Load reads <version>_<name>.up.sql and .down.sql files from a filesystem
+func Load(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int64]*Migration)
+	for _, e := range entries {
+		name := e.Name()
+		var direction string
+		switch {
+		case strings.HasSuffix(name, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(name, ".down.sql"):
+			direction = "down"
+		default:
+			continue
+		}
+
+		base := strings.TrimSuffix(name, "."+direction+".sql")
+		versionStr, label, _ := strings.Cut(base, "_")
+		version, err := strconv.ParseInt(versionStr, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration file name %s", name)
+		}
+
+		body, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: label}
+			byVersion[version] = m
+		} else if m.Name != label {
+			return nil, fmt.Errorf("migration %d has conflicting names %q and %q", version, m.Name, label)
+		}
+		if direction == "up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+
+	result := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %d (%s) has no up migration", m.Version, m.Name)
+		}
+		result = append(result, *m)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Version < result[j].Version })
+	return result, nil
+}
+
+// Latest returns the version of the newest embedded migration
+func (m *Migrator) Latest() int64 {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+// ensureTable creates the migration bookkeeping table
+func ensureTable(ctx context.Context, tx pgx.Tx) error {
+	_, err := tx.Exec(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version BIGINT PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)`)
+	return err
+}
+
+// applied returns the applied migration versions and when they were applied.
+// A database without schema_migrations has none applied.
+func (m *Migrator) applied(ctx context.Context, db pgx.Tx) (map[int64]time.Time, error) {
+	var exists bool
+	if err := db.QueryRow(ctx, `SELECT to_regclass('schema_migrations') IS NOT NULL`).Scan(&exists); err != nil {
+		return nil, err
+	}
+	result := make(map[int64]time.Time)
+	if !exists {
+		return result, nil
+	}
+
+	rows, err := db.Query(ctx, `SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var version int64
+		var at time.Time
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		result[version] = at
+	}
+	return result, rows.Err()
+}
+
+// Status lists every embedded migration and whether it has been applied,
+// followed by applied versions this binary does not know, which are newer
+// than Latest when a newer server migrated the database. It only reads.
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	var result []Status
+	err := m.withReadTx(ctx, func(tx pgx.Tx) error {
+		applied, err := m.applied(ctx, tx)
+		if err != nil {
+			return err
+		}
+		known := make(map[int64]bool, len(m.migrations))
+		for _, mig := range m.migrations {
+			at, ok := applied[mig.Version]
+			known[mig.Version] = true
+			result = append(result, Status{Version: mig.Version, Name: mig.Name, Applied: ok, AppliedAt: at})
+		}
+		for version, at := range applied {
+			if !known[version] {
+				result = append(result, Status{Version: version, Name: "unknown", Applied: true, AppliedAt: at})
+			}
+		}
+		sort.Slice(result, func(i, j int) bool { return result[i].Version < result[j].Version })
+		return nil
+	})
+	return result, err
+}
+
+// Unknown returns the applied migrations this binary does not know
+func Unknown(status []Status, latest int64) []Status {
+	var unknown []Status
+	for _, s := range status {
+		if s.Applied && s.Version > latest {
+			unknown = append(unknown, s)
+		}
+	}
+	return unknown
+}
+
+// Pending returns the migrations that have not been applied yet
+func (m *Migrator) Pending(ctx context.Context) ([]Status, error) {
+	status, err := m.Status(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var pending []Status
+	for _, s := range status {
+		if !s.Applied {
+			pending = append(pending, s)
+		}
+	}
+	return pending, nil
+}
+
+// Up applies every pending migration, each in its own transaction. It
+// refuses to run against a schema newer than this binary.
+func (m *Migrator) Up(ctx context.Context) (int, error) {
+	if err := m.checkNewer(ctx); err != nil {
+		return 0, err
+	}
+	var count int
+	for _, mig := range m.migrations {
+		done := false
+		err := m.withLockedTx(ctx, func(tx pgx.Tx) error {
+			applied, err := m.applied(ctx, tx)
+			if err != nil {
+				return err
+			}
+			if _, ok := applied[mig.Version]; ok {
+				done = true
+				return nil
+			}
+
+			slog.Info("Applying migration", "version", mig.Version, "name", mig.Name)
+			if _, err := tx.Exec(ctx, mig.Up); err != nil {
+				return fmt.Errorf("migration %d (%s) failed: %w", mig.Version, mig.Name, err)
+			}
+			_, err = tx.Exec(ctx, `INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`, mig.Version, mig.Name)
+			return err
+		})
+		if err != nil {
+			return count, err
+		}
+		if !done {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// Down reverts the most recently applied migrations, newest first. It
+// refuses to run against a schema newer than this binary.
+func (m *Migrator) Down(ctx context.Context, steps int) (int, error) {
+	if err := m.checkNewer(ctx); err != nil {
+		return 0, err
+	}
+	var count int
+	for count < steps {
+		reverted := false
+		err := m.withLockedTx(ctx, func(tx pgx.Tx) error {
+			applied, err := m.applied(ctx, tx)
+			if err != nil {
+				return err
+			}
+
+			for i := len(m.migrations) - 1; i >= 0; i-- {
+				mig := m.migrations[i]
+				if _, ok := applied[mig.Version]; !ok {
+					continue
+				}
+				if mig.Down == "" {
+					return fmt.Errorf("migration %d (%s) cannot be reverted", mig.Version, mig.Name)
+				}
+
+				slog.Info("Reverting migration", "version", mig.Version, "name", mig.Name)
+				if _, err := tx.Exec(ctx, mig.Down); err != nil {
+					return fmt.Errorf("reverting migration %d (%s) failed: %w", mig.Version, mig.Name, err)
+				}
+				if _, err := tx.Exec(ctx, `DELETE FROM schema_migrations WHERE version = $1`, mig.Version); err != nil {
+					return err
+				}
+				reverted = true
+				return nil
+			}
+			return nil
+		})
+		if err != nil {
+			return count, err
+		}
+		if !reverted {
+			break
+		}
+		count++
+	}
+	return count, nil
+}
+
+// withReadTx runs fn in a read-only transaction
+func (m *Migrator) withReadTx(ctx context.Context, fn func(pgx.Tx) error) error {
+	tx, err := m.pool.BeginTx(ctx, pgx.TxOptions{AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	return fn(tx)
+}
+
+// withLockedTx runs fn in a transaction holding the migration advisory lock
+func (m *Migrator) withLockedTx(ctx context.Context, fn func(pgx.Tx) error) error {
+	tx, err := m.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1)`, lockID); err != nil {
+		return fmt.Errorf("failed to acquire migration lock: %w", err)
+	}
+	if err := ensureTable(ctx, tx); err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// ErrSchemaOutdated is returned by Check when migrations are pending
+var ErrSchemaOutdated = errors.New("database schema is outdated")
+
+// ErrSchemaNewer is returned by Check, Up and Down when the database has
+// migrations applied that this binary does not know
+var ErrSchemaNewer = errors.New("database schema is newer than this server")
+
+// checkNewer returns ErrSchemaNewer if the database has unknown migrations
+func (m *Migrator) checkNewer(ctx context.Context) error {
+	status, err := m.Status(ctx)
+	if err != nil {
+		return err
+	}
+	return m.newer(status)
+}
+
+func (m *Migrator) newer(status []Status) error {
+	if unknown := Unknown(status, m.Latest()); len(unknown) > 0 {
+		return fmt.Errorf("%w: version %d is applied, latest known is %d", ErrSchemaNewer, unknown[len(unknown)-1].Version, m.Latest())
+	}
+	return nil
+}
+
+// Check returns ErrSchemaNewer if the database has migrations this binary
+// does not know and ErrSchemaOutdated if there are pending migrations
+func (m *Migrator) Check(ctx context.Context) error {
+	status, err := m.Status(ctx)
+	if err != nil {
+		return err
+	}
+	if err := m.newer(status); err != nil {
+		return err
+	}
+	var pending []Status
+	for _, s := range status {
+		if !s.Applied {
+			pending = append(pending, s)
+		}
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("%w: %d pending migrations, latest is %d", ErrSchemaOutdated, len(pending), m.Latest())
+	}
+	return nil
+}
@@ -0,0 +1,287 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/tendant/filededup/pkg/record/recorddb"
+)
+
+// testPool connects to FILEDEDUP_TEST_DATABASE_URL, e.g. the postgres
+// service of docker-compose.yml, and gives the test an empty schema of its
+// own that is dropped afterwards
+func testPool(t *testing.T) *pgxpool.Pool {
+	t.Helper()
+	url := os.Getenv("FILEDEDUP_TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("FILEDEDUP_TEST_DATABASE_URL is not set")
+	}
+	ctx := context.Background()
+
+	admin, err := pgx.Connect(ctx, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := pgx.Identifier{fmt.Sprintf("filededup_test_%d", time.Now().UnixNano())}.Sanitize()
+	if _, err := admin.Exec(ctx, "CREATE SCHEMA "+schema); err != nil {
+		admin.Close(ctx)
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if _, err := admin.Exec(ctx, "DROP SCHEMA "+schema+" CASCADE"); err != nil {
+			t.Errorf("failed to drop %s: %v", schema, err)
+		}
+		admin.Close(ctx)
+	})
+
+	config, err := pgxpool.ParseConfig(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.ConnConfig.RuntimeParams["search_path"] = schema
+	pool, err := pgxpool.NewWithConfig(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(pool.Close)
+	return pool
+}
+
+func newMigrator(t *testing.T, pool *pgxpool.Pool) *Migrator {
+	t.Helper()
+	m, err := New(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestLoad(t *testing.T) {
+	m := newMigrator(t, nil)
+	if len(m.migrations) == 0 {
+		t.Fatal("no migrations embedded")
+	}
+	for i, mig := range m.migrations {
+		if mig.Version != int64(i+1) {
+			t.Errorf("migration %d has version %d", i+1, mig.Version)
+		}
+		if strings.TrimSpace(mig.Down) == "" {
+			t.Errorf("migration %d (%s) has no down migration", mig.Version, mig.Name)
+		}
+	}
+	if m.Latest() != m.migrations[len(m.migrations)-1].Version {
+		t.Errorf("Latest() = %d", m.Latest())
+	}
+}
+
+func TestUpDown(t *testing.T) {
+	pool := testPool(t)
+	ctx := context.Background()
+	m := newMigrator(t, pool)
+	all := len(m.migrations)
+
+	// Reading the status of an empty database creates nothing
+	status, err := m.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status) != all || status[0].Applied {
+		t.Fatalf("Status() = %+v, want %d pending migrations", status, all)
+	}
+	var exists bool
+	if err := pool.QueryRow(ctx, `SELECT to_regclass('schema_migrations') IS NOT NULL`).Scan(&exists); err != nil {
+		t.Fatal(err)
+	}
+	if exists {
+		t.Fatal("Status() created schema_migrations")
+	}
+	if err := m.Check(ctx); !errors.Is(err, ErrSchemaOutdated) {
+		t.Fatalf("Check() = %v, want %v", err, ErrSchemaOutdated)
+	}
+
+	if n, err := m.Up(ctx); err != nil || n != all {
+		t.Fatalf("Up() = %d, %v, want %d", n, err, all)
+	}
+	if err := m.Check(ctx); err != nil {
+		t.Fatalf("Check() after Up = %v", err)
+	}
+	if n, err := m.Up(ctx); err != nil || n != 0 {
+		t.Fatalf("second Up() = %d, %v, want 0", n, err)
+	}
+
+	if n, err := m.Down(ctx, all+1); err != nil || n != all {
+		t.Fatalf("Down() = %d, %v, want %d", n, err, all)
+	}
+	var left []string
+	rows, err := pool.Query(ctx, `
+		SELECT c.relname::text FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE n.nspname = current_schema() AND c.relkind IN ('r', 'p', 'v', 'm')
+		  AND c.relname <> 'schema_migrations'
+		ORDER BY 1`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if left, err = pgx.CollectRows(rows, pgx.RowTo[string]); err != nil {
+		t.Fatal(err)
+	}
+	if len(left) > 0 {
+		t.Fatalf("Down() left %v behind", left)
+	}
+
+	if n, err := m.Up(ctx); err != nil || n != all {
+		t.Fatalf("Up() after Down = %d, %v, want %d", n, err, all)
+	}
+}
+
+func TestNewerSchema(t *testing.T) {
+	pool := testPool(t)
+	ctx := context.Background()
+	m := newMigrator(t, pool)
+	if _, err := m.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pool.Exec(ctx, `INSERT INTO schema_migrations (version, name) VALUES ($1, 'from_the_future')`, m.Latest()+1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Check(ctx); !errors.Is(err, ErrSchemaNewer) {
+		t.Fatalf("Check() = %v, want %v", err, ErrSchemaNewer)
+	}
+	if _, err := m.Up(ctx); !errors.Is(err, ErrSchemaNewer) {
+		t.Fatalf("Up() = %v, want %v", err, ErrSchemaNewer)
+	}
+	if _, err := m.Down(ctx, 1); !errors.Is(err, ErrSchemaNewer) {
+		t.Fatalf("Down() = %v, want %v", err, ErrSchemaNewer)
+	}
+	status, err := m.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unknown := Unknown(status, m.Latest()); len(unknown) != 1 || unknown[0].Version != m.Latest()+1 {
+		t.Fatalf("Unknown() = %+v", unknown)
+	}
+}
+
+// TestRebalanceKeepsCounts checks that instance counts and aliases stay
+// consistent through ingestion, quarantine and repartitioning
+func TestRebalanceKeepsCounts(t *testing.T) {
+	pool := testPool(t)
+	ctx := context.Background()
+	if _, err := newMigrator(t, pool).Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	q := recorddb.New(pool)
+
+	shared := strings.Repeat("a", 64)
+	upsert := func(machineID, path, hash, volumeID string, inode int64) {
+		t.Helper()
+		err := q.UpsertFile(ctx, recorddb.UpsertFileParams{
+			Hash:      hash,
+			Size:      1024,
+			MachineID: machineID,
+			Path:      path,
+			Filename:  "data.bin",
+			Mtime:     pgtype.Timestamp{Time: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC), Valid: true},
+			VolumeID:  volumeID,
+			Inode:     inode,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	instanceCount := func(hash string) int64 {
+		t.Helper()
+		var n int64
+		if err := pool.QueryRow(ctx, `SELECT instance_count FROM contents WHERE hash = decode($1, 'hex')`, hash).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	checkDrift := func(step string) {
+		t.Helper()
+		for _, c := range []struct {
+			name  string
+			count func(context.Context) (int64, error)
+		}{
+			{"instance count", q.CountInstanceCountDrift},
+			{"alias", q.CountAliasDrift},
+			{"duplicate group", q.CountDuplicateGroupDrift},
+		} {
+			n, err := c.count(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != 0 {
+				t.Errorf("%s: %d contents with %s drift", step, n, c.name)
+			}
+		}
+	}
+
+	// Two machines mount the same share, a third holds its own copy
+	upsert("machine-a", "/share", shared, "vol-nfs", 42)
+	upsert("machine-b", "/mnt/share", shared, "vol-nfs", 42)
+	upsert("machine-c", "/home", shared, "vol-c", 7)
+	for i := 0; i < 50; i++ {
+		upsert(fmt.Sprintf("machine-%02d", i), "/unique", fmt.Sprintf("%064x", i+1), "", 0)
+	}
+	if n := instanceCount(shared); n != 2 {
+		t.Fatalf("instance count = %d, want 2", n)
+	}
+	checkDrift("after ingestion")
+
+	// The other mount takes over when the counted instance is quarantined
+	if _, err := q.SetQuarantineState(ctx, recorddb.SetQuarantineStateParams{
+		QuarantineState: "quarantined", MachineID: "machine-a", Path: "/share", Filename: "data.bin",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if n := instanceCount(shared); n != 2 {
+		t.Fatalf("instance count after quarantine = %d, want 2", n)
+	}
+	checkDrift("after quarantine")
+
+	for _, partitions := range []int{4, 7} {
+		if err := q.RebalanceFilePartitions(ctx, partitions); err != nil {
+			t.Fatal(err)
+		}
+		parts, err := q.ListFilePartitions(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(parts) != partitions || int(parts[0].Modulus) != partitions {
+			t.Fatalf("partitions after rebalancing to %d: %+v", partitions, parts)
+		}
+		var files int64
+		if err := pool.QueryRow(ctx, `SELECT COUNT(*) FROM file_instances`).Scan(&files); err != nil {
+			t.Fatal(err)
+		}
+		if files != 53 {
+			t.Fatalf("%d files after rebalancing to %d, want 53", files, partitions)
+		}
+		if n := instanceCount(shared); n != 2 {
+			t.Fatalf("instance count after rebalancing to %d = %d, want 2", partitions, n)
+		}
+		checkDrift(fmt.Sprintf("after rebalancing to %d", partitions))
+	}
+
+	// The triggers are enabled again: restoring and adding copies counts them
+	if _, err := q.SetQuarantineState(ctx, recorddb.SetQuarantineStateParams{
+		QuarantineState: "active", MachineID: "machine-a", Path: "/share", Filename: "data.bin",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	upsert("machine-d", "/backup", shared, "vol-d", 9)
+	if n := instanceCount(shared); n != 3 {
+		t.Fatalf("instance count after rebalancing and ingestion = %d, want 3", n)
+	}
+	checkDrift("after rebalancing and ingestion")
+}
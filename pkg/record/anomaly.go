@@ -0,0 +1,253 @@
+package record
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/tendant/filededup/pkg/metrics"
+	"github.com/tendant/filededup/pkg/record/recorddb"
+)
+
+// Defaults and bounds of the /anomalies limit parameter
+const (
+	DefaultAnomaliesLimit = 100
+	MaxAnomaliesLimit     = 1000
+)
+
+// Reasons of an anomaly alert
+const (
+	AnomalyChanged   = "changed"
+	AnomalyDeleted   = "deleted"
+	AnomalyRenamed   = "renamed"
+	AnomalyExtension = "extension"
+)
+
+// AnomalyRules decide when a completed scan session raises an alert. A ratio
+// exceeds its threshold when it reaches the threshold and BaselineFactor
+// times the machine's baseline, the average ratio of its last
+// BaselineSessions sessions. A zero threshold disables the ratio.
+type AnomalyRules struct {
+	ChangedRatio     float64 // Share of files whose hash changed
+	DeletedRatio     float64 // Share of files removed and not found again under another name
+	RenamedRatio     float64 // Share of files found again under another name
+	ExtensionRatio   float64 // Share of files found again under another extension
+	BaselineFactor   float64
+	BaselineSessions int
+	MinFiles         int64 // Sessions that saw fewer existing files are not checked
+}
+
+// AnomalyAlert is a scan session that changed, deleted or renamed an unusual
+// share of a machine's files, as by ransomware or a runaway sync. Ratios are
+// relative to the files the machine had under the session roots; the
+// extension ratio counts the renamed files whose extension changed.
+type AnomalyAlert struct {
+	ID                     int64     `json:"id"`
+	MachineID              string    `json:"machine_id"`
+	SessionID              string    `json:"session_id"`
+	FilesBefore            int64     `json:"files_before"`
+	ChangedRatio           float64   `json:"changed_ratio"`
+	DeletedRatio           float64   `json:"deleted_ratio"`
+	RenamedRatio           float64   `json:"renamed_ratio"`
+	BaselineChangedRatio   float64   `json:"baseline_changed_ratio"`
+	BaselineDeletedRatio   float64   `json:"baseline_deleted_ratio"`
+	BaselineRenamedRatio   float64   `json:"baseline_renamed_ratio"`
+	ExtensionRatio         float64   `json:"extension_ratio"`
+	BaselineExtensionRatio float64   `json:"baseline_extension_ratio"`
+	Reasons                []string  `json:"reasons"`
+	CreatedAt              time.Time `json:"created_at"`
+}
+
+func toAnomalyAlert(a recorddb.AnomalyAlert) AnomalyAlert {
+	return AnomalyAlert{
+		ID:                     a.ID,
+		MachineID:              a.MachineID,
+		SessionID:              formatUUID(a.SessionID),
+		FilesBefore:            a.FilesBefore,
+		ChangedRatio:           a.ChangedRatio,
+		DeletedRatio:           a.DeletedRatio,
+		RenamedRatio:           a.RenamedRatio,
+		BaselineChangedRatio:   a.BaselineChangedRatio,
+		BaselineDeletedRatio:   a.BaselineDeletedRatio,
+		BaselineRenamedRatio:   a.BaselineRenamedRatio,
+		ExtensionRatio:         a.ExtensionRatio,
+		BaselineExtensionRatio: a.BaselineExtensionRatio,
+		Reasons:                a.Reasons,
+		CreatedAt:              a.CreatedAt.Time,
+	}
+}
+
+// AnomalyStore loads session baselines and records anomaly alerts.
+// *recorddb.Queries implements it.
+type AnomalyStore interface {
+	GetSessionBaseline(ctx context.Context, arg recorddb.GetSessionBaselineParams) (recorddb.GetSessionBaselineRow, error)
+	InsertAnomalyAlert(ctx context.Context, arg recorddb.InsertAnomalyAlertParams) (recorddb.AnomalyAlert, error)
+}
+
+var _ AnomalyStore = (*recorddb.Queries)(nil)
+
+// Anomalies checks completed scan sessions for mass changes, records alerts
+// and posts them and integrity events to webhooks. A nil *Anomalies checks
+// and posts nothing.
+type Anomalies struct {
+	q         AnomalyStore
+	rules     AnomalyRules
+	webhook   *webhook
+	integrity *webhook
+}
+
+// NewAnomalies creates an anomaly detector. Alerts are posted as JSON to
+// webhookURL and integrity events to integrityWebhookURL unless they are empty.
+func NewAnomalies(q AnomalyStore, rules AnomalyRules, webhookURL, integrityWebhookURL string) *Anomalies {
+	return &Anomalies{
+		q:         q,
+		rules:     rules,
+		webhook:   newWebhook(webhookURL, "anomaly alert", metrics.AnomalyWebhookFailures),
+		integrity: newWebhook(integrityWebhookURL, "integrity event", metrics.IntegrityWebhookFailures),
+	}
+}
+
+// Check compares a completed session with the machine's baseline and raises
+// an alert if a ratio exceeds its threshold. Failures are logged and never
+// fail the session.
+func (a *Anomalies) Check(ctx context.Context, s recorddb.ScanSession) {
+	if a == nil {
+		return
+	}
+	before := s.FilesSeen - s.FilesAdded + s.FilesDeleted
+	if before <= 0 || before < a.rules.MinFiles {
+		return
+	}
+	arg := recorddb.InsertAnomalyAlertParams{
+		MachineID:    s.MachineID,
+		SessionID:    s.ID,
+		FilesBefore:  before,
+		ChangedRatio: float64(s.FilesChanged) / float64(before),
+		// Renamed files were removed from their old name too; they only count as renamed
+		DeletedRatio: float64(s.FilesDeleted-s.FilesRenamed) / float64(before),
+		RenamedRatio: float64(s.FilesRenamed) / float64(before),
+		// Encrypting files often renames them to a new extension
+		ExtensionRatio: float64(s.FilesExtensionChanged) / float64(before),
+	}
+	if a.rules.BaselineSessions > 0 {
+		baseline, err := a.q.GetSessionBaseline(ctx, recorddb.GetSessionBaselineParams{
+			MachineID: s.MachineID,
+			SessionID: s.ID,
+			Sessions:  int32(a.rules.BaselineSessions),
+		})
+		if err != nil {
+			slog.Error("Failed to load scan session baseline", "machineID", s.MachineID, "error", err)
+			return
+		}
+		arg.BaselineChangedRatio = baseline.ChangedRatio
+		arg.BaselineDeletedRatio = baseline.DeletedRatio
+		arg.BaselineRenamedRatio = baseline.RenamedRatio
+		arg.BaselineExtensionRatio = baseline.ExtensionRatio
+	}
+
+	arg.Reasons = []string{}
+	for _, c := range []struct {
+		reason              string
+		ratio, max, average float64
+	}{
+		{AnomalyChanged, arg.ChangedRatio, a.rules.ChangedRatio, arg.BaselineChangedRatio},
+		{AnomalyDeleted, arg.DeletedRatio, a.rules.DeletedRatio, arg.BaselineDeletedRatio},
+		{AnomalyRenamed, arg.RenamedRatio, a.rules.RenamedRatio, arg.BaselineRenamedRatio},
+		{AnomalyExtension, arg.ExtensionRatio, a.rules.ExtensionRatio, arg.BaselineExtensionRatio},
+	} {
+		if c.max > 0 && c.ratio >= c.max && c.ratio >= c.average*a.rules.BaselineFactor {
+			arg.Reasons = append(arg.Reasons, c.reason)
+		}
+	}
+	if len(arg.Reasons) == 0 {
+		return
+	}
+
+	row, err := a.q.InsertAnomalyAlert(ctx, arg)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return // The session raised an alert before
+	}
+	if err != nil {
+		slog.Error("Failed to record anomaly alert", "machineID", s.MachineID, "error", err)
+		return
+	}
+	alert := toAnomalyAlert(row)
+	slog.Warn("Scan session changed an unusual share of files, possible ransomware or runaway sync",
+		"machineID", alert.MachineID, "session", alert.SessionID, "reasons", alert.Reasons,
+		"filesBefore", alert.FilesBefore, "changedRatio", alert.ChangedRatio,
+		"deletedRatio", alert.DeletedRatio, "renamedRatio", alert.RenamedRatio,
+		"extensionRatio", alert.ExtensionRatio)
+	metrics.AnomalyAlerts.WithLabelValues(alert.MachineID).Inc()
+	a.webhook.send(alert.ID, alert)
+}
+
+// Integrity posts an integrity event to the integrity webhook
+func (a *Anomalies) Integrity(e IntegrityEvent) {
+	if a != nil {
+		a.integrity.send(e.ID, e)
+	}
+}
+
+// Wait stops posting to webhooks and blocks until queued deliveries are done,
+// cancelling those still pending after a few seconds
+func (a *Anomalies) Wait() {
+	if a != nil {
+		a.webhook.wait()
+		a.integrity.wait()
+	}
+}
+
+// AnomalyAlertsPage is the /anomalies response
+type AnomalyAlertsPage struct {
+	Alerts []AnomalyAlert `json:"alerts"`
+	Cursor Cursor         `json:"cursor"`
+	More   bool           `json:"more"` // The page is full; fetch again from Cursor
+}
+
+// AnomalyAlertsHandler lists anomaly alerts, oldest first. The machine query
+// parameter filters by machine; since (RFC 3339) and after (alert ID) resume
+// from a previous cursor; limit caps the page size (default 100).
+func AnomalyAlertsHandler(q *recorddb.Queries) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cursor, since, ok := parseCursor(r)
+		if !ok {
+			http.Error(w, "Invalid since or after", http.StatusBadRequest)
+			return
+		}
+		limit, ok := intParam(r, "limit", DefaultAnomaliesLimit, MaxAnomaliesLimit)
+		if !ok {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+
+		rows, err := q.ListAnomalyAlerts(r.Context(), recorddb.ListAnomalyAlertsParams{
+			MachineID: r.URL.Query().Get("machine"),
+			Since:     since,
+			AfterID:   cursor.After,
+			PageSize:  int32(limit),
+		})
+		if err != nil {
+			slog.Error("Error querying anomaly alerts", "error", err)
+			http.Error(w, "Failed to query anomaly alerts", http.StatusInternalServerError)
+			return
+		}
+
+		page := AnomalyAlertsPage{Alerts: make([]AnomalyAlert, 0, len(rows)), Cursor: cursor, More: len(rows) == limit}
+		for _, row := range rows {
+			page.Alerts = append(page.Alerts, toAnomalyAlert(row))
+		}
+		if n := len(page.Alerts); n > 0 {
+			last := page.Alerts[n-1]
+			page.Cursor = Cursor{Since: &last.CreatedAt, After: last.ID}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(page); err != nil {
+			slog.Error("Error encoding JSON response", "error", err)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package record
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/tendant/filededup/pkg/record/recorddb"
+)
+
+// fakeAnomalyStore answers GetSessionBaseline with baseline and keeps the
+// alerts inserted
+type fakeAnomalyStore struct {
+	baseline recorddb.GetSessionBaselineRow
+	alerts   []recorddb.InsertAnomalyAlertParams
+}
+
+func (f *fakeAnomalyStore) GetSessionBaseline(ctx context.Context, arg recorddb.GetSessionBaselineParams) (recorddb.GetSessionBaselineRow, error) {
+	return f.baseline, nil
+}
+
+func (f *fakeAnomalyStore) InsertAnomalyAlert(ctx context.Context, arg recorddb.InsertAnomalyAlertParams) (recorddb.AnomalyAlert, error) {
+	f.alerts = append(f.alerts, arg)
+	return recorddb.AnomalyAlert{
+		ID:                     int64(len(f.alerts)),
+		MachineID:              arg.MachineID,
+		SessionID:              arg.SessionID,
+		FilesBefore:            arg.FilesBefore,
+		ExtensionRatio:         arg.ExtensionRatio,
+		BaselineExtensionRatio: arg.BaselineExtensionRatio,
+		Reasons:                arg.Reasons,
+	}, nil
+}
+
+var testRules = AnomalyRules{
+	ChangedRatio:     0.4,
+	DeletedRatio:     0.4,
+	RenamedRatio:     0.4,
+	ExtensionRatio:   0.2,
+	BaselineFactor:   3,
+	BaselineSessions: 10,
+	MinFiles:         100,
+}
+
+func TestAnomalyCheck(t *testing.T) {
+	tests := []struct {
+		name     string
+		rules    AnomalyRules
+		session  recorddb.ScanSession
+		baseline float64 // Baseline extension ratio
+		want     []string
+	}{
+		{"quiet session", testRules,
+			recorddb.ScanSession{FilesSeen: 1000, FilesAdded: 10, FilesDeleted: 10, FilesRenamed: 10, FilesExtensionChanged: 1}, 0, nil},
+		{"renamed to a new extension", testRules,
+			recorddb.ScanSession{FilesSeen: 1000, FilesAdded: 300, FilesDeleted: 300, FilesRenamed: 300, FilesExtensionChanged: 300}, 0,
+			[]string{AnomalyExtension}},
+		{"renamed and deleted", testRules,
+			recorddb.ScanSession{FilesSeen: 1000, FilesAdded: 900, FilesDeleted: 900, FilesRenamed: 450, FilesExtensionChanged: 250}, 0,
+			[]string{AnomalyDeleted, AnomalyRenamed, AnomalyExtension}},
+		{"within the baseline", testRules,
+			recorddb.ScanSession{FilesSeen: 1000, FilesAdded: 300, FilesDeleted: 300, FilesRenamed: 300, FilesExtensionChanged: 300}, 0.25, nil},
+		{"extension check disabled", AnomalyRules{RenamedRatio: 0.4, BaselineFactor: 3, BaselineSessions: 10},
+			recorddb.ScanSession{FilesSeen: 1000, FilesAdded: 300, FilesDeleted: 300, FilesRenamed: 300, FilesExtensionChanged: 300}, 0, nil},
+		{"too few files", testRules,
+			recorddb.ScanSession{FilesSeen: 50, FilesAdded: 50, FilesDeleted: 50, FilesRenamed: 50, FilesExtensionChanged: 50}, 0, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &fakeAnomalyStore{baseline: recorddb.GetSessionBaselineRow{Sessions: 10, ExtensionRatio: tt.baseline}}
+			tt.session.MachineID = "machine-a"
+			NewAnomalies(store, tt.rules, "", "").Check(context.Background(), tt.session)
+
+			if tt.want == nil {
+				if len(store.alerts) != 0 {
+					t.Fatalf("raised %+v, want no alert", store.alerts)
+				}
+				return
+			}
+			if len(store.alerts) != 1 {
+				t.Fatalf("raised %d alerts, want 1", len(store.alerts))
+			}
+			alert := store.alerts[0]
+			if !slices.Equal(alert.Reasons, tt.want) {
+				t.Errorf("reasons = %v, want %v", alert.Reasons, tt.want)
+			}
+			before := tt.session.FilesSeen - tt.session.FilesAdded + tt.session.FilesDeleted
+			if want := float64(tt.session.FilesExtensionChanged) / float64(before); alert.ExtensionRatio != want {
+				t.Errorf("extension ratio = %v, want %v", alert.ExtensionRatio, want)
+			}
+			if alert.BaselineExtensionRatio != tt.baseline {
+				t.Errorf("baseline extension ratio = %v, want %v", alert.BaselineExtensionRatio, tt.baseline)
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package record
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tendant/filededup/pkg/record/recorddb"
+)
+
+// Defaults and bounds of the /compare limit parameter
+const (
+	DefaultCompareLimit = 1000
+	MaxCompareLimit     = 100000
+)
+
+// CompareSide is a machine, or a root directory on a machine, in a comparison
+type CompareSide struct {
+	MachineID string `json:"machine_id"`
+	Root      string `json:"root"` // Empty for the whole machine
+}
+
+// ParseCompareSide parses machine:/root, or machine alone for the whole
+// machine. The machine ends at the first colon, so Windows roots such as
+// machine:C:\data keep their drive.
+func ParseCompareSide(s string) (CompareSide, error) {
+	machine, root, _ := strings.Cut(s, ":")
+	if machine == "" {
+		return CompareSide{}, fmt.Errorf("expected machine or machine:/root, got %q", s)
+	}
+	return CompareSide{MachineID: machine, Root: root}, nil
+}
+
+func (s CompareSide) String() string {
+	if s.Root == "" {
+		return s.MachineID
+	}
+	return s.MachineID + ":" + s.Root
+}
+
+// CompareFile is a file of one side. Name is relative to the side's root;
+// for different_path files, OtherNames lists where the content is on the
+// right side.
+type CompareFile struct {
+	Name       string    `json:"name"`
+	Path       string    `json:"path"`
+	Filename   string    `json:"filename"`
+	Hash       string    `json:"hash"`
+	Size       int64     `json:"size"`
+	MTime      time.Time `json:"mtime"`
+	OtherNames []string  `json:"other_names,omitempty"`
+}
+
+// CompareSet is one category of a comparison. FileCount and Bytes cover
+// every file; Files holds at most the requested number of them and
+// Truncated is set when there were more.
+type CompareSet struct {
+	FileCount int64         `json:"file_count"`
+	Bytes     int64         `json:"bytes"`
+	Files     []CompareFile `json:"files"`
+	Truncated bool          `json:"truncated"`
+}
+
+// CompareResult is the content-based difference between two sides. Files on
+// the left are only_left when their content is nowhere on the right,
+// same_path when it is at the same relative name and different_path
+// otherwise; only_right holds the right files whose content is nowhere on
+// the left.
+type CompareResult struct {
+	Left          CompareSide `json:"left"`
+	Right         CompareSide `json:"right"`
+	OnlyLeft      CompareSet  `json:"only_left"`
+	OnlyRight     CompareSet  `json:"only_right"`
+	SamePath      CompareSet  `json:"same_path"`
+	DifferentPath CompareSet  `json:"different_path"`
+}
+
+// Compare computes the content-based difference between two sides from the
+// stored hashes, listing at most limit files per category (0 = all)
+func Compare(ctx context.Context, q *recorddb.Queries, left, right CompareSide, limit int) (CompareResult, error) {
+	result := CompareResult{Left: left, Right: right}
+	sets := map[string]*CompareSet{
+		recorddb.CompareOnlyLeft:      &result.OnlyLeft,
+		recorddb.CompareOnlyRight:     &result.OnlyRight,
+		recorddb.CompareSamePath:      &result.SamePath,
+		recorddb.CompareDifferentPath: &result.DifferentPath,
+	}
+	for _, set := range sets {
+		set.Files = []CompareFile{}
+	}
+
+	err := q.CompareRoots(ctx, recorddb.CompareRootsParams{
+		LeftMachineID:  left.MachineID,
+		LeftRoot:       left.Root,
+		RightMachineID: right.MachineID,
+		RightRoot:      right.Root,
+	}, func(row recorddb.CompareRootsRow) error {
+		set, ok := sets[row.Category]
+		if !ok {
+			return fmt.Errorf("unknown comparison category %q", row.Category)
+		}
+		set.FileCount++
+		set.Bytes += row.Size
+		if limit > 0 && len(set.Files) >= limit {
+			set.Truncated = true
+			return nil
+		}
+		f := CompareFile{
+			Name:     row.RelativeName,
+			Path:     row.Path,
+			Filename: row.Filename,
+			Hash:     row.Hash,
+			Size:     row.Size,
+			MTime:    row.Mtime.Time,
+		}
+		if row.Category == recorddb.CompareDifferentPath {
+			f.OtherNames = row.RightNames
+		}
+		set.Files = append(set.Files, f)
+		return nil
+	})
+	return result, err
+}
+
+// CompareHandler compares two machines or roots by content. The left and
+// right query parameters name the sides as machine:/root or machine; limit
+// caps the files listed per category (default 1000), totals count them all.
+func CompareHandler(q *recorddb.Queries) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		left, err := ParseCompareSide(r.URL.Query().Get("left"))
+		if err != nil {
+			http.Error(w, "Invalid left: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		right, err := ParseCompareSide(r.URL.Query().Get("right"))
+		if err != nil {
+			http.Error(w, "Invalid right: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		limit, ok := intParam(r, "limit", DefaultCompareLimit, MaxCompareLimit)
+		if !ok {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+
+		result, err := Compare(r.Context(), q, left, right, limit)
+		if err != nil {
+			slog.Error("Error comparing", "left", left, "right", right, "error", err)
+			http.Error(w, "Failed to compare", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(result); err != nil {
+			slog.Error("Error encoding JSON response", "error", err)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package record
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/tendant/filededup/pkg/record/recorddb"
+)
+
+// Defaults and bounds of the /contents/{hash} limit parameter
+const (
+	DefaultContentLimit = 1000
+	MaxContentLimit     = 10000
+)
+
+// ContentInstance is one copy of a content
+type ContentInstance struct {
+	MachineID       string    `json:"machine_id"`
+	Volume          string    `json:"volume"`
+	VolumeID        string    `json:"volume_id,omitempty"`
+	Alias           bool      `json:"alias"` // Same physical file as another copy, e.g. the same NFS export seen from another machine
+	Path            string    `json:"path"`
+	Filename        string    `json:"filename"`
+	Size            int64     `json:"size"`
+	MTime           time.Time `json:"mtime"`
+	QuarantineState string    `json:"quarantine_state"`
+	LastSeenAt      time.Time `json:"last_seen_at"`
+}
+
+// ContentInstances is the /contents/{hash} response
+type ContentInstances struct {
+	Hash      string            `json:"hash"`
+	Size      int64             `json:"size"`
+	Instances []ContentInstance `json:"instances"`
+	Truncated bool              `json:"truncated"` // More instances than the limit
+}
+
+// ContentInstancesHandler lists every copy of the content with the hash in
+// the URL, active copies first and then quarantined ones, with their machine,
+// path, size and mtime. limit caps the copies listed (default 1000). Unknown
+// hashes are answered with 404.
+func ContentInstancesHandler(q *recorddb.Queries) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hash := chi.URLParam(r, "hash")
+		limit, ok := intParam(r, "limit", DefaultContentLimit, MaxContentLimit)
+		if !ok {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+
+		// One extra row tells whether the list is complete
+		rows, err := q.ListContentInstances(r.Context(), recorddb.ListContentInstancesParams{
+			Hash:     hash,
+			PageSize: int32(limit + 1),
+		})
+		if err != nil {
+			slog.Error("Error querying content instances", "hash", hash, "error", err)
+			http.Error(w, "Failed to query content instances", http.StatusInternalServerError)
+			return
+		}
+		if len(rows) == 0 {
+			http.Error(w, "Content not found", http.StatusNotFound)
+			return
+		}
+
+		result := ContentInstances{Hash: rows[0].Hash, Size: rows[0].Size, Instances: make([]ContentInstance, 0, len(rows))}
+		if len(rows) > limit {
+			rows, result.Truncated = rows[:limit], true
+		}
+		for _, row := range rows {
+			result.Instances = append(result.Instances, ContentInstance{
+				MachineID:       row.MachineID,
+				Volume:          row.Volume,
+				VolumeID:        row.VolumeID,
+				Alias:           row.Alias,
+				Path:            row.Path,
+				Filename:        row.Filename,
+				Size:            row.Size,
+				MTime:           row.Mtime.Time,
+				QuarantineState: row.QuarantineState,
+				LastSeenAt:      row.LastSeenAt.Time,
+			})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(result); err != nil {
+			slog.Error("Error encoding JSON response", "error", err)
+		}
+	}
+}
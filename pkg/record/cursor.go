@@ -0,0 +1,70 @@
+package record
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// Cursor marks the position after the last returned item of a list ordered
+// by time and ID. Passing it back as since and after returns the items that
+// came later.
+type Cursor struct {
+	Since *time.Time `json:"since,omitempty"`
+	After int64      `json:"after"`
+}
+
+// parseCursor reads the since (RFC 3339) and after (ID) query parameters. It
+// also returns since as a query argument, minus infinity when it is not set.
+func parseCursor(r *http.Request) (Cursor, pgtype.Timestamp, bool) {
+	var c Cursor
+	since := pgtype.Timestamp{InfinityModifier: pgtype.NegativeInfinity, Valid: true}
+	if v := r.URL.Query().Get("since"); v != "" {
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return c, since, false
+		}
+		since = pgtype.Timestamp{Time: t, Valid: true}
+		c.Since = &t
+	}
+	if v := r.URL.Query().Get("after"); v != "" {
+		after, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || after < 0 {
+			return c, since, false
+		}
+		c.After = after
+	}
+	return c, since, true
+}
+
+// GroupsCursor marks the position after the last returned duplicate group.
+// Groups are ordered by the transaction that last changed them and by ID;
+// passing the cursor back as change and after returns the groups that
+// changed later.
+type GroupsCursor struct {
+	Change int64 `json:"change"`
+	After  int64 `json:"after"`
+}
+
+// parseGroupsCursor reads the change (transaction ID) and after (group ID)
+// query parameters
+func parseGroupsCursor(r *http.Request) (GroupsCursor, bool) {
+	var c GroupsCursor
+	for _, p := range []struct {
+		name  string
+		value *int64
+	}{{"change", &c.Change}, {"after", &c.After}} {
+		v := r.URL.Query().Get(p.name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return c, false
+		}
+		*p.value = n
+	}
+	return c, true
+}
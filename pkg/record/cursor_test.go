@@ -0,0 +1,26 @@
+package record
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseGroupsCursor(t *testing.T) {
+	tests := []struct {
+		query string
+		want  GroupsCursor
+		ok    bool
+	}{
+		{"", GroupsCursor{}, true},
+		{"change=1234&after=7", GroupsCursor{Change: 1234, After: 7}, true},
+		{"after=7", GroupsCursor{After: 7}, true},
+		{"change=soon", GroupsCursor{}, false},
+		{"change=1&after=-1", GroupsCursor{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseGroupsCursor(httptest.NewRequest("GET", "/duplicates/groups?"+tt.query, nil))
+		if ok != tt.ok || (ok && got != tt.want) {
+			t.Errorf("parseGroupsCursor(%q) = %+v, %v, want %+v, %v", tt.query, got, ok, tt.want, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package record
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/tendant/filededup/pkg/record/recorddb"
+)
+
+// Export formats
+const (
+	ExportCSV    = "csv"
+	ExportNDJSON = "ndjson"
+	ExportHTML   = "html"
+)
+
+// ExportRow is one duplicate file in an export. WastedBytes is the space
+// wasted by the file's whole duplicate set.
+type ExportRow struct {
+	Hash        string    `json:"hash"`
+	Size        int64     `json:"size"`
+	Copies      int64     `json:"copies"`
+	WastedBytes int64     `json:"wasted_bytes"`
+	MachineID   string    `json:"machine_id"`
+	Path        string    `json:"path"`
+	MTime       time.Time `json:"mtime"`
+}
+
+// ExportFilter restricts an export to duplicate sets with a copy on a
+// machine or under a path prefix
+type ExportFilter struct {
+	MachineID  string
+	PathPrefix string
+}
+
+// ExportWriter writes export rows in one format
+type ExportWriter interface {
+	WriteRow(ExportRow) error
+	Close() error // Writes any trailer and flushes; does not close the underlying writer
+}
+
+// NewExportWriter returns a writer for the given format and writes its header
+func NewExportWriter(w io.Writer, format string) (ExportWriter, error) {
+	switch format {
+	case ExportCSV:
+		cw := csv.NewWriter(w)
+		err := cw.Write([]string{"hash", "size", "copies", "wasted_bytes", "machine_id", "path", "mtime"})
+		return &csvExportWriter{w: cw}, err
+	case ExportNDJSON:
+		return &ndjsonExportWriter{enc: json.NewEncoder(w)}, nil
+	case ExportHTML:
+		hw := &htmlExportWriter{w: w}
+		return hw, exportHTML.ExecuteTemplate(w, "header", time.Now().UTC())
+	}
+	return nil, fmt.Errorf("unknown export format %q", format)
+}
+
+// ExportContentType returns the MIME type of an export format
+func ExportContentType(format string) string {
+	switch format {
+	case ExportCSV:
+		return "text/csv; charset=utf-8"
+	case ExportNDJSON:
+		return "application/x-ndjson"
+	case ExportHTML:
+		return "text/html; charset=utf-8"
+	}
+	return "application/octet-stream"
+}
+
+type csvExportWriter struct {
+	w *csv.Writer
+}
+
+func (c *csvExportWriter) WriteRow(r ExportRow) error {
+	return c.w.Write([]string{
+		r.Hash,
+		strconv.FormatInt(r.Size, 10),
+		strconv.FormatInt(r.Copies, 10),
+		strconv.FormatInt(r.WastedBytes, 10),
+		r.MachineID,
+		r.Path,
+		r.MTime.Format(time.RFC3339),
+	})
+}
+
+func (c *csvExportWriter) Close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+type ndjsonExportWriter struct {
+	enc *json.Encoder
+}
+
+func (n *ndjsonExportWriter) WriteRow(r ExportRow) error {
+	return n.enc.Encode(r)
+}
+
+func (n *ndjsonExportWriter) Close() error {
+	return nil
+}
+
+type htmlExportWriter struct {
+	w     io.Writer
+	rows  int64
+	bytes int64
+	last  string
+}
+
+func (h *htmlExportWriter) WriteRow(r ExportRow) error {
+	// Count each set's waste once
+	if r.Hash != h.last {
+		h.bytes += r.WastedBytes
+		h.last = r.Hash
+	}
+	h.rows++
+	return exportHTML.ExecuteTemplate(h.w, "row", r)
+}
+
+func (h *htmlExportWriter) Close() error {
+	return exportHTML.ExecuteTemplate(h.w, "footer", struct {
+		Rows        int64
+		WastedBytes int64
+	}{h.rows, h.bytes})
+}
+
+// exportHTML renders a standalone report; rows are rendered one at a time so
+// large exports are streamed
+var exportHTML = template.Must(template.New("export").Funcs(template.FuncMap{
+	"bytes": formatBytes,
+	"time":  func(t time.Time) string { return t.Format("2006-01-02 15:04:05") },
+}).Parse(`{{define "header"}}<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>filededup duplicate report</title>
+<style>
+body { font-family: system-ui, sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; width: 100%; font-size: 0.9em; }
+th, td { border-bottom: 1px solid #ddd; padding: 4px 8px; text-align: left; }
+th { background: #f4f4f4; position: sticky; top: 0; }
+td.num { text-align: right; white-space: nowrap; }
+td.hash { font-family: monospace; }
+</style>
+</head>
+<body>
+<h1>Duplicate report</h1>
+<p>Generated {{time .}} UTC</p>
+<table>
+<thead><tr><th>Hash</th><th>Size</th><th>Copies</th><th>Wasted</th><th>Machine</th><th>Path</th><th>Modified</th></tr></thead>
+<tbody>
+{{end}}{{define "row"}}<tr><td class="hash" title="{{.Hash}}">{{printf "%.12s" .Hash}}</td><td class="num">{{bytes .Size}}</td><td class="num">{{.Copies}}</td><td class="num">{{bytes .WastedBytes}}</td><td>{{.MachineID}}</td><td>{{.Path}}</td><td>{{time .MTime}}</td></tr>
+{{end}}{{define "footer"}}</tbody>
+</table>
+<p>{{.Rows}} files, {{bytes .WastedBytes}} wasted</p>
+</body>
+</html>
+{{end}}`))
+
+// formatBytes converts bytes to a human-readable string (KB, MB, GB, etc.)
+func formatBytes(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
+
+// Export streams every duplicate file matching the filter to w and returns
+// the number of rows written
+func Export(ctx context.Context, q *recorddb.Queries, filter ExportFilter, w ExportWriter) (int64, error) {
+	var n int64
+	err := q.ExportDuplicateFiles(ctx, recorddb.ExportDuplicateFilesParams{
+		MachineID:  filter.MachineID,
+		PathPrefix: filter.PathPrefix,
+	}, func(row recorddb.ExportDuplicateFilesRow) error {
+		n++
+		return w.WriteRow(ExportRow{
+			Hash:        row.Hash,
+			Size:        row.Size,
+			Copies:      row.Copies,
+			WastedBytes: row.WastedBytes,
+			MachineID:   row.MachineID,
+			Path:        path.Join(row.Path, row.Filename),
+			MTime:       row.Mtime.Time,
+		})
+	})
+	if err != nil {
+		return n, err
+	}
+	return n, w.Close()
+}
+
+// ExportHandler handles HTTP requests exporting duplicate files.
+// Query parameters: format (csv, ndjson or html; default csv), machine and path_prefix.
+func ExportHandler(q *recorddb.Queries) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = ExportCSV
+		}
+		filter := ExportFilter{
+			MachineID:  r.URL.Query().Get("machine"),
+			PathPrefix: r.URL.Query().Get("path_prefix"),
+		}
+
+		w.Header().Set("Content-Type", ExportContentType(format))
+		w.Header().Set("Content-Disposition",
+			fmt.Sprintf(`attachment; filename="duplicates-%s.%s"`, time.Now().UTC().Format("20060102"), format))
+		ew, err := NewExportWriter(w, format)
+		if err != nil {
+			w.Header().Del("Content-Disposition")
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		n, err := Export(r.Context(), q, filter, ew)
+		if err != nil {
+			// The status line has already been sent; abort so the client sees a truncated response
+			slog.Error("Export failed", "format", format, "rows", n, "error", err)
+			panic(http.ErrAbortHandler)
+		}
+		slog.Info("Export completed", "format", format, "rows", n)
+	}
+}
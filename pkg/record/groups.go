@@ -0,0 +1,114 @@
+package record
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/tendant/filededup/pkg/record/recorddb"
+)
+
+// Defaults and bounds of the /duplicates/groups limit parameter
+const (
+	DefaultGroupsLimit = 1000
+	MaxGroupsLimit     = 10000
+)
+
+// GroupFile is an active copy in a duplicate group
+type GroupFile struct {
+	MachineID string    `json:"machine_id"`
+	Path      string    `json:"path"`
+	Filename  string    `json:"filename"`
+	MTime     time.Time `json:"mtime"`
+}
+
+// DuplicateGroup is a content shared by several active files. The ID is
+// stable; a group with fewer than two copies has been resolved.
+type DuplicateGroup struct {
+	ID          int64       `json:"id"`
+	Hash        string      `json:"hash"`
+	Size        int64       `json:"size"`
+	Copies      int64       `json:"copies"`
+	FirstSeenAt time.Time   `json:"first_seen_at"`
+	ChangedAt   time.Time   `json:"changed_at"`
+	Files       []GroupFile `json:"files"`
+}
+
+// DuplicateGroupsPage is the /duplicates/groups response
+type DuplicateGroupsPage struct {
+	Groups []DuplicateGroup `json:"groups"`
+	Cursor GroupsCursor     `json:"cursor"`
+	More   bool             `json:"more"` // The page is full; fetch again from Cursor
+}
+
+// DuplicateGroupsHandler lists duplicate groups in the order they last
+// changed. The change and after query parameters resume from a previous
+// cursor; limit caps the page size (default 1000). Groups changed by
+// transactions that may still be running are returned on a later page.
+func DuplicateGroupsHandler(q *recorddb.Queries) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cursor, ok := parseGroupsCursor(r)
+		if !ok {
+			http.Error(w, "Invalid change or after", http.StatusBadRequest)
+			return
+		}
+		limit, ok := intParam(r, "limit", DefaultGroupsLimit, MaxGroupsLimit)
+		if !ok {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+
+		rows, err := q.ListDuplicateGroups(r.Context(), recorddb.ListDuplicateGroupsParams{
+			ChangeXid: cursor.Change,
+			AfterID:   cursor.After,
+			PageSize:  int32(limit),
+		})
+		if err != nil {
+			slog.Error("Error querying duplicate groups", "error", err)
+			http.Error(w, "Failed to query duplicate groups", http.StatusInternalServerError)
+			return
+		}
+
+		page := DuplicateGroupsPage{Groups: make([]DuplicateGroup, 0, len(rows)), Cursor: cursor, More: len(rows) == limit}
+		index := make(map[int64]int, len(rows))
+		contentIDs := make([]int64, 0, len(rows))
+		for _, row := range rows {
+			index[row.ContentID] = len(page.Groups)
+			contentIDs = append(contentIDs, row.ContentID)
+			page.Groups = append(page.Groups, DuplicateGroup{
+				ID:          row.ID,
+				Hash:        row.Hash,
+				Size:        row.Size,
+				Copies:      row.Copies,
+				FirstSeenAt: row.FirstSeenAt.Time,
+				ChangedAt:   row.ChangedAt.Time,
+				Files:       []GroupFile{},
+			})
+		}
+		if n := len(rows); n > 0 {
+			page.Cursor = GroupsCursor{Change: rows[n-1].ChangeXid, After: rows[n-1].ID}
+		}
+
+		files, err := q.ListDuplicateGroupFiles(r.Context(), contentIDs)
+		if err != nil {
+			slog.Error("Error querying duplicate group files", "error", err)
+			http.Error(w, "Failed to query duplicate groups", http.StatusInternalServerError)
+			return
+		}
+		for _, f := range files {
+			g := &page.Groups[index[f.ContentID]]
+			g.Files = append(g.Files, GroupFile{
+				MachineID: f.MachineID,
+				Path:      f.Path,
+				Filename:  f.Filename,
+				MTime:     f.Mtime.Time,
+			})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(page); err != nil {
+			slog.Error("Error encoding JSON response", "error", err)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package record
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/tendant/filededup/pkg/record/recorddb"
+)
+
+// Bounds of a file history lookup
+const (
+	MaxHistoryLocations = 100  // Locations followed through moves
+	MaxHistoryEvents    = 1000 // Events read per location
+)
+
+// Events of a file's history
+const (
+	FileMoved   = "moved"
+	FileChanged = "changed"
+	FileDeleted = "deleted"
+)
+
+// recordFileChanges records a changed event for every record whose content
+// differs from the stored one
+func recordFileChanges(ctx context.Context, hs HistoryStore, records []recorddb.UpsertFileParams, stored map[fileKey]recorddb.ListStoredFilesRow) {
+	var arg recorddb.InsertFileChangesParams
+	for _, r := range records {
+		s, ok := stored[fileKey{r.MachineID, r.Path, r.Filename}]
+		if !ok || (s.Hash == r.Hash && s.Size == r.Size) {
+			continue
+		}
+		arg.MachineIds = append(arg.MachineIds, r.MachineID)
+		arg.Paths = append(arg.Paths, r.Path)
+		arg.Filenames = append(arg.Filenames, r.Filename)
+		arg.Hashes = append(arg.Hashes, r.Hash)
+		arg.Sizes = append(arg.Sizes, r.Size)
+		arg.Mtimes = append(arg.Mtimes, r.Mtime)
+		arg.PreviousHashes = append(arg.PreviousHashes, s.Hash)
+		arg.PreviousSizes = append(arg.PreviousSizes, s.Size)
+		arg.SessionIds = append(arg.SessionIds, r.SessionID)
+	}
+	if len(arg.MachineIds) == 0 {
+		return
+	}
+	if err := hs.InsertFileChanges(ctx, arg); err != nil {
+		slog.Warn("Failed to record file changes", "files", len(arg.MachineIds), "error", err)
+	}
+}
+
+// recordMovesAndDeletions records where the files a session is about to
+// remove went: a move when the session added their content under another name,
+// a deletion otherwise. It returns the number of moves, which the session
+// reports as renamed files, and how many of them changed the extension.
+// Failing to record the moves fails the session,
+// since every removed file would count as deleted; failing to record the
+// deletions is only logged.
+func recordMovesAndDeletions(ctx context.Context, q *recorddb.Queries, s recorddb.ScanSession) (recorddb.RecordMovedFilesRow, error) {
+	moved, err := q.RecordMovedFiles(ctx, recorddb.RecordMovedFilesParams{
+		SessionID: s.ID,
+		MachineID: s.MachineID,
+		Roots:     s.Roots,
+		StartedAt: s.StartedAt,
+	})
+	if err != nil {
+		return moved, fmt.Errorf("failed to record moved files: %w", err)
+	}
+	if _, err := q.RecordDeletedFiles(ctx, recorddb.RecordDeletedFilesParams{
+		SessionID: s.ID,
+		MachineID: s.MachineID,
+		Roots:     s.Roots,
+	}); err != nil {
+		slog.Warn("Failed to record deleted files", "machineID", s.MachineID, "session", formatUUID(s.ID), "error", err)
+	}
+	return moved, nil
+}
+
+// FileEvent is one step of a file's history. Path and Filename are the
+// location after the event; moves report the location before as PreviousPath
+// and PreviousFilename, changes the content before as PreviousHash and
+// PreviousSize.
+type FileEvent struct {
+	ID               int64     `json:"id"`
+	Event            string    `json:"event"`
+	Path             string    `json:"path"`
+	Filename         string    `json:"filename"`
+	Hash             string    `json:"hash"`
+	Size             int64     `json:"size"`
+	MTime            time.Time `json:"mtime"`
+	PreviousPath     string    `json:"previous_path,omitempty"`
+	PreviousFilename string    `json:"previous_filename,omitempty"`
+	PreviousHash     string    `json:"previous_hash,omitempty"`
+	PreviousSize     *int64    `json:"previous_size,omitempty"`
+	SessionID        string    `json:"session_id,omitempty"`
+	RecordedAt       time.Time `json:"recorded_at"`
+}
+
+// FileHistory is the /files/history response: the events of a file and of
+// the locations it moved from or to, oldest first. CurrentPath and
+// CurrentFilename follow the moves from the requested location to where the
+// file is now; Deleted is set when it was deleted there.
+type FileHistory struct {
+	MachineID       string      `json:"machine_id"`
+	Path            string      `json:"path"`
+	Filename        string      `json:"filename"`
+	CurrentPath     string      `json:"current_path"`
+	CurrentFilename string      `json:"current_filename"`
+	Deleted         bool        `json:"deleted"`
+	Events          []FileEvent `json:"events"`
+	Truncated       bool        `json:"truncated"` // More locations or events than the lookup follows
+}
+
+// location is a file's place on a machine
+type location struct {
+	path, filename string
+}
+
+func toFileEvent(h recorddb.FileHistory) FileEvent {
+	e := FileEvent{
+		ID:               h.ID,
+		Event:            h.Event,
+		Path:             h.Path,
+		Filename:         h.Filename,
+		Hash:             h.Hash,
+		Size:             h.Size,
+		MTime:            h.Mtime.Time,
+		PreviousPath:     h.PreviousPath.String,
+		PreviousFilename: h.PreviousFilename.String,
+		PreviousHash:     h.PreviousHash.String,
+		SessionID:        formatUUID(h.SessionID),
+		RecordedAt:       h.RecordedAt.Time,
+	}
+	if h.PreviousSize.Valid {
+		e.PreviousSize = &h.PreviousSize.Int64
+	}
+	return e
+}
+
+// FileHistoryReader reads the events recorded at a file location.
+// *recorddb.Queries implements it.
+type FileHistoryReader interface {
+	ListFileHistoryAt(ctx context.Context, arg recorddb.ListFileHistoryAtParams) ([]recorddb.FileHistory, error)
+}
+
+var _ FileHistoryReader = (*recorddb.Queries)(nil)
+
+// LoadFileHistory collects the history of a file, following its moves in both
+// directions
+func LoadFileHistory(ctx context.Context, q FileHistoryReader, machineID, path, filename string) (FileHistory, error) {
+	h := FileHistory{MachineID: machineID, Path: path, Filename: filename, Events: []FileEvent{}}
+	start := location{path, filename}
+	seen := map[location]bool{start: true}
+	queue := []location{start}
+	byID := make(map[int64]bool)
+	for len(queue) > 0 {
+		loc := queue[0]
+		queue = queue[1:]
+		rows, err := q.ListFileHistoryAt(ctx, recorddb.ListFileHistoryAtParams{
+			MachineID: machineID,
+			Path:      loc.path,
+			Filename:  loc.filename,
+			PageSize:  MaxHistoryEvents,
+		})
+		if err != nil {
+			return h, err
+		}
+		if len(rows) == MaxHistoryEvents {
+			h.Truncated = true
+		}
+		for _, row := range rows {
+			if byID[row.ID] {
+				continue
+			}
+			byID[row.ID] = true
+			e := toFileEvent(row)
+			h.Events = append(h.Events, e)
+			if e.Event != FileMoved {
+				continue
+			}
+			for _, next := range []location{{e.Path, e.Filename}, {e.PreviousPath, e.PreviousFilename}} {
+				if seen[next] {
+					continue
+				}
+				if len(seen) == MaxHistoryLocations {
+					h.Truncated = true
+					continue
+				}
+				seen[next] = true
+				queue = append(queue, next)
+			}
+		}
+	}
+	sort.Slice(h.Events, func(i, j int) bool {
+		a, b := h.Events[i], h.Events[j]
+		if !a.RecordedAt.Equal(b.RecordedAt) {
+			return a.RecordedAt.Before(b.RecordedAt)
+		}
+		return a.ID < b.ID
+	})
+
+	// Follow the moves away from the requested location in order; later events
+	// at the current location tell whether the file was deleted there
+	cur := start
+	for _, e := range h.Events {
+		switch {
+		case e.Event == FileMoved && (location{e.PreviousPath, e.PreviousFilename}) == cur:
+			cur = location{e.Path, e.Filename}
+			h.Deleted = false
+		case e.Event == FileDeleted && (location{e.Path, e.Filename}) == cur:
+			h.Deleted = true
+		case (location{e.Path, e.Filename}) == cur:
+			h.Deleted = false
+		}
+	}
+	h.CurrentPath, h.CurrentFilename = cur.path, cur.filename
+	return h, nil
+}
+
+// FileHistoryHandler answers where a file went and when it changed. The
+// machine, path and filename query parameters name the file at any location
+// it had; the response holds its moves, content changes and deletion.
+func FileHistoryHandler(q *recorddb.Queries) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		machineID, path, filename := query.Get("machine"), query.Get("path"), query.Get("filename")
+		if machineID == "" || path == "" || filename == "" {
+			http.Error(w, "machine, path and filename are required", http.StatusBadRequest)
+			return
+		}
+
+		h, err := LoadFileHistory(r.Context(), q, machineID, path, filename)
+		if err != nil {
+			slog.Error("Error loading file history", "machineID", machineID, "path", path, "filename", filename, "error", err)
+			http.Error(w, "Failed to load file history", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(h); err != nil {
+			slog.Error("Error encoding JSON response", "error", err)
+		}
+	}
+}
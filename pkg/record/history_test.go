@@ -0,0 +1,174 @@
+package record
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/tendant/filededup/pkg/record/recorddb"
+)
+
+// fakeHistory answers ListFileHistoryAt from a list of events, oldest first
+type fakeHistory struct {
+	events []recorddb.FileHistory
+	err    error
+}
+
+func (f *fakeHistory) ListFileHistoryAt(ctx context.Context, arg recorddb.ListFileHistoryAtParams) ([]recorddb.FileHistory, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	var rows []recorddb.FileHistory
+	for _, e := range f.events {
+		at := e.Path == arg.Path && e.Filename == arg.Filename
+		from := e.PreviousPath.String == arg.Path && e.PreviousFilename.String == arg.Filename
+		if e.MachineID != arg.MachineID || (!at && !from) {
+			continue
+		}
+		if len(rows) == int(arg.PageSize) {
+			break
+		}
+		rows = append(rows, e)
+	}
+	return rows, nil
+}
+
+// add records an event on machine-a; from is the location before a move
+func (f *fakeHistory) add(event, path, filename string, from ...string) {
+	id := int64(len(f.events) + 1)
+	e := recorddb.FileHistory{
+		ID:         id,
+		MachineID:  "machine-a",
+		Path:       path,
+		Filename:   filename,
+		Event:      event,
+		Hash:       "aa",
+		Size:       1,
+		RecordedAt: pgtype.Timestamp{Time: time.Date(2026, 1, 1, 0, 0, int(id), 0, time.UTC), Valid: true},
+	}
+	if len(from) == 2 {
+		e.PreviousPath = pgtype.Text{String: from[0], Valid: true}
+		e.PreviousFilename = pgtype.Text{String: from[1], Valid: true}
+	}
+	f.events = append(f.events, e)
+}
+
+func eventIDs(h FileHistory) []int64 {
+	ids := make([]int64, len(h.Events))
+	for i, e := range h.Events {
+		ids[i] = e.ID
+	}
+	return ids
+}
+
+func equalIDs(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestLoadFileHistory(t *testing.T) {
+	f := &fakeHistory{}
+	f.add(FileChanged, "/a", "one.txt")                // 1
+	f.add(FileMoved, "/b", "one.txt", "/a", "one.txt") // 2
+	f.add(FileChanged, "/b", "one.txt")                // 3
+	f.add(FileMoved, "/c", "uno.txt", "/b", "one.txt") // 4
+	f.add(FileDeleted, "/c", "uno.txt")                // 5
+	f.add(FileChanged, "/a", "other.txt")              // 6, another file
+	f.events = append(f.events, recorddb.FileHistory{ID: 7, MachineID: "machine-b", Path: "/a", Filename: "one.txt", Event: FileDeleted})
+
+	tests := []struct {
+		name           string
+		path, filename string
+		wantIDs        []int64
+		wantPath       string
+		wantFilename   string
+		wantDeleted    bool
+	}{
+		{"from the first location", "/a", "one.txt", []int64{1, 2, 3, 4, 5}, "/c", "uno.txt", true},
+		{"from a later location", "/b", "one.txt", []int64{1, 2, 3, 4, 5}, "/c", "uno.txt", true},
+		{"from the last location", "/c", "uno.txt", []int64{1, 2, 3, 4, 5}, "/c", "uno.txt", true},
+		{"unrelated file", "/a", "other.txt", []int64{6}, "/a", "other.txt", false},
+		{"unknown file", "/x", "none.txt", []int64{}, "/x", "none.txt", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := LoadFileHistory(context.Background(), f, "machine-a", tt.path, tt.filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := eventIDs(h); !equalIDs(got, tt.wantIDs) {
+				t.Errorf("events = %v, want %v", got, tt.wantIDs)
+			}
+			if h.CurrentPath != tt.wantPath || h.CurrentFilename != tt.wantFilename || h.Deleted != tt.wantDeleted {
+				t.Errorf("current = %s/%s deleted %v, want %s/%s deleted %v",
+					h.CurrentPath, h.CurrentFilename, h.Deleted, tt.wantPath, tt.wantFilename, tt.wantDeleted)
+			}
+			if h.Truncated {
+				t.Error("history truncated")
+			}
+		})
+	}
+}
+
+func TestLoadFileHistoryMovedBack(t *testing.T) {
+	f := &fakeHistory{}
+	f.add(FileMoved, "/b", "one.txt", "/a", "one.txt")
+	f.add(FileDeleted, "/b", "one.txt")
+	f.add(FileChanged, "/b", "one.txt") // Created again at /b
+	f.add(FileMoved, "/a", "one.txt", "/b", "one.txt")
+
+	h, err := LoadFileHistory(context.Background(), f, "machine-a", "/a", "one.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := eventIDs(h); !equalIDs(got, []int64{1, 2, 3, 4}) {
+		t.Errorf("events = %v, want [1 2 3 4]", got)
+	}
+	if h.CurrentPath != "/a" || h.CurrentFilename != "one.txt" || h.Deleted {
+		t.Errorf("current = %s/%s deleted %v, want /a/one.txt not deleted", h.CurrentPath, h.CurrentFilename, h.Deleted)
+	}
+}
+
+func TestLoadFileHistoryTruncated(t *testing.T) {
+	f := &fakeHistory{}
+	for i := 0; i <= MaxHistoryEvents; i++ {
+		f.add(FileChanged, "/a", "busy.txt")
+	}
+	h, err := LoadFileHistory(context.Background(), f, "machine-a", "/a", "busy.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.Truncated || len(h.Events) != MaxHistoryEvents {
+		t.Fatalf("truncated = %v with %d events, want true with %d", h.Truncated, len(h.Events), MaxHistoryEvents)
+	}
+
+	// A chain of moves longer than the locations followed
+	f = &fakeHistory{}
+	for i := 0; i <= MaxHistoryLocations; i++ {
+		f.add(FileMoved, "/moves", fmt.Sprintf("file-%03d.txt", i+1), "/moves", fmt.Sprintf("file-%03d.txt", i))
+	}
+	h, err = LoadFileHistory(context.Background(), f, "machine-a", "/moves", "file-000.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.Truncated {
+		t.Fatalf("truncated = false after following %d moves", len(h.Events))
+	}
+}
+
+func TestLoadFileHistoryError(t *testing.T) {
+	f := &fakeHistory{err: errors.New("connection lost")}
+	if _, err := LoadFileHistory(context.Background(), f, "machine-a", "/a", "one.txt"); !errors.Is(err, f.err) {
+		t.Fatalf("LoadFileHistory() error = %v, want %v", err, f.err)
+	}
+}
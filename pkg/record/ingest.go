@@ -0,0 +1,216 @@
+package record
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/tendant/filededup/pkg/archive"
+	"github.com/tendant/filededup/pkg/auth"
+	"github.com/tendant/filededup/pkg/metrics"
+	"github.com/tendant/filededup/pkg/record/recorddb"
+)
+
+// ErrArchiveIngested is returned when an archive was ingested before
+var ErrArchiveIngested = errors.New("archive was already ingested")
+
+// ingestBatchSize is the number of archive records compared and stored at a time
+const ingestBatchSize = 1000
+
+// IngestResult summarizes an ingested scan archive
+type IngestResult struct {
+	ArchiveID string      `json:"archive_id"`
+	MachineID string      `json:"machine_id"`
+	Records   int64       `json:"records"`
+	Session   ScanSession `json:"session"`
+}
+
+// IngestArchive stores the records of a verified archive with the same
+// semantics as an online scan: the machine is registered, the records are
+// uploaded in a scan session, the session is completed (removing deleted files
+// if the scan was complete) and the scan statistics are recorded. The
+// completed session is checked for mass changes by anomalies. If ingestion
+// fails, the session is abandoned, so the archive can be ingested again.
+func IngestArchive(ctx context.Context, q *recorddb.Queries, ar *archive.Reader, anomalies *Anomalies) (IngestResult, error) {
+	m := ar.Manifest
+	result := IngestResult{ArchiveID: m.ID, MachineID: m.MachineID}
+	archiveID := pgtype.Text{String: m.ID, Valid: true}
+
+	ingested, err := q.IsArchiveIngested(ctx, archiveID)
+	if err != nil {
+		return result, err
+	}
+	if ingested {
+		return result, ErrArchiveIngested
+	}
+
+	roots := m.Roots
+	if roots == nil {
+		roots = []string{}
+	}
+	if _, err := q.RegisterMachine(ctx, recorddb.RegisterMachineParams{
+		MachineID: m.MachineID,
+		Hostname:  m.Hostname,
+		Os:        m.OS,
+		Arch:      m.Arch,
+		Version:   m.AgentVersion,
+		Roots:     roots,
+	}); err != nil {
+		return result, fmt.Errorf("failed to register machine: %w", err)
+	}
+
+	rootVolumes := m.RootVolumes
+	if len(rootVolumes) != len(roots) {
+		rootVolumes = []string{}
+	}
+	s, err := q.StartScanSession(ctx, recorddb.StartScanSessionParams{MachineID: m.MachineID, Roots: roots, RootVolumes: rootVolumes})
+	if err != nil {
+		return result, fmt.Errorf("failed to start scan session: %w", err)
+	}
+
+	records, err := ingestRecords(ctx, q, ar, s.ID, anomalies)
+	result.Records = records
+	var finished recorddb.ScanSession
+	if err == nil {
+		finished, err = completeSession(ctx, q, s, SessionComplete{
+			ScanBytes:     m.ScanBytes,
+			ScanErrors:    m.ScanErrors,
+			DeleteMissing: m.Complete,
+		}, archiveID)
+	}
+	if err != nil {
+		// The request may be canceled already; the session must still end
+		if aerr := q.AbandonScanSession(context.WithoutCancel(ctx), s.ID); aerr != nil {
+			slog.Warn("Failed to abandon scan session", "session", formatUUID(s.ID), "error", aerr)
+		}
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			return result, ErrArchiveIngested
+		}
+		return result, err
+	}
+	result.Session = toScanSession(finished)
+	anomalies.Check(ctx, finished)
+
+	files := result.Records
+	if _, err := q.RecordHeartbeat(ctx, recorddb.RecordHeartbeatParams{
+		ScanStartedAt:  pgTimestamp(&m.StartedAt),
+		ScanFinishedAt: pgTimestamp(&m.FinishedAt),
+		ScanFiles:      pgInt8(&files),
+		ScanBytes:      pgInt8(&m.ScanBytes),
+		ScanErrors:     pgInt8(&m.ScanErrors),
+		MachineID:      m.MachineID,
+	}); err != nil {
+		slog.Warn("Failed to record scan statistics", "machineID", m.MachineID, "error", err)
+	}
+
+	slog.Info("Scan archive ingested", "archive", m.ID, "machineID", m.MachineID,
+		"records", result.Records, "filesDeleted", finished.FilesDeleted)
+	return result, nil
+}
+
+// ingestRecords stores the records of an archive in the session, comparing
+// them with the stored records a batch at a time like uploads, and returns the
+// number of records stored
+func ingestRecords(ctx context.Context, q *recorddb.Queries, ar *archive.Reader, sessionID pgtype.UUID, anomalies *Anomalies) (int64, error) {
+	machineID := ar.Manifest.MachineID
+	var stored int64
+	records := make([]recorddb.UpsertFileParams, 0, ingestBatchSize)
+	readErrors := make(map[fileKey]string)
+	flush := func() error {
+		compareStored(ctx, q, records, readErrors, anomalies)
+		for _, rec := range records {
+			if err := q.UpsertFile(ctx, rec); err != nil {
+				metrics.RecordsFailed.WithLabelValues("archive").Inc()
+				return fmt.Errorf("failed to store file record: %w", err)
+			}
+			metrics.RecordsIngested.WithLabelValues("archive").Inc()
+			stored++
+		}
+		records = records[:0]
+		clear(readErrors)
+		return nil
+	}
+
+	for {
+		var f FileRecord
+		err := ar.Next(&f)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return stored, err
+		}
+		// The signing key is trusted for the manifest's machine only
+		if f.MachineID != machineID {
+			return stored, fmt.Errorf("archive for %s contains a record for %s", machineID, f.MachineID)
+		}
+		if f.ReadError != "" {
+			readErrors[fileKey{f.MachineID, f.Path, f.Filename}] = f.ReadError
+		}
+		records = append(records, recorddb.UpsertFileParams{
+			MachineID: f.MachineID,
+			Path:      f.Path,
+			Filename:  f.Filename,
+			Size:      f.Size,
+			Mtime:     pgtype.Timestamp{Time: f.MTime.UTC(), Valid: true},
+			Hash:      f.Hash,
+			SessionID: sessionID,
+			Volume:    f.Volume,
+			VolumeID:  f.VolumeID,
+			Inode:     int64(f.Inode),
+			FullHash:  f.FullHash,
+		})
+		if len(records) == ingestBatchSize {
+			if err := flush(); err != nil {
+				return stored, err
+			}
+		}
+	}
+	return stored, flush()
+}
+
+// IngestArchiveHandler handles HTTP requests uploading a scan archive
+func IngestArchiveHandler(q *recorddb.Queries, trusted archive.TrustedKeys, anomalies *Anomalies) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ar, err := archive.Open(r.Body, trusted)
+		if err != nil {
+			if errors.Is(err, archive.ErrUntrustedKey) || errors.Is(err, archive.ErrInvalidSignature) {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+			http.Error(w, "Invalid archive: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer ar.Close()
+		if !auth.Allowed(r, ar.Manifest.MachineID) {
+			http.Error(w, "Archive machine_id does not match token", http.StatusForbidden)
+			return
+		}
+
+		result, err := IngestArchive(r.Context(), q, ar, anomalies)
+		switch {
+		case errors.Is(err, ErrArchiveIngested):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case errors.Is(err, archive.ErrCorrupt):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		case err != nil:
+			slog.Error("Error ingesting archive", "archive", ar.Manifest.ID, "error", err)
+			http.Error(w, "Failed to ingest archive", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(result); err != nil {
+			slog.Error("Error encoding JSON response", "error", err)
+		}
+	}
+}
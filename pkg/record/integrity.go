@@ -0,0 +1,243 @@
+package record
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/tendant/filededup/pkg/metrics"
+	"github.com/tendant/filededup/pkg/record/recorddb"
+)
+
+// Defaults and bounds of the /integrity/events limit parameter
+const (
+	DefaultIntegrityLimit = 100
+	MaxIntegrityLimit     = 1000
+)
+
+// Hashes an integrity event compares
+const (
+	IntegrityContent = "content" // The hash files are deduplicated by, sampled for large files
+	IntegrityFull    = "sha256"  // The full hash of a scrub
+)
+
+// HistoryStore is implemented by stores that compare incoming records with
+// the stored ones to detect silent corruption, record file changes and count
+// the changes of scan sessions. *recorddb.Queries implements it; other stores skip the comparison.
+type HistoryStore interface {
+	ListStoredFiles(ctx context.Context, arg recorddb.ListStoredFilesParams) ([]recorddb.ListStoredFilesRow, error)
+	InsertIntegrityEvent(ctx context.Context, arg recorddb.InsertIntegrityEventParams) (recorddb.IntegrityEvent, error)
+	AddSessionChanges(ctx context.Context, arg recorddb.AddSessionChangesParams) error
+	InsertFileChanges(ctx context.Context, arg recorddb.InsertFileChangesParams) error
+}
+
+var _ HistoryStore = (*recorddb.Queries)(nil)
+
+// fileKey identifies a file record
+type fileKey struct {
+	machineID, path, filename string
+}
+
+// wallClock drops the time zone and the precision Postgres does not store,
+// since file times are stored as UTC wall clock time in microseconds
+func wallClock(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC).Truncate(time.Microsecond)
+}
+
+// compareStored compares incoming records with the stored ones before they
+// are replaced, recording integrity events, content changes and the files
+// each scan session added or changed. readErrors holds the files a scrub could
+// not read. Failures are logged and never stop ingestion.
+func compareStored(ctx context.Context, store Store, records []recorddb.UpsertFileParams, readErrors map[fileKey]string, anomalies *Anomalies) {
+	hs, ok := store.(HistoryStore)
+	if !ok || len(records) == 0 {
+		return
+	}
+
+	arg := recorddb.ListStoredFilesParams{
+		MachineIds: make([]string, len(records)),
+		Paths:      make([]string, len(records)),
+		Filenames:  make([]string, len(records)),
+	}
+	for i, r := range records {
+		arg.MachineIds[i], arg.Paths[i], arg.Filenames[i] = r.MachineID, r.Path, r.Filename
+	}
+	stored, err := hs.ListStoredFiles(ctx, arg)
+	if err != nil {
+		slog.Warn("Failed to compare with stored records", "error", err)
+		return
+	}
+	byKey := make(map[fileKey]recorddb.ListStoredFilesRow, len(stored))
+	for _, s := range stored {
+		byKey[fileKey{s.MachineID, s.Path, s.Filename}] = s
+	}
+
+	checkIntegrity(ctx, hs, anomalies, records, byKey, readErrors)
+	recordFileChanges(ctx, hs, records, byKey)
+	countSessionChanges(ctx, hs, records, byKey)
+}
+
+// checkIntegrity records an integrity event for every file whose hash changed
+// while size and mtime stayed the same: an edit would have changed the mtime.
+// Content hashes are compared with content hashes and the full hashes of
+// scrubs with full hashes. Files a scrub could not read raise an event too.
+func checkIntegrity(ctx context.Context, hs HistoryStore, anomalies *Anomalies, records []recorddb.UpsertFileParams, stored map[fileKey]recorddb.ListStoredFilesRow, readErrors map[fileKey]string) {
+	for _, r := range records {
+		key := fileKey{r.MachineID, r.Path, r.Filename}
+		s, ok := stored[key]
+		unchanged := ok && s.Size == r.Size && wallClock(s.Mtime.Time).Equal(wallClock(r.Mtime.Time))
+		arg := recorddb.InsertIntegrityEventParams{
+			MachineID: r.MachineID,
+			Path:      r.Path,
+			Filename:  r.Filename,
+			Size:      r.Size,
+			Mtime:     r.Mtime,
+			SessionID: r.SessionID,
+		}
+		switch readErr := readErrors[key]; {
+		case readErr != "":
+			arg.Algorithm, arg.ExpectedHash = IntegrityFull, s.FullHash
+			arg.ReadError = pgtype.Text{String: readErr, Valid: true}
+			slog.Warn("Scrub could not read file, possible corruption",
+				"machineID", r.MachineID, "path", r.Path, "filename", r.Filename, "error", readErr)
+		case unchanged && s.Hash != r.Hash:
+			arg.Algorithm, arg.ExpectedHash, arg.ActualHash = IntegrityContent, s.Hash, r.Hash
+		case unchanged && s.FullHash != "" && r.FullHash != "" && s.FullHash != r.FullHash:
+			arg.Algorithm, arg.ExpectedHash, arg.ActualHash = IntegrityFull, s.FullHash, r.FullHash
+		default:
+			continue
+		}
+		if !arg.ReadError.Valid {
+			slog.Warn("File content changed without a change of size or mtime, possible corruption",
+				"machineID", r.MachineID, "path", r.Path, "filename", r.Filename,
+				"algorithm", arg.Algorithm, "expectedHash", arg.ExpectedHash, "actualHash", arg.ActualHash)
+		}
+		metrics.IntegrityEvents.WithLabelValues(r.MachineID).Inc()
+		row, err := hs.InsertIntegrityEvent(ctx, arg)
+		if err != nil {
+			slog.Error("Failed to record integrity event", "machineID", r.MachineID, "path", r.Path, "error", err)
+			continue
+		}
+		anomalies.Integrity(toIntegrityEvent(row))
+	}
+}
+
+// countSessionChanges adds the records that were not stored before or changed
+// their hash to the counts of their scan session. Records uploaded again
+// within a session match what the first upload stored and are not counted.
+func countSessionChanges(ctx context.Context, hs HistoryStore, records []recorddb.UpsertFileParams, stored map[fileKey]recorddb.ListStoredFilesRow) {
+	counts := make(map[pgtype.UUID]*recorddb.AddSessionChangesParams)
+	for _, r := range records {
+		if !r.SessionID.Valid {
+			continue
+		}
+		c := counts[r.SessionID]
+		if c == nil {
+			c = &recorddb.AddSessionChangesParams{ID: r.SessionID}
+			counts[r.SessionID] = c
+		}
+		s, ok := stored[fileKey{r.MachineID, r.Path, r.Filename}]
+		switch {
+		case !ok:
+			c.Added++
+		case s.Hash != r.Hash:
+			c.Changed++
+		}
+	}
+	for _, c := range counts {
+		if c.Added == 0 && c.Changed == 0 {
+			continue
+		}
+		if err := hs.AddSessionChanges(ctx, *c); err != nil {
+			slog.Warn("Failed to count scan session changes", "session", formatUUID(c.ID), "error", err)
+		}
+	}
+}
+
+// IntegrityEvent is a file whose content changed while its size and
+// modification time stayed the same, or that a scrub could not read
+type IntegrityEvent struct {
+	ID           int64     `json:"id"`
+	MachineID    string    `json:"machine_id"`
+	Path         string    `json:"path"`
+	Filename     string    `json:"filename"`
+	Size         int64     `json:"size"`
+	MTime        time.Time `json:"mtime"`
+	ExpectedHash string    `json:"expected_hash"` // Hash of the previous scan
+	ActualHash   string    `json:"actual_hash"`   // Hash of the scan that detected the change
+	Algorithm    string    `json:"algorithm"`     // Hashes compared: content or sha256
+	ReadError    string    `json:"read_error,omitempty"`
+	SessionID    string    `json:"session_id,omitempty"`
+	DetectedAt   time.Time `json:"detected_at"`
+}
+
+func toIntegrityEvent(e recorddb.IntegrityEvent) IntegrityEvent {
+	return IntegrityEvent{
+		ID:           e.ID,
+		MachineID:    e.MachineID,
+		Path:         e.Path,
+		Filename:     e.Filename,
+		Size:         e.Size,
+		MTime:        e.Mtime.Time,
+		ExpectedHash: e.ExpectedHash,
+		ActualHash:   e.ActualHash,
+		Algorithm:    e.Algorithm,
+		ReadError:    e.ReadError.String,
+		SessionID:    formatUUID(e.SessionID),
+		DetectedAt:   e.DetectedAt.Time,
+	}
+}
+
+// IntegrityEventsPage is the /integrity/events response
+type IntegrityEventsPage struct {
+	Events []IntegrityEvent `json:"events"`
+	Cursor Cursor           `json:"cursor"`
+	More   bool             `json:"more"` // The page is full; fetch again from Cursor
+}
+
+// IntegrityEventsHandler lists integrity events, oldest first. The machine
+// query parameter filters by machine; since (RFC 3339) and after (event ID)
+// resume from a previous cursor; limit caps the page size (default 100).
+func IntegrityEventsHandler(q *recorddb.Queries) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cursor, since, ok := parseCursor(r)
+		if !ok {
+			http.Error(w, "Invalid since or after", http.StatusBadRequest)
+			return
+		}
+		limit, ok := intParam(r, "limit", DefaultIntegrityLimit, MaxIntegrityLimit)
+		if !ok {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+
+		rows, err := q.ListIntegrityEvents(r.Context(), recorddb.ListIntegrityEventsParams{
+			MachineID: r.URL.Query().Get("machine"),
+			Since:     since,
+			AfterID:   cursor.After,
+			PageSize:  int32(limit),
+		})
+		if err != nil {
+			slog.Error("Error querying integrity events", "error", err)
+			http.Error(w, "Failed to query integrity events", http.StatusInternalServerError)
+			return
+		}
+
+		page := IntegrityEventsPage{Events: make([]IntegrityEvent, 0, len(rows)), Cursor: cursor, More: len(rows) == limit}
+		for _, row := range rows {
+			page.Events = append(page.Events, toIntegrityEvent(row))
+		}
+		if n := len(page.Events); n > 0 {
+			last := page.Events[n-1]
+			page.Cursor = Cursor{Since: &last.DetectedAt, After: last.ID}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(page); err != nil {
+			slog.Error("Error encoding JSON response", "error", err)
+		}
+	}
+}
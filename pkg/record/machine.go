@@ -0,0 +1,211 @@
+package record
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/tendant/filededup/pkg/auth"
+	"github.com/tendant/filededup/pkg/record/recorddb"
+)
+
+// DefaultSilentAfter is how long an agent may go without a heartbeat before it is flagged as silent
+const DefaultSilentAfter = 24 * time.Hour
+
+// MachineRegistration is sent by an agent when it starts
+type MachineRegistration struct {
+	MachineID string   `json:"machine_id"`
+	Hostname  string   `json:"hostname"`
+	OS        string   `json:"os"`
+	Arch      string   `json:"arch"`
+	Version   string   `json:"version"`
+	Roots     []string `json:"roots"`
+}
+
+// Heartbeat is sent periodically by an agent; scan fields are only set when they changed
+type Heartbeat struct {
+	ScanStartedAt  *time.Time `json:"scan_started_at,omitempty"`
+	ScanFinishedAt *time.Time `json:"scan_finished_at,omitempty"`
+	ScanFiles      *int64     `json:"scan_files,omitempty"`
+	ScanBytes      *int64     `json:"scan_bytes,omitempty"`
+	ScanErrors     *int64     `json:"scan_errors,omitempty"`
+}
+
+// Machine describes a registered agent
+type Machine struct {
+	MachineID          string     `json:"machine_id"`
+	Hostname           string     `json:"hostname"`
+	OS                 string     `json:"os"`
+	Arch               string     `json:"arch"`
+	Version            string     `json:"version"`
+	Roots              []string   `json:"roots"`
+	RegisteredAt       time.Time  `json:"registered_at"`
+	LastSeenAt         time.Time  `json:"last_seen_at"`
+	LastScanStartedAt  *time.Time `json:"last_scan_started_at,omitempty"`
+	LastScanFinishedAt *time.Time `json:"last_scan_finished_at,omitempty"`
+	LastScanFiles      int64      `json:"last_scan_files"`
+	LastScanBytes      int64      `json:"last_scan_bytes"`
+	LastScanErrors     int64      `json:"last_scan_errors"`
+	Silent             bool       `json:"silent"`
+}
+
+func toMachine(m recorddb.Machine, silent bool) Machine {
+	return Machine{
+		MachineID:          m.MachineID,
+		Hostname:           m.Hostname,
+		OS:                 m.Os,
+		Arch:               m.Arch,
+		Version:            m.Version,
+		Roots:              m.Roots,
+		RegisteredAt:       m.RegisteredAt.Time,
+		LastSeenAt:         m.LastSeenAt.Time,
+		LastScanStartedAt:  timePtr(m.LastScanStartedAt),
+		LastScanFinishedAt: timePtr(m.LastScanFinishedAt),
+		LastScanFiles:      m.LastScanFiles,
+		LastScanBytes:      m.LastScanBytes,
+		LastScanErrors:     m.LastScanErrors,
+		Silent:             silent,
+	}
+}
+
+func timePtr(t pgtype.Timestamp) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+func pgTimestamp(t *time.Time) pgtype.Timestamp {
+	if t == nil {
+		return pgtype.Timestamp{}
+	}
+	return pgtype.Timestamp{Time: t.UTC(), Valid: true}
+}
+
+func pgInt8(v *int64) pgtype.Int8 {
+	if v == nil {
+		return pgtype.Int8{}
+	}
+	return pgtype.Int8{Int64: *v, Valid: true}
+}
+
+// RegisterMachineHandler handles HTTP requests from agents announcing themselves
+func RegisterMachineHandler(q *recorddb.Queries) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var reg MachineRegistration
+		if err := json.NewDecoder(r.Body).Decode(&reg); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if reg.MachineID == "" {
+			http.Error(w, "machine_id is required", http.StatusBadRequest)
+			return
+		}
+		if !auth.Allowed(r, reg.MachineID) {
+			http.Error(w, "Machine does not match token", http.StatusForbidden)
+			return
+		}
+		if reg.Roots == nil {
+			reg.Roots = []string{}
+		}
+
+		m, err := q.RegisterMachine(r.Context(), recorddb.RegisterMachineParams{
+			MachineID: reg.MachineID,
+			Hostname:  reg.Hostname,
+			Os:        reg.OS,
+			Arch:      reg.Arch,
+			Version:   reg.Version,
+			Roots:     reg.Roots,
+		})
+		if err != nil {
+			slog.Error("Error registering machine", "machineID", reg.MachineID, "error", err)
+			http.Error(w, "Failed to register machine", http.StatusInternalServerError)
+			return
+		}
+		slog.Info("Machine registered", "machineID", m.MachineID, "hostname", m.Hostname, "version", m.Version)
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(toMachine(m, false)); err != nil {
+			slog.Error("Error encoding JSON response", "error", err)
+		}
+	}
+}
+
+// HeartbeatHandler handles periodic HTTP requests from registered agents
+func HeartbeatHandler(q *recorddb.Queries) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		machineID := chi.URLParam(r, "machineID")
+		if !auth.Allowed(r, machineID) {
+			http.Error(w, "Machine does not match token", http.StatusForbidden)
+			return
+		}
+
+		var hb Heartbeat
+		if err := json.NewDecoder(r.Body).Decode(&hb); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+
+		n, err := q.RecordHeartbeat(r.Context(), recorddb.RecordHeartbeatParams{
+			ScanStartedAt:  pgTimestamp(hb.ScanStartedAt),
+			ScanFinishedAt: pgTimestamp(hb.ScanFinishedAt),
+			ScanFiles:      pgInt8(hb.ScanFiles),
+			ScanBytes:      pgInt8(hb.ScanBytes),
+			ScanErrors:     pgInt8(hb.ScanErrors),
+			MachineID:      machineID,
+		})
+		if err != nil {
+			slog.Error("Error recording heartbeat", "machineID", machineID, "error", err)
+			http.Error(w, "Failed to record heartbeat", http.StatusInternalServerError)
+			return
+		}
+		if n == 0 {
+			http.Error(w, "Machine is not registered", http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// ListMachinesHandler handles HTTP requests listing registered agents.
+// The silent_after query parameter (a Go duration, default 24h) controls when
+// an agent is flagged as silent; silent=true only returns silent agents.
+func ListMachinesHandler(q *recorddb.Queries) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		silentAfter := DefaultSilentAfter
+		if v := r.URL.Query().Get("silent_after"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				http.Error(w, "Invalid silent_after duration", http.StatusBadRequest)
+				return
+			}
+			silentAfter = d
+		}
+		onlySilent := r.URL.Query().Get("silent") == "true"
+
+		machines, err := q.ListMachines(r.Context(), pgtype.Interval{Microseconds: silentAfter.Microseconds(), Valid: true})
+		if err != nil {
+			slog.Error("Error listing machines", "error", err)
+			http.Error(w, "Failed to list machines", http.StatusInternalServerError)
+			return
+		}
+
+		result := make([]Machine, 0, len(machines))
+		for _, m := range machines {
+			machine := toMachine(m.Machine, m.Silent)
+			if onlySilent && !machine.Silent {
+				continue
+			}
+			result = append(result, machine)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(result); err != nil {
+			slog.Error("Error encoding JSON response", "error", err)
+		}
+	}
+}
@@ -1,4 +1,4 @@
-CREATE TABLE files (
+CREATE TABLE IF NOT EXISTS files (
     id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
     machine_id TEXT NOT NULL,
     path TEXT NOT NULL,
@@ -8,4 +8,4 @@ CREATE TABLE files (
     hash TEXT NOT NULL,
     created_at TIMESTAMP DEFAULT now(),
     UNIQUE (machine_id, path, filename)
-);
\ No newline at end of file
+);
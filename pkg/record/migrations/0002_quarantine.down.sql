@@ -0,0 +1,3 @@
+ALTER TABLE files DROP COLUMN IF EXISTS quarantined_at;
+ALTER TABLE files DROP COLUMN IF EXISTS quarantine_path;
+ALTER TABLE files DROP COLUMN IF EXISTS quarantine_state;
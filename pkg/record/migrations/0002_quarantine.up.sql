@@ -0,0 +1,4 @@
+-- quarantine_state is one of 'active', 'quarantined' or 'purged'
+ALTER TABLE files ADD COLUMN IF NOT EXISTS quarantine_state TEXT NOT NULL DEFAULT 'active';
+ALTER TABLE files ADD COLUMN IF NOT EXISTS quarantine_path TEXT;
+ALTER TABLE files ADD COLUMN IF NOT EXISTS quarantined_at TIMESTAMP;
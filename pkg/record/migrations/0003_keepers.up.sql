@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS keepers (
+    hash TEXT PRIMARY KEY,
+    file_id UUID NOT NULL REFERENCES files (id) ON DELETE CASCADE,
+    selected_at TIMESTAMP NOT NULL DEFAULT now()
+);
@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS machines (
+    machine_id TEXT PRIMARY KEY,
+    hostname TEXT NOT NULL DEFAULT '',
+    os TEXT NOT NULL DEFAULT '',
+    arch TEXT NOT NULL DEFAULT '',
+    version TEXT NOT NULL DEFAULT '',
+    roots TEXT[] NOT NULL DEFAULT '{}',
+    registered_at TIMESTAMP NOT NULL DEFAULT now(),
+    last_seen_at TIMESTAMP NOT NULL DEFAULT now(),
+    last_scan_started_at TIMESTAMP,
+    last_scan_finished_at TIMESTAMP,
+    last_scan_files BIGINT NOT NULL DEFAULT 0,
+    last_scan_bytes BIGINT NOT NULL DEFAULT 0,
+    last_scan_errors BIGINT NOT NULL DEFAULT 0
+);
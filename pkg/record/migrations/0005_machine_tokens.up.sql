@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS machine_tokens (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    machine_id TEXT NOT NULL,
+    -- token_hash is the hex encoded SHA-256 of the bearer token; tokens are never stored
+    token_hash TEXT NOT NULL UNIQUE,
+    description TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL DEFAULT now(),
+    last_used_at TIMESTAMP,
+    revoked_at TIMESTAMP
+);
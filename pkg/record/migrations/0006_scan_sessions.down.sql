@@ -0,0 +1,3 @@
+ALTER TABLE files DROP COLUMN IF EXISTS last_seen_at;
+ALTER TABLE files DROP COLUMN IF EXISTS session_id;
+DROP TABLE IF EXISTS scan_sessions;
@@ -0,0 +1,22 @@
+-- A scan session groups the uploads of one agent scan. Completing a session
+-- removes active files under its roots that the scan did not see.
+CREATE TABLE IF NOT EXISTS scan_sessions (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    machine_id TEXT NOT NULL,
+    roots TEXT[] NOT NULL DEFAULT '{}',
+    started_at TIMESTAMP NOT NULL DEFAULT now(),
+    finished_at TIMESTAMP,
+    -- status is one of 'running' or 'completed'
+    status TEXT NOT NULL DEFAULT 'running',
+    files_seen BIGINT NOT NULL DEFAULT 0,
+    scan_bytes BIGINT NOT NULL DEFAULT 0,
+    scan_errors BIGINT NOT NULL DEFAULT 0,
+    files_deleted BIGINT NOT NULL DEFAULT 0,
+    -- archive_id is set for sessions ingested from a scan archive
+    archive_id TEXT UNIQUE
+);
+
+CREATE INDEX IF NOT EXISTS scan_sessions_machine_idx ON scan_sessions (machine_id, started_at DESC);
+
+ALTER TABLE files ADD COLUMN IF NOT EXISTS session_id UUID;
+ALTER TABLE files ADD COLUMN IF NOT EXISTS last_seen_at TIMESTAMP;
@@ -0,0 +1,10 @@
+DROP TABLE IF EXISTS stats_snapshots;
+DROP MATERIALIZED VIEW IF EXISTS mv_stats_extensions;
+DROP MATERIALIZED VIEW IF EXISTS mv_stats_size_buckets;
+DROP MATERIALIZED VIEW IF EXISTS mv_stats_directories;
+DROP MATERIALIZED VIEW IF EXISTS mv_stats_machines;
+DROP VIEW IF EXISTS stats_extensions;
+DROP VIEW IF EXISTS stats_size_buckets;
+DROP VIEW IF EXISTS stats_directories;
+DROP VIEW IF EXISTS stats_machines;
+DROP VIEW IF EXISTS file_copies;
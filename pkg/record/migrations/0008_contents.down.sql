@@ -0,0 +1,137 @@
+DROP MATERIALIZED VIEW IF EXISTS mv_stats_extensions;
+DROP MATERIALIZED VIEW IF EXISTS mv_stats_size_buckets;
+DROP MATERIALIZED VIEW IF EXISTS mv_stats_directories;
+DROP MATERIALIZED VIEW IF EXISTS mv_stats_machines;
+DROP VIEW IF EXISTS stats_extensions;
+DROP VIEW IF EXISTS stats_size_buckets;
+DROP VIEW IF EXISTS stats_directories;
+DROP VIEW IF EXISTS stats_machines;
+DROP VIEW IF EXISTS file_copies;
+
+DROP TRIGGER IF EXISTS file_instances_count ON file_instances;
+DROP FUNCTION IF EXISTS file_instances_count();
+
+ALTER TABLE file_instances ADD COLUMN hash TEXT;
+ALTER TABLE file_instances ADD COLUMN size BIGINT;
+UPDATE file_instances f SET hash = content_hash_text(c.algorithm, c.hash), size = c.size
+FROM contents c
+WHERE c.id = f.content_id;
+ALTER TABLE file_instances
+    ALTER COLUMN hash SET NOT NULL,
+    ALTER COLUMN size SET NOT NULL;
+
+ALTER TABLE keepers ADD COLUMN hash TEXT;
+UPDATE keepers k SET hash = content_hash_text(c.algorithm, c.hash)
+FROM contents c
+WHERE c.id = k.content_id;
+ALTER TABLE keepers DROP CONSTRAINT keepers_pkey;
+ALTER TABLE keepers DROP COLUMN content_id;
+ALTER TABLE keepers ADD PRIMARY KEY (hash);
+
+ALTER TABLE file_instances DROP COLUMN content_id;
+ALTER TABLE file_instances RENAME CONSTRAINT file_instances_pkey TO files_pkey;
+ALTER TABLE file_instances RENAME CONSTRAINT file_instances_machine_id_path_filename_key TO files_machine_id_path_filename_key;
+ALTER TABLE file_instances RENAME TO files;
+
+DROP TABLE IF EXISTS contents;
+DROP FUNCTION IF EXISTS content_hash_text(text, bytea);
+DROP FUNCTION IF EXISTS content_hash_bytes(text);
+DROP FUNCTION IF EXISTS content_algorithm(text);
+
+-- file_copies ranks the copies of every active file by hash. The keeper, or
+-- else the first copy by machine and path, has copy_rank 1; every other copy
+-- of a duplicate set is redundant.
+CREATE OR REPLACE VIEW file_copies AS
+SELECT f.machine_id, f.path, f.filename, f.size, f.hash,
+    COUNT(*) OVER (PARTITION BY f.hash) AS copies,
+    row_number() OVER (
+        PARTITION BY f.hash
+        ORDER BY (k.file_id IS NOT NULL) DESC, f.machine_id, f.path, f.filename
+    ) AS copy_rank
+FROM files f
+LEFT JOIN keepers k ON k.file_id = f.id AND k.hash = f.hash
+WHERE f.quarantine_state = 'active';
+
+CREATE OR REPLACE VIEW stats_machines AS
+SELECT machine_id,
+    COUNT(*)::bigint AS files,
+    COALESCE(SUM(size), 0)::bigint AS bytes,
+    COUNT(*) FILTER (WHERE copies > 1)::bigint AS duplicate_files,
+    COALESCE(SUM(size) FILTER (WHERE copies > 1), 0)::bigint AS duplicate_bytes,
+    COALESCE(SUM(size) FILTER (WHERE copy_rank > 1), 0)::bigint AS wasted_bytes
+FROM file_copies
+GROUP BY machine_id;
+
+CREATE OR REPLACE VIEW stats_directories AS
+SELECT machine_id, path,
+    COUNT(*)::bigint AS redundant_files,
+    SUM(size)::bigint AS wasted_bytes
+FROM file_copies
+WHERE copy_rank > 1
+GROUP BY machine_id, path;
+
+-- Buckets are [min_size, max_size); the last bucket has no upper bound
+CREATE OR REPLACE VIEW stats_size_buckets AS
+WITH buckets (bucket, min_size, max_size) AS (
+    VALUES (0, 0::bigint, 1024::bigint),
+           (1, 1024, 1048576),
+           (2, 1048576, 10485760),
+           (3, 10485760, 104857600),
+           (4, 104857600, 1073741824),
+           (5, 1073741824, NULL)
+), counted AS (
+    SELECT CASE
+            WHEN size < 1024 THEN 0
+            WHEN size < 1048576 THEN 1
+            WHEN size < 10485760 THEN 2
+            WHEN size < 104857600 THEN 3
+            WHEN size < 1073741824 THEN 4
+            ELSE 5
+        END AS bucket,
+        COUNT(*) AS files,
+        SUM(size) AS bytes,
+        COUNT(*) FILTER (WHERE copies > 1 AND copy_rank = 1) AS duplicate_sets,
+        COUNT(*) FILTER (WHERE copies > 1) AS duplicate_files,
+        SUM(size) FILTER (WHERE copy_rank > 1) AS wasted_bytes
+    FROM file_copies
+    GROUP BY 1
+)
+SELECT b.bucket, b.min_size, b.max_size,
+    COALESCE(c.files, 0)::bigint AS files,
+    COALESCE(c.bytes, 0)::bigint AS bytes,
+    COALESCE(c.duplicate_sets, 0)::bigint AS duplicate_sets,
+    COALESCE(c.duplicate_files, 0)::bigint AS duplicate_files,
+    COALESCE(c.wasted_bytes, 0)::bigint AS wasted_bytes
+FROM buckets b
+LEFT JOIN counted c ON c.bucket = b.bucket;
+
+-- extension is the lower-cased text after the last dot, or '' if there is none
+CREATE OR REPLACE VIEW stats_extensions AS
+SELECT lower(COALESCE(substring(filename FROM '\.([^.]+)$'), '')) AS extension,
+    COUNT(*)::bigint AS files,
+    COALESCE(SUM(size), 0)::bigint AS bytes,
+    COUNT(*) FILTER (WHERE copies > 1)::bigint AS duplicate_files,
+    COALESCE(SUM(size) FILTER (WHERE copy_rank > 1), 0)::bigint AS wasted_bytes
+FROM file_copies
+GROUP BY 1;
+
+-- Materialized copies of the views for large databases. They are created
+-- empty and filled by the server when stats.materialized is enabled; the
+-- unique indexes allow them to be refreshed concurrently.
+CREATE MATERIALIZED VIEW IF NOT EXISTS mv_stats_machines AS
+SELECT * FROM stats_machines WITH NO DATA;
+CREATE UNIQUE INDEX IF NOT EXISTS mv_stats_machines_key ON mv_stats_machines (machine_id);
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS mv_stats_directories AS
+SELECT * FROM stats_directories WITH NO DATA;
+CREATE UNIQUE INDEX IF NOT EXISTS mv_stats_directories_key ON mv_stats_directories (machine_id, path);
+CREATE INDEX IF NOT EXISTS mv_stats_directories_wasted_idx ON mv_stats_directories (wasted_bytes DESC);
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS mv_stats_size_buckets AS
+SELECT * FROM stats_size_buckets WITH NO DATA;
+CREATE UNIQUE INDEX IF NOT EXISTS mv_stats_size_buckets_key ON mv_stats_size_buckets (bucket);
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS mv_stats_extensions AS
+SELECT * FROM stats_extensions WITH NO DATA;
+CREATE UNIQUE INDEX IF NOT EXISTS mv_stats_extensions_key ON mv_stats_extensions (extension);
+
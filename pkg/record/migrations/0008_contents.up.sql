@@ -0,0 +1,193 @@
+-- Splits files into contents, one row per distinct hash, and file_instances,
+-- one row per copy. Hashes are stored as bytes; the API keeps using hex.
+-- Hashes that are not 64 hex digits are kept as their text under the
+-- 'legacy' algorithm.
+CREATE OR REPLACE FUNCTION content_algorithm(hash text) RETURNS text
+    LANGUAGE sql IMMUTABLE STRICT PARALLEL SAFE
+    AS $$ SELECT CASE WHEN hash ~ '^[0-9a-fA-F]{64}$' THEN 'sha256' ELSE 'legacy' END $$;
+
+CREATE OR REPLACE FUNCTION content_hash_bytes(hash text) RETURNS bytea
+    LANGUAGE sql IMMUTABLE STRICT PARALLEL SAFE
+    AS $$ SELECT CASE WHEN hash ~ '^[0-9a-fA-F]{64}$' THEN decode(hash, 'hex') ELSE convert_to(hash, 'UTF8') END $$;
+
+CREATE OR REPLACE FUNCTION content_hash_text(algorithm text, hash bytea) RETURNS text
+    LANGUAGE sql IMMUTABLE STRICT PARALLEL SAFE
+    AS $$ SELECT CASE WHEN algorithm = 'sha256' THEN encode(hash, 'hex') ELSE convert_from(hash, 'UTF8') END $$;
+
+-- The statistics views read the columns that move to contents; they are
+-- recreated below
+DROP MATERIALIZED VIEW IF EXISTS mv_stats_extensions;
+DROP MATERIALIZED VIEW IF EXISTS mv_stats_size_buckets;
+DROP MATERIALIZED VIEW IF EXISTS mv_stats_directories;
+DROP MATERIALIZED VIEW IF EXISTS mv_stats_machines;
+DROP VIEW IF EXISTS stats_extensions;
+DROP VIEW IF EXISTS stats_size_buckets;
+DROP VIEW IF EXISTS stats_directories;
+DROP VIEW IF EXISTS stats_machines;
+DROP VIEW IF EXISTS file_copies;
+
+-- instance_count is the number of active instances, maintained by a trigger
+CREATE TABLE contents (
+    id BIGSERIAL PRIMARY KEY,
+    algorithm TEXT NOT NULL DEFAULT 'sha256',
+    hash BYTEA NOT NULL,
+    size BIGINT NOT NULL,
+    instance_count BIGINT NOT NULL DEFAULT 0,
+    UNIQUE (algorithm, hash)
+);
+
+INSERT INTO contents (algorithm, hash, size, instance_count)
+SELECT content_algorithm(hash), content_hash_bytes(hash), MAX(size),
+    COUNT(*) FILTER (WHERE quarantine_state = 'active')
+FROM files
+GROUP BY 1, 2;
+
+CREATE INDEX contents_duplicates_idx ON contents (instance_count) WHERE instance_count > 1;
+
+ALTER TABLE files RENAME TO file_instances;
+ALTER TABLE file_instances RENAME CONSTRAINT files_pkey TO file_instances_pkey;
+ALTER TABLE file_instances RENAME CONSTRAINT files_machine_id_path_filename_key TO file_instances_machine_id_path_filename_key;
+ALTER TABLE file_instances ADD COLUMN content_id BIGINT;
+UPDATE file_instances f SET content_id = c.id
+FROM contents c
+WHERE c.algorithm = content_algorithm(f.hash) AND c.hash = content_hash_bytes(f.hash);
+ALTER TABLE file_instances
+    ALTER COLUMN content_id SET NOT NULL,
+    ADD CONSTRAINT file_instances_content_id_fkey FOREIGN KEY (content_id) REFERENCES contents (id);
+CREATE INDEX file_instances_content_idx ON file_instances (content_id);
+
+-- Keepers are selected per content; keepers whose file was rehashed are dropped
+DELETE FROM keepers k USING file_instances f WHERE f.id = k.file_id AND f.hash <> k.hash;
+ALTER TABLE keepers ADD COLUMN content_id BIGINT;
+UPDATE keepers k SET content_id = f.content_id FROM file_instances f WHERE f.id = k.file_id;
+ALTER TABLE keepers DROP CONSTRAINT keepers_pkey;
+ALTER TABLE keepers DROP COLUMN hash;
+ALTER TABLE keepers
+    ALTER COLUMN content_id SET NOT NULL,
+    ADD CONSTRAINT keepers_pkey PRIMARY KEY (content_id),
+    ADD CONSTRAINT keepers_content_id_fkey FOREIGN KEY (content_id) REFERENCES contents (id) ON DELETE CASCADE;
+
+ALTER TABLE file_instances DROP COLUMN hash;
+ALTER TABLE file_instances DROP COLUMN size;
+
+-- Keeps contents.instance_count in step with the active instances and drops
+-- the keeper selection of a file whose content changed
+CREATE OR REPLACE FUNCTION file_instances_count() RETURNS trigger
+    LANGUAGE plpgsql AS $$
+BEGIN
+    IF TG_OP = 'UPDATE' AND OLD.content_id = NEW.content_id
+        AND (OLD.quarantine_state = 'active') = (NEW.quarantine_state = 'active') THEN
+        RETURN NULL;
+    END IF;
+    IF TG_OP IN ('UPDATE', 'DELETE') AND OLD.quarantine_state = 'active' THEN
+        UPDATE contents SET instance_count = instance_count - 1 WHERE id = OLD.content_id;
+    END IF;
+    IF TG_OP IN ('INSERT', 'UPDATE') AND NEW.quarantine_state = 'active' THEN
+        UPDATE contents SET instance_count = instance_count + 1 WHERE id = NEW.content_id;
+    END IF;
+    IF TG_OP = 'UPDATE' AND OLD.content_id <> NEW.content_id THEN
+        DELETE FROM keepers WHERE file_id = NEW.id AND content_id = OLD.content_id;
+    END IF;
+    RETURN NULL;
+END
+$$;
+
+CREATE TRIGGER file_instances_count
+    AFTER INSERT OR UPDATE OF content_id, quarantine_state OR DELETE ON file_instances
+    FOR EACH ROW EXECUTE FUNCTION file_instances_count();
+
+-- file_copies ranks the active instances of every content. The keeper, or
+-- else the first copy by machine and path, has copy_rank 1; every other copy
+-- of a duplicate set is redundant.
+CREATE OR REPLACE VIEW file_copies AS
+SELECT f.machine_id, f.path, f.filename, c.size, f.content_id,
+    c.instance_count AS copies,
+    row_number() OVER (
+        PARTITION BY f.content_id
+        ORDER BY (k.file_id IS NOT NULL) DESC, f.machine_id, f.path, f.filename
+    ) AS copy_rank
+FROM file_instances f
+JOIN contents c ON c.id = f.content_id
+LEFT JOIN keepers k ON k.file_id = f.id AND k.content_id = f.content_id
+WHERE f.quarantine_state = 'active';
+
+CREATE OR REPLACE VIEW stats_machines AS
+SELECT machine_id,
+    COUNT(*)::bigint AS files,
+    COALESCE(SUM(size), 0)::bigint AS bytes,
+    COUNT(*) FILTER (WHERE copies > 1)::bigint AS duplicate_files,
+    COALESCE(SUM(size) FILTER (WHERE copies > 1), 0)::bigint AS duplicate_bytes,
+    COALESCE(SUM(size) FILTER (WHERE copy_rank > 1), 0)::bigint AS wasted_bytes
+FROM file_copies
+GROUP BY machine_id;
+
+CREATE OR REPLACE VIEW stats_directories AS
+SELECT machine_id, path,
+    COUNT(*)::bigint AS redundant_files,
+    SUM(size)::bigint AS wasted_bytes
+FROM file_copies
+WHERE copy_rank > 1
+GROUP BY machine_id, path;
+
+-- Buckets are [min_size, max_size); the last bucket has no upper bound
+CREATE OR REPLACE VIEW stats_size_buckets AS
+WITH buckets (bucket, min_size, max_size) AS (
+    VALUES (0, 0::bigint, 1024::bigint),
+           (1, 1024, 1048576),
+           (2, 1048576, 10485760),
+           (3, 10485760, 104857600),
+           (4, 104857600, 1073741824),
+           (5, 1073741824, NULL)
+), counted AS (
+    SELECT CASE
+            WHEN size < 1024 THEN 0
+            WHEN size < 1048576 THEN 1
+            WHEN size < 10485760 THEN 2
+            WHEN size < 104857600 THEN 3
+            WHEN size < 1073741824 THEN 4
+            ELSE 5
+        END AS bucket,
+        COUNT(*) AS files,
+        SUM(size) AS bytes,
+        COUNT(*) FILTER (WHERE copies > 1 AND copy_rank = 1) AS duplicate_sets,
+        COUNT(*) FILTER (WHERE copies > 1) AS duplicate_files,
+        SUM(size) FILTER (WHERE copy_rank > 1) AS wasted_bytes
+    FROM file_copies
+    GROUP BY 1
+)
+SELECT b.bucket, b.min_size, b.max_size,
+    COALESCE(c.files, 0)::bigint AS files,
+    COALESCE(c.bytes, 0)::bigint AS bytes,
+    COALESCE(c.duplicate_sets, 0)::bigint AS duplicate_sets,
+    COALESCE(c.duplicate_files, 0)::bigint AS duplicate_files,
+    COALESCE(c.wasted_bytes, 0)::bigint AS wasted_bytes
+FROM buckets b
+LEFT JOIN counted c ON c.bucket = b.bucket;
+
+-- extension is the lower-cased text after the last dot, or '' if there is none
+CREATE OR REPLACE VIEW stats_extensions AS
+SELECT lower(COALESCE(substring(filename FROM '\.([^.]+)$'), '')) AS extension,
+    COUNT(*)::bigint AS files,
+    COALESCE(SUM(size), 0)::bigint AS bytes,
+    COUNT(*) FILTER (WHERE copies > 1)::bigint AS duplicate_files,
+    COALESCE(SUM(size) FILTER (WHERE copy_rank > 1), 0)::bigint AS wasted_bytes
+FROM file_copies
+GROUP BY 1;
+
+-- Materialized copies, as created by 0007_stats
+CREATE MATERIALIZED VIEW mv_stats_machines AS
+SELECT * FROM stats_machines WITH NO DATA;
+CREATE UNIQUE INDEX mv_stats_machines_key ON mv_stats_machines (machine_id);
+
+CREATE MATERIALIZED VIEW mv_stats_directories AS
+SELECT * FROM stats_directories WITH NO DATA;
+CREATE UNIQUE INDEX mv_stats_directories_key ON mv_stats_directories (machine_id, path);
+CREATE INDEX mv_stats_directories_wasted_idx ON mv_stats_directories (wasted_bytes DESC);
+
+CREATE MATERIALIZED VIEW mv_stats_size_buckets AS
+SELECT * FROM stats_size_buckets WITH NO DATA;
+CREATE UNIQUE INDEX mv_stats_size_buckets_key ON mv_stats_size_buckets (bucket);
+
+CREATE MATERIALIZED VIEW mv_stats_extensions AS
+SELECT * FROM stats_extensions WITH NO DATA;
+CREATE UNIQUE INDEX mv_stats_extensions_key ON mv_stats_extensions (extension);
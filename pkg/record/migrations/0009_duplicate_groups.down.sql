@@ -0,0 +1,3 @@
+DROP TRIGGER IF EXISTS contents_duplicate_group ON contents;
+DROP FUNCTION IF EXISTS contents_duplicate_group();
+DROP TABLE IF EXISTS duplicate_groups;
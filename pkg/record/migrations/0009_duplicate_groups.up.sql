@@ -0,0 +1,43 @@
+-- A duplicate group is a content with more than one active instance. Groups
+-- keep their ID when they shrink below two copies, so clients that sync by
+-- changed_at also see groups that were resolved; copies is then 0 or 1.
+CREATE TABLE IF NOT EXISTS duplicate_groups (
+    id BIGSERIAL PRIMARY KEY,
+    content_id BIGINT NOT NULL UNIQUE REFERENCES contents (id) ON DELETE CASCADE,
+    copies BIGINT NOT NULL,
+    first_seen_at TIMESTAMP NOT NULL DEFAULT now(),
+    changed_at TIMESTAMP NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS duplicate_groups_active_idx ON duplicate_groups (id) WHERE copies > 1;
+CREATE INDEX IF NOT EXISTS duplicate_groups_changed_idx ON duplicate_groups (changed_at, id);
+
+INSERT INTO duplicate_groups (content_id, copies)
+SELECT id, instance_count FROM contents
+WHERE instance_count > 1
+ORDER BY id
+ON CONFLICT (content_id) DO NOTHING;
+
+-- Every change of a content's instance count touches its group; a group is
+-- created when the content gets its second copy
+CREATE OR REPLACE FUNCTION contents_duplicate_group() RETURNS trigger
+    LANGUAGE plpgsql AS $$
+BEGIN
+    IF NEW.instance_count > 1 THEN
+        INSERT INTO duplicate_groups (content_id, copies)
+        VALUES (NEW.id, NEW.instance_count)
+        ON CONFLICT (content_id)
+        DO UPDATE SET copies = EXCLUDED.copies, changed_at = now();
+    ELSE
+        UPDATE duplicate_groups SET copies = NEW.instance_count, changed_at = now()
+        WHERE content_id = NEW.id;
+    END IF;
+    RETURN NULL;
+END
+$$;
+
+CREATE TRIGGER contents_duplicate_group
+    AFTER UPDATE OF instance_count ON contents
+    FOR EACH ROW
+    WHEN (OLD.instance_count <> NEW.instance_count)
+    EXECUTE FUNCTION contents_duplicate_group();
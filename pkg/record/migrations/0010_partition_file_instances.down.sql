@@ -0,0 +1,75 @@
+ALTER TABLE file_instances RENAME TO file_instances_partitioned;
+ALTER TABLE file_instances_partitioned RENAME CONSTRAINT file_instances_pkey TO file_instances_partitioned_pkey;
+ALTER TABLE file_instances_partitioned RENAME CONSTRAINT file_instances_machine_id_path_filename_key TO file_instances_partitioned_machine_id_path_filename_key;
+ALTER TABLE file_instances_partitioned RENAME CONSTRAINT file_instances_content_id_fkey TO file_instances_partitioned_content_id_fkey;
+ALTER INDEX file_instances_content_idx RENAME TO file_instances_partitioned_content_idx;
+DROP INDEX IF EXISTS file_instances_session_idx;
+DROP INDEX IF EXISTS file_instances_machine_seen_idx;
+
+CREATE TABLE file_instances (
+    id UUID NOT NULL DEFAULT gen_random_uuid(),
+    machine_id TEXT NOT NULL,
+    path TEXT NOT NULL,
+    filename TEXT NOT NULL,
+    mtime TIMESTAMP NOT NULL,
+    created_at TIMESTAMP DEFAULT now(),
+    quarantine_state TEXT NOT NULL DEFAULT 'active',
+    quarantine_path TEXT,
+    quarantined_at TIMESTAMP,
+    session_id UUID,
+    last_seen_at TIMESTAMP,
+    content_id BIGINT NOT NULL,
+    CONSTRAINT file_instances_pkey PRIMARY KEY (id),
+    CONSTRAINT file_instances_machine_id_path_filename_key UNIQUE (machine_id, path, filename),
+    CONSTRAINT file_instances_content_id_fkey FOREIGN KEY (content_id) REFERENCES contents (id)
+);
+CREATE INDEX file_instances_content_idx ON file_instances (content_id);
+
+INSERT INTO file_instances (id, machine_id, path, filename, mtime, created_at, quarantine_state,
+    quarantine_path, quarantined_at, session_id, last_seen_at, content_id)
+SELECT id, machine_id, path, filename, mtime, created_at, quarantine_state,
+    quarantine_path, quarantined_at, session_id, last_seen_at, content_id
+FROM file_instances_partitioned;
+
+CREATE OR REPLACE FUNCTION file_instances_count() RETURNS trigger
+    LANGUAGE plpgsql AS $$
+BEGIN
+    IF TG_OP = 'UPDATE' AND OLD.content_id = NEW.content_id
+        AND (OLD.quarantine_state = 'active') = (NEW.quarantine_state = 'active') THEN
+        RETURN NULL;
+    END IF;
+    IF TG_OP IN ('UPDATE', 'DELETE') AND OLD.quarantine_state = 'active' THEN
+        UPDATE contents SET instance_count = instance_count - 1 WHERE id = OLD.content_id;
+    END IF;
+    IF TG_OP IN ('INSERT', 'UPDATE') AND NEW.quarantine_state = 'active' THEN
+        UPDATE contents SET instance_count = instance_count + 1 WHERE id = NEW.content_id;
+    END IF;
+    IF TG_OP = 'UPDATE' AND OLD.content_id <> NEW.content_id THEN
+        DELETE FROM keepers WHERE file_id = NEW.id AND content_id = OLD.content_id;
+    END IF;
+    RETURN NULL;
+END
+$$;
+
+CREATE TRIGGER file_instances_count
+    AFTER INSERT OR UPDATE OF content_id, quarantine_state OR DELETE ON file_instances
+    FOR EACH ROW EXECUTE FUNCTION file_instances_count();
+
+CREATE OR REPLACE VIEW file_copies AS
+SELECT f.machine_id, f.path, f.filename, c.size, f.content_id,
+    c.instance_count AS copies,
+    row_number() OVER (
+        PARTITION BY f.content_id
+        ORDER BY (k.file_id IS NOT NULL) DESC, f.machine_id, f.path, f.filename
+    ) AS copy_rank
+FROM file_instances f
+JOIN contents c ON c.id = f.content_id
+LEFT JOIN keepers k ON k.file_id = f.id AND k.content_id = f.content_id
+WHERE f.quarantine_state = 'active';
+
+DROP TABLE file_instances_partitioned;
+
+DELETE FROM keepers k WHERE NOT EXISTS (SELECT 1 FROM file_instances f WHERE f.id = k.file_id);
+DROP INDEX IF EXISTS keepers_file_idx;
+ALTER TABLE keepers
+    ADD CONSTRAINT keepers_file_id_fkey FOREIGN KEY (file_id) REFERENCES file_instances (id) ON DELETE CASCADE;
@@ -0,0 +1,18 @@
+-- An integrity event records a file whose hash changed between two scans
+-- while its size and modification time stayed the same, which points to
+-- silent corruption rather than an edit
+CREATE TABLE IF NOT EXISTS integrity_events (
+    id BIGSERIAL PRIMARY KEY,
+    machine_id TEXT NOT NULL,
+    path TEXT NOT NULL,
+    filename TEXT NOT NULL,
+    size BIGINT NOT NULL,
+    mtime TIMESTAMP NOT NULL,
+    expected_hash TEXT NOT NULL,
+    actual_hash TEXT NOT NULL,
+    session_id UUID,
+    detected_at TIMESTAMP NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS integrity_events_detected_idx ON integrity_events (detected_at, id);
+CREATE INDEX IF NOT EXISTS integrity_events_machine_idx ON integrity_events (machine_id, detected_at);
@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS anomaly_alerts;
+
+DROP INDEX IF EXISTS scan_sessions_finished_idx;
+ALTER TABLE scan_sessions DROP COLUMN IF EXISTS files_renamed;
+ALTER TABLE scan_sessions DROP COLUMN IF EXISTS files_changed;
+ALTER TABLE scan_sessions DROP COLUMN IF EXISTS files_added;
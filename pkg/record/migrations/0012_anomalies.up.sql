@@ -0,0 +1,30 @@
+-- Scan sessions count the files they added, changed and renamed so that
+-- mass changes can be compared with the earlier sessions of the machine
+ALTER TABLE scan_sessions ADD COLUMN IF NOT EXISTS files_added BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE scan_sessions ADD COLUMN IF NOT EXISTS files_changed BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE scan_sessions ADD COLUMN IF NOT EXISTS files_renamed BIGINT NOT NULL DEFAULT 0;
+
+CREATE INDEX IF NOT EXISTS scan_sessions_finished_idx ON scan_sessions (machine_id, finished_at DESC)
+    WHERE status = 'completed';
+
+-- An anomaly alert records a scan session that changed, deleted or renamed a
+-- larger share of the machine's files than its thresholds and baseline allow.
+-- Ratios are relative to the files the machine had under the session roots.
+CREATE TABLE IF NOT EXISTS anomaly_alerts (
+    id BIGSERIAL PRIMARY KEY,
+    machine_id TEXT NOT NULL,
+    session_id UUID NOT NULL UNIQUE REFERENCES scan_sessions (id) ON DELETE CASCADE,
+    files_before BIGINT NOT NULL,
+    changed_ratio DOUBLE PRECISION NOT NULL,
+    deleted_ratio DOUBLE PRECISION NOT NULL,
+    renamed_ratio DOUBLE PRECISION NOT NULL,
+    baseline_changed_ratio DOUBLE PRECISION NOT NULL,
+    baseline_deleted_ratio DOUBLE PRECISION NOT NULL,
+    baseline_renamed_ratio DOUBLE PRECISION NOT NULL,
+    -- reasons lists the exceeded ratios: changed, deleted and/or renamed
+    reasons TEXT[] NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS anomaly_alerts_created_idx ON anomaly_alerts (created_at, id);
+CREATE INDEX IF NOT EXISTS anomaly_alerts_machine_idx ON anomaly_alerts (machine_id, created_at);
@@ -0,0 +1 @@
+ALTER TABLE file_instances DROP COLUMN IF EXISTS volume;
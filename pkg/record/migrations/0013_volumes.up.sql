@@ -0,0 +1,4 @@
+-- The volume a file is stored on, as reported by the agent: the mount point on
+-- Unix, the drive or share on Windows. Files of agents that do not report it
+-- share the empty volume of their machine.
+ALTER TABLE file_instances ADD COLUMN IF NOT EXISTS volume TEXT NOT NULL DEFAULT '';
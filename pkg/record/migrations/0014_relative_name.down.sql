@@ -0,0 +1 @@
+DROP FUNCTION IF EXISTS relative_name(text, text, text);
@@ -0,0 +1,12 @@
+-- relative_name returns the name of a file relative to a root directory with
+-- forward slashes, so that files under different roots and on different
+-- operating systems can be compared by location. An empty root keeps the
+-- full path.
+CREATE OR REPLACE FUNCTION relative_name(path text, filename text, root text) RETURNS text
+    LANGUAGE sql IMMUTABLE STRICT PARALLEL SAFE
+    AS $$ SELECT replace(ltrim(
+        CASE
+            WHEN root = '' THEN path
+            WHEN path = root OR path = rtrim(root, '/\') THEN ''
+            ELSE substr(path, length(rtrim(root, '/\')) + 2)
+        END || '/' || filename, '/\'), '\', '/') $$;
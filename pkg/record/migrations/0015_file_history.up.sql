@@ -0,0 +1,27 @@
+-- file_history records how files changed between scans: a file moved to
+-- another path or name with the same content, changed its content or size, or
+-- was deleted. path and filename are the location after the event; moves keep
+-- the location before in previous_path and previous_filename, changes the
+-- content before in previous_hash and previous_size.
+CREATE TABLE IF NOT EXISTS file_history (
+    id BIGSERIAL PRIMARY KEY,
+    machine_id TEXT NOT NULL,
+    path TEXT NOT NULL,
+    filename TEXT NOT NULL,
+    -- event is moved, changed or deleted
+    event TEXT NOT NULL,
+    hash TEXT NOT NULL,
+    size BIGINT NOT NULL,
+    mtime TIMESTAMP NOT NULL,
+    previous_path TEXT,
+    previous_filename TEXT,
+    previous_hash TEXT,
+    previous_size BIGINT,
+    session_id UUID,
+    recorded_at TIMESTAMP NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS file_history_location_idx ON file_history (machine_id, path, filename, recorded_at);
+CREATE INDEX IF NOT EXISTS file_history_previous_idx ON file_history (machine_id, previous_path, previous_filename)
+    WHERE previous_path IS NOT NULL;
+CREATE INDEX IF NOT EXISTS file_history_session_idx ON file_history (session_id);
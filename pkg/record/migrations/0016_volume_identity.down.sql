@@ -0,0 +1,54 @@
+CREATE OR REPLACE VIEW file_copies AS
+SELECT f.machine_id, f.path, f.filename, c.size, f.content_id,
+    c.instance_count AS copies,
+    row_number() OVER (
+        PARTITION BY f.content_id
+        ORDER BY (k.file_id IS NOT NULL) DESC, f.machine_id, f.path, f.filename
+    ) AS copy_rank
+FROM file_instances f
+JOIN contents c ON c.id = f.content_id
+LEFT JOIN keepers k ON k.file_id = f.id AND k.content_id = f.content_id
+WHERE f.quarantine_state = 'active';
+
+CREATE OR REPLACE FUNCTION file_instances_count() RETURNS trigger
+    LANGUAGE plpgsql AS $$
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        DELETE FROM keepers WHERE file_id = OLD.id;
+    END IF;
+    IF TG_OP = 'UPDATE' AND OLD.content_id = NEW.content_id
+        AND (OLD.quarantine_state = 'active') = (NEW.quarantine_state = 'active') THEN
+        RETURN NULL;
+    END IF;
+    IF TG_OP IN ('UPDATE', 'DELETE') AND OLD.quarantine_state = 'active' THEN
+        UPDATE contents SET instance_count = instance_count - 1 WHERE id = OLD.content_id;
+    END IF;
+    IF TG_OP IN ('INSERT', 'UPDATE') AND NEW.quarantine_state = 'active' THEN
+        UPDATE contents SET instance_count = instance_count + 1 WHERE id = NEW.content_id;
+    END IF;
+    IF TG_OP = 'UPDATE' AND OLD.content_id <> NEW.content_id THEN
+        DELETE FROM keepers WHERE file_id = NEW.id AND content_id = OLD.content_id;
+    END IF;
+    RETURN NULL;
+END
+$$;
+
+DROP TRIGGER IF EXISTS file_instances_count ON file_instances;
+CREATE TRIGGER file_instances_count
+    AFTER INSERT OR UPDATE OF content_id, quarantine_state OR DELETE ON file_instances
+    FOR EACH ROW EXECUTE FUNCTION file_instances_count();
+
+-- Aliases count again once the column is gone
+UPDATE contents c SET instance_count = n.active
+FROM (
+    SELECT content_id, COUNT(*) AS active FROM file_instances
+    WHERE quarantine_state = 'active'
+    GROUP BY content_id
+) n
+WHERE n.content_id = c.id AND c.instance_count <> n.active;
+
+ALTER TABLE scan_sessions DROP COLUMN IF EXISTS root_volumes;
+DROP INDEX IF EXISTS file_instances_inode_idx;
+ALTER TABLE file_instances DROP COLUMN IF EXISTS alias;
+ALTER TABLE file_instances DROP COLUMN IF EXISTS inode;
+ALTER TABLE file_instances DROP COLUMN IF EXISTS volume_id;
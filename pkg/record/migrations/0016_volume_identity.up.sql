@@ -0,0 +1,75 @@
+-- volume_id identifies the filesystem a file is stored on across machines: the
+-- NFS export, SMB share or filesystem UUID, or a device of one machine when
+-- none is known. With the inode it identifies the physical file, so machines
+-- that mount the same share report the same file. Agents that do not report
+-- them leave volume_id empty and inode 0.
+ALTER TABLE file_instances ADD COLUMN IF NOT EXISTS volume_id TEXT NOT NULL DEFAULT '';
+ALTER TABLE file_instances ADD COLUMN IF NOT EXISTS inode BIGINT NOT NULL DEFAULT 0;
+-- An alias is another view of a physical file that an active instance already
+-- counts, such as the same share seen from a second machine or a hard link.
+-- Aliases are kept so that scans and comparisons see them, but are no copies.
+ALTER TABLE file_instances ADD COLUMN IF NOT EXISTS alias BOOLEAN NOT NULL DEFAULT false;
+
+CREATE INDEX IF NOT EXISTS file_instances_inode_idx ON file_instances (volume_id, inode)
+    WHERE volume_id <> '' AND inode <> 0;
+
+-- The volume of each session root, in the order of roots
+ALTER TABLE scan_sessions ADD COLUMN IF NOT EXISTS root_volumes TEXT[] NOT NULL DEFAULT '{}';
+
+-- Only active instances that are not aliases count. When the counted instance
+-- of a physical file goes away, one of its aliases takes over. The repeated
+-- volume_id and inode conditions let the planner use the partial index.
+CREATE OR REPLACE FUNCTION file_instances_count() RETURNS trigger
+    LANGUAGE plpgsql AS $$
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        DELETE FROM keepers WHERE file_id = OLD.id;
+    END IF;
+    IF TG_OP = 'UPDATE' AND OLD.content_id = NEW.content_id
+        AND (OLD.quarantine_state = 'active' AND NOT OLD.alias) = (NEW.quarantine_state = 'active' AND NOT NEW.alias)
+        AND OLD.volume_id = NEW.volume_id AND OLD.inode = NEW.inode THEN
+        RETURN NULL;
+    END IF;
+    IF TG_OP IN ('UPDATE', 'DELETE') AND OLD.quarantine_state = 'active' AND NOT OLD.alias THEN
+        UPDATE contents SET instance_count = instance_count - 1 WHERE id = OLD.content_id;
+        IF OLD.volume_id <> '' AND OLD.inode <> 0 AND NOT EXISTS (
+            SELECT 1 FROM file_instances p
+            WHERE p.volume_id <> '' AND p.inode <> 0
+              AND p.volume_id = OLD.volume_id AND p.inode = OLD.inode AND p.content_id = OLD.content_id
+              AND p.quarantine_state = 'active' AND NOT p.alias AND p.id <> OLD.id) THEN
+            UPDATE file_instances SET alias = false
+            WHERE id = (
+                SELECT a.id FROM file_instances a
+                WHERE a.volume_id <> '' AND a.inode <> 0
+                  AND a.volume_id = OLD.volume_id AND a.inode = OLD.inode AND a.content_id = OLD.content_id
+                  AND a.quarantine_state = 'active' AND a.alias AND a.id <> OLD.id
+                ORDER BY a.machine_id, a.path, a.filename
+                LIMIT 1);
+        END IF;
+    END IF;
+    IF TG_OP IN ('INSERT', 'UPDATE') AND NEW.quarantine_state = 'active' AND NOT NEW.alias THEN
+        UPDATE contents SET instance_count = instance_count + 1 WHERE id = NEW.content_id;
+    END IF;
+    IF TG_OP = 'UPDATE' AND OLD.content_id <> NEW.content_id THEN
+        DELETE FROM keepers WHERE file_id = NEW.id AND content_id = OLD.content_id;
+    END IF;
+    RETURN NULL;
+END
+$$;
+
+DROP TRIGGER IF EXISTS file_instances_count ON file_instances;
+CREATE TRIGGER file_instances_count
+    AFTER INSERT OR UPDATE OF content_id, quarantine_state, alias, volume_id, inode OR DELETE ON file_instances
+    FOR EACH ROW EXECUTE FUNCTION file_instances_count();
+
+CREATE OR REPLACE VIEW file_copies AS
+SELECT f.machine_id, f.path, f.filename, c.size, f.content_id,
+    c.instance_count AS copies,
+    row_number() OVER (
+        PARTITION BY f.content_id
+        ORDER BY (k.file_id IS NOT NULL) DESC, f.machine_id, f.path, f.filename
+    ) AS copy_rank
+FROM file_instances f
+JOIN contents c ON c.id = f.content_id
+LEFT JOIN keepers k ON k.file_id = f.id AND k.content_id = f.content_id
+WHERE f.quarantine_state = 'active' AND NOT f.alias;
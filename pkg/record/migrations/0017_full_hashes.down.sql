@@ -0,0 +1,3 @@
+ALTER TABLE integrity_events DROP COLUMN IF EXISTS read_error;
+ALTER TABLE integrity_events DROP COLUMN IF EXISTS algorithm;
+ALTER TABLE file_instances DROP COLUMN IF EXISTS full_hash;
@@ -0,0 +1,10 @@
+-- Files hashed by sampling are also hashed completely by agents in scrub mode.
+-- The full hash is kept next to the sampled content hash so the next scrub
+-- can compare like with like; it is cleared when the file changes.
+ALTER TABLE file_instances ADD COLUMN IF NOT EXISTS full_hash TEXT NOT NULL DEFAULT '';
+
+-- algorithm tells which hashes an event compares: 'content' for the hash files
+-- are deduplicated by, 'sha256' for the full hash of a scrub. read_error is set
+-- when a scrub could not read the file.
+ALTER TABLE integrity_events ADD COLUMN IF NOT EXISTS algorithm TEXT NOT NULL DEFAULT 'content';
+ALTER TABLE integrity_events ADD COLUMN IF NOT EXISTS read_error TEXT;
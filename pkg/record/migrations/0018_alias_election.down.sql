@@ -0,0 +1,42 @@
+DROP TRIGGER IF EXISTS file_instances_alias ON file_instances;
+DROP FUNCTION IF EXISTS file_instances_alias();
+
+CREATE OR REPLACE FUNCTION file_instances_count() RETURNS trigger
+    LANGUAGE plpgsql AS $$
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        DELETE FROM keepers WHERE file_id = OLD.id;
+    END IF;
+    IF TG_OP = 'UPDATE' AND OLD.content_id = NEW.content_id
+        AND (OLD.quarantine_state = 'active' AND NOT OLD.alias) = (NEW.quarantine_state = 'active' AND NOT NEW.alias)
+        AND OLD.volume_id = NEW.volume_id AND OLD.inode = NEW.inode THEN
+        RETURN NULL;
+    END IF;
+    IF TG_OP IN ('UPDATE', 'DELETE') AND OLD.quarantine_state = 'active' AND NOT OLD.alias THEN
+        UPDATE contents SET instance_count = instance_count - 1 WHERE id = OLD.content_id;
+        IF OLD.volume_id <> '' AND OLD.inode <> 0 AND NOT EXISTS (
+            SELECT 1 FROM file_instances p
+            WHERE p.volume_id <> '' AND p.inode <> 0
+              AND p.volume_id = OLD.volume_id AND p.inode = OLD.inode AND p.content_id = OLD.content_id
+              AND p.quarantine_state = 'active' AND NOT p.alias AND p.id <> OLD.id) THEN
+            UPDATE file_instances SET alias = false
+            WHERE id = (
+                SELECT a.id FROM file_instances a
+                WHERE a.volume_id <> '' AND a.inode <> 0
+                  AND a.volume_id = OLD.volume_id AND a.inode = OLD.inode AND a.content_id = OLD.content_id
+                  AND a.quarantine_state = 'active' AND a.alias AND a.id <> OLD.id
+                ORDER BY a.machine_id, a.path, a.filename
+                LIMIT 1);
+        END IF;
+    END IF;
+    IF TG_OP IN ('INSERT', 'UPDATE') AND NEW.quarantine_state = 'active' AND NOT NEW.alias THEN
+        UPDATE contents SET instance_count = instance_count + 1 WHERE id = NEW.content_id;
+    END IF;
+    IF TG_OP = 'UPDATE' AND OLD.content_id <> NEW.content_id THEN
+        DELETE FROM keepers WHERE file_id = NEW.id AND content_id = OLD.content_id;
+    END IF;
+    RETURN NULL;
+END
+$$;
+
+DROP FUNCTION IF EXISTS file_instances_alias_lock(TEXT, BIGINT);
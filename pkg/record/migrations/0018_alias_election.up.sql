@@ -0,0 +1,89 @@
+-- Aliases are elected under a transaction-level advisory lock on the volume_id
+-- and inode of the physical file, so concurrent uploads of two views of the
+-- same file cannot both count, and the election sees the rows that earlier
+-- lock holders committed.
+CREATE OR REPLACE FUNCTION file_instances_alias_lock(volume_id TEXT, inode BIGINT) RETURNS void
+    LANGUAGE sql AS $$
+SELECT pg_advisory_xact_lock(hashtextextended(volume_id || ':' || inode::text, 0));
+$$;
+
+-- An active instance of a shared file is an alias when another active
+-- instance with the same content already counts.
+CREATE OR REPLACE FUNCTION file_instances_alias() RETURNS trigger
+    LANGUAGE plpgsql AS $$
+BEGIN
+    IF NEW.volume_id = '' OR NEW.inode = 0 OR NEW.quarantine_state <> 'active' THEN
+        NEW.alias := false;
+        RETURN NEW;
+    END IF;
+    PERFORM file_instances_alias_lock(NEW.volume_id, NEW.inode);
+    NEW.alias := EXISTS (
+        SELECT 1 FROM file_instances o
+        WHERE o.volume_id <> '' AND o.inode <> 0
+          AND o.volume_id = NEW.volume_id AND o.inode = NEW.inode AND o.content_id = NEW.content_id
+          AND o.quarantine_state = 'active' AND NOT o.alias AND o.id <> NEW.id);
+    RETURN NEW;
+END
+$$;
+
+DROP TRIGGER IF EXISTS file_instances_alias ON file_instances;
+CREATE TRIGGER file_instances_alias
+    BEFORE INSERT OR UPDATE OF content_id, quarantine_state, volume_id, inode ON file_instances
+    FOR EACH ROW EXECUTE FUNCTION file_instances_alias();
+
+-- When the counted instance of a shared file goes away, one of its aliases is
+-- elected under the same lock.
+CREATE OR REPLACE FUNCTION file_instances_count() RETURNS trigger
+    LANGUAGE plpgsql AS $$
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        DELETE FROM keepers WHERE file_id = OLD.id;
+    END IF;
+    IF TG_OP = 'UPDATE' AND OLD.content_id = NEW.content_id
+        AND (OLD.quarantine_state = 'active' AND NOT OLD.alias) = (NEW.quarantine_state = 'active' AND NOT NEW.alias)
+        AND OLD.volume_id = NEW.volume_id AND OLD.inode = NEW.inode THEN
+        RETURN NULL;
+    END IF;
+    IF TG_OP IN ('UPDATE', 'DELETE') AND OLD.quarantine_state = 'active' AND NOT OLD.alias THEN
+        UPDATE contents SET instance_count = instance_count - 1 WHERE id = OLD.content_id;
+        IF OLD.volume_id <> '' AND OLD.inode <> 0 THEN
+            PERFORM file_instances_alias_lock(OLD.volume_id, OLD.inode);
+            IF NOT EXISTS (
+                SELECT 1 FROM file_instances p
+                WHERE p.volume_id <> '' AND p.inode <> 0
+                  AND p.volume_id = OLD.volume_id AND p.inode = OLD.inode AND p.content_id = OLD.content_id
+                  AND p.quarantine_state = 'active' AND NOT p.alias AND p.id <> OLD.id) THEN
+                UPDATE file_instances SET alias = false
+                WHERE id = (
+                    SELECT a.id FROM file_instances a
+                    WHERE a.volume_id <> '' AND a.inode <> 0
+                      AND a.volume_id = OLD.volume_id AND a.inode = OLD.inode AND a.content_id = OLD.content_id
+                      AND a.quarantine_state = 'active' AND a.alias AND a.id <> OLD.id
+                    ORDER BY a.machine_id, a.path, a.filename
+                    LIMIT 1);
+            END IF;
+        END IF;
+    END IF;
+    IF TG_OP IN ('INSERT', 'UPDATE') AND NEW.quarantine_state = 'active' AND NOT NEW.alias THEN
+        UPDATE contents SET instance_count = instance_count + 1 WHERE id = NEW.content_id;
+    END IF;
+    IF TG_OP = 'UPDATE' AND OLD.content_id <> NEW.content_id THEN
+        DELETE FROM keepers WHERE file_id = NEW.id AND content_id = OLD.content_id;
+    END IF;
+    RETURN NULL;
+END
+$$;
+
+-- Repair files whose aliases drifted before elections were serialized: the
+-- first active instance by alias state and location counts. The count
+-- trigger adjusts the instance counts.
+UPDATE file_instances f
+SET alias = r.alias
+FROM (
+    SELECT id, machine_id, row_number() OVER (
+        PARTITION BY volume_id, inode, content_id
+        ORDER BY alias, machine_id, path, filename) > 1 AS alias
+    FROM file_instances
+    WHERE volume_id <> '' AND inode <> 0 AND quarantine_state = 'active'
+) r
+WHERE f.id = r.id AND f.machine_id = r.machine_id AND f.alias <> r.alias;
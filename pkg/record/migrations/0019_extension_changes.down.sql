@@ -0,0 +1,4 @@
+ALTER TABLE anomaly_alerts DROP COLUMN IF EXISTS baseline_extension_ratio;
+ALTER TABLE anomaly_alerts DROP COLUMN IF EXISTS extension_ratio;
+ALTER TABLE scan_sessions DROP COLUMN IF EXISTS files_extension_changed;
+DROP FUNCTION IF EXISTS file_extension(text);
@@ -0,0 +1,11 @@
+-- Scan sessions count the moves that changed a file's extension, as
+-- ransomware does when it renames the files it encrypts, and anomaly alerts
+-- compare that share with the machine's baseline.
+CREATE OR REPLACE FUNCTION file_extension(filename text) RETURNS text
+    LANGUAGE sql IMMUTABLE STRICT PARALLEL SAFE
+    AS $$ SELECT lower(COALESCE(substring(filename FROM '\.([^.]+)$'), '')) $$;
+
+ALTER TABLE scan_sessions ADD COLUMN IF NOT EXISTS files_extension_changed BIGINT NOT NULL DEFAULT 0;
+
+ALTER TABLE anomaly_alerts ADD COLUMN IF NOT EXISTS extension_ratio DOUBLE PRECISION NOT NULL DEFAULT 0;
+ALTER TABLE anomaly_alerts ADD COLUMN IF NOT EXISTS baseline_extension_ratio DOUBLE PRECISION NOT NULL DEFAULT 0;
@@ -0,0 +1,20 @@
+CREATE OR REPLACE FUNCTION contents_duplicate_group() RETURNS trigger
+    LANGUAGE plpgsql AS $$
+BEGIN
+    IF NEW.instance_count > 1 THEN
+        INSERT INTO duplicate_groups (content_id, copies)
+        VALUES (NEW.id, NEW.instance_count)
+        ON CONFLICT (content_id)
+        DO UPDATE SET copies = EXCLUDED.copies, changed_at = now();
+    ELSE
+        UPDATE duplicate_groups SET copies = NEW.instance_count, changed_at = now()
+        WHERE content_id = NEW.id;
+    END IF;
+    RETURN NULL;
+END
+$$;
+
+DROP INDEX IF EXISTS duplicate_groups_change_idx;
+CREATE INDEX IF NOT EXISTS duplicate_groups_changed_idx ON duplicate_groups (changed_at, id);
+
+ALTER TABLE duplicate_groups DROP COLUMN IF EXISTS change_xid;
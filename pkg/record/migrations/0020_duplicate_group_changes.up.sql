@@ -0,0 +1,27 @@
+-- Duplicate groups are synced by the transaction that last changed them
+-- instead of changed_at. now() is the time a transaction started, so a long
+-- transaction could commit a change behind a client's cursor. change_xid is
+-- the ID of that transaction; ListDuplicateGroups only returns changes of
+-- transactions older than every running one, which no later commit can precede.
+ALTER TABLE duplicate_groups ADD COLUMN IF NOT EXISTS change_xid BIGINT NOT NULL DEFAULT pg_current_xact_id()::text::bigint;
+
+DROP INDEX IF EXISTS duplicate_groups_changed_idx;
+CREATE INDEX IF NOT EXISTS duplicate_groups_change_idx ON duplicate_groups (change_xid, id);
+
+CREATE OR REPLACE FUNCTION contents_duplicate_group() RETURNS trigger
+    LANGUAGE plpgsql AS $$
+BEGIN
+    IF NEW.instance_count > 1 THEN
+        INSERT INTO duplicate_groups (content_id, copies)
+        VALUES (NEW.id, NEW.instance_count)
+        ON CONFLICT (content_id)
+        DO UPDATE SET copies = EXCLUDED.copies, changed_at = now(),
+            change_xid = pg_current_xact_id()::text::bigint;
+    ELSE
+        UPDATE duplicate_groups SET copies = NEW.instance_count, changed_at = now(),
+            change_xid = pg_current_xact_id()::text::bigint
+        WHERE content_id = NEW.id;
+    END IF;
+    RETURN NULL;
+END
+$$;
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS file_instances_active_content_idx;
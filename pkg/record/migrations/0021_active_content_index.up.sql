@@ -0,0 +1,4 @@
+-- ListUnderReplicatedFiles counts the active copies of each content it lists,
+-- leaving out aliases
+CREATE INDEX IF NOT EXISTS file_instances_active_content_idx ON file_instances (content_id)
+    WHERE quarantine_state = 'active' AND NOT alias;
@@ -0,0 +1,10 @@
+// Package migrations embeds the versioned database schema.
+//
+// Files are named <version>_<name>.up.sql and <version>_<name>.down.sql.
+// sqlc reads the up migrations as the schema for recorddb.
+package migrations
+
+import "embed"
+
+//go:embed *.sql
+var FS embed.FS
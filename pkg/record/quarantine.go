@@ -0,0 +1,129 @@
+package record
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/tendant/filededup/pkg/auth"
+	"github.com/tendant/filededup/pkg/record/recorddb"
+)
+
+// Quarantine states tracked per file record
+const (
+	QuarantineStateActive      = "active"
+	QuarantineStateQuarantined = "quarantined"
+	QuarantineStatePurged      = "purged"
+)
+
+// QuarantineUpdate reports a change in the quarantine state of a single file
+type QuarantineUpdate struct {
+	MachineID      string `json:"machine_id"`
+	Path           string `json:"path"`
+	Filename       string `json:"filename"`
+	State          string `json:"state"`
+	QuarantinePath string `json:"quarantine_path,omitempty"`
+}
+
+// MachineDuplicate is a file on one machine whose content also exists elsewhere on that machine
+type MachineDuplicate struct {
+	Hash     string    `json:"hash"`
+	Path     string    `json:"path"`
+	Filename string    `json:"filename"`
+	Size     int64     `json:"size"`
+	MTime    time.Time `json:"mtime"`
+	IsKeeper bool      `json:"is_keeper"`
+}
+
+func validQuarantineState(state string) bool {
+	switch state {
+	case QuarantineStateActive, QuarantineStateQuarantined, QuarantineStatePurged:
+		return true
+	}
+	return false
+}
+
+// UpdateQuarantineHandler handles HTTP requests reporting quarantine, restore and purge actions
+func UpdateQuarantineHandler(q *recorddb.Queries) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var updates []QuarantineUpdate
+		if err := json.NewDecoder(r.Body).Decode(&updates); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+
+		for _, u := range updates {
+			if !validQuarantineState(u.State) {
+				http.Error(w, "Invalid quarantine state: "+u.State, http.StatusBadRequest)
+				return
+			}
+			if !auth.Allowed(r, u.MachineID) {
+				http.Error(w, "Record machine_id does not match token", http.StatusForbidden)
+				return
+			}
+		}
+
+		for _, u := range updates {
+			var qPath pgtype.Text
+			if u.State != QuarantineStateActive && u.QuarantinePath != "" {
+				qPath = pgtype.Text{String: u.QuarantinePath, Valid: true}
+			}
+
+			n, err := q.SetQuarantineState(r.Context(), recorddb.SetQuarantineStateParams{
+				QuarantineState: u.State,
+				QuarantinePath:  qPath,
+				MachineID:       u.MachineID,
+				Path:            u.Path,
+				Filename:        u.Filename,
+			})
+			if err != nil {
+				slog.Error("Error updating quarantine state", "machineID", u.MachineID, "path", u.Path, "filename", u.Filename, "error", err)
+				http.Error(w, "Failed to update quarantine state", http.StatusInternalServerError)
+				return
+			}
+			if n == 0 {
+				slog.Warn("Quarantine update for unknown file", "machineID", u.MachineID, "path", u.Path, "filename", u.Filename)
+			}
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// MachineDuplicatesHandler handles HTTP requests listing duplicate files on a single machine
+func MachineDuplicatesHandler(q *recorddb.Queries) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		machineID := chi.URLParam(r, "machineID")
+		if !auth.Allowed(r, machineID) {
+			http.Error(w, "Machine does not match token", http.StatusForbidden)
+			return
+		}
+
+		rows, err := q.ListMachineDuplicates(r.Context(), machineID)
+		if err != nil {
+			slog.Error("Error querying machine duplicates", "machineID", machineID, "error", err)
+			http.Error(w, "Failed to query duplicates", http.StatusInternalServerError)
+			return
+		}
+
+		result := make([]MachineDuplicate, 0, len(rows))
+		for _, row := range rows {
+			result = append(result, MachineDuplicate{
+				Hash:     row.Hash,
+				Path:     row.Path,
+				Filename: row.Filename,
+				Size:     row.Size,
+				MTime:    row.Mtime.Time,
+				IsKeeper: row.IsKeeper,
+			})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(result); err != nil {
+			slog.Error("Error encoding JSON response", "error", err)
+		}
+	}
+}
@@ -4,12 +4,16 @@ package record
 import (
 	"compress/gzip"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
 	"time"
 
 	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/tendant/filededup/pkg/auth"
+	"github.com/tendant/filededup/pkg/metrics"
 	"github.com/tendant/filededup/pkg/record/recorddb"
 )
 
@@ -20,12 +24,26 @@ type FileRecord struct {
 	Size      int64     `json:"size"`
 	MTime     time.Time `json:"mtime"`
 	Hash      string    `json:"hash"`
+	SessionID string    `json:"session_id,omitempty"` // Scan session the record belongs to, if any
+	Volume    string    `json:"volume,omitempty"`     // Mount point, drive or share the file is stored on
+	VolumeID  string    `json:"volume_id,omitempty"`  // Filesystem the file is stored on, shared by machines mounting it
+	Inode     uint64    `json:"inode,omitempty"`      // Inode on the volume; with VolumeID it identifies the physical file
+	FullHash  string    `json:"full_hash,omitempty"`  // SHA-256 of the whole file, sent by scrubs for files hashed by sampling
+	ReadError string    `json:"read_error,omitempty"` // Why a scrub could not read the whole file
 }
 
-// UploadFilesHandler handles HTTP requests to upload file records
-func UploadFilesHandler(q *recorddb.Queries) http.HandlerFunc {
+// Limits bounds the size of uploads (0 = unlimited)
+type Limits struct {
+	MaxBodyBytes    int64 // Maximum size of the request body after decompression
+	MaxBatchRecords int   // Maximum number of records in one upload
+}
+
+// UploadFilesHandler handles HTTP requests to upload file records. Integrity
+// events are posted through anomalies.
+func UploadFilesHandler(store Store, limits Limits, anomalies *Anomalies) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		var reader io.Reader = r.Body
+		start := time.Now()
+		var reader io.ReadCloser = r.Body
 		if r.Header.Get("Content-Encoding") == "gzip" {
 			gz, err := gzip.NewReader(r.Body)
 			if err != nil {
@@ -35,39 +53,105 @@ func UploadFilesHandler(q *recorddb.Queries) http.HandlerFunc {
 			defer gz.Close()
 			reader = gz
 		}
+		// Limit the decompressed size so small gzip bodies cannot expand without bound
+		if limits.MaxBodyBytes > 0 {
+			reader = http.MaxBytesReader(w, reader, limits.MaxBodyBytes)
+		}
 
 		var files []FileRecord
 		if err := json.NewDecoder(reader).Decode(&files); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
 			http.Error(w, "Invalid JSON", http.StatusBadRequest)
 			return
 		}
+		if limits.MaxBatchRecords > 0 && len(files) > limits.MaxBatchRecords {
+			http.Error(w, "Too many records in batch", http.StatusRequestEntityTooLarge)
+			return
+		}
 
+		// A token may only upload records for the machine it was issued to
+		sessions := make(map[string]pgtype.UUID)
 		for _, f := range files {
+			if !auth.Allowed(r, f.MachineID) {
+				http.Error(w, "Record machine_id does not match token", http.StatusForbidden)
+				return
+			}
+			if _, ok := sessions[f.SessionID]; f.SessionID != "" && !ok {
+				var id pgtype.UUID
+				if err := id.Scan(f.SessionID); err != nil {
+					http.Error(w, "Invalid session_id", http.StatusBadRequest)
+					return
+				}
+				sessions[f.SessionID] = id
+			}
+		}
+
+		records := make([]recorddb.UpsertFileParams, 0, len(files))
+		readErrors := make(map[fileKey]string)
+		for _, f := range files {
+			if f.ReadError != "" {
+				readErrors[fileKey{f.MachineID, f.Path, f.Filename}] = f.ReadError
+			}
 			var pgTime pgtype.Timestamp
-			pgTime.Time = f.MTime
+			// Stored without a zone, so in UTC like the server's own timestamps
+			pgTime.Time = f.MTime.UTC()
 			pgTime.Valid = true
 
-			_ = q.UpsertFile(r.Context(), recorddb.UpsertFileParams{
+			records = append(records, recorddb.UpsertFileParams{
 				MachineID: f.MachineID,
 				Path:      f.Path,
 				Filename:  f.Filename,
 				Size:      f.Size,
 				Mtime:     pgTime,
 				Hash:      f.Hash,
+				SessionID: sessions[f.SessionID],
+				Volume:    f.Volume,
+				VolumeID:  f.VolumeID,
+				Inode:     int64(f.Inode),
+				FullHash:  f.FullHash,
 			})
 		}
 
+		// Compare with the stored records before they are replaced
+		compareStored(r.Context(), store, records, readErrors, anomalies)
+
+		var failed int
+		for _, rec := range records {
+			if err := store.UpsertFile(r.Context(), rec); err != nil {
+				failed++
+				slog.Debug("Failed to store file record", "path", rec.Path, "error", err)
+			}
+		}
+		if failed > 0 {
+			slog.Warn("Some file records could not be stored", "failed", failed, "total", len(files))
+		}
+
+		metrics.RecordsIngested.WithLabelValues("upload").Add(float64(len(files) - failed))
+		metrics.RecordsFailed.WithLabelValues("upload").Add(float64(failed))
+		metrics.BatchSize.Observe(float64(len(files)))
+		metrics.BatchDuration.Observe(time.Since(start).Seconds())
+
+		// The agent must not complete its session with delete_missing, or the
+		// files that were not stored would be removed as unseen
+		if failed > 0 {
+			http.Error(w, fmt.Sprintf("Failed to store %d of %d records", failed, len(files)), http.StatusInternalServerError)
+			return
+		}
 		w.WriteHeader(http.StatusNoContent)
 	}
 }
 
 // FindDuplicatesHandler handles HTTP requests to find duplicate files
-func FindDuplicatesHandler(q *recorddb.Queries) http.HandlerFunc {
+func FindDuplicatesHandler(store Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		slog.Info("Handling request for duplicates")
 		
 		// First, check if we have any files in the database
-		count, err := q.CountFiles(r.Context())
+		count, err := store.CountFiles(r.Context())
 		if err != nil {
 			slog.Error("Error counting files", "error", err)
 			http.Error(w, "Failed to query database", http.StatusInternalServerError)
@@ -84,7 +168,7 @@ func FindDuplicatesHandler(q *recorddb.Queries) http.HandlerFunc {
 		
 		// Query for duplicates
 		slog.Info("Querying for duplicate files")
-		dupes, err := q.FindDuplicateFiles(r.Context())
+		dupes, err := store.FindDuplicateFiles(r.Context())
 		if err != nil {
 			slog.Error("Error querying duplicates", "error", err)
 			http.Error(w, "Failed to query duplicates", http.StatusInternalServerError)
@@ -0,0 +1,92 @@
+package record
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/tendant/filededup/pkg/record/recorddb"
+)
+
+// fakeStore keeps uploaded records and fails to store the paths in fail
+type fakeStore struct {
+	stored []recorddb.UpsertFileParams
+	fail   map[string]bool
+}
+
+func (s *fakeStore) UpsertFile(ctx context.Context, arg recorddb.UpsertFileParams) error {
+	if s.fail[arg.Path] {
+		return errors.New("disk full")
+	}
+	s.stored = append(s.stored, arg)
+	return nil
+}
+
+func (s *fakeStore) CountFiles(ctx context.Context) (int64, error) {
+	return int64(len(s.stored)), nil
+}
+
+func (s *fakeStore) FindDuplicateFiles(ctx context.Context) ([]recorddb.FindDuplicateFilesRow, error) {
+	return nil, nil
+}
+
+const uploadBody = `[
+	{"machine_id": "machine-a", "path": "/a", "filename": "one.txt", "size": 1, "mtime": "2026-01-01T00:00:00Z", "hash": "aa"},
+	{"machine_id": "machine-a", "path": "/b", "filename": "two.txt", "size": 2, "mtime": "2026-01-01T00:00:00Z", "hash": "bb"}
+]`
+
+func upload(store Store, limits Limits, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	UploadFilesHandler(store, limits, nil)(w, httptest.NewRequest(http.MethodPost, "/files", strings.NewReader(body)))
+	return w
+}
+
+func TestUploadFiles(t *testing.T) {
+	store := &fakeStore{}
+	if w := upload(store, Limits{}, uploadBody); w.Code != http.StatusNoContent {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusNoContent)
+	}
+	if len(store.stored) != 2 || store.stored[1].Path != "/b" || store.stored[1].Hash != "bb" {
+		t.Fatalf("stored %+v", store.stored)
+	}
+}
+
+func TestUploadFilesReportsStoreFailures(t *testing.T) {
+	// The agent must see the failure, or it would complete its session with
+	// delete_missing and the file that was not stored would be removed
+	store := &fakeStore{fail: map[string]bool{"/b": true}}
+	if w := upload(store, Limits{}, uploadBody); w.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+	if len(store.stored) != 1 {
+		t.Fatalf("stored %d records, want the 1 that did not fail", len(store.stored))
+	}
+}
+
+func TestUploadFilesLimits(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits Limits
+		body   string
+		want   int
+	}{
+		{"invalid JSON", Limits{}, "[{", http.StatusBadRequest},
+		{"invalid session", Limits{}, `[{"machine_id": "machine-a", "session_id": "nope"}]`, http.StatusBadRequest},
+		{"too many records", Limits{MaxBatchRecords: 1}, uploadBody, http.StatusRequestEntityTooLarge},
+		{"body too large", Limits{MaxBodyBytes: 16}, uploadBody, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &fakeStore{}
+			if w := upload(store, tt.limits, tt.body); w.Code != tt.want {
+				t.Fatalf("status = %d, want %d", w.Code, tt.want)
+			}
+			if len(store.stored) != 0 {
+				t.Fatalf("stored %d records", len(store.stored))
+			}
+		})
+	}
+}
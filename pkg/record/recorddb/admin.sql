@@ -0,0 +1,146 @@
+-- Queries used by filededupctl for maintenance and consistency checks
+
+-- name: ListIndexes :many
+SELECT indexname::text FROM pg_indexes WHERE schemaname = current_schema()
+ORDER BY indexname;
+
+-- name: CountUnregisteredMachineFiles :one
+-- Files uploaded by machines that never registered
+SELECT COUNT(*) FROM file_instances f
+WHERE NOT EXISTS (SELECT 1 FROM machines m WHERE m.machine_id = f.machine_id);
+
+-- name: CountDanglingFileSessions :one
+-- Files that reference a scan session that no longer exists
+SELECT COUNT(*) FROM file_instances f
+WHERE f.session_id IS NOT NULL
+  AND NOT EXISTS (SELECT 1 FROM scan_sessions s WHERE s.id = f.session_id);
+
+-- name: CountStaleKeepers :one
+-- Keepers whose file was rehashed and no longer belongs to the set
+SELECT COUNT(*) FROM keepers k
+JOIN file_instances f ON f.id = k.file_id
+WHERE f.content_id <> k.content_id;
+
+-- name: CountUnfinishedSessions :one
+-- Scan sessions still running long after they started
+SELECT COUNT(*) FROM scan_sessions
+WHERE status = 'running'
+  AND started_at < now() - sqlc.arg(older_than_secs)::bigint * interval '1 second';
+
+-- name: ListTableStats :many
+SELECT relname::text AS table_name,
+    n_live_tup AS live_rows,
+    n_dead_tup AS dead_rows,
+    pg_total_relation_size(relid)::bigint AS total_bytes
+FROM pg_stat_user_tables
+WHERE schemaname = current_schema()
+ORDER BY relname;
+
+-- name: VacuumAnalyze :exec
+VACUUM (ANALYZE) contents, duplicate_groups, file_instances, keepers, machines, machine_tokens, scan_sessions;
+
+-- name: VacuumFull :exec
+VACUUM (FULL, ANALYZE) contents, duplicate_groups, file_instances, keepers, machines, machine_tokens, scan_sessions;
+
+-- name: CountStaleFiles :one
+SELECT COUNT(*) FROM file_instances
+WHERE machine_id = sqlc.arg(machine_id)
+  AND quarantine_state <> 'quarantined'
+  AND COALESCE(last_seen_at, created_at) < now() - sqlc.arg(older_than_secs)::bigint * interval '1 second';
+
+-- name: PruneStaleFiles :execrows
+-- Quarantined files are kept so that they can still be restored
+DELETE FROM file_instances
+WHERE machine_id = sqlc.arg(machine_id)
+  AND quarantine_state <> 'quarantined'
+  AND COALESCE(last_seen_at, created_at) < now() - sqlc.arg(older_than_secs)::bigint * interval '1 second';
+
+-- name: ListSampledDuplicateSets :many
+-- Duplicate sets of files large enough to have been hashed by sampling
+SELECT content_hash_text(c.algorithm, c.hash)::text AS hash,
+    c.size,
+    c.instance_count AS copies,
+    (SELECT COUNT(DISTINCT f.machine_id) FROM file_instances f
+        WHERE f.content_id = c.id AND f.quarantine_state = 'active' AND NOT f.alias) AS machines,
+    (c.size * (c.instance_count - 1))::bigint AS wasted_bytes
+FROM contents c
+WHERE c.instance_count > 1 AND c.size >= sqlc.arg(min_size)
+ORDER BY wasted_bytes DESC, hash;
+
+-- name: CountInstanceCountDrift :one
+-- Contents whose instance_count differs from their active instances that are
+-- not aliases
+SELECT COUNT(*) FROM contents c
+WHERE c.instance_count <> (
+    SELECT COUNT(*) FROM file_instances f
+    WHERE f.content_id = c.id AND f.quarantine_state = 'active' AND NOT f.alias);
+
+-- name: CountAliasDrift :one
+-- Files shared by volume and inode whose active instances do not count
+-- exactly once
+SELECT COUNT(*) FROM (
+    SELECT 1 FROM file_instances
+    WHERE volume_id <> '' AND inode <> 0 AND quarantine_state = 'active'
+    GROUP BY volume_id, inode, content_id
+    HAVING COUNT(*) FILTER (WHERE NOT alias) <> 1
+) d;
+
+-- name: CountUnreferencedContents :one
+-- Contents no file instance refers to any more
+SELECT COUNT(*) FROM contents c
+WHERE NOT EXISTS (SELECT 1 FROM file_instances f WHERE f.content_id = c.id);
+
+-- name: SyncAliases :execrows
+-- Repairs aliases so the first active instance of every file shared by volume
+-- and inode counts and the others do not. Runs before RecountInstances.
+UPDATE file_instances f
+SET alias = r.alias
+FROM (
+    SELECT id, machine_id, row_number() OVER (
+        PARTITION BY volume_id, inode, content_id
+        ORDER BY alias, machine_id, path, filename) > 1 AS alias
+    FROM file_instances
+    WHERE volume_id <> '' AND inode <> 0 AND quarantine_state = 'active'
+) r
+WHERE f.id = r.id AND f.machine_id = r.machine_id AND f.alias <> r.alias;
+
+-- name: RecountInstances :execrows
+-- Repairs instance counts that drifted from the active instances
+UPDATE contents c
+SET instance_count = n.active
+FROM (
+    SELECT a.id, COUNT(f.id) FILTER (WHERE f.quarantine_state = 'active' AND NOT f.alias) AS active
+    FROM contents a
+    LEFT JOIN file_instances f ON f.content_id = a.id
+    GROUP BY a.id
+) n
+WHERE n.id = c.id AND c.instance_count <> n.active;
+
+-- name: DeleteUnreferencedContents :execrows
+DELETE FROM contents c
+WHERE NOT EXISTS (SELECT 1 FROM file_instances f WHERE f.content_id = c.id);
+
+-- name: CountDuplicateGroupDrift :one
+-- Contents whose duplicate group is missing or has a wrong number of copies
+SELECT COUNT(*) FROM contents c
+LEFT JOIN duplicate_groups g ON g.content_id = c.id
+WHERE (c.instance_count > 1 OR g.id IS NOT NULL) AND g.copies IS DISTINCT FROM c.instance_count;
+
+-- name: SyncDuplicateGroups :execrows
+-- Repairs duplicate groups that drifted from the instance counts
+INSERT INTO duplicate_groups (content_id, copies)
+SELECT c.id, c.instance_count FROM contents c
+LEFT JOIN duplicate_groups g ON g.content_id = c.id
+WHERE (c.instance_count > 1 OR g.id IS NOT NULL) AND g.copies IS DISTINCT FROM c.instance_count
+ON CONFLICT (content_id)
+DO UPDATE SET copies = EXCLUDED.copies, changed_at = now(),
+    change_xid = pg_current_xact_id()::text::bigint;
+
+-- name: CountDanglingKeepers :one
+-- Keepers whose file no longer exists
+SELECT COUNT(*) FROM keepers k
+WHERE NOT EXISTS (SELECT 1 FROM file_instances f WHERE f.id = k.file_id);
+
+-- name: DeleteDanglingKeepers :execrows
+DELETE FROM keepers k
+WHERE NOT EXISTS (SELECT 1 FROM file_instances f WHERE f.id = k.file_id);
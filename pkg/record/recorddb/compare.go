@@ -0,0 +1,145 @@
+package recorddb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// This file is written by hand: sqlc cannot generate cursor-based queries.
+
+// Comparison categories
+const (
+	CompareOnlyLeft      = "only_left"
+	CompareOnlyRight     = "only_right"
+	CompareSamePath      = "same_path"
+	CompareDifferentPath = "different_path"
+)
+
+const compareRoots = `
+WITH l AS (
+    SELECT f.content_id, f.path, f.filename, f.mtime, relative_name(f.path, f.filename, $2::text) AS rel
+    FROM file_instances f
+    WHERE f.machine_id = $1::text AND f.quarantine_state = 'active'
+      AND ($2::text = '' OR f.path = $2::text
+        OR starts_with(f.path, rtrim($2::text, '/\') || '/')
+        OR starts_with(f.path, rtrim($2::text, '/\') || '\'))
+), r AS (
+    SELECT f.content_id, f.path, f.filename, f.mtime, relative_name(f.path, f.filename, $4::text) AS rel
+    FROM file_instances f
+    WHERE f.machine_id = $3::text AND f.quarantine_state = 'active'
+      AND ($4::text = '' OR f.path = $4::text
+        OR starts_with(f.path, rtrim($4::text, '/\') || '/')
+        OR starts_with(f.path, rtrim($4::text, '/\') || '\'))
+), rc AS (
+    SELECT content_id, array_agg(rel ORDER BY rel) AS rels FROM r GROUP BY content_id
+)
+SELECT CASE
+        WHEN rc.rels IS NULL THEN 'only_left'
+        WHEN l.rel = ANY(rc.rels) THEN 'same_path'
+        ELSE 'different_path'
+    END AS category,
+    l.path, l.filename, l.rel, content_hash_text(c.algorithm, c.hash) AS hash, c.size, l.mtime,
+    COALESCE(rc.rels, '{}') AS right_names
+FROM l
+JOIN contents c ON c.id = l.content_id
+LEFT JOIN rc ON rc.content_id = l.content_id
+UNION ALL
+SELECT 'only_right', r.path, r.filename, r.rel, content_hash_text(c.algorithm, c.hash), c.size, r.mtime, '{}'
+FROM r
+JOIN contents c ON c.id = r.content_id
+WHERE NOT EXISTS (SELECT 1 FROM l WHERE l.content_id = r.content_id)
+ORDER BY category, rel
+`
+
+// compareFetchSize is the number of rows fetched from the cursor at a time
+const compareFetchSize = 1000
+
+type CompareRootsParams struct {
+	LeftMachineID  string
+	LeftRoot       string
+	RightMachineID string
+	RightRoot      string
+}
+
+type CompareRootsRow struct {
+	Category     string
+	Path         string
+	Filename     string
+	RelativeName string
+	Hash         string
+	Size         int64
+	Mtime        pgtype.Timestamp
+	RightNames   []string // Names of the same content on the right, relative to its root
+}
+
+// CompareRoots compares the active files of two machines or roots by content.
+// It calls fn for every file on the left, categorized as only_left,
+// same_path or different_path depending on where its content exists on the
+// right, and for every file on the right whose content is missing on the
+// left (only_right), ordered by category and relative name. An empty root
+// covers the whole machine. Aliases are compared like other files: a share
+// the machine mounts is on that machine, whichever view of it counts. Rows
+// are read through a server-side cursor; the Queries must be backed by a
+// pool, connection or transaction that can begin a transaction.
+func (q *Queries) CompareRoots(ctx context.Context, arg CompareRootsParams, fn func(CompareRootsRow) error) error {
+	db, ok := q.db.(interface {
+		Begin(context.Context) (pgx.Tx, error)
+	})
+	if !ok {
+		return errors.New("comparing requires a database that supports transactions")
+	}
+
+	// Cursors only live inside a transaction; nothing is written, so it is
+	// always rolled back
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, "DECLARE compare_roots NO SCROLL CURSOR FOR "+compareRoots,
+		arg.LeftMachineID, arg.LeftRoot, arg.RightMachineID, arg.RightRoot); err != nil {
+		return fmt.Errorf("failed to declare cursor: %w", err)
+	}
+
+	fetch := fmt.Sprintf("FETCH FORWARD %d FROM compare_roots", compareFetchSize)
+	for {
+		rows, err := tx.Query(ctx, fetch)
+		if err != nil {
+			return err
+		}
+		var n int
+		for rows.Next() {
+			var i CompareRootsRow
+			if err := rows.Scan(
+				&i.Category,
+				&i.Path,
+				&i.Filename,
+				&i.RelativeName,
+				&i.Hash,
+				&i.Size,
+				&i.Mtime,
+				&i.RightNames,
+			); err != nil {
+				rows.Close()
+				return err
+			}
+			n++
+			if err := fn(i); err != nil {
+				rows.Close()
+				return err
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if n < compareFetchSize {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package recorddb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// This file is written by hand: sqlc cannot generate cursor-based queries.
+
+const exportDuplicateFiles = `
+SELECT content_hash_text(c.algorithm, c.hash) AS hash, c.size, c.instance_count AS copies,
+    (c.size * (c.instance_count - 1))::bigint AS wasted_bytes,
+    f.machine_id, f.path, f.filename, f.mtime
+FROM contents c
+JOIN file_instances f ON f.content_id = c.id AND f.quarantine_state = 'active' AND NOT f.alias
+WHERE c.instance_count > 1
+    AND ($1::text = '' OR EXISTS (
+        SELECT 1 FROM file_instances m
+        WHERE m.content_id = c.id AND m.quarantine_state = 'active' AND NOT m.alias AND m.machine_id = $1::text))
+    AND ($2::text = '' OR EXISTS (
+        SELECT 1 FROM file_instances m
+        WHERE m.content_id = c.id AND m.quarantine_state = 'active' AND NOT m.alias AND starts_with(m.path, $2::text)))
+ORDER BY c.size * (c.instance_count - 1) DESC, hash, f.machine_id, f.path, f.filename
+`
+
+// exportFetchSize is the number of rows fetched from the cursor at a time
+const exportFetchSize = 1000
+
+type ExportDuplicateFilesParams struct {
+	MachineID  string
+	PathPrefix string
+}
+
+type ExportDuplicateFilesRow struct {
+	Hash        string
+	Size        int64
+	Copies      int64
+	WastedBytes int64
+	MachineID   string
+	Path        string
+	Filename    string
+	Mtime       pgtype.Timestamp
+}
+
+// ExportDuplicateFiles calls fn for every active file that has duplicates,
+// largest waste first. Rows are read through a server-side cursor so the
+// result never has to fit in memory. The Queries must be backed by a pool,
+// connection or transaction that can begin a transaction.
+func (q *Queries) ExportDuplicateFiles(ctx context.Context, arg ExportDuplicateFilesParams, fn func(ExportDuplicateFilesRow) error) error {
+	db, ok := q.db.(interface {
+		Begin(context.Context) (pgx.Tx, error)
+	})
+	if !ok {
+		return errors.New("export requires a database that supports transactions")
+	}
+
+	// Cursors only live inside a transaction; nothing is written, so it is
+	// always rolled back
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, "DECLARE export_duplicates NO SCROLL CURSOR FOR "+exportDuplicateFiles, arg.MachineID, arg.PathPrefix); err != nil {
+		return fmt.Errorf("failed to declare cursor: %w", err)
+	}
+
+	fetch := fmt.Sprintf("FETCH FORWARD %d FROM export_duplicates", exportFetchSize)
+	for {
+		rows, err := tx.Query(ctx, fetch)
+		if err != nil {
+			return err
+		}
+		var n int
+		for rows.Next() {
+			var i ExportDuplicateFilesRow
+			if err := rows.Scan(
+				&i.Hash,
+				&i.Size,
+				&i.Copies,
+				&i.WastedBytes,
+				&i.MachineID,
+				&i.Path,
+				&i.Filename,
+				&i.Mtime,
+			); err != nil {
+				rows.Close()
+				return err
+			}
+			n++
+			if err := fn(i); err != nil {
+				rows.Close()
+				return err
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if n < exportFetchSize {
+			return nil
+		}
+	}
+}
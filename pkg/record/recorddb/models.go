@@ -8,13 +8,148 @@ import (
 	"github.com/jackc/pgx/v5/pgtype"
 )
 
-type File struct {
-	ID        pgtype.UUID
-	MachineID string
-	Path      string
-	Filename  string
-	Size      int64
-	Mtime     pgtype.Timestamp
-	Hash      string
-	CreatedAt pgtype.Timestamp
+type AnomalyAlert struct {
+	ID                     int64
+	MachineID              string
+	SessionID              pgtype.UUID
+	FilesBefore            int64
+	ChangedRatio           float64
+	DeletedRatio           float64
+	RenamedRatio           float64
+	BaselineChangedRatio   float64
+	BaselineDeletedRatio   float64
+	BaselineRenamedRatio   float64
+	Reasons                []string
+	CreatedAt              pgtype.Timestamp
+	ExtensionRatio         float64
+	BaselineExtensionRatio float64
+}
+
+type Content struct {
+	ID            int64
+	Algorithm     string
+	Hash          []byte
+	Size          int64
+	InstanceCount int64
+}
+
+type DuplicateGroup struct {
+	ID          int64
+	ContentID   int64
+	Copies      int64
+	FirstSeenAt pgtype.Timestamp
+	ChangedAt   pgtype.Timestamp
+	ChangeXid   int64
+}
+
+type FileHistory struct {
+	ID               int64
+	MachineID        string
+	Path             string
+	Filename         string
+	Event            string
+	Hash             string
+	Size             int64
+	Mtime            pgtype.Timestamp
+	PreviousPath     pgtype.Text
+	PreviousFilename pgtype.Text
+	PreviousHash     pgtype.Text
+	PreviousSize     pgtype.Int8
+	SessionID        pgtype.UUID
+	RecordedAt       pgtype.Timestamp
+}
+
+type FileInstance struct {
+	ID              pgtype.UUID
+	MachineID       string
+	Path            string
+	Filename        string
+	Mtime           pgtype.Timestamp
+	CreatedAt       pgtype.Timestamp
+	QuarantineState string
+	QuarantinePath  pgtype.Text
+	QuarantinedAt   pgtype.Timestamp
+	SessionID       pgtype.UUID
+	LastSeenAt      pgtype.Timestamp
+	ContentID       int64
+	Volume          string
+	VolumeID        string
+	Inode           int64
+	Alias           bool
+	FullHash        string
+}
+
+type IntegrityEvent struct {
+	ID           int64
+	MachineID    string
+	Path         string
+	Filename     string
+	Size         int64
+	Mtime        pgtype.Timestamp
+	ExpectedHash string
+	ActualHash   string
+	SessionID    pgtype.UUID
+	DetectedAt   pgtype.Timestamp
+	Algorithm    string
+	ReadError    pgtype.Text
+}
+
+type Keeper struct {
+	FileID     pgtype.UUID
+	SelectedAt pgtype.Timestamp
+	ContentID  int64
+}
+
+type Machine struct {
+	MachineID          string
+	Hostname           string
+	Os                 string
+	Arch               string
+	Version            string
+	Roots              []string
+	RegisteredAt       pgtype.Timestamp
+	LastSeenAt         pgtype.Timestamp
+	LastScanStartedAt  pgtype.Timestamp
+	LastScanFinishedAt pgtype.Timestamp
+	LastScanFiles      int64
+	LastScanBytes      int64
+	LastScanErrors     int64
+}
+
+type MachineToken struct {
+	ID          pgtype.UUID
+	MachineID   string
+	TokenHash   string
+	Description string
+	CreatedAt   pgtype.Timestamp
+	LastUsedAt  pgtype.Timestamp
+	RevokedAt   pgtype.Timestamp
+}
+
+type ScanSession struct {
+	ID                    pgtype.UUID
+	MachineID             string
+	Roots                 []string
+	StartedAt             pgtype.Timestamp
+	FinishedAt            pgtype.Timestamp
+	Status                string
+	FilesSeen             int64
+	ScanBytes             int64
+	ScanErrors            int64
+	FilesDeleted          int64
+	ArchiveID             pgtype.Text
+	FilesAdded            int64
+	FilesChanged          int64
+	FilesRenamed          int64
+	RootVolumes           []string
+	FilesExtensionChanged int64
+}
+
+type StatsSnapshot struct {
+	TakenAt        pgtype.Timestamp
+	TotalFiles     int64
+	TotalBytes     int64
+	DuplicateSets  int64
+	DuplicateFiles int64
+	WastedBytes    int64
 }
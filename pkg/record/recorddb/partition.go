@@ -0,0 +1,145 @@
+package recorddb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// This file is written by hand: rebalancing creates and drops partitions,
+// whose names sqlc cannot parameterize.
+
+type FilePartitionRow struct {
+	Name          string
+	Modulus       int32
+	Remainder     int32
+	EstimatedRows int64
+	TotalBytes    int64
+}
+
+const listFilePartitions = `-- name: ListFilePartitions :many
+SELECT c.relname::text,
+    COALESCE(substring(pg_get_expr(c.relpartbound, c.oid) FROM 'modulus (\d+)')::int, 0),
+    COALESCE(substring(pg_get_expr(c.relpartbound, c.oid) FROM 'remainder (\d+)')::int, 0),
+    GREATEST(c.reltuples, 0)::bigint,
+    pg_total_relation_size(c.oid)::bigint
+FROM pg_inherits i
+JOIN pg_class c ON c.oid = i.inhrelid
+WHERE i.inhparent = 'file_instances'::regclass
+ORDER BY 3, 1
+`
+
+// ListFilePartitions returns the partitions of file_instances with their
+// hash bounds, planner row estimates and sizes
+func (q *Queries) ListFilePartitions(ctx context.Context) ([]FilePartitionRow, error) {
+	rows, err := q.db.Query(ctx, listFilePartitions)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (FilePartitionRow, error) {
+		var i FilePartitionRow
+		err := row.Scan(&i.Name, &i.Modulus, &i.Remainder, &i.EstimatedRows, &i.TotalBytes)
+		return i, err
+	})
+}
+
+// partitionName names a partition after its modulus and remainder, so a new
+// layout never collides with the partitions it replaces
+func partitionName(modulus, remainder int) string {
+	return fmt.Sprintf("file_instances_m%d_r%02d", modulus, remainder)
+}
+
+// RebalanceFilePartitions redistributes file_instances over the given number
+// of hash partitions. The old partitions are detached, the new ones created
+// and the rows copied back through the parent table, all in one transaction
+// that locks file_instances exclusively until it commits. The instance count
+// and alias triggers are disabled meanwhile since no instance changes. The
+// Queries must be backed by a pool, connection or transaction that can begin
+// a transaction.
+func (q *Queries) RebalanceFilePartitions(ctx context.Context, partitions int) error {
+	if partitions < 1 {
+		return errors.New("at least one partition is required")
+	}
+	db, ok := q.db.(interface {
+		Begin(context.Context) (pgx.Tx, error)
+	})
+	if !ok {
+		return errors.New("rebalancing requires a database that supports transactions")
+	}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	for _, stmt := range []string{
+		"LOCK TABLE file_instances IN ACCESS EXCLUSIVE MODE",
+		"ALTER TABLE file_instances DISABLE TRIGGER file_instances_count",
+		"ALTER TABLE file_instances DISABLE TRIGGER file_instances_alias",
+	} {
+		if _, err := tx.Exec(ctx, stmt); err != nil {
+			return err
+		}
+	}
+
+	old, err := New(tx).ListFilePartitions(ctx)
+	if err != nil {
+		return err
+	}
+	if balanced(old, partitions) {
+		return nil
+	}
+	for _, p := range old {
+		if _, err := tx.Exec(ctx, "ALTER TABLE file_instances DETACH PARTITION "+pgx.Identifier{p.Name}.Sanitize()); err != nil {
+			return fmt.Errorf("failed to detach %s: %w", p.Name, err)
+		}
+	}
+	for r := 0; r < partitions; r++ {
+		name := partitionName(partitions, r)
+		stmt := fmt.Sprintf("CREATE TABLE %s PARTITION OF file_instances FOR VALUES WITH (MODULUS %d, REMAINDER %d)",
+			pgx.Identifier{name}.Sanitize(), partitions, r)
+		if _, err := tx.Exec(ctx, stmt); err != nil {
+			return fmt.Errorf("failed to create %s: %w", name, err)
+		}
+	}
+	for _, p := range old {
+		table := pgx.Identifier{p.Name}.Sanitize()
+		if _, err := tx.Exec(ctx, "INSERT INTO file_instances SELECT * FROM "+table); err != nil {
+			return fmt.Errorf("failed to move the rows of %s: %w", p.Name, err)
+		}
+		if _, err := tx.Exec(ctx, "DROP TABLE "+table); err != nil {
+			return fmt.Errorf("failed to drop %s: %w", p.Name, err)
+		}
+	}
+
+	for _, stmt := range []string{
+		"ALTER TABLE file_instances ENABLE TRIGGER file_instances_count",
+		"ALTER TABLE file_instances ENABLE TRIGGER file_instances_alias",
+	} {
+		if _, err := tx.Exec(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+	// New partitions have no planner statistics yet
+	_, err = q.db.Exec(ctx, "ANALYZE file_instances")
+	return err
+}
+
+// balanced reports whether the partitions already form the requested layout
+func balanced(partitions []FilePartitionRow, n int) bool {
+	if len(partitions) != n {
+		return false
+	}
+	for _, p := range partitions {
+		if int(p.Modulus) != n {
+			return false
+		}
+	}
+	return true
+}
@@ -1,14 +1,476 @@
 -- name: FindDuplicateFiles :many
-SELECT hash, COUNT(*) AS duplicate_count, array_agg(path || '/' || filename ORDER BY path, filename) AS paths
-FROM files
-GROUP BY hash
-HAVING COUNT(*) > 1;
+SELECT content_hash_text(c.algorithm, c.hash)::text AS hash, g.copies AS duplicate_count,
+    array_agg(f.path || '/' || f.filename ORDER BY f.path, f.filename) AS paths
+FROM duplicate_groups g
+JOIN contents c ON c.id = g.content_id
+JOIN file_instances f ON f.content_id = g.content_id AND f.quarantine_state = 'active' AND NOT f.alias
+WHERE g.copies > 1
+GROUP BY g.id, c.id
+ORDER BY g.id;
 
 -- name: CountFiles :one
-SELECT COUNT(*) FROM files;
+SELECT COUNT(*) FROM file_instances;
 
 -- name: UpsertFile :exec
-INSERT INTO files (machine_id, path, filename, size, mtime, hash)
-VALUES ($1, $2, $3, $4, $5, $6)
+-- Stores the record of a file. Records without a full hash keep the stored
+-- one while the content and mtime of the file are unchanged. The
+-- file_instances_alias trigger decides whether the file is an alias. Known
+-- contents are only read; the update on conflict only returns the ID of a
+-- content another upload inserted concurrently.
+WITH existing AS (
+    SELECT id FROM contents
+    WHERE algorithm = content_algorithm(sqlc.arg(hash)::text) AND hash = content_hash_bytes(sqlc.arg(hash)::text)
+), inserted AS (
+    INSERT INTO contents (algorithm, hash, size)
+    SELECT content_algorithm(sqlc.arg(hash)::text), content_hash_bytes(sqlc.arg(hash)::text), sqlc.arg(size)::bigint
+    WHERE NOT EXISTS (SELECT 1 FROM existing)
+    ON CONFLICT (algorithm, hash)
+    DO UPDATE SET size = EXCLUDED.size
+    RETURNING id
+), content AS (
+    SELECT id FROM existing UNION ALL SELECT id FROM inserted
+)
+INSERT INTO file_instances (machine_id, path, filename, content_id, mtime, session_id, volume, volume_id, inode, full_hash, last_seen_at)
+VALUES (sqlc.arg(machine_id), sqlc.arg(path), sqlc.arg(filename), (SELECT id FROM content), sqlc.arg(mtime), sqlc.arg(session_id),
+    sqlc.arg(volume), sqlc.arg(volume_id)::text, sqlc.arg(inode)::bigint, sqlc.arg(full_hash)::text, now())
 ON CONFLICT (machine_id, path, filename)
-DO UPDATE SET size = EXCLUDED.size, mtime = EXCLUDED.mtime, hash = EXCLUDED.hash;
\ No newline at end of file
+DO UPDATE SET content_id = EXCLUDED.content_id, mtime = EXCLUDED.mtime,
+    quarantine_state = 'active', quarantine_path = NULL, quarantined_at = NULL,
+    session_id = EXCLUDED.session_id, volume = EXCLUDED.volume, volume_id = EXCLUDED.volume_id,
+    inode = EXCLUDED.inode, last_seen_at = EXCLUDED.last_seen_at,
+    full_hash = CASE
+        WHEN EXCLUDED.full_hash = '' AND file_instances.content_id = EXCLUDED.content_id AND file_instances.mtime = EXCLUDED.mtime
+        THEN file_instances.full_hash ELSE EXCLUDED.full_hash END;
+
+-- name: ListMachineDuplicates :many
+SELECT content_hash_text(c.algorithm, c.hash)::text AS hash, f.path, f.filename, c.size, f.mtime,
+    EXISTS (SELECT 1 FROM keepers k WHERE k.file_id = f.id) AS is_keeper
+FROM file_instances f
+JOIN contents c ON c.id = f.content_id
+WHERE f.machine_id = $1
+  AND f.quarantine_state = 'active'
+  AND NOT f.alias
+  AND c.instance_count > 1
+  AND f.content_id IN (
+    SELECT d.content_id FROM file_instances d
+    WHERE d.machine_id = $1 AND d.quarantine_state = 'active' AND NOT d.alias
+    GROUP BY d.content_id
+    HAVING COUNT(*) > 1
+  )
+ORDER BY hash, f.mtime, f.path, f.filename;
+
+-- name: SetQuarantineState :execrows
+UPDATE file_instances
+SET quarantine_state = sqlc.arg(quarantine_state),
+    quarantine_path = sqlc.narg(quarantine_path),
+    quarantined_at = CASE WHEN sqlc.arg(quarantine_state)::text = 'active' THEN NULL ELSE COALESCE(quarantined_at, now()) END
+WHERE machine_id = sqlc.arg(machine_id) AND path = sqlc.arg(path) AND filename = sqlc.arg(filename);
+
+
+-- name: GetDuplicateSummary :one
+SELECT
+    (SELECT COALESCE(SUM(a.instance_count), 0) FROM contents a)::bigint AS total_files,
+    (SELECT COALESCE(SUM(a.size * a.instance_count), 0) FROM contents a)::bigint AS total_bytes,
+    COUNT(*)::bigint AS duplicate_sets,
+    COALESCE(SUM(c.instance_count), 0)::bigint AS duplicate_files,
+    COALESCE(SUM(c.size * (c.instance_count - 1)), 0)::bigint AS wasted_bytes
+FROM contents c
+WHERE c.instance_count > 1;
+
+-- name: ListDuplicateSets :many
+SELECT content_hash_text(c.algorithm, c.hash)::text AS hash,
+    c.instance_count AS copies,
+    (SELECT COUNT(DISTINCT f.machine_id) FROM file_instances f
+        WHERE f.content_id = c.id AND f.quarantine_state = 'active' AND NOT f.alias) AS machines,
+    c.size,
+    (c.size * (c.instance_count - 1))::bigint AS wasted_bytes
+FROM contents c
+WHERE c.instance_count > 1
+    AND (sqlc.arg(machine_id)::text = '' OR EXISTS (
+        SELECT 1 FROM file_instances f
+        WHERE f.content_id = c.id AND f.quarantine_state = 'active' AND NOT f.alias AND f.machine_id = sqlc.arg(machine_id)::text))
+    AND (sqlc.arg(path_prefix)::text = '' OR EXISTS (
+        SELECT 1 FROM file_instances f
+        WHERE f.content_id = c.id AND f.quarantine_state = 'active' AND NOT f.alias AND starts_with(f.path, sqlc.arg(path_prefix)::text)))
+ORDER BY wasted_bytes DESC, hash
+LIMIT sqlc.arg(page_size) OFFSET sqlc.arg(page_offset);
+
+-- name: CountDuplicateSets :one
+SELECT COUNT(*) FROM contents c
+WHERE c.instance_count > 1
+    AND (sqlc.arg(machine_id)::text = '' OR EXISTS (
+        SELECT 1 FROM file_instances f
+        WHERE f.content_id = c.id AND f.quarantine_state = 'active' AND NOT f.alias AND f.machine_id = sqlc.arg(machine_id)::text))
+    AND (sqlc.arg(path_prefix)::text = '' OR EXISTS (
+        SELECT 1 FROM file_instances f
+        WHERE f.content_id = c.id AND f.quarantine_state = 'active' AND NOT f.alias AND starts_with(f.path, sqlc.arg(path_prefix)::text)));
+
+-- name: ListFilesByHash :many
+SELECT f.id, f.machine_id, f.path, f.filename, c.size, f.mtime, f.quarantine_state,
+    (k.file_id IS NOT NULL)::boolean AS is_keeper
+FROM contents c
+JOIN file_instances f ON f.content_id = c.id
+LEFT JOIN keepers k ON k.file_id = f.id
+WHERE c.algorithm = content_algorithm(sqlc.arg(hash)::text) AND c.hash = content_hash_bytes(sqlc.arg(hash)::text)
+  AND NOT f.alias
+ORDER BY f.machine_id, f.path, f.filename;
+
+-- name: SetKeeper :execrows
+-- Selects the keeper of a content given by its hash. Files with other content,
+-- inactive files and aliases are not selected.
+INSERT INTO keepers (content_id, file_id)
+SELECT f.content_id, f.id FROM file_instances f
+JOIN contents c ON c.id = f.content_id
+WHERE f.id = sqlc.arg(id)
+  AND c.algorithm = content_algorithm(sqlc.arg(hash)::text) AND c.hash = content_hash_bytes(sqlc.arg(hash)::text)
+  AND f.quarantine_state = 'active' AND NOT f.alias
+ON CONFLICT (content_id)
+DO UPDATE SET file_id = EXCLUDED.file_id, selected_at = now();
+
+-- name: ClearKeeper :exec
+DELETE FROM keepers k
+USING contents c
+WHERE c.id = k.content_id
+  AND c.algorithm = content_algorithm(sqlc.arg(hash)::text) AND c.hash = content_hash_bytes(sqlc.arg(hash)::text);
+
+-- name: RegisterMachine :one
+INSERT INTO machines (machine_id, hostname, os, arch, version, roots)
+VALUES ($1, $2, $3, $4, $5, $6)
+ON CONFLICT (machine_id)
+DO UPDATE SET hostname = EXCLUDED.hostname, os = EXCLUDED.os, arch = EXCLUDED.arch,
+    version = EXCLUDED.version, roots = EXCLUDED.roots, last_seen_at = now()
+RETURNING *;
+
+-- name: RecordHeartbeat :execrows
+UPDATE machines
+SET last_seen_at = now(),
+    last_scan_started_at = COALESCE(sqlc.narg(scan_started_at), last_scan_started_at),
+    last_scan_finished_at = COALESCE(sqlc.narg(scan_finished_at), last_scan_finished_at),
+    last_scan_files = COALESCE(sqlc.narg(scan_files), last_scan_files),
+    last_scan_bytes = COALESCE(sqlc.narg(scan_bytes), last_scan_bytes),
+    last_scan_errors = COALESCE(sqlc.narg(scan_errors), last_scan_errors)
+WHERE machine_id = sqlc.arg(machine_id);
+
+-- name: ListMachines :many
+-- Lists the machines, flagging those not seen for silent_after. The
+-- comparison is made by the database, which also sets last_seen_at.
+SELECT sqlc.embed(machines), (last_seen_at < now() - sqlc.arg(silent_after)::interval)::boolean AS silent
+FROM machines
+ORDER BY machine_id;
+
+-- name: CreateMachineToken :one
+INSERT INTO machine_tokens (machine_id, token_hash, description)
+VALUES ($1, $2, $3)
+RETURNING id, machine_id, description, created_at;
+
+-- name: GetActiveMachineToken :one
+SELECT id, machine_id FROM machine_tokens
+WHERE token_hash = $1 AND revoked_at IS NULL;
+
+-- name: TouchMachineToken :exec
+UPDATE machine_tokens SET last_used_at = now() WHERE id = $1;
+
+-- name: ListMachineTokens :many
+SELECT id, machine_id, description, created_at, last_used_at, revoked_at
+FROM machine_tokens
+ORDER BY machine_id, created_at;
+
+-- name: RevokeMachineToken :execrows
+UPDATE machine_tokens SET revoked_at = now()
+WHERE id = $1 AND revoked_at IS NULL;
+
+-- name: StartScanSession :one
+INSERT INTO scan_sessions (machine_id, roots, root_volumes)
+VALUES ($1, $2, $3)
+RETURNING *;
+
+-- name: GetScanSession :one
+SELECT * FROM scan_sessions
+WHERE id = $1;
+
+-- name: IsArchiveIngested :one
+SELECT EXISTS (SELECT 1 FROM scan_sessions WHERE archive_id = $1);
+
+-- name: AddSessionChanges :exec
+-- Adds the files of an uploaded batch that were new or changed their hash
+UPDATE scan_sessions
+SET files_added = files_added + sqlc.arg(added),
+    files_changed = files_changed + sqlc.arg(changed)
+WHERE id = sqlc.arg(id) AND status = 'running';
+
+-- name: RecordMovedFiles :one
+-- Records a move for every file DeleteUnseenFiles would remove whose content
+-- the session added under another path or name. Copies of the same content are
+-- paired in name order; moves the session recorded before are skipped. Returns
+-- the moves recorded and how many of them changed the filename extension.
+WITH moved AS (
+INSERT INTO file_history (machine_id, path, filename, event, hash, size, mtime,
+    previous_path, previous_filename, previous_hash, previous_size, session_id)
+SELECT n.machine_id, n.path, n.filename, 'moved', content_hash_text(c.algorithm, c.hash), c.size, n.mtime,
+    o.path, o.filename, content_hash_text(c.algorithm, c.hash), c.size, sqlc.arg(session_id)::uuid
+FROM (
+    SELECT f.content_id, f.path, f.filename,
+        row_number() OVER (PARTITION BY f.content_id ORDER BY f.filename, f.path) AS n
+    FROM file_instances f
+    WHERE f.machine_id = sqlc.arg(machine_id)
+      AND f.quarantine_state = 'active'
+      AND f.session_id IS DISTINCT FROM sqlc.arg(session_id)::uuid
+      AND EXISTS (
+        SELECT 1 FROM unnest(sqlc.arg(roots)::text[]) AS r(root)
+        WHERE f.path = r.root
+           OR starts_with(f.path, rtrim(r.root, '/\') || '/')
+           OR starts_with(f.path, rtrim(r.root, '/\') || '\'))
+) o
+JOIN (
+    SELECT f.machine_id, f.content_id, f.path, f.filename, f.mtime,
+        row_number() OVER (PARTITION BY f.content_id ORDER BY f.filename, f.path) AS n
+    FROM file_instances f
+    WHERE f.machine_id = sqlc.arg(machine_id)
+      AND f.quarantine_state = 'active'
+      AND f.session_id = sqlc.arg(session_id)::uuid
+      AND f.created_at >= sqlc.arg(started_at)::timestamp
+) n ON n.content_id = o.content_id AND n.n = o.n
+JOIN contents c ON c.id = o.content_id
+WHERE NOT EXISTS (
+    SELECT 1 FROM file_history h
+    WHERE h.machine_id = n.machine_id
+      AND h.previous_path = o.path
+      AND h.previous_filename = o.filename
+      AND h.session_id = sqlc.arg(session_id)::uuid
+      AND h.event = 'moved')
+RETURNING filename, previous_filename
+)
+SELECT COUNT(*)::bigint AS moved,
+    COUNT(*) FILTER (WHERE file_extension(filename) <> file_extension(previous_filename))::bigint AS extension_changed
+FROM moved;
+
+-- name: RecordDeletedFiles :execrows
+-- Records a deletion for every file DeleteUnseenFiles would remove that did not
+-- move; runs after RecordMovedFiles. Deletions the session recorded before are
+-- skipped.
+INSERT INTO file_history (machine_id, path, filename, event, hash, size, mtime, session_id)
+SELECT f.machine_id, f.path, f.filename, 'deleted', content_hash_text(c.algorithm, c.hash), c.size, f.mtime,
+    sqlc.arg(session_id)::uuid
+FROM file_instances f
+JOIN contents c ON c.id = f.content_id
+WHERE f.machine_id = sqlc.arg(machine_id)
+  AND f.quarantine_state = 'active'
+  AND f.session_id IS DISTINCT FROM sqlc.arg(session_id)::uuid
+  AND EXISTS (
+    SELECT 1 FROM unnest(sqlc.arg(roots)::text[]) AS r(root)
+    WHERE f.path = r.root
+       OR starts_with(f.path, rtrim(r.root, '/\') || '/')
+       OR starts_with(f.path, rtrim(r.root, '/\') || '\'))
+  AND NOT EXISTS (
+    SELECT 1 FROM file_history h
+    WHERE h.machine_id = f.machine_id
+      AND h.session_id = sqlc.arg(session_id)::uuid
+      AND ((h.event = 'moved' AND h.previous_path = f.path AND h.previous_filename = f.filename)
+        OR (h.event = 'deleted' AND h.path = f.path AND h.filename = f.filename)));
+
+-- name: GetSessionBaseline :one
+-- Averages the change ratios of the machine's last completed sessions, leaving
+-- out the given session and sessions that raised an alert. Ratios are relative
+-- to the files the machine had under the session roots before the scan.
+SELECT COUNT(*)::bigint AS sessions,
+    COALESCE(AVG(s.files_changed::float8 / NULLIF(s.files_seen - s.files_added + s.files_deleted, 0)), 0)::float8 AS changed_ratio,
+    COALESCE(AVG((s.files_deleted - s.files_renamed)::float8 / NULLIF(s.files_seen - s.files_added + s.files_deleted, 0)), 0)::float8 AS deleted_ratio,
+    COALESCE(AVG(s.files_renamed::float8 / NULLIF(s.files_seen - s.files_added + s.files_deleted, 0)), 0)::float8 AS renamed_ratio,
+    COALESCE(AVG(s.files_extension_changed::float8 / NULLIF(s.files_seen - s.files_added + s.files_deleted, 0)), 0)::float8 AS extension_ratio
+FROM (
+    SELECT * FROM scan_sessions p
+    WHERE p.machine_id = sqlc.arg(machine_id)
+      AND p.status = 'completed'
+      AND p.id <> sqlc.arg(session_id)
+      AND NOT EXISTS (SELECT 1 FROM anomaly_alerts a WHERE a.session_id = p.id)
+    ORDER BY p.finished_at DESC
+    LIMIT sqlc.arg(sessions)
+) s;
+
+-- name: DeleteUnseenFiles :execrows
+-- Removes active files under the session roots that the session did not upload
+DELETE FROM file_instances
+WHERE machine_id = sqlc.arg(machine_id)
+  AND quarantine_state = 'active'
+  AND session_id IS DISTINCT FROM sqlc.arg(session_id)
+  AND EXISTS (
+    SELECT 1 FROM unnest(sqlc.arg(roots)::text[]) AS r(root)
+    WHERE path = r.root
+       OR starts_with(path, rtrim(r.root, '/\') || '/')
+       OR starts_with(path, rtrim(r.root, '/\') || '\'));
+
+-- name: FinishScanSession :one
+UPDATE scan_sessions
+SET status = 'completed',
+    finished_at = now(),
+    files_seen = (SELECT COUNT(*) FROM file_instances WHERE session_id = sqlc.arg(id)),
+    scan_bytes = sqlc.arg(scan_bytes),
+    scan_errors = sqlc.arg(scan_errors),
+    files_deleted = sqlc.arg(files_deleted),
+    files_renamed = sqlc.arg(files_renamed),
+    files_extension_changed = sqlc.arg(files_extension_changed),
+    archive_id = COALESCE(sqlc.narg(archive_id), archive_id)
+WHERE id = sqlc.arg(id) AND status = 'running'
+RETURNING *;
+
+-- name: AbandonScanSession :exec
+-- Ends a running session without removing unseen files
+UPDATE scan_sessions
+SET status = 'abandoned',
+    finished_at = now()
+WHERE id = $1 AND status = 'running';
+
+-- name: CountFilesByMachine :many
+SELECT machine_id, COUNT(*)::bigint AS files
+FROM file_instances
+WHERE quarantine_state = 'active'
+GROUP BY machine_id;
+
+-- name: InsertStatsSnapshot :exec
+INSERT INTO stats_snapshots (total_files, total_bytes, duplicate_sets, duplicate_files, wasted_bytes)
+VALUES ($1, $2, $3, $4, $5)
+ON CONFLICT (taken_at) DO NOTHING;
+
+-- name: ListStatsSnapshots :many
+-- Returns the last snapshot of each day
+SELECT DISTINCT ON (date_trunc('day', taken_at)) taken_at, total_files, total_bytes, duplicate_sets, duplicate_files, wasted_bytes
+FROM stats_snapshots
+WHERE taken_at >= now() - sqlc.arg(days)::int * interval '1 day'
+ORDER BY date_trunc('day', taken_at), taken_at DESC;
+
+-- name: ListDuplicateGroups :many
+-- Returns groups changed after the (change_xid, id) cursor, including resolved
+-- groups. Changes of transactions that may still be running are left for a
+-- later page, so no change can commit behind the cursor.
+SELECT g.id, g.content_id, content_hash_text(c.algorithm, c.hash)::text AS hash, c.size, g.copies,
+    g.first_seen_at, g.changed_at, g.change_xid
+FROM duplicate_groups g
+JOIN contents c ON c.id = g.content_id
+WHERE (g.change_xid, g.id) > (sqlc.arg(change_xid)::bigint, sqlc.arg(after_id)::bigint)
+  AND g.change_xid < pg_snapshot_xmin(pg_current_snapshot())::text::bigint
+ORDER BY g.change_xid, g.id
+LIMIT sqlc.arg(page_size);
+
+-- name: ListDuplicateGroupFiles :many
+SELECT f.content_id, f.machine_id, f.path, f.filename, f.mtime
+FROM file_instances f
+WHERE f.content_id = ANY(sqlc.arg(content_ids)::bigint[]) AND f.quarantine_state = 'active' AND NOT f.alias
+ORDER BY f.content_id, f.machine_id, f.path, f.filename;
+
+-- name: ListContentInstances :many
+-- Returns the active and quarantined instances of a content given by its hash,
+-- active ones first
+SELECT content_hash_text(c.algorithm, c.hash)::text AS hash, c.size,
+    f.machine_id, f.volume, f.volume_id, f.path, f.filename, f.mtime, f.quarantine_state, f.alias, f.last_seen_at
+FROM contents c
+JOIN file_instances f ON f.content_id = c.id
+WHERE c.algorithm = content_algorithm(sqlc.arg(hash)::text)
+  AND c.hash = content_hash_bytes(sqlc.arg(hash)::text)
+  AND f.quarantine_state <> 'purged'
+ORDER BY f.quarantine_state = 'active' DESC, f.machine_id, f.path, f.filename
+LIMIT sqlc.arg(page_size);
+
+-- name: ListStoredFiles :many
+-- Returns the active records stored for the given files; the arrays hold one
+-- machine, path and filename per file
+SELECT f.machine_id, f.path, f.filename, c.size, f.mtime, content_hash_text(c.algorithm, c.hash)::text AS hash, f.full_hash
+FROM unnest(sqlc.arg(machine_ids)::text[], sqlc.arg(paths)::text[], sqlc.arg(filenames)::text[]) AS k(machine_id, path, filename)
+JOIN file_instances f ON f.machine_id = k.machine_id AND f.path = k.path AND f.filename = k.filename
+JOIN contents c ON c.id = f.content_id
+WHERE f.quarantine_state = 'active';
+
+-- name: InsertIntegrityEvent :one
+INSERT INTO integrity_events (machine_id, path, filename, size, mtime, expected_hash, actual_hash, session_id, algorithm, read_error)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+RETURNING *;
+
+-- name: InsertFileChanges :exec
+-- Records files whose content changed; the arrays hold one file per element
+INSERT INTO file_history (machine_id, path, filename, event, hash, size, mtime, previous_hash, previous_size, session_id)
+SELECT u.machine_id, u.path, u.filename, 'changed', u.hash, u.size, u.mtime, u.previous_hash, u.previous_size, u.session_id
+FROM unnest(sqlc.arg(machine_ids)::text[], sqlc.arg(paths)::text[], sqlc.arg(filenames)::text[],
+    sqlc.arg(hashes)::text[], sqlc.arg(sizes)::bigint[], sqlc.arg(mtimes)::timestamp[],
+    sqlc.arg(previous_hashes)::text[], sqlc.arg(previous_sizes)::bigint[], sqlc.arg(session_ids)::uuid[])
+    AS u(machine_id, path, filename, hash, size, mtime, previous_hash, previous_size, session_id);
+
+-- name: ListIntegrityEvents :many
+SELECT * FROM integrity_events
+WHERE (sqlc.arg(machine_id)::text = '' OR machine_id = sqlc.arg(machine_id)::text)
+  AND (detected_at, id) > (sqlc.arg(since)::timestamp, sqlc.arg(after_id)::bigint)
+ORDER BY detected_at, id
+LIMIT sqlc.arg(page_size);
+
+-- name: ListFileHistoryAt :many
+-- Returns the events that left a file at the given location and the moves away
+-- from it, oldest first
+SELECT * FROM file_history
+WHERE machine_id = sqlc.arg(machine_id)
+  AND ((path = sqlc.arg(path) AND filename = sqlc.arg(filename))
+    OR (previous_path = sqlc.arg(path) AND previous_filename = sqlc.arg(filename)))
+ORDER BY recorded_at, id
+LIMIT sqlc.arg(page_size);
+
+-- name: InsertAnomalyAlert :one
+INSERT INTO anomaly_alerts (machine_id, session_id, files_before, changed_ratio, deleted_ratio, renamed_ratio,
+    baseline_changed_ratio, baseline_deleted_ratio, baseline_renamed_ratio, reasons,
+    extension_ratio, baseline_extension_ratio)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+ON CONFLICT (session_id) DO NOTHING
+RETURNING *;
+
+-- name: ListAnomalyAlerts :many
+SELECT * FROM anomaly_alerts
+WHERE (sqlc.arg(machine_id)::text = '' OR machine_id = sqlc.arg(machine_id)::text)
+  AND (created_at, id) > (sqlc.arg(since)::timestamp, sqlc.arg(after_id)::bigint)
+ORDER BY created_at, id
+LIMIT sqlc.arg(page_size);
+
+-- name: ListUnderReplicatedFiles :many
+-- Returns active files whose content has fewer copies than the policy with the
+-- longest matching path prefix requires, counting distinct machines and
+-- distinct volumes: by volume ID where agents report it, else per machine.
+-- Aliases neither count nor are listed. Copies are counted once per content,
+-- for the contents of the files that pass the filters. The policy arrays hold
+-- one prefix and its minimum machines and volumes per policy; the empty prefix
+-- matches every path.
+WITH candidates AS (
+    SELECT f.machine_id, f.volume, f.path, f.filename, f.mtime, f.content_id, c.algorithm, c.hash, c.size,
+        p.prefix, p.min_machines, p.min_volumes
+    FROM file_instances f
+    JOIN contents c ON c.id = f.content_id
+    CROSS JOIN LATERAL (
+        SELECT p.prefix, p.min_machines, p.min_volumes
+        FROM unnest(sqlc.arg(policy_prefixes)::text[], sqlc.arg(policy_min_machines)::int[], sqlc.arg(policy_min_volumes)::int[])
+            AS p(prefix, min_machines, min_volumes)
+        WHERE p.prefix = ''
+           OR f.path = p.prefix
+           OR starts_with(f.path, rtrim(p.prefix, '/\') || '/')
+           OR starts_with(f.path, rtrim(p.prefix, '/\') || '\')
+        ORDER BY length(p.prefix) DESC
+        LIMIT 1
+    ) p
+    WHERE f.quarantine_state = 'active'
+      AND NOT f.alias
+      AND (sqlc.arg(machine_id)::text = '' OR f.machine_id = sqlc.arg(machine_id)::text)
+      AND (sqlc.arg(path_prefix)::text = '' OR starts_with(f.path, sqlc.arg(path_prefix)::text))
+      AND c.size >= sqlc.arg(min_size)::bigint
+      AND (sqlc.arg(max_size)::bigint = 0 OR c.size <= sqlc.arg(max_size)::bigint)
+      AND f.mtime <= sqlc.arg(modified_before)::timestamp
+),
+copies AS (
+    SELECT o.content_id, COUNT(DISTINCT o.machine_id)::bigint AS machines,
+        COUNT(DISTINCT CASE WHEN o.volume_id <> '' THEN o.volume_id ELSE o.machine_id || ':' || o.volume END)::bigint AS volumes
+    FROM file_instances o
+    WHERE o.content_id IN (SELECT content_id FROM candidates)
+      AND o.quarantine_state = 'active'
+      AND NOT o.alias
+    GROUP BY o.content_id
+)
+SELECT f.machine_id, f.volume, f.path, f.filename, content_hash_text(f.algorithm, f.hash)::text AS hash,
+    f.size, f.mtime, r.machines, r.volumes,
+    f.prefix::text AS policy_prefix, f.min_machines::int AS min_machines, f.min_volumes::int AS min_volumes
+FROM candidates f
+JOIN copies r ON r.content_id = f.content_id
+WHERE r.machines < f.min_machines OR r.volumes < f.min_volumes
+ORDER BY f.machine_id, f.path, f.filename
+LIMIT sqlc.arg(page_size) OFFSET sqlc.arg(page_offset);
@@ -11,8 +11,43 @@ import (
 	"github.com/jackc/pgx/v5/pgtype"
 )
 
+const clearKeeper = `-- name: ClearKeeper :exec
+DELETE FROM keepers k
+USING contents c
+WHERE c.id = k.content_id
+  AND c.algorithm = content_algorithm($1::text) AND c.hash = content_hash_bytes($1::text)
+`
+
+func (q *Queries) ClearKeeper(ctx context.Context, hash string) error {
+	_, err := q.db.Exec(ctx, clearKeeper, hash)
+	return err
+}
+
+const countDuplicateSets = `-- name: CountDuplicateSets :one
+SELECT COUNT(*) FROM contents c
+WHERE c.instance_count > 1
+    AND ($1::text = '' OR EXISTS (
+        SELECT 1 FROM file_instances f
+        WHERE f.content_id = c.id AND f.quarantine_state = 'active' AND NOT f.alias AND f.machine_id = $1::text))
+    AND ($2::text = '' OR EXISTS (
+        SELECT 1 FROM file_instances f
+        WHERE f.content_id = c.id AND f.quarantine_state = 'active' AND NOT f.alias AND starts_with(f.path, $2::text)))
+`
+
+type CountDuplicateSetsParams struct {
+	MachineID  string
+	PathPrefix string
+}
+
+func (q *Queries) CountDuplicateSets(ctx context.Context, arg CountDuplicateSetsParams) (int64, error) {
+	row := q.db.QueryRow(ctx, countDuplicateSets, arg.MachineID, arg.PathPrefix)
+	var count int64
+	err := row.Scan(&count)
+	return count, err
+}
+
 const countFiles = `-- name: CountFiles :one
-SELECT COUNT(*) FROM files
+SELECT COUNT(*) FROM file_instances
 `
 
 func (q *Queries) CountFiles(ctx context.Context) (int64, error) {
@@ -22,11 +57,78 @@ func (q *Queries) CountFiles(ctx context.Context) (int64, error) {
 	return count, err
 }
 
+const countFilesByMachine = `-- name: CountFilesByMachine :many
+SELECT machine_id, COUNT(*)::bigint AS files
+FROM file_instances
+WHERE quarantine_state = 'active'
+GROUP BY machine_id
+`
+
+type CountFilesByMachineRow struct {
+	MachineID string
+	Files     int64
+}
+
+func (q *Queries) CountFilesByMachine(ctx context.Context) ([]CountFilesByMachineRow, error) {
+	rows, err := q.db.Query(ctx, countFilesByMachine)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []CountFilesByMachineRow
+	for rows.Next() {
+		var i CountFilesByMachineRow
+		if err := rows.Scan(&i.MachineID, &i.Files); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const createMachineToken = `-- name: CreateMachineToken :one
+INSERT INTO machine_tokens (machine_id, token_hash, description)
+VALUES ($1, $2, $3)
+RETURNING id, machine_id, description, created_at
+`
+
+type CreateMachineTokenParams struct {
+	MachineID   string
+	TokenHash   string
+	Description string
+}
+
+type CreateMachineTokenRow struct {
+	ID          pgtype.UUID
+	MachineID   string
+	Description string
+	CreatedAt   pgtype.Timestamp
+}
+
+func (q *Queries) CreateMachineToken(ctx context.Context, arg CreateMachineTokenParams) (CreateMachineTokenRow, error) {
+	row := q.db.QueryRow(ctx, createMachineToken, arg.MachineID, arg.TokenHash, arg.Description)
+	var i CreateMachineTokenRow
+	err := row.Scan(
+		&i.ID,
+		&i.MachineID,
+		&i.Description,
+		&i.CreatedAt,
+	)
+	return i, err
+}
+
 const findDuplicateFiles = `-- name: FindDuplicateFiles :many
-SELECT hash, COUNT(*) AS duplicate_count, array_agg(path || '/' || filename ORDER BY path, filename) AS paths
-FROM files
-GROUP BY hash
-HAVING COUNT(*) > 1
+SELECT content_hash_text(c.algorithm, c.hash)::text AS hash, g.copies AS duplicate_count,
+    array_agg(f.path || '/' || f.filename ORDER BY f.path, f.filename) AS paths
+FROM duplicate_groups g
+JOIN contents c ON c.id = g.content_id
+JOIN file_instances f ON f.content_id = g.content_id AND f.quarantine_state = 'active' AND NOT f.alias
+WHERE g.copies > 1
+GROUP BY g.id, c.id
+ORDER BY g.id;
 `
 
 type FindDuplicateFilesRow struct {
@@ -55,30 +157,1597 @@ func (q *Queries) FindDuplicateFiles(ctx context.Context) ([]FindDuplicateFilesR
 	return items, nil
 }
 
-const upsertFile = `-- name: UpsertFile :exec
-INSERT INTO files (machine_id, path, filename, size, mtime, hash)
-VALUES ($1, $2, $3, $4, $5, $6)
-ON CONFLICT (machine_id, path, filename)
-DO UPDATE SET size = EXCLUDED.size, mtime = EXCLUDED.mtime, hash = EXCLUDED.hash
+const getActiveMachineToken = `-- name: GetActiveMachineToken :one
+SELECT id, machine_id FROM machine_tokens
+WHERE token_hash = $1 AND revoked_at IS NULL
 `
 
-type UpsertFileParams struct {
+type GetActiveMachineTokenRow struct {
+	ID        pgtype.UUID
+	MachineID string
+}
+
+func (q *Queries) GetActiveMachineToken(ctx context.Context, tokenHash string) (GetActiveMachineTokenRow, error) {
+	row := q.db.QueryRow(ctx, getActiveMachineToken, tokenHash)
+	var i GetActiveMachineTokenRow
+	err := row.Scan(&i.ID, &i.MachineID)
+	return i, err
+}
+
+const getDuplicateSummary = `-- name: GetDuplicateSummary :one
+SELECT
+    (SELECT COALESCE(SUM(a.instance_count), 0) FROM contents a)::bigint AS total_files,
+    (SELECT COALESCE(SUM(a.size * a.instance_count), 0) FROM contents a)::bigint AS total_bytes,
+    COUNT(*)::bigint AS duplicate_sets,
+    COALESCE(SUM(c.instance_count), 0)::bigint AS duplicate_files,
+    COALESCE(SUM(c.size * (c.instance_count - 1)), 0)::bigint AS wasted_bytes
+FROM contents c
+WHERE c.instance_count > 1
+`
+
+type GetDuplicateSummaryRow struct {
+	TotalFiles     int64
+	TotalBytes     int64
+	DuplicateSets  int64
+	DuplicateFiles int64
+	WastedBytes    int64
+}
+
+func (q *Queries) GetDuplicateSummary(ctx context.Context) (GetDuplicateSummaryRow, error) {
+	row := q.db.QueryRow(ctx, getDuplicateSummary)
+	var i GetDuplicateSummaryRow
+	err := row.Scan(
+		&i.TotalFiles,
+		&i.TotalBytes,
+		&i.DuplicateSets,
+		&i.DuplicateFiles,
+		&i.WastedBytes,
+	)
+	return i, err
+}
+
+const insertIntegrityEvent = `-- name: InsertIntegrityEvent :one
+INSERT INTO integrity_events (machine_id, path, filename, size, mtime, expected_hash, actual_hash, session_id, algorithm, read_error)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+RETURNING id, machine_id, path, filename, size, mtime, expected_hash, actual_hash, session_id, detected_at, algorithm, read_error
+`
+
+type InsertIntegrityEventParams struct {
+	MachineID    string
+	Path         string
+	Filename     string
+	Size         int64
+	Mtime        pgtype.Timestamp
+	ExpectedHash string
+	ActualHash   string
+	SessionID    pgtype.UUID
+	Algorithm    string
+	ReadError    pgtype.Text
+}
+
+func (q *Queries) InsertIntegrityEvent(ctx context.Context, arg InsertIntegrityEventParams) (IntegrityEvent, error) {
+	row := q.db.QueryRow(ctx, insertIntegrityEvent,
+		arg.MachineID,
+		arg.Path,
+		arg.Filename,
+		arg.Size,
+		arg.Mtime,
+		arg.ExpectedHash,
+		arg.ActualHash,
+		arg.SessionID,
+		arg.Algorithm,
+		arg.ReadError,
+	)
+	var i IntegrityEvent
+	err := row.Scan(
+		&i.ID,
+		&i.MachineID,
+		&i.Path,
+		&i.Filename,
+		&i.Size,
+		&i.Mtime,
+		&i.ExpectedHash,
+		&i.ActualHash,
+		&i.SessionID,
+		&i.DetectedAt,
+		&i.Algorithm,
+		&i.ReadError,
+	)
+	return i, err
+}
+
+const listDuplicateGroupFiles = `-- name: ListDuplicateGroupFiles :many
+SELECT f.content_id, f.machine_id, f.path, f.filename, f.mtime
+FROM file_instances f
+WHERE f.content_id = ANY($1::bigint[]) AND f.quarantine_state = 'active' AND NOT f.alias
+ORDER BY f.content_id, f.machine_id, f.path, f.filename
+`
+
+type ListDuplicateGroupFilesRow struct {
+	ContentID int64
 	MachineID string
 	Path      string
 	Filename  string
-	Size      int64
 	Mtime     pgtype.Timestamp
-	Hash      string
 }
 
-func (q *Queries) UpsertFile(ctx context.Context, arg UpsertFileParams) error {
-	_, err := q.db.Exec(ctx, upsertFile,
+func (q *Queries) ListDuplicateGroupFiles(ctx context.Context, contentIds []int64) ([]ListDuplicateGroupFilesRow, error) {
+	rows, err := q.db.Query(ctx, listDuplicateGroupFiles, contentIds)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ListDuplicateGroupFilesRow
+	for rows.Next() {
+		var i ListDuplicateGroupFilesRow
+		if err := rows.Scan(
+			&i.ContentID,
+			&i.MachineID,
+			&i.Path,
+			&i.Filename,
+			&i.Mtime,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listDuplicateGroups = `-- name: ListDuplicateGroups :many
+SELECT g.id, g.content_id, content_hash_text(c.algorithm, c.hash)::text AS hash, c.size, g.copies,
+    g.first_seen_at, g.changed_at, g.change_xid
+FROM duplicate_groups g
+JOIN contents c ON c.id = g.content_id
+WHERE (g.change_xid, g.id) > ($1::bigint, $2::bigint)
+  AND g.change_xid < pg_snapshot_xmin(pg_current_snapshot())::text::bigint
+ORDER BY g.change_xid, g.id
+LIMIT $3
+`
+
+type ListDuplicateGroupsParams struct {
+	ChangeXid int64
+	AfterID   int64
+	PageSize  int32
+}
+
+type ListDuplicateGroupsRow struct {
+	ID          int64
+	ContentID   int64
+	Hash        string
+	Size        int64
+	Copies      int64
+	FirstSeenAt pgtype.Timestamp
+	ChangedAt   pgtype.Timestamp
+	ChangeXid   int64
+}
+
+// Returns groups changed after the (change_xid, id) cursor, including resolved
+// groups. Changes of transactions that may still be running are left for a
+// later page, so no change can commit behind the cursor.
+func (q *Queries) ListDuplicateGroups(ctx context.Context, arg ListDuplicateGroupsParams) ([]ListDuplicateGroupsRow, error) {
+	rows, err := q.db.Query(ctx, listDuplicateGroups, arg.ChangeXid, arg.AfterID, arg.PageSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ListDuplicateGroupsRow
+	for rows.Next() {
+		var i ListDuplicateGroupsRow
+		if err := rows.Scan(
+			&i.ID,
+			&i.ContentID,
+			&i.Hash,
+			&i.Size,
+			&i.Copies,
+			&i.FirstSeenAt,
+			&i.ChangedAt,
+			&i.ChangeXid,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listDuplicateSets = `-- name: ListDuplicateSets :many
+SELECT content_hash_text(c.algorithm, c.hash)::text AS hash,
+    c.instance_count AS copies,
+    (SELECT COUNT(DISTINCT f.machine_id) FROM file_instances f
+        WHERE f.content_id = c.id AND f.quarantine_state = 'active' AND NOT f.alias) AS machines,
+    c.size,
+    (c.size * (c.instance_count - 1))::bigint AS wasted_bytes
+FROM contents c
+WHERE c.instance_count > 1
+    AND ($1::text = '' OR EXISTS (
+        SELECT 1 FROM file_instances f
+        WHERE f.content_id = c.id AND f.quarantine_state = 'active' AND NOT f.alias AND f.machine_id = $1::text))
+    AND ($2::text = '' OR EXISTS (
+        SELECT 1 FROM file_instances f
+        WHERE f.content_id = c.id AND f.quarantine_state = 'active' AND NOT f.alias AND starts_with(f.path, $2::text)))
+ORDER BY wasted_bytes DESC, hash
+LIMIT $3 OFFSET $4
+`
+
+type ListDuplicateSetsParams struct {
+	MachineID  string
+	PathPrefix string
+	PageSize   int32
+	PageOffset int32
+}
+
+type ListDuplicateSetsRow struct {
+	Hash        string
+	Copies      int64
+	Machines    int64
+	Size        int64
+	WastedBytes int64
+}
+
+func (q *Queries) ListDuplicateSets(ctx context.Context, arg ListDuplicateSetsParams) ([]ListDuplicateSetsRow, error) {
+	rows, err := q.db.Query(ctx, listDuplicateSets,
+		arg.MachineID,
+		arg.PathPrefix,
+		arg.PageSize,
+		arg.PageOffset,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ListDuplicateSetsRow
+	for rows.Next() {
+		var i ListDuplicateSetsRow
+		if err := rows.Scan(
+			&i.Hash,
+			&i.Copies,
+			&i.Machines,
+			&i.Size,
+			&i.WastedBytes,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listFilesByHash = `-- name: ListFilesByHash :many
+SELECT f.id, f.machine_id, f.path, f.filename, c.size, f.mtime, f.quarantine_state,
+    (k.file_id IS NOT NULL)::boolean AS is_keeper
+FROM contents c
+JOIN file_instances f ON f.content_id = c.id
+LEFT JOIN keepers k ON k.file_id = f.id
+WHERE c.algorithm = content_algorithm($1::text) AND c.hash = content_hash_bytes($1::text)
+  AND NOT f.alias
+ORDER BY f.machine_id, f.path, f.filename
+`
+
+type ListFilesByHashRow struct {
+	ID              pgtype.UUID
+	MachineID       string
+	Path            string
+	Filename        string
+	Size            int64
+	Mtime           pgtype.Timestamp
+	QuarantineState string
+	IsKeeper        bool
+}
+
+func (q *Queries) ListFilesByHash(ctx context.Context, hash string) ([]ListFilesByHashRow, error) {
+	rows, err := q.db.Query(ctx, listFilesByHash, hash)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ListFilesByHashRow
+	for rows.Next() {
+		var i ListFilesByHashRow
+		if err := rows.Scan(
+			&i.ID,
+			&i.MachineID,
+			&i.Path,
+			&i.Filename,
+			&i.Size,
+			&i.Mtime,
+			&i.QuarantineState,
+			&i.IsKeeper,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listIntegrityEvents = `-- name: ListIntegrityEvents :many
+SELECT id, machine_id, path, filename, size, mtime, expected_hash, actual_hash, session_id, detected_at, algorithm, read_error FROM integrity_events
+WHERE ($1::text = '' OR machine_id = $1::text)
+  AND (detected_at, id) > ($2::timestamp, $3::bigint)
+ORDER BY detected_at, id
+LIMIT $4
+`
+
+type ListIntegrityEventsParams struct {
+	MachineID string
+	Since     pgtype.Timestamp
+	AfterID   int64
+	PageSize  int32
+}
+
+func (q *Queries) ListIntegrityEvents(ctx context.Context, arg ListIntegrityEventsParams) ([]IntegrityEvent, error) {
+	rows, err := q.db.Query(ctx, listIntegrityEvents,
+		arg.MachineID,
+		arg.Since,
+		arg.AfterID,
+		arg.PageSize,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []IntegrityEvent
+	for rows.Next() {
+		var i IntegrityEvent
+		if err := rows.Scan(
+			&i.ID,
+			&i.MachineID,
+			&i.Path,
+			&i.Filename,
+			&i.Size,
+			&i.Mtime,
+			&i.ExpectedHash,
+			&i.ActualHash,
+			&i.SessionID,
+			&i.DetectedAt,
+			&i.Algorithm,
+			&i.ReadError,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listFileHistoryAt = `-- name: ListFileHistoryAt :many
+SELECT id, machine_id, path, filename, event, hash, size, mtime, previous_path, previous_filename, previous_hash, previous_size, session_id, recorded_at FROM file_history
+WHERE machine_id = $1
+  AND ((path = $2 AND filename = $3)
+    OR (previous_path = $2 AND previous_filename = $3))
+ORDER BY recorded_at, id
+LIMIT $4
+`
+
+type ListFileHistoryAtParams struct {
+	MachineID string
+	Path      string
+	Filename  string
+	PageSize  int32
+}
+
+// Returns the events that left a file at the given location and the moves away
+// from it, oldest first
+func (q *Queries) ListFileHistoryAt(ctx context.Context, arg ListFileHistoryAtParams) ([]FileHistory, error) {
+	rows, err := q.db.Query(ctx, listFileHistoryAt,
 		arg.MachineID,
 		arg.Path,
 		arg.Filename,
-		arg.Size,
-		arg.Mtime,
-		arg.Hash,
+		arg.PageSize,
 	)
-	return err
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []FileHistory
+	for rows.Next() {
+		var i FileHistory
+		if err := rows.Scan(
+			&i.ID,
+			&i.MachineID,
+			&i.Path,
+			&i.Filename,
+			&i.Event,
+			&i.Hash,
+			&i.Size,
+			&i.Mtime,
+			&i.PreviousPath,
+			&i.PreviousFilename,
+			&i.PreviousHash,
+			&i.PreviousSize,
+			&i.SessionID,
+			&i.RecordedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listMachineDuplicates = `-- name: ListMachineDuplicates :many
+SELECT content_hash_text(c.algorithm, c.hash)::text AS hash, f.path, f.filename, c.size, f.mtime,
+    EXISTS (SELECT 1 FROM keepers k WHERE k.file_id = f.id) AS is_keeper
+FROM file_instances f
+JOIN contents c ON c.id = f.content_id
+WHERE f.machine_id = $1
+  AND f.quarantine_state = 'active'
+  AND NOT f.alias
+  AND c.instance_count > 1
+  AND f.content_id IN (
+    SELECT d.content_id FROM file_instances d
+    WHERE d.machine_id = $1 AND d.quarantine_state = 'active' AND NOT d.alias
+    GROUP BY d.content_id
+    HAVING COUNT(*) > 1
+  )
+ORDER BY hash, f.mtime, f.path, f.filename
+`
+
+type ListMachineDuplicatesRow struct {
+	Hash     string
+	Path     string
+	Filename string
+	Size     int64
+	Mtime    pgtype.Timestamp
+	IsKeeper bool
+}
+
+func (q *Queries) ListMachineDuplicates(ctx context.Context, machineID string) ([]ListMachineDuplicatesRow, error) {
+	rows, err := q.db.Query(ctx, listMachineDuplicates, machineID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ListMachineDuplicatesRow
+	for rows.Next() {
+		var i ListMachineDuplicatesRow
+		if err := rows.Scan(
+			&i.Hash,
+			&i.Path,
+			&i.Filename,
+			&i.Size,
+			&i.Mtime,
+			&i.IsKeeper,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listMachineTokens = `-- name: ListMachineTokens :many
+SELECT id, machine_id, description, created_at, last_used_at, revoked_at
+FROM machine_tokens
+ORDER BY machine_id, created_at
+`
+
+type ListMachineTokensRow struct {
+	ID          pgtype.UUID
+	MachineID   string
+	Description string
+	CreatedAt   pgtype.Timestamp
+	LastUsedAt  pgtype.Timestamp
+	RevokedAt   pgtype.Timestamp
+}
+
+func (q *Queries) ListMachineTokens(ctx context.Context) ([]ListMachineTokensRow, error) {
+	rows, err := q.db.Query(ctx, listMachineTokens)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ListMachineTokensRow
+	for rows.Next() {
+		var i ListMachineTokensRow
+		if err := rows.Scan(
+			&i.ID,
+			&i.MachineID,
+			&i.Description,
+			&i.CreatedAt,
+			&i.LastUsedAt,
+			&i.RevokedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listMachines = `-- name: ListMachines :many
+SELECT machines.machine_id, machines.hostname, machines.os, machines.arch, machines.version, machines.roots, machines.registered_at, machines.last_seen_at, machines.last_scan_started_at, machines.last_scan_finished_at, machines.last_scan_files, machines.last_scan_bytes, machines.last_scan_errors, (last_seen_at < now() - $1::interval)::boolean AS silent
+FROM machines
+ORDER BY machine_id
+`
+
+type ListMachinesRow struct {
+	Machine Machine
+	Silent  bool
+}
+
+// Lists the machines, flagging those not seen for silent_after. The
+// comparison is made by the database, which also sets last_seen_at.
+func (q *Queries) ListMachines(ctx context.Context, silentAfter pgtype.Interval) ([]ListMachinesRow, error) {
+	rows, err := q.db.Query(ctx, listMachines, silentAfter)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ListMachinesRow
+	for rows.Next() {
+		var i ListMachinesRow
+		if err := rows.Scan(
+			&i.Machine.MachineID,
+			&i.Machine.Hostname,
+			&i.Machine.Os,
+			&i.Machine.Arch,
+			&i.Machine.Version,
+			&i.Machine.Roots,
+			&i.Machine.RegisteredAt,
+			&i.Machine.LastSeenAt,
+			&i.Machine.LastScanStartedAt,
+			&i.Machine.LastScanFinishedAt,
+			&i.Machine.LastScanFiles,
+			&i.Machine.LastScanBytes,
+			&i.Machine.LastScanErrors,
+			&i.Silent,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listContentInstances = `-- name: ListContentInstances :many
+SELECT content_hash_text(c.algorithm, c.hash)::text AS hash, c.size,
+    f.machine_id, f.volume, f.volume_id, f.path, f.filename, f.mtime, f.quarantine_state, f.alias, f.last_seen_at
+FROM contents c
+JOIN file_instances f ON f.content_id = c.id
+WHERE c.algorithm = content_algorithm($1::text)
+  AND c.hash = content_hash_bytes($1::text)
+  AND f.quarantine_state <> 'purged'
+ORDER BY f.quarantine_state = 'active' DESC, f.machine_id, f.path, f.filename
+LIMIT $2
+`
+
+type ListContentInstancesParams struct {
+	Hash     string
+	PageSize int32
+}
+
+type ListContentInstancesRow struct {
+	Hash            string
+	Size            int64
+	MachineID       string
+	Volume          string
+	VolumeID        string
+	Path            string
+	Filename        string
+	Mtime           pgtype.Timestamp
+	QuarantineState string
+	Alias           bool
+	LastSeenAt      pgtype.Timestamp
+}
+
+// Returns the active and quarantined instances of a content given by its hash,
+// active ones first
+func (q *Queries) ListContentInstances(ctx context.Context, arg ListContentInstancesParams) ([]ListContentInstancesRow, error) {
+	rows, err := q.db.Query(ctx, listContentInstances, arg.Hash, arg.PageSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ListContentInstancesRow
+	for rows.Next() {
+		var i ListContentInstancesRow
+		if err := rows.Scan(
+			&i.Hash,
+			&i.Size,
+			&i.MachineID,
+			&i.Volume,
+			&i.VolumeID,
+			&i.Path,
+			&i.Filename,
+			&i.Mtime,
+			&i.QuarantineState,
+			&i.Alias,
+			&i.LastSeenAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listStoredFiles = `-- name: ListStoredFiles :many
+SELECT f.machine_id, f.path, f.filename, c.size, f.mtime, content_hash_text(c.algorithm, c.hash)::text AS hash, f.full_hash
+FROM unnest($1::text[], $2::text[], $3::text[]) AS k(machine_id, path, filename)
+JOIN file_instances f ON f.machine_id = k.machine_id AND f.path = k.path AND f.filename = k.filename
+JOIN contents c ON c.id = f.content_id
+WHERE f.quarantine_state = 'active'
+`
+
+type ListStoredFilesParams struct {
+	MachineIds []string
+	Paths      []string
+	Filenames  []string
+}
+
+type ListStoredFilesRow struct {
+	MachineID string
+	Path      string
+	Filename  string
+	Size      int64
+	Mtime     pgtype.Timestamp
+	Hash      string
+	FullHash  string
+}
+
+// Returns the active records stored for the given files; the arrays hold one
+// machine, path and filename per file
+func (q *Queries) ListStoredFiles(ctx context.Context, arg ListStoredFilesParams) ([]ListStoredFilesRow, error) {
+	rows, err := q.db.Query(ctx, listStoredFiles, arg.MachineIds, arg.Paths, arg.Filenames)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ListStoredFilesRow
+	for rows.Next() {
+		var i ListStoredFilesRow
+		if err := rows.Scan(
+			&i.MachineID,
+			&i.Path,
+			&i.Filename,
+			&i.Size,
+			&i.Mtime,
+			&i.Hash,
+			&i.FullHash,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const insertFileChanges = `-- name: InsertFileChanges :exec
+INSERT INTO file_history (machine_id, path, filename, event, hash, size, mtime, previous_hash, previous_size, session_id)
+SELECT u.machine_id, u.path, u.filename, 'changed', u.hash, u.size, u.mtime, u.previous_hash, u.previous_size, u.session_id
+FROM unnest($1::text[], $2::text[], $3::text[],
+    $4::text[], $5::bigint[], $6::timestamp[],
+    $7::text[], $8::bigint[], $9::uuid[])
+    AS u(machine_id, path, filename, hash, size, mtime, previous_hash, previous_size, session_id)
+`
+
+type InsertFileChangesParams struct {
+	MachineIds     []string
+	Paths          []string
+	Filenames      []string
+	Hashes         []string
+	Sizes          []int64
+	Mtimes         []pgtype.Timestamp
+	PreviousHashes []string
+	PreviousSizes  []int64
+	SessionIds     []pgtype.UUID
+}
+
+// Records files whose content changed; the arrays hold one file per element
+func (q *Queries) InsertFileChanges(ctx context.Context, arg InsertFileChangesParams) error {
+	_, err := q.db.Exec(ctx, insertFileChanges,
+		arg.MachineIds,
+		arg.Paths,
+		arg.Filenames,
+		arg.Hashes,
+		arg.Sizes,
+		arg.Mtimes,
+		arg.PreviousHashes,
+		arg.PreviousSizes,
+		arg.SessionIds,
+	)
+	return err
+}
+
+const recordHeartbeat = `-- name: RecordHeartbeat :execrows
+UPDATE machines
+SET last_seen_at = now(),
+    last_scan_started_at = COALESCE($1, last_scan_started_at),
+    last_scan_finished_at = COALESCE($2, last_scan_finished_at),
+    last_scan_files = COALESCE($3, last_scan_files),
+    last_scan_bytes = COALESCE($4, last_scan_bytes),
+    last_scan_errors = COALESCE($5, last_scan_errors)
+WHERE machine_id = $6
+`
+
+type RecordHeartbeatParams struct {
+	ScanStartedAt  pgtype.Timestamp
+	ScanFinishedAt pgtype.Timestamp
+	ScanFiles      pgtype.Int8
+	ScanBytes      pgtype.Int8
+	ScanErrors     pgtype.Int8
+	MachineID      string
+}
+
+func (q *Queries) RecordHeartbeat(ctx context.Context, arg RecordHeartbeatParams) (int64, error) {
+	result, err := q.db.Exec(ctx, recordHeartbeat,
+		arg.ScanStartedAt,
+		arg.ScanFinishedAt,
+		arg.ScanFiles,
+		arg.ScanBytes,
+		arg.ScanErrors,
+		arg.MachineID,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const registerMachine = `-- name: RegisterMachine :one
+INSERT INTO machines (machine_id, hostname, os, arch, version, roots)
+VALUES ($1, $2, $3, $4, $5, $6)
+ON CONFLICT (machine_id)
+DO UPDATE SET hostname = EXCLUDED.hostname, os = EXCLUDED.os, arch = EXCLUDED.arch,
+    version = EXCLUDED.version, roots = EXCLUDED.roots, last_seen_at = now()
+RETURNING machine_id, hostname, os, arch, version, roots, registered_at, last_seen_at, last_scan_started_at, last_scan_finished_at, last_scan_files, last_scan_bytes, last_scan_errors
+`
+
+type RegisterMachineParams struct {
+	MachineID string
+	Hostname  string
+	Os        string
+	Arch      string
+	Version   string
+	Roots     []string
+}
+
+func (q *Queries) RegisterMachine(ctx context.Context, arg RegisterMachineParams) (Machine, error) {
+	row := q.db.QueryRow(ctx, registerMachine,
+		arg.MachineID,
+		arg.Hostname,
+		arg.Os,
+		arg.Arch,
+		arg.Version,
+		arg.Roots,
+	)
+	var i Machine
+	err := row.Scan(
+		&i.MachineID,
+		&i.Hostname,
+		&i.Os,
+		&i.Arch,
+		&i.Version,
+		&i.Roots,
+		&i.RegisteredAt,
+		&i.LastSeenAt,
+		&i.LastScanStartedAt,
+		&i.LastScanFinishedAt,
+		&i.LastScanFiles,
+		&i.LastScanBytes,
+		&i.LastScanErrors,
+	)
+	return i, err
+}
+
+const revokeMachineToken = `-- name: RevokeMachineToken :execrows
+UPDATE machine_tokens SET revoked_at = now()
+WHERE id = $1 AND revoked_at IS NULL
+`
+
+func (q *Queries) RevokeMachineToken(ctx context.Context, id pgtype.UUID) (int64, error) {
+	result, err := q.db.Exec(ctx, revokeMachineToken, id)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const setKeeper = `-- name: SetKeeper :execrows
+INSERT INTO keepers (content_id, file_id)
+SELECT f.content_id, f.id FROM file_instances f
+JOIN contents c ON c.id = f.content_id
+WHERE f.id = $1
+  AND c.algorithm = content_algorithm($2::text) AND c.hash = content_hash_bytes($2::text)
+  AND f.quarantine_state = 'active' AND NOT f.alias
+ON CONFLICT (content_id)
+DO UPDATE SET file_id = EXCLUDED.file_id, selected_at = now()
+`
+
+type SetKeeperParams struct {
+	ID   pgtype.UUID
+	Hash string
+}
+
+// Selects the keeper of a content given by its hash. Files with other content,
+// inactive files and aliases are not selected.
+func (q *Queries) SetKeeper(ctx context.Context, arg SetKeeperParams) (int64, error) {
+	result, err := q.db.Exec(ctx, setKeeper, arg.ID, arg.Hash)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const setQuarantineState = `-- name: SetQuarantineState :execrows
+UPDATE file_instances
+SET quarantine_state = $1,
+    quarantine_path = $2,
+    quarantined_at = CASE WHEN $1::text = 'active' THEN NULL ELSE COALESCE(quarantined_at, now()) END
+WHERE machine_id = $3 AND path = $4 AND filename = $5
+`
+
+type SetQuarantineStateParams struct {
+	QuarantineState string
+	QuarantinePath  pgtype.Text
+	MachineID       string
+	Path            string
+	Filename        string
+}
+
+func (q *Queries) SetQuarantineState(ctx context.Context, arg SetQuarantineStateParams) (int64, error) {
+	result, err := q.db.Exec(ctx, setQuarantineState,
+		arg.QuarantineState,
+		arg.QuarantinePath,
+		arg.MachineID,
+		arg.Path,
+		arg.Filename,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const touchMachineToken = `-- name: TouchMachineToken :exec
+UPDATE machine_tokens SET last_used_at = now() WHERE id = $1
+`
+
+func (q *Queries) TouchMachineToken(ctx context.Context, id pgtype.UUID) error {
+	_, err := q.db.Exec(ctx, touchMachineToken, id)
+	return err
+}
+
+const upsertFile = `-- name: UpsertFile :exec
+WITH existing AS (
+    SELECT id FROM contents
+    WHERE algorithm = content_algorithm($1::text) AND hash = content_hash_bytes($1::text)
+), inserted AS (
+    INSERT INTO contents (algorithm, hash, size)
+    SELECT content_algorithm($1::text), content_hash_bytes($1::text), $2::bigint
+    WHERE NOT EXISTS (SELECT 1 FROM existing)
+    ON CONFLICT (algorithm, hash)
+    DO UPDATE SET size = EXCLUDED.size
+    RETURNING id
+), content AS (
+    SELECT id FROM existing UNION ALL SELECT id FROM inserted
+)
+INSERT INTO file_instances (machine_id, path, filename, content_id, mtime, session_id, volume, volume_id, inode, full_hash, last_seen_at)
+VALUES ($3, $4, $5, (SELECT id FROM content), $6, $7,
+    $8, $9::text, $10::bigint, $11::text, now())
+ON CONFLICT (machine_id, path, filename)
+DO UPDATE SET content_id = EXCLUDED.content_id, mtime = EXCLUDED.mtime,
+    quarantine_state = 'active', quarantine_path = NULL, quarantined_at = NULL,
+    session_id = EXCLUDED.session_id, volume = EXCLUDED.volume, volume_id = EXCLUDED.volume_id,
+    inode = EXCLUDED.inode, last_seen_at = EXCLUDED.last_seen_at,
+    full_hash = CASE
+        WHEN EXCLUDED.full_hash = '' AND file_instances.content_id = EXCLUDED.content_id AND file_instances.mtime = EXCLUDED.mtime
+        THEN file_instances.full_hash ELSE EXCLUDED.full_hash END
+`
+
+type UpsertFileParams struct {
+	Hash      string
+	Size      int64
+	MachineID string
+	Path      string
+	Filename  string
+	Mtime     pgtype.Timestamp
+	SessionID pgtype.UUID
+	Volume    string
+	VolumeID  string
+	Inode     int64
+	FullHash  string
+}
+
+// Stores the record of a file. Records without a full hash keep the stored
+// one while the content and mtime of the file are unchanged. The
+// file_instances_alias trigger decides whether the file is an alias. Known
+// contents are only read; the update on conflict only returns the ID of a
+// content another upload inserted concurrently.
+func (q *Queries) UpsertFile(ctx context.Context, arg UpsertFileParams) error {
+	_, err := q.db.Exec(ctx, upsertFile,
+		arg.Hash,
+		arg.Size,
+		arg.MachineID,
+		arg.Path,
+		arg.Filename,
+		arg.Mtime,
+		arg.SessionID,
+		arg.Volume,
+		arg.VolumeID,
+		arg.Inode,
+		arg.FullHash,
+	)
+	return err
+}
+
+const addSessionChanges = `-- name: AddSessionChanges :exec
+UPDATE scan_sessions
+SET files_added = files_added + $1,
+    files_changed = files_changed + $2
+WHERE id = $3 AND status = 'running'
+`
+
+type AddSessionChangesParams struct {
+	Added   int64
+	Changed int64
+	ID      pgtype.UUID
+}
+
+// Adds the files of an uploaded batch that were new or changed their hash
+func (q *Queries) AddSessionChanges(ctx context.Context, arg AddSessionChangesParams) error {
+	_, err := q.db.Exec(ctx, addSessionChanges, arg.Added, arg.Changed, arg.ID)
+	return err
+}
+
+const deleteUnseenFiles = `-- name: DeleteUnseenFiles :execrows
+DELETE FROM file_instances
+WHERE machine_id = $1
+  AND quarantine_state = 'active'
+  AND session_id IS DISTINCT FROM $2
+  AND EXISTS (
+    SELECT 1 FROM unnest($3::text[]) AS r(root)
+    WHERE path = r.root
+       OR starts_with(path, rtrim(r.root, '/\') || '/')
+       OR starts_with(path, rtrim(r.root, '/\') || '\'))
+`
+
+type DeleteUnseenFilesParams struct {
+	MachineID string
+	SessionID pgtype.UUID
+	Roots     []string
+}
+
+// Removes active files under the session roots that the session did not upload
+func (q *Queries) DeleteUnseenFiles(ctx context.Context, arg DeleteUnseenFilesParams) (int64, error) {
+	result, err := q.db.Exec(ctx, deleteUnseenFiles, arg.MachineID, arg.SessionID, arg.Roots)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const recordMovedFiles = `-- name: RecordMovedFiles :one
+WITH moved AS (
+INSERT INTO file_history (machine_id, path, filename, event, hash, size, mtime,
+    previous_path, previous_filename, previous_hash, previous_size, session_id)
+SELECT n.machine_id, n.path, n.filename, 'moved', content_hash_text(c.algorithm, c.hash), c.size, n.mtime,
+    o.path, o.filename, content_hash_text(c.algorithm, c.hash), c.size, $1::uuid
+FROM (
+    SELECT f.content_id, f.path, f.filename,
+        row_number() OVER (PARTITION BY f.content_id ORDER BY f.filename, f.path) AS n
+    FROM file_instances f
+    WHERE f.machine_id = $2
+      AND f.quarantine_state = 'active'
+      AND f.session_id IS DISTINCT FROM $1::uuid
+      AND EXISTS (
+        SELECT 1 FROM unnest($3::text[]) AS r(root)
+        WHERE f.path = r.root
+           OR starts_with(f.path, rtrim(r.root, '/\') || '/')
+           OR starts_with(f.path, rtrim(r.root, '/\') || '\'))
+) o
+JOIN (
+    SELECT f.machine_id, f.content_id, f.path, f.filename, f.mtime,
+        row_number() OVER (PARTITION BY f.content_id ORDER BY f.filename, f.path) AS n
+    FROM file_instances f
+    WHERE f.machine_id = $2
+      AND f.quarantine_state = 'active'
+      AND f.session_id = $1::uuid
+      AND f.created_at >= $4::timestamp
+) n ON n.content_id = o.content_id AND n.n = o.n
+JOIN contents c ON c.id = o.content_id
+WHERE NOT EXISTS (
+    SELECT 1 FROM file_history h
+    WHERE h.machine_id = n.machine_id
+      AND h.previous_path = o.path
+      AND h.previous_filename = o.filename
+      AND h.session_id = $1::uuid
+      AND h.event = 'moved')
+RETURNING filename, previous_filename
+)
+SELECT COUNT(*)::bigint AS moved,
+    COUNT(*) FILTER (WHERE file_extension(filename) <> file_extension(previous_filename))::bigint AS extension_changed
+FROM moved
+`
+
+type RecordMovedFilesParams struct {
+	SessionID pgtype.UUID
+	MachineID string
+	Roots     []string
+	StartedAt pgtype.Timestamp
+}
+
+type RecordMovedFilesRow struct {
+	Moved            int64
+	ExtensionChanged int64
+}
+
+// Records a move for every file DeleteUnseenFiles would remove whose content
+// the session added under another path or name. Copies of the same content are
+// paired in name order; moves the session recorded before are skipped. Returns
+// the moves recorded and how many of them changed the filename extension.
+func (q *Queries) RecordMovedFiles(ctx context.Context, arg RecordMovedFilesParams) (RecordMovedFilesRow, error) {
+	row := q.db.QueryRow(ctx, recordMovedFiles,
+		arg.SessionID,
+		arg.MachineID,
+		arg.Roots,
+		arg.StartedAt,
+	)
+	var i RecordMovedFilesRow
+	err := row.Scan(&i.Moved, &i.ExtensionChanged)
+	return i, err
+}
+
+const recordDeletedFiles = `-- name: RecordDeletedFiles :execrows
+INSERT INTO file_history (machine_id, path, filename, event, hash, size, mtime, session_id)
+SELECT f.machine_id, f.path, f.filename, 'deleted', content_hash_text(c.algorithm, c.hash), c.size, f.mtime,
+    $1::uuid
+FROM file_instances f
+JOIN contents c ON c.id = f.content_id
+WHERE f.machine_id = $2
+  AND f.quarantine_state = 'active'
+  AND f.session_id IS DISTINCT FROM $1::uuid
+  AND EXISTS (
+    SELECT 1 FROM unnest($3::text[]) AS r(root)
+    WHERE f.path = r.root
+       OR starts_with(f.path, rtrim(r.root, '/\') || '/')
+       OR starts_with(f.path, rtrim(r.root, '/\') || '\'))
+  AND NOT EXISTS (
+    SELECT 1 FROM file_history h
+    WHERE h.machine_id = f.machine_id
+      AND h.session_id = $1::uuid
+      AND ((h.event = 'moved' AND h.previous_path = f.path AND h.previous_filename = f.filename)
+        OR (h.event = 'deleted' AND h.path = f.path AND h.filename = f.filename)))
+`
+
+type RecordDeletedFilesParams struct {
+	SessionID pgtype.UUID
+	MachineID string
+	Roots     []string
+}
+
+// Records a deletion for every file DeleteUnseenFiles would remove that did not
+// move; runs after RecordMovedFiles. Deletions the session recorded before are
+// skipped.
+func (q *Queries) RecordDeletedFiles(ctx context.Context, arg RecordDeletedFilesParams) (int64, error) {
+	result, err := q.db.Exec(ctx, recordDeletedFiles, arg.SessionID, arg.MachineID, arg.Roots)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const finishScanSession = `-- name: FinishScanSession :one
+UPDATE scan_sessions
+SET status = 'completed',
+    finished_at = now(),
+    files_seen = (SELECT COUNT(*) FROM file_instances WHERE session_id = $1),
+    scan_bytes = $2,
+    scan_errors = $3,
+    files_deleted = $4,
+    files_renamed = $5,
+    files_extension_changed = $6,
+    archive_id = COALESCE($7, archive_id)
+WHERE id = $1 AND status = 'running'
+RETURNING id, machine_id, roots, started_at, finished_at, status, files_seen, scan_bytes, scan_errors, files_deleted, archive_id, files_added, files_changed, files_renamed, root_volumes, files_extension_changed
+`
+
+type FinishScanSessionParams struct {
+	ID                    pgtype.UUID
+	ScanBytes             int64
+	ScanErrors            int64
+	FilesDeleted          int64
+	FilesRenamed          int64
+	FilesExtensionChanged int64
+	ArchiveID             pgtype.Text
+}
+
+func (q *Queries) FinishScanSession(ctx context.Context, arg FinishScanSessionParams) (ScanSession, error) {
+	row := q.db.QueryRow(ctx, finishScanSession,
+		arg.ID,
+		arg.ScanBytes,
+		arg.ScanErrors,
+		arg.FilesDeleted,
+		arg.FilesRenamed,
+		arg.FilesExtensionChanged,
+		arg.ArchiveID,
+	)
+	var i ScanSession
+	err := row.Scan(
+		&i.ID,
+		&i.MachineID,
+		&i.Roots,
+		&i.StartedAt,
+		&i.FinishedAt,
+		&i.Status,
+		&i.FilesSeen,
+		&i.ScanBytes,
+		&i.ScanErrors,
+		&i.FilesDeleted,
+		&i.ArchiveID,
+		&i.FilesAdded,
+		&i.FilesChanged,
+		&i.FilesRenamed,
+		&i.RootVolumes,
+		&i.FilesExtensionChanged,
+	)
+	return i, err
+}
+
+const abandonScanSession = `-- name: AbandonScanSession :exec
+UPDATE scan_sessions
+SET status = 'abandoned',
+    finished_at = now()
+WHERE id = $1 AND status = 'running'
+`
+
+// Ends a running session without removing unseen files
+func (q *Queries) AbandonScanSession(ctx context.Context, id pgtype.UUID) error {
+	_, err := q.db.Exec(ctx, abandonScanSession, id)
+	return err
+}
+
+const getScanSession = `-- name: GetScanSession :one
+SELECT id, machine_id, roots, started_at, finished_at, status, files_seen, scan_bytes, scan_errors, files_deleted, archive_id, files_added, files_changed, files_renamed, root_volumes, files_extension_changed FROM scan_sessions
+WHERE id = $1
+`
+
+func (q *Queries) GetScanSession(ctx context.Context, id pgtype.UUID) (ScanSession, error) {
+	row := q.db.QueryRow(ctx, getScanSession, id)
+	var i ScanSession
+	err := row.Scan(
+		&i.ID,
+		&i.MachineID,
+		&i.Roots,
+		&i.StartedAt,
+		&i.FinishedAt,
+		&i.Status,
+		&i.FilesSeen,
+		&i.ScanBytes,
+		&i.ScanErrors,
+		&i.FilesDeleted,
+		&i.ArchiveID,
+		&i.FilesAdded,
+		&i.FilesChanged,
+		&i.FilesRenamed,
+		&i.RootVolumes,
+		&i.FilesExtensionChanged,
+	)
+	return i, err
+}
+
+const getSessionBaseline = `-- name: GetSessionBaseline :one
+SELECT COUNT(*)::bigint AS sessions,
+    COALESCE(AVG(s.files_changed::float8 / NULLIF(s.files_seen - s.files_added + s.files_deleted, 0)), 0)::float8 AS changed_ratio,
+    COALESCE(AVG((s.files_deleted - s.files_renamed)::float8 / NULLIF(s.files_seen - s.files_added + s.files_deleted, 0)), 0)::float8 AS deleted_ratio,
+    COALESCE(AVG(s.files_renamed::float8 / NULLIF(s.files_seen - s.files_added + s.files_deleted, 0)), 0)::float8 AS renamed_ratio,
+    COALESCE(AVG(s.files_extension_changed::float8 / NULLIF(s.files_seen - s.files_added + s.files_deleted, 0)), 0)::float8 AS extension_ratio
+FROM (
+    SELECT * FROM scan_sessions p
+    WHERE p.machine_id = $1
+      AND p.status = 'completed'
+      AND p.id <> $2
+      AND NOT EXISTS (SELECT 1 FROM anomaly_alerts a WHERE a.session_id = p.id)
+    ORDER BY p.finished_at DESC
+    LIMIT $3
+) s
+`
+
+type GetSessionBaselineParams struct {
+	MachineID string
+	SessionID pgtype.UUID
+	Sessions  int32
+}
+
+type GetSessionBaselineRow struct {
+	Sessions       int64
+	ChangedRatio   float64
+	DeletedRatio   float64
+	RenamedRatio   float64
+	ExtensionRatio float64
+}
+
+// Averages the change ratios of the machine's last completed sessions, leaving
+// out the given session and sessions that raised an alert. Ratios are relative
+// to the files the machine had under the session roots before the scan.
+func (q *Queries) GetSessionBaseline(ctx context.Context, arg GetSessionBaselineParams) (GetSessionBaselineRow, error) {
+	row := q.db.QueryRow(ctx, getSessionBaseline, arg.MachineID, arg.SessionID, arg.Sessions)
+	var i GetSessionBaselineRow
+	err := row.Scan(
+		&i.Sessions,
+		&i.ChangedRatio,
+		&i.DeletedRatio,
+		&i.RenamedRatio,
+		&i.ExtensionRatio,
+	)
+	return i, err
+}
+
+const isArchiveIngested = `-- name: IsArchiveIngested :one
+SELECT EXISTS (SELECT 1 FROM scan_sessions WHERE archive_id = $1)
+`
+
+func (q *Queries) IsArchiveIngested(ctx context.Context, archiveID pgtype.Text) (bool, error) {
+	row := q.db.QueryRow(ctx, isArchiveIngested, archiveID)
+	var exists bool
+	err := row.Scan(&exists)
+	return exists, err
+}
+
+const startScanSession = `-- name: StartScanSession :one
+INSERT INTO scan_sessions (machine_id, roots, root_volumes)
+VALUES ($1, $2, $3)
+RETURNING id, machine_id, roots, started_at, finished_at, status, files_seen, scan_bytes, scan_errors, files_deleted, archive_id, files_added, files_changed, files_renamed, root_volumes, files_extension_changed
+`
+
+type StartScanSessionParams struct {
+	MachineID   string
+	Roots       []string
+	RootVolumes []string
+}
+
+func (q *Queries) StartScanSession(ctx context.Context, arg StartScanSessionParams) (ScanSession, error) {
+	row := q.db.QueryRow(ctx, startScanSession, arg.MachineID, arg.Roots, arg.RootVolumes)
+	var i ScanSession
+	err := row.Scan(
+		&i.ID,
+		&i.MachineID,
+		&i.Roots,
+		&i.StartedAt,
+		&i.FinishedAt,
+		&i.Status,
+		&i.FilesSeen,
+		&i.ScanBytes,
+		&i.ScanErrors,
+		&i.FilesDeleted,
+		&i.ArchiveID,
+		&i.FilesAdded,
+		&i.FilesChanged,
+		&i.FilesRenamed,
+		&i.RootVolumes,
+		&i.FilesExtensionChanged,
+	)
+	return i, err
+}
+
+const insertStatsSnapshot = `-- name: InsertStatsSnapshot :exec
+INSERT INTO stats_snapshots (total_files, total_bytes, duplicate_sets, duplicate_files, wasted_bytes)
+VALUES ($1, $2, $3, $4, $5)
+ON CONFLICT (taken_at) DO NOTHING
+`
+
+type InsertStatsSnapshotParams struct {
+	TotalFiles     int64
+	TotalBytes     int64
+	DuplicateSets  int64
+	DuplicateFiles int64
+	WastedBytes    int64
+}
+
+func (q *Queries) InsertStatsSnapshot(ctx context.Context, arg InsertStatsSnapshotParams) error {
+	_, err := q.db.Exec(ctx, insertStatsSnapshot,
+		arg.TotalFiles,
+		arg.TotalBytes,
+		arg.DuplicateSets,
+		arg.DuplicateFiles,
+		arg.WastedBytes,
+	)
+	return err
+}
+
+const listStatsSnapshots = `-- name: ListStatsSnapshots :many
+SELECT DISTINCT ON (date_trunc('day', taken_at)) taken_at, total_files, total_bytes, duplicate_sets, duplicate_files, wasted_bytes
+FROM stats_snapshots
+WHERE taken_at >= now() - $1::int * interval '1 day'
+ORDER BY date_trunc('day', taken_at), taken_at DESC
+`
+
+// Returns the last snapshot of each day
+func (q *Queries) ListStatsSnapshots(ctx context.Context, days int32) ([]StatsSnapshot, error) {
+	rows, err := q.db.Query(ctx, listStatsSnapshots, days)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []StatsSnapshot
+	for rows.Next() {
+		var i StatsSnapshot
+		if err := rows.Scan(
+			&i.TakenAt,
+			&i.TotalFiles,
+			&i.TotalBytes,
+			&i.DuplicateSets,
+			&i.DuplicateFiles,
+			&i.WastedBytes,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const insertAnomalyAlert = `-- name: InsertAnomalyAlert :one
+INSERT INTO anomaly_alerts (machine_id, session_id, files_before, changed_ratio, deleted_ratio, renamed_ratio,
+    baseline_changed_ratio, baseline_deleted_ratio, baseline_renamed_ratio, reasons,
+    extension_ratio, baseline_extension_ratio)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+ON CONFLICT (session_id) DO NOTHING
+RETURNING id, machine_id, session_id, files_before, changed_ratio, deleted_ratio, renamed_ratio, baseline_changed_ratio, baseline_deleted_ratio, baseline_renamed_ratio, reasons, created_at, extension_ratio, baseline_extension_ratio
+`
+
+type InsertAnomalyAlertParams struct {
+	MachineID              string
+	SessionID              pgtype.UUID
+	FilesBefore            int64
+	ChangedRatio           float64
+	DeletedRatio           float64
+	RenamedRatio           float64
+	BaselineChangedRatio   float64
+	BaselineDeletedRatio   float64
+	BaselineRenamedRatio   float64
+	Reasons                []string
+	ExtensionRatio         float64
+	BaselineExtensionRatio float64
+}
+
+func (q *Queries) InsertAnomalyAlert(ctx context.Context, arg InsertAnomalyAlertParams) (AnomalyAlert, error) {
+	row := q.db.QueryRow(ctx, insertAnomalyAlert,
+		arg.MachineID,
+		arg.SessionID,
+		arg.FilesBefore,
+		arg.ChangedRatio,
+		arg.DeletedRatio,
+		arg.RenamedRatio,
+		arg.BaselineChangedRatio,
+		arg.BaselineDeletedRatio,
+		arg.BaselineRenamedRatio,
+		arg.Reasons,
+		arg.ExtensionRatio,
+		arg.BaselineExtensionRatio,
+	)
+	var i AnomalyAlert
+	err := row.Scan(
+		&i.ID,
+		&i.MachineID,
+		&i.SessionID,
+		&i.FilesBefore,
+		&i.ChangedRatio,
+		&i.DeletedRatio,
+		&i.RenamedRatio,
+		&i.BaselineChangedRatio,
+		&i.BaselineDeletedRatio,
+		&i.BaselineRenamedRatio,
+		&i.Reasons,
+		&i.CreatedAt,
+		&i.ExtensionRatio,
+		&i.BaselineExtensionRatio,
+	)
+	return i, err
+}
+
+const listAnomalyAlerts = `-- name: ListAnomalyAlerts :many
+SELECT id, machine_id, session_id, files_before, changed_ratio, deleted_ratio, renamed_ratio, baseline_changed_ratio, baseline_deleted_ratio, baseline_renamed_ratio, reasons, created_at, extension_ratio, baseline_extension_ratio FROM anomaly_alerts
+WHERE ($1::text = '' OR machine_id = $1::text)
+  AND (created_at, id) > ($2::timestamp, $3::bigint)
+ORDER BY created_at, id
+LIMIT $4
+`
+
+type ListAnomalyAlertsParams struct {
+	MachineID string
+	Since     pgtype.Timestamp
+	AfterID   int64
+	PageSize  int32
+}
+
+func (q *Queries) ListAnomalyAlerts(ctx context.Context, arg ListAnomalyAlertsParams) ([]AnomalyAlert, error) {
+	rows, err := q.db.Query(ctx, listAnomalyAlerts,
+		arg.MachineID,
+		arg.Since,
+		arg.AfterID,
+		arg.PageSize,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []AnomalyAlert
+	for rows.Next() {
+		var i AnomalyAlert
+		if err := rows.Scan(
+			&i.ID,
+			&i.MachineID,
+			&i.SessionID,
+			&i.FilesBefore,
+			&i.ChangedRatio,
+			&i.DeletedRatio,
+			&i.RenamedRatio,
+			&i.BaselineChangedRatio,
+			&i.BaselineDeletedRatio,
+			&i.BaselineRenamedRatio,
+			&i.Reasons,
+			&i.CreatedAt,
+			&i.ExtensionRatio,
+			&i.BaselineExtensionRatio,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listUnderReplicatedFiles = `-- name: ListUnderReplicatedFiles :many
+WITH candidates AS (
+    SELECT f.machine_id, f.volume, f.path, f.filename, f.mtime, f.content_id, c.algorithm, c.hash, c.size,
+        p.prefix, p.min_machines, p.min_volumes
+    FROM file_instances f
+    JOIN contents c ON c.id = f.content_id
+    CROSS JOIN LATERAL (
+        SELECT p.prefix, p.min_machines, p.min_volumes
+        FROM unnest($1::text[], $2::int[], $3::int[])
+            AS p(prefix, min_machines, min_volumes)
+        WHERE p.prefix = ''
+           OR f.path = p.prefix
+           OR starts_with(f.path, rtrim(p.prefix, '/\') || '/')
+           OR starts_with(f.path, rtrim(p.prefix, '/\') || '\')
+        ORDER BY length(p.prefix) DESC
+        LIMIT 1
+    ) p
+    WHERE f.quarantine_state = 'active'
+      AND NOT f.alias
+      AND ($4::text = '' OR f.machine_id = $4::text)
+      AND ($5::text = '' OR starts_with(f.path, $5::text))
+      AND c.size >= $6::bigint
+      AND ($7::bigint = 0 OR c.size <= $7::bigint)
+      AND f.mtime <= $8::timestamp
+),
+copies AS (
+    SELECT o.content_id, COUNT(DISTINCT o.machine_id)::bigint AS machines,
+        COUNT(DISTINCT CASE WHEN o.volume_id <> '' THEN o.volume_id ELSE o.machine_id || ':' || o.volume END)::bigint AS volumes
+    FROM file_instances o
+    WHERE o.content_id IN (SELECT content_id FROM candidates)
+      AND o.quarantine_state = 'active'
+      AND NOT o.alias
+    GROUP BY o.content_id
+)
+SELECT f.machine_id, f.volume, f.path, f.filename, content_hash_text(f.algorithm, f.hash)::text AS hash,
+    f.size, f.mtime, r.machines, r.volumes,
+    f.prefix::text AS policy_prefix, f.min_machines::int AS min_machines, f.min_volumes::int AS min_volumes
+FROM candidates f
+JOIN copies r ON r.content_id = f.content_id
+WHERE r.machines < f.min_machines OR r.volumes < f.min_volumes
+ORDER BY f.machine_id, f.path, f.filename
+LIMIT $9 OFFSET $10
+`
+
+type ListUnderReplicatedFilesParams struct {
+	PolicyPrefixes    []string
+	PolicyMinMachines []int32
+	PolicyMinVolumes  []int32
+	MachineID         string
+	PathPrefix        string
+	MinSize           int64
+	MaxSize           int64
+	ModifiedBefore    pgtype.Timestamp
+	PageSize          int32
+	PageOffset        int32
+}
+
+type ListUnderReplicatedFilesRow struct {
+	MachineID    string
+	Volume       string
+	Path         string
+	Filename     string
+	Hash         string
+	Size         int64
+	Mtime        pgtype.Timestamp
+	Machines     int64
+	Volumes      int64
+	PolicyPrefix string
+	MinMachines  int32
+	MinVolumes   int32
+}
+
+// Returns active files whose content has fewer copies than the policy with the
+// longest matching path prefix requires, counting distinct machines and
+// distinct volumes: by volume ID where agents report it, else per machine.
+// Aliases neither count nor are listed. Copies are counted once per content,
+// for the contents of the files that pass the filters. The policy arrays hold
+// one prefix and its minimum machines and volumes per policy; the empty prefix
+// matches every path.
+func (q *Queries) ListUnderReplicatedFiles(ctx context.Context, arg ListUnderReplicatedFilesParams) ([]ListUnderReplicatedFilesRow, error) {
+	rows, err := q.db.Query(ctx, listUnderReplicatedFiles,
+		arg.PolicyPrefixes,
+		arg.PolicyMinMachines,
+		arg.PolicyMinVolumes,
+		arg.MachineID,
+		arg.PathPrefix,
+		arg.MinSize,
+		arg.MaxSize,
+		arg.ModifiedBefore,
+		arg.PageSize,
+		arg.PageOffset,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ListUnderReplicatedFilesRow
+	for rows.Next() {
+		var i ListUnderReplicatedFilesRow
+		if err := rows.Scan(
+			&i.MachineID,
+			&i.Volume,
+			&i.Path,
+			&i.Filename,
+			&i.Hash,
+			&i.Size,
+			&i.Mtime,
+			&i.Machines,
+			&i.Volumes,
+			&i.PolicyPrefix,
+			&i.MinMachines,
+			&i.MinVolumes,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
 }
@@ -0,0 +1,196 @@
+package recorddb
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// This file is written by hand: the statistics queries read either the live
+// views or their materialized copies, which sqlc would generate as separate
+// queries with separate row types.
+
+// statsViews are the statistics views; each has a materialized copy named
+// with the mv_ prefix
+var statsViews = []string{"stats_machines", "stats_directories", "stats_size_buckets", "stats_extensions"}
+
+// statsView returns the view to read, or its materialized copy
+func statsView(name string, materialized bool) string {
+	if materialized {
+		return "mv_" + name
+	}
+	return name
+}
+
+type MachineStatsRow struct {
+	MachineID      string
+	Files          int64
+	Bytes          int64
+	DuplicateFiles int64
+	DuplicateBytes int64
+	WastedBytes    int64
+}
+
+const listMachineStats = `-- name: ListMachineStats :many
+SELECT machine_id, files, bytes, duplicate_files, duplicate_bytes, wasted_bytes
+FROM %s
+ORDER BY machine_id
+`
+
+// ListMachineStats returns file and duplicate totals per machine
+func (q *Queries) ListMachineStats(ctx context.Context, materialized bool) ([]MachineStatsRow, error) {
+	rows, err := q.db.Query(ctx, fmt.Sprintf(listMachineStats, statsView("stats_machines", materialized)))
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (MachineStatsRow, error) {
+		var i MachineStatsRow
+		err := row.Scan(&i.MachineID, &i.Files, &i.Bytes, &i.DuplicateFiles, &i.DuplicateBytes, &i.WastedBytes)
+		return i, err
+	})
+}
+
+type DirectoryStatsRow struct {
+	MachineID      string
+	Path           string
+	RedundantFiles int64
+	WastedBytes    int64
+}
+
+const listTopDirectories = `-- name: ListTopDirectories :many
+SELECT machine_id, path, redundant_files, wasted_bytes
+FROM %s
+ORDER BY wasted_bytes DESC, machine_id, path
+LIMIT $1
+`
+
+// ListTopDirectories returns the directories holding the most redundant copies
+func (q *Queries) ListTopDirectories(ctx context.Context, materialized bool, limit int32) ([]DirectoryStatsRow, error) {
+	rows, err := q.db.Query(ctx, fmt.Sprintf(listTopDirectories, statsView("stats_directories", materialized)), limit)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (DirectoryStatsRow, error) {
+		var i DirectoryStatsRow
+		err := row.Scan(&i.MachineID, &i.Path, &i.RedundantFiles, &i.WastedBytes)
+		return i, err
+	})
+}
+
+type SizeBucketStatsRow struct {
+	Bucket         int32
+	MinSize        int64
+	MaxSize        *int64 // nil for the last, unbounded bucket
+	Files          int64
+	Bytes          int64
+	DuplicateSets  int64
+	DuplicateFiles int64
+	WastedBytes    int64
+}
+
+const listSizeBuckets = `-- name: ListSizeBuckets :many
+SELECT bucket, min_size, max_size, files, bytes, duplicate_sets, duplicate_files, wasted_bytes
+FROM %s
+ORDER BY bucket
+`
+
+// ListSizeBuckets returns the file size histogram, smallest bucket first
+func (q *Queries) ListSizeBuckets(ctx context.Context, materialized bool) ([]SizeBucketStatsRow, error) {
+	rows, err := q.db.Query(ctx, fmt.Sprintf(listSizeBuckets, statsView("stats_size_buckets", materialized)))
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (SizeBucketStatsRow, error) {
+		var i SizeBucketStatsRow
+		err := row.Scan(&i.Bucket, &i.MinSize, &i.MaxSize, &i.Files, &i.Bytes, &i.DuplicateSets, &i.DuplicateFiles, &i.WastedBytes)
+		return i, err
+	})
+}
+
+type ExtensionStatsRow struct {
+	Extension      string
+	Files          int64
+	Bytes          int64
+	DuplicateFiles int64
+	WastedBytes    int64
+}
+
+const listExtensionStats = `-- name: ListExtensionStats :many
+SELECT extension, files, bytes, duplicate_files, wasted_bytes
+FROM %s
+ORDER BY wasted_bytes DESC, bytes DESC, extension
+LIMIT $1
+`
+
+// ListExtensionStats returns the file extensions with the most wasted space
+func (q *Queries) ListExtensionStats(ctx context.Context, materialized bool, limit int32) ([]ExtensionStatsRow, error) {
+	rows, err := q.db.Query(ctx, fmt.Sprintf(listExtensionStats, statsView("stats_extensions", materialized)), limit)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (ExtensionStatsRow, error) {
+		var i ExtensionStatsRow
+		err := row.Scan(&i.Extension, &i.Files, &i.Bytes, &i.DuplicateFiles, &i.WastedBytes)
+		return i, err
+	})
+}
+
+const countPopulatedStatsViews = `-- name: CountPopulatedStatsViews :one
+SELECT COUNT(*) FROM pg_matviews
+WHERE schemaname = current_schema() AND matviewname = ANY($1::text[]) AND ispopulated
+`
+
+// StatsViewsPopulated reports whether every materialized statistics view has
+// been refreshed at least once
+func (q *Queries) StatsViewsPopulated(ctx context.Context) (bool, error) {
+	var populated int
+	err := q.db.QueryRow(ctx, countPopulatedStatsViews, materializedStatsViews()).Scan(&populated)
+	return populated == len(statsViews), err
+}
+
+const listPopulatedStatsViews = `-- name: ListPopulatedStatsViews :many
+SELECT matviewname::text FROM pg_matviews
+WHERE schemaname = current_schema() AND matviewname = ANY($1::text[]) AND ispopulated
+`
+
+const refreshStatsView = `-- name: RefreshStatsViews :exec
+REFRESH MATERIALIZED VIEW %s%s
+`
+
+// RefreshStatsViews recomputes the materialized statistics views. Views that
+// were refreshed before are refreshed concurrently so readers are not blocked.
+func (q *Queries) RefreshStatsViews(ctx context.Context) error {
+	rows, err := q.db.Query(ctx, listPopulatedStatsViews, materializedStatsViews())
+	if err != nil {
+		return err
+	}
+	populated, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return err
+	}
+	isPopulated := make(map[string]bool, len(populated))
+	for _, name := range populated {
+		isPopulated[name] = true
+	}
+
+	for _, name := range materializedStatsViews() {
+		// A view that was never populated cannot be refreshed concurrently
+		mode := ""
+		if isPopulated[name] {
+			mode = "CONCURRENTLY "
+		}
+		if _, err := q.db.Exec(ctx, fmt.Sprintf(refreshStatsView, mode, name)); err != nil {
+			return fmt.Errorf("failed to refresh %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func materializedStatsViews() []string {
+	names := make([]string, len(statsViews))
+	for i, name := range statsViews {
+		names[i] = statsView(name, true)
+	}
+	return names
+}
@@ -0,0 +1,165 @@
+package record
+
+import (
+	"encoding/json"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/tendant/filededup/pkg/record/recorddb"
+)
+
+// Defaults and bounds of the /replication/under limit parameter
+const (
+	DefaultReplicationLimit = 1000
+	MaxReplicationLimit     = 10000
+)
+
+// ReplicationPolicy requires the content of files under PathPrefix to exist on
+// at least MinMachines machines and MinVolumes volumes. Volumes are counted
+// per machine, so two machines with a volume each count as two volumes.
+type ReplicationPolicy struct {
+	PathPrefix  string `json:"path_prefix"`
+	MinMachines int    `json:"min_machines"`
+	MinVolumes  int    `json:"min_volumes"`
+}
+
+// UnderReplicatedFile is an active file whose content has fewer copies than
+// the policy with the longest matching path prefix requires
+type UnderReplicatedFile struct {
+	MachineID string            `json:"machine_id"`
+	Volume    string            `json:"volume"`
+	Path      string            `json:"path"`
+	Filename  string            `json:"filename"`
+	Hash      string            `json:"hash"`
+	Size      int64             `json:"size"`
+	MTime     time.Time         `json:"mtime"`
+	Machines  int64             `json:"machines"` // Machines with an active copy
+	Volumes   int64             `json:"volumes"`  // Volumes with an active copy
+	Policy    ReplicationPolicy `json:"policy"`
+}
+
+// UnderReplicatedPage is the /replication/under response
+type UnderReplicatedPage struct {
+	Files  []UnderReplicatedFile `json:"files"`
+	Offset int                   `json:"offset"`
+	More   bool                  `json:"more"` // The page is full; fetch again from Offset + len(Files)
+}
+
+// UnderReplicatedHandler lists files whose content exists on too few machines
+// or volumes, ordered by machine and path. def applies to files that none of
+// policies covers; the min_machines and min_volumes query parameters replace
+// all policies for one request. Filters: machine, path_prefix, min_size and
+// max_size (bytes), min_age (time since the last modification, e.g. 720h).
+// limit caps the page size (default 1000) and offset skips files.
+func UnderReplicatedHandler(q *recorddb.Queries, def ReplicationPolicy, policies []ReplicationPolicy) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		limit, ok := intParam(r, "limit", DefaultReplicationLimit, MaxReplicationLimit)
+		if !ok {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		offset, ok := countParam(r, "offset", 0)
+		if !ok || offset > math.MaxInt32 {
+			http.Error(w, "Invalid offset", http.StatusBadRequest)
+			return
+		}
+		minSize, ok := countParam(r, "min_size", 0)
+		if !ok {
+			http.Error(w, "Invalid min_size", http.StatusBadRequest)
+			return
+		}
+		maxSize, ok := countParam(r, "max_size", 0)
+		if !ok {
+			http.Error(w, "Invalid max_size", http.StatusBadRequest)
+			return
+		}
+		modifiedBefore := pgtype.Timestamp{InfinityModifier: pgtype.Infinity, Valid: true}
+		if v := query.Get("min_age"); v != "" {
+			age, err := time.ParseDuration(v)
+			if err != nil || age < 0 {
+				http.Error(w, "Invalid min_age", http.StatusBadRequest)
+				return
+			}
+			// File times are stored in UTC
+			modifiedBefore = pgtype.Timestamp{Time: time.Now().UTC().Add(-age), Valid: true}
+		}
+
+		// An explicit requirement replaces the configured policies
+		if query.Has("min_machines") || query.Has("min_volumes") {
+			machines, ok1 := countParam(r, "min_machines", 1)
+			volumes, ok2 := countParam(r, "min_volumes", 1)
+			if !ok1 || !ok2 {
+				http.Error(w, "Invalid min_machines or min_volumes", http.StatusBadRequest)
+				return
+			}
+			def = ReplicationPolicy{MinMachines: int(machines), MinVolumes: int(volumes)}
+			policies = nil
+		}
+
+		arg := recorddb.ListUnderReplicatedFilesParams{
+			MachineID:      query.Get("machine"),
+			PathPrefix:     query.Get("path_prefix"),
+			MinSize:        minSize,
+			MaxSize:        maxSize,
+			ModifiedBefore: modifiedBefore,
+			PageSize:       int32(limit),
+			PageOffset:     int32(offset),
+		}
+		def.PathPrefix = ""
+		for _, p := range append([]ReplicationPolicy{def}, policies...) {
+			arg.PolicyPrefixes = append(arg.PolicyPrefixes, p.PathPrefix)
+			arg.PolicyMinMachines = append(arg.PolicyMinMachines, int32(p.MinMachines))
+			arg.PolicyMinVolumes = append(arg.PolicyMinVolumes, int32(p.MinVolumes))
+		}
+
+		rows, err := q.ListUnderReplicatedFiles(r.Context(), arg)
+		if err != nil {
+			slog.Error("Error querying under-replicated files", "error", err)
+			http.Error(w, "Failed to query under-replicated files", http.StatusInternalServerError)
+			return
+		}
+
+		page := UnderReplicatedPage{Files: make([]UnderReplicatedFile, 0, len(rows)), Offset: int(offset), More: len(rows) == limit}
+		for _, row := range rows {
+			page.Files = append(page.Files, UnderReplicatedFile{
+				MachineID: row.MachineID,
+				Volume:    row.Volume,
+				Path:      row.Path,
+				Filename:  row.Filename,
+				Hash:      row.Hash,
+				Size:      row.Size,
+				MTime:     row.Mtime.Time,
+				Machines:  row.Machines,
+				Volumes:   row.Volumes,
+				Policy: ReplicationPolicy{
+					PathPrefix:  row.PolicyPrefix,
+					MinMachines: int(row.MinMachines),
+					MinVolumes:  int(row.MinVolumes),
+				},
+			})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(page); err != nil {
+			slog.Error("Error encoding JSON response", "error", err)
+		}
+	}
+}
+
+// countParam reads a non-negative integer query parameter
+func countParam(r *http.Request, name string, def int64) (int64, bool) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, true
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return n, true
+}
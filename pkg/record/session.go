@@ -0,0 +1,247 @@
+package record
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/tendant/filededup/pkg/auth"
+	"github.com/tendant/filededup/pkg/record/recorddb"
+)
+
+// Scan session states
+const (
+	SessionRunning   = "running"
+	SessionCompleted = "completed"
+	SessionAbandoned = "abandoned" // Archive ingestion failed; unseen files were kept
+)
+
+// SessionStart is sent by an agent before it uploads the files of a scan
+type SessionStart struct {
+	Roots       []string `json:"roots"`
+	RootVolumes []string `json:"root_volumes,omitempty"` // Volume ID of each root, "" when unknown
+}
+
+// SessionComplete is sent by an agent after the last batch of a scan.
+// DeleteMissing is only set when every batch was uploaded, so files under the
+// session roots that were not uploaded are known to be gone.
+type SessionComplete struct {
+	ScanBytes     int64 `json:"scan_bytes"`
+	ScanErrors    int64 `json:"scan_errors"`
+	DeleteMissing bool  `json:"delete_missing"`
+}
+
+// ScanSession describes one agent scan
+type ScanSession struct {
+	ID                    string     `json:"id"`
+	MachineID             string     `json:"machine_id"`
+	Roots                 []string   `json:"roots"`
+	RootVolumes           []string   `json:"root_volumes,omitempty"`
+	StartedAt             time.Time  `json:"started_at"`
+	FinishedAt            *time.Time `json:"finished_at,omitempty"`
+	Status                string     `json:"status"`
+	FilesSeen             int64      `json:"files_seen"`
+	ScanBytes             int64      `json:"scan_bytes"`
+	ScanErrors            int64      `json:"scan_errors"`
+	FilesAdded            int64      `json:"files_added"`
+	FilesChanged          int64      `json:"files_changed"`
+	FilesDeleted          int64      `json:"files_deleted"`
+	FilesRenamed          int64      `json:"files_renamed"`
+	FilesExtensionChanged int64      `json:"files_extension_changed"`
+	ArchiveID             string     `json:"archive_id,omitempty"`
+}
+
+func toScanSession(s recorddb.ScanSession) ScanSession {
+	return ScanSession{
+		ID:                    formatUUID(s.ID),
+		MachineID:             s.MachineID,
+		Roots:                 s.Roots,
+		RootVolumes:           s.RootVolumes,
+		StartedAt:             s.StartedAt.Time,
+		FinishedAt:            timePtr(s.FinishedAt),
+		Status:                s.Status,
+		FilesSeen:             s.FilesSeen,
+		ScanBytes:             s.ScanBytes,
+		ScanErrors:            s.ScanErrors,
+		FilesAdded:            s.FilesAdded,
+		FilesChanged:          s.FilesChanged,
+		FilesDeleted:          s.FilesDeleted,
+		FilesRenamed:          s.FilesRenamed,
+		FilesExtensionChanged: s.FilesExtensionChanged,
+		ArchiveID:             s.ArchiveID.String,
+	}
+}
+
+// formatUUID renders a UUID in its canonical string form
+func formatUUID(id pgtype.UUID) string {
+	if !id.Valid {
+		return ""
+	}
+	b := id.Bytes
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// ErrSessionNotRunning is returned when completing a session that was already completed
+var ErrSessionNotRunning = errors.New("scan session is not running")
+
+// CompleteSession finishes a scan session. With DeleteMissing, active files
+// under the session roots that were not uploaded during the session are
+// removed, after counting those the session found again under another name and
+// recording where they went in the file history.
+func CompleteSession(ctx context.Context, q *recorddb.Queries, s recorddb.ScanSession, done SessionComplete) (recorddb.ScanSession, error) {
+	return completeSession(ctx, q, s, done, pgtype.Text{})
+}
+
+// completeSession finishes a session, recording the archive it was ingested from, if any
+func completeSession(ctx context.Context, q *recorddb.Queries, s recorddb.ScanSession, done SessionComplete, archiveID pgtype.Text) (recorddb.ScanSession, error) {
+	if s.Status != SessionRunning {
+		return s, ErrSessionNotRunning
+	}
+
+	var deleted int64
+	var moved recorddb.RecordMovedFilesRow
+	if done.DeleteMissing && len(s.Roots) > 0 {
+		// Files found again under another path or name count as renamed
+		var err error
+		moved, err = recordMovesAndDeletions(ctx, q, s)
+		if err != nil {
+			return s, err
+		}
+
+		n, err := q.DeleteUnseenFiles(ctx, recorddb.DeleteUnseenFilesParams{
+			MachineID: s.MachineID,
+			SessionID: s.ID,
+			Roots:     s.Roots,
+		})
+		if err != nil {
+			return s, fmt.Errorf("failed to remove deleted files: %w", err)
+		}
+		deleted = n
+	}
+
+	finished, err := q.FinishScanSession(ctx, recorddb.FinishScanSessionParams{
+		ID:                    s.ID,
+		ScanBytes:             done.ScanBytes,
+		ScanErrors:            done.ScanErrors,
+		FilesDeleted:          deleted,
+		FilesRenamed:          moved.Moved,
+		FilesExtensionChanged: moved.ExtensionChanged,
+		ArchiveID:             archiveID,
+	})
+	if errors.Is(err, pgx.ErrNoRows) {
+		return s, ErrSessionNotRunning
+	}
+	if err != nil {
+		return s, err
+	}
+	slog.Info("Scan session completed", "machineID", finished.MachineID, "session", formatUUID(finished.ID),
+		"filesSeen", finished.FilesSeen, "filesAdded", finished.FilesAdded, "filesChanged", finished.FilesChanged,
+		"filesDeleted", finished.FilesDeleted, "filesRenamed", finished.FilesRenamed)
+	return finished, nil
+}
+
+// StartSessionHandler handles HTTP requests from agents starting a scan
+func StartSessionHandler(q *recorddb.Queries) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		machineID := chi.URLParam(r, "machineID")
+		if !auth.Allowed(r, machineID) {
+			http.Error(w, "Machine does not match token", http.StatusForbidden)
+			return
+		}
+
+		var start SessionStart
+		if err := json.NewDecoder(r.Body).Decode(&start); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if start.Roots == nil {
+			start.Roots = []string{}
+		}
+		if start.RootVolumes == nil {
+			start.RootVolumes = []string{}
+		}
+		if len(start.RootVolumes) > 0 && len(start.RootVolumes) != len(start.Roots) {
+			http.Error(w, "root_volumes must have one entry per root", http.StatusBadRequest)
+			return
+		}
+
+		s, err := q.StartScanSession(r.Context(), recorddb.StartScanSessionParams{
+			MachineID:   machineID,
+			Roots:       start.Roots,
+			RootVolumes: start.RootVolumes,
+		})
+		if err != nil {
+			slog.Error("Error starting scan session", "machineID", machineID, "error", err)
+			http.Error(w, "Failed to start scan session", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(w).Encode(toScanSession(s)); err != nil {
+			slog.Error("Error encoding JSON response", "error", err)
+		}
+	}
+}
+
+// CompleteSessionHandler handles HTTP requests from agents finishing a scan.
+// Completed sessions are checked for mass changes by anomalies.
+func CompleteSessionHandler(q *recorddb.Queries, anomalies *Anomalies) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		machineID := chi.URLParam(r, "machineID")
+		if !auth.Allowed(r, machineID) {
+			http.Error(w, "Machine does not match token", http.StatusForbidden)
+			return
+		}
+		var id pgtype.UUID
+		if err := id.Scan(chi.URLParam(r, "sessionID")); err != nil {
+			http.Error(w, "Invalid session ID", http.StatusBadRequest)
+			return
+		}
+
+		var done SessionComplete
+		if err := json.NewDecoder(r.Body).Decode(&done); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+
+		s, err := q.GetScanSession(r.Context(), id)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				http.Error(w, "Scan session not found", http.StatusNotFound)
+				return
+			}
+			slog.Error("Error loading scan session", "error", err)
+			http.Error(w, "Failed to load scan session", http.StatusInternalServerError)
+			return
+		}
+		if s.MachineID != machineID {
+			http.Error(w, "Scan session not found", http.StatusNotFound)
+			return
+		}
+
+		finished, err := CompleteSession(r.Context(), q, s, done)
+		if errors.Is(err, ErrSessionNotRunning) {
+			http.Error(w, "Scan session is already completed", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			slog.Error("Error completing scan session", "machineID", machineID, "error", err)
+			http.Error(w, "Failed to complete scan session", http.StatusInternalServerError)
+			return
+		}
+		anomalies.Check(r.Context(), finished)
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(toScanSession(finished)); err != nil {
+			slog.Error("Error encoding JSON response", "error", err)
+		}
+	}
+}
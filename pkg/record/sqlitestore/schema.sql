@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS files (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    machine_id TEXT NOT NULL,
+    path TEXT NOT NULL,
+    filename TEXT NOT NULL,
+    size INTEGER NOT NULL,
+    mtime TEXT NOT NULL,
+    hash TEXT NOT NULL,
+    created_at TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now')),
+    quarantine_state TEXT NOT NULL DEFAULT 'active',
+    quarantine_path TEXT,
+    quarantined_at TEXT,
+    UNIQUE (machine_id, path, filename)
+);
+
+CREATE INDEX IF NOT EXISTS files_hash_idx ON files (hash);
@@ -0,0 +1,109 @@
+// Package sqlitestore stores file records in an embedded SQLite database,
+// for running the server on a single machine without Postgres.
+package sqlitestore
+
+import (
+	"context"
+	"database/sql"
+	_ "embed"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/tendant/filededup/pkg/record/recorddb"
+	_ "modernc.org/sqlite"
+)
+
+//go:embed schema.sql
+var schema string
+
+// Store implements record.Store on top of SQLite
+type Store struct {
+	db *sql.DB
+}
+
+// Open opens or creates the database file and ensures the schema exists
+func Open(ctx context.Context, path string) (*Store, error) {
+	dsn := "file:" + url.PathEscape(path) +
+		"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=synchronous(NORMAL)"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows a single writer; one connection avoids SQLITE_BUSY errors
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.ExecContext(ctx, schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create schema in %s: %w", path, err)
+	}
+	return &Store{db: db}, nil
+}
+
+// Close closes the database
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+const upsertFile = `
+INSERT INTO files (machine_id, path, filename, size, mtime, hash)
+VALUES (?, ?, ?, ?, ?, ?)
+ON CONFLICT (machine_id, path, filename)
+DO UPDATE SET size = excluded.size, mtime = excluded.mtime, hash = excluded.hash,
+    quarantine_state = 'active', quarantine_path = NULL, quarantined_at = NULL`
+
+// UpsertFile inserts or updates the record of a file
+func (s *Store) UpsertFile(ctx context.Context, arg recorddb.UpsertFileParams) error {
+	_, err := s.db.ExecContext(ctx, upsertFile,
+		arg.MachineID,
+		arg.Path,
+		arg.Filename,
+		arg.Size,
+		arg.Mtime.Time.UTC().Format(time.RFC3339Nano),
+		arg.Hash,
+	)
+	return err
+}
+
+// CountFiles returns the number of recorded files
+func (s *Store) CountFiles(ctx context.Context) (int64, error) {
+	var count int64
+	err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM files`).Scan(&count)
+	return count, err
+}
+
+const findDuplicateFiles = `
+SELECT hash, path || '/' || filename
+FROM files
+WHERE quarantine_state = 'active'
+  AND hash IN (
+    SELECT hash FROM files
+    WHERE quarantine_state = 'active'
+    GROUP BY hash
+    HAVING COUNT(*) > 1)
+ORDER BY hash, path, filename`
+
+// FindDuplicateFiles returns every hash shared by more than one active file.
+// Paths is a []interface{} of strings, matching what Postgres returns for array_agg.
+func (s *Store) FindDuplicateFiles(ctx context.Context) ([]recorddb.FindDuplicateFilesRow, error) {
+	rows, err := s.db.QueryContext(ctx, findDuplicateFiles)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []recorddb.FindDuplicateFilesRow
+	for rows.Next() {
+		var hash, path string
+		if err := rows.Scan(&hash, &path); err != nil {
+			return nil, err
+		}
+		if n := len(items); n == 0 || items[n-1].Hash != hash {
+			items = append(items, recorddb.FindDuplicateFilesRow{Hash: hash, Paths: []interface{}{}})
+		}
+		last := &items[len(items)-1]
+		last.Paths = append(last.Paths.([]interface{}), path)
+		last.DuplicateCount++
+	}
+	return items, rows.Err()
+}
@@ -0,0 +1,334 @@
+package record
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/tendant/filededup/pkg/record/recorddb"
+)
+
+// Defaults and bounds of the /stats query parameters
+const (
+	DefaultStatsTop  = 20
+	MaxStatsTop      = 1000
+	DefaultStatsDays = 30
+	MaxStatsDays     = 3650
+)
+
+// DefaultStatsRefreshInterval is how often statistics are refreshed after ingestion
+const DefaultStatsRefreshInterval = 15 * time.Minute
+
+// StatsSummary holds totals over all active files
+type StatsSummary struct {
+	Files          int64 `json:"files"`
+	Bytes          int64 `json:"bytes"`
+	DuplicateSets  int64 `json:"duplicate_sets"`
+	DuplicateFiles int64 `json:"duplicate_files"`
+	WastedBytes    int64 `json:"wasted_bytes"`
+}
+
+// MachineStats holds the totals of one machine. WastedBytes counts the
+// machine's redundant copies: every copy of a set except the keeper, or the
+// first copy by machine and path if no keeper was selected.
+type MachineStats struct {
+	MachineID      string `json:"machine_id"`
+	Files          int64  `json:"files"`
+	Bytes          int64  `json:"bytes"`
+	DuplicateFiles int64  `json:"duplicate_files"`
+	DuplicateBytes int64  `json:"duplicate_bytes"`
+	WastedBytes    int64  `json:"wasted_bytes"`
+}
+
+// DirectoryStats holds the redundant copies in one directory
+type DirectoryStats struct {
+	MachineID      string `json:"machine_id"`
+	Path           string `json:"path"`
+	RedundantFiles int64  `json:"redundant_files"`
+	WastedBytes    int64  `json:"wasted_bytes"`
+}
+
+// SizeBucket is one bar of the file size histogram, covering [MinSize, MaxSize)
+type SizeBucket struct {
+	MinSize        int64  `json:"min_size"`
+	MaxSize        *int64 `json:"max_size"` // null for the last bucket
+	Files          int64  `json:"files"`
+	Bytes          int64  `json:"bytes"`
+	DuplicateSets  int64  `json:"duplicate_sets"`
+	DuplicateFiles int64  `json:"duplicate_files"`
+	WastedBytes    int64  `json:"wasted_bytes"`
+}
+
+// ExtensionStats holds the totals of one file extension ("" for none)
+type ExtensionStats struct {
+	Extension      string `json:"extension"`
+	Files          int64  `json:"files"`
+	Bytes          int64  `json:"bytes"`
+	DuplicateFiles int64  `json:"duplicate_files"`
+	WastedBytes    int64  `json:"wasted_bytes"`
+}
+
+// StatsTrendPoint holds the totals at the last snapshot of a day
+type StatsTrendPoint struct {
+	TakenAt time.Time `json:"taken_at"`
+	StatsSummary
+}
+
+// StatsReport is the /stats response
+type StatsReport struct {
+	Materialized   bool              `json:"materialized"`           // Read from the materialized views
+	RefreshedAt    *time.Time        `json:"refreshed_at,omitempty"` // Last refresh by this server
+	Summary        StatsSummary      `json:"summary"`
+	Machines       []MachineStats    `json:"machines"`
+	TopDirectories []DirectoryStats  `json:"top_directories"`
+	SizeBuckets    []SizeBucket      `json:"size_buckets"`
+	Extensions     []ExtensionStats  `json:"extensions"`
+	Trend          []StatsTrendPoint `json:"trend"`
+}
+
+// Stats serves aggregate statistics and keeps the materialized views and the
+// trend snapshots up to date. Ingestion marks the statistics as stale; they
+// are refreshed at most once per interval.
+type Stats struct {
+	q            *recorddb.Queries
+	materialized bool
+	interval     time.Duration
+
+	stale       atomic.Bool
+	mu          sync.Mutex
+	refreshedAt time.Time
+}
+
+// NewStats creates the statistics service. With materialized set, /stats
+// reads the materialized views once they have been refreshed.
+func NewStats(q *recorddb.Queries, materialized bool, interval time.Duration) *Stats {
+	if interval <= 0 {
+		interval = DefaultStatsRefreshInterval
+	}
+	s := &Stats{q: q, materialized: materialized, interval: interval}
+	// Refresh on the first tick so a new server has views and a snapshot
+	s.stale.Store(true)
+	return s
+}
+
+// Touch marks the statistics as stale
+func (s *Stats) Touch() {
+	s.stale.Store(true)
+}
+
+// Middleware marks the statistics as stale after a successful request, for
+// routes that ingest or change file records
+func (s *Stats) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+		if status := ww.Status(); status == 0 || status < 300 {
+			s.Touch()
+		}
+	})
+}
+
+// Run refreshes stale statistics every interval until ctx is done
+func (s *Stats) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		if s.stale.Swap(false) {
+			if err := s.Refresh(ctx); err != nil {
+				slog.Error("Failed to refresh statistics", "error", err)
+				s.Touch()
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Refresh recomputes the materialized views, if enabled, and records a
+// snapshot of the totals for the trend
+func (s *Stats) Refresh(ctx context.Context) error {
+	start := time.Now()
+	if s.materialized {
+		if err := s.q.RefreshStatsViews(ctx); err != nil {
+			return err
+		}
+		s.mu.Lock()
+		s.refreshedAt = time.Now().UTC()
+		s.mu.Unlock()
+	}
+
+	buckets, err := s.q.ListSizeBuckets(ctx, s.materialized)
+	if err != nil {
+		return err
+	}
+	sum := summarize(buckets)
+	if err := s.q.InsertStatsSnapshot(ctx, recorddb.InsertStatsSnapshotParams{
+		TotalFiles:     sum.Files,
+		TotalBytes:     sum.Bytes,
+		DuplicateSets:  sum.DuplicateSets,
+		DuplicateFiles: sum.DuplicateFiles,
+		WastedBytes:    sum.WastedBytes,
+	}); err != nil {
+		return err
+	}
+	slog.Info("Statistics refreshed", "materialized", s.materialized, "duration", time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// summarize adds up the size buckets, which together cover every active file
+func summarize(buckets []recorddb.SizeBucketStatsRow) StatsSummary {
+	var sum StatsSummary
+	for _, b := range buckets {
+		sum.Files += b.Files
+		sum.Bytes += b.Bytes
+		sum.DuplicateSets += b.DuplicateSets
+		sum.DuplicateFiles += b.DuplicateFiles
+		sum.WastedBytes += b.WastedBytes
+	}
+	return sum
+}
+
+// intParam parses an optional integer query parameter within [1, max]
+func intParam(r *http.Request, name string, def, max int) (int, bool) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, true
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 || n > max {
+		return 0, false
+	}
+	return n, true
+}
+
+// Handler handles HTTP requests for aggregate statistics. The top query
+// parameter limits directories and extensions (default 20); days sets the
+// length of the trend (default 30).
+func (s *Stats) Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		top, ok := intParam(r, "top", DefaultStatsTop, MaxStatsTop)
+		if !ok {
+			http.Error(w, "Invalid top", http.StatusBadRequest)
+			return
+		}
+		days, ok := intParam(r, "days", DefaultStatsDays, MaxStatsDays)
+		if !ok {
+			http.Error(w, "Invalid days", http.StatusBadRequest)
+			return
+		}
+		ctx := r.Context()
+
+		// Until the first refresh completes the live views are used
+		materialized := s.materialized
+		if materialized {
+			populated, err := s.q.StatsViewsPopulated(ctx)
+			if err != nil {
+				slog.Error("Error checking statistics views", "error", err)
+				http.Error(w, "Failed to query statistics", http.StatusInternalServerError)
+				return
+			}
+			materialized = populated
+		}
+
+		report, err := s.report(ctx, materialized, int32(top), int32(days))
+		if err != nil {
+			slog.Error("Error querying statistics", "error", err)
+			http.Error(w, "Failed to query statistics", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(report); err != nil {
+			slog.Error("Error encoding JSON response", "error", err)
+		}
+	}
+}
+
+// report reads every statistic from the live or the materialized views
+func (s *Stats) report(ctx context.Context, materialized bool, top, days int32) (StatsReport, error) {
+	report := StatsReport{
+		Materialized:   materialized,
+		Machines:       []MachineStats{},
+		TopDirectories: []DirectoryStats{},
+		SizeBuckets:    []SizeBucket{},
+		Extensions:     []ExtensionStats{},
+		Trend:          []StatsTrendPoint{},
+	}
+	if materialized {
+		s.mu.Lock()
+		if !s.refreshedAt.IsZero() {
+			at := s.refreshedAt
+			report.RefreshedAt = &at
+		}
+		s.mu.Unlock()
+	}
+
+	buckets, err := s.q.ListSizeBuckets(ctx, materialized)
+	if err != nil {
+		return report, err
+	}
+	report.Summary = summarize(buckets)
+	for _, b := range buckets {
+		report.SizeBuckets = append(report.SizeBuckets, SizeBucket{
+			MinSize:        b.MinSize,
+			MaxSize:        b.MaxSize,
+			Files:          b.Files,
+			Bytes:          b.Bytes,
+			DuplicateSets:  b.DuplicateSets,
+			DuplicateFiles: b.DuplicateFiles,
+			WastedBytes:    b.WastedBytes,
+		})
+	}
+
+	machines, err := s.q.ListMachineStats(ctx, materialized)
+	if err != nil {
+		return report, err
+	}
+	for _, m := range machines {
+		report.Machines = append(report.Machines, MachineStats(m))
+	}
+
+	dirs, err := s.q.ListTopDirectories(ctx, materialized, top)
+	if err != nil {
+		return report, err
+	}
+	for _, d := range dirs {
+		report.TopDirectories = append(report.TopDirectories, DirectoryStats(d))
+	}
+
+	exts, err := s.q.ListExtensionStats(ctx, materialized, top)
+	if err != nil {
+		return report, err
+	}
+	for _, e := range exts {
+		report.Extensions = append(report.Extensions, ExtensionStats(e))
+	}
+
+	snapshots, err := s.q.ListStatsSnapshots(ctx, days)
+	if err != nil {
+		return report, err
+	}
+	for _, snap := range snapshots {
+		report.Trend = append(report.Trend, StatsTrendPoint{
+			TakenAt: snap.TakenAt.Time,
+			StatsSummary: StatsSummary{
+				Files:          snap.TotalFiles,
+				Bytes:          snap.TotalBytes,
+				DuplicateSets:  snap.DuplicateSets,
+				DuplicateFiles: snap.DuplicateFiles,
+				WastedBytes:    snap.WastedBytes,
+			},
+		})
+	}
+	return report, nil
+}
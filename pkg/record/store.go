@@ -0,0 +1,18 @@
+package record
+
+import (
+	"context"
+
+	"github.com/tendant/filededup/pkg/record/recorddb"
+)
+
+// Store holds the file records used by the upload and duplicate endpoints.
+// *recorddb.Queries is the Postgres implementation; sqlitestore provides an
+// embedded alternative for single-machine setups.
+type Store interface {
+	UpsertFile(ctx context.Context, arg recorddb.UpsertFileParams) error
+	CountFiles(ctx context.Context) (int64, error)
+	FindDuplicateFiles(ctx context.Context) ([]recorddb.FindDuplicateFilesRow, error)
+}
+
+var _ Store = (*recorddb.Queries)(nil)
@@ -0,0 +1,166 @@
+package record
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Webhook delivery settings
+const (
+	webhookAttempts = 3
+	webhookTimeout  = 10 * time.Second
+	webhookBackoff  = 5 * time.Second
+	// Payloads waiting for delivery; more are dropped and counted as failures
+	webhookQueueSize = 256
+	// Time wait gives queued deliveries before cancelling them
+	webhookDrainTimeout = 10 * time.Second
+)
+
+// webhook posts JSON payloads to a URL from a bounded queue, one at a time,
+// retrying failed deliveries. A nil *webhook posts nothing.
+type webhook struct {
+	url      string
+	what     string // Name of the payloads in logs
+	failures prometheus.Counter
+	client   *http.Client
+
+	queue  chan webhookPayload
+	ctx    context.Context // Cancelled when wait gives up on the queue
+	cancel context.CancelFunc
+	done   chan struct{} // Closed when the worker has emptied the queue
+	drain  time.Duration // Time wait gives queued deliveries
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// webhookPayload is a queued delivery
+type webhookPayload struct {
+	id   int64
+	body []byte
+}
+
+// newWebhook returns a webhook posting to url, or nil if url is empty
+func newWebhook(url, what string, failures prometheus.Counter) *webhook {
+	if url == "" {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &webhook{
+		url:      url,
+		what:     what,
+		failures: failures,
+		client:   &http.Client{Timeout: webhookTimeout},
+		queue:    make(chan webhookPayload, webhookQueueSize),
+		ctx:      ctx,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+		drain:    webhookDrainTimeout,
+	}
+	go w.run()
+	return w
+}
+
+// send queues payload for delivery. Payloads sent while the queue is full or
+// after wait are dropped and counted as failures.
+func (w *webhook) send(id int64, payload any) {
+	if w == nil {
+		return
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		slog.Error("Failed to encode webhook payload", "what", w.what, "error", err)
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.closed {
+		select {
+		case w.queue <- webhookPayload{id: id, body: body}:
+			return
+		default:
+		}
+	}
+	w.failures.Inc()
+	slog.Error("Dropped webhook delivery", "what", w.what, "id", id, "queued", len(w.queue), "stopped", w.closed)
+}
+
+// wait stops accepting payloads and blocks until the queued ones are
+// delivered. Deliveries still pending after the drain timeout are cancelled
+// and counted as failures.
+func (w *webhook) wait() {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+	w.mu.Unlock()
+
+	timer := time.NewTimer(w.drain)
+	defer timer.Stop()
+	select {
+	case <-w.done:
+	case <-timer.C:
+		slog.Warn("Cancelling pending webhook deliveries", "what", w.what, "queued", len(w.queue))
+		w.cancel()
+		<-w.done
+	}
+	w.cancel()
+}
+
+// run delivers queued payloads until the queue is closed
+func (w *webhook) run() {
+	defer close(w.done)
+	for p := range w.queue {
+		w.deliver(p.id, p.body)
+	}
+}
+
+// deliver posts a payload, retrying failed deliveries
+func (w *webhook) deliver(id int64, body []byte) {
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = w.post(body)
+		if err == nil {
+			return
+		}
+		if attempt == webhookAttempts || w.ctx.Err() != nil {
+			break
+		}
+		select {
+		case <-time.After(time.Duration(attempt) * webhookBackoff):
+		case <-w.ctx.Done():
+		}
+	}
+	w.failures.Inc()
+	slog.Error("Failed to deliver webhook", "what", w.what, "id", id, "error", err)
+}
+
+// post sends one webhook request
+func (w *webhook) post(body []byte) error {
+	req, err := http.NewRequestWithContext(w.ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
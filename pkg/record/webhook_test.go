@@ -0,0 +1,102 @@
+package record
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func newTestWebhook(t *testing.T, handler http.HandlerFunc) (*webhook, prometheus.Counter) {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	failures := prometheus.NewCounter(prometheus.CounterOpts{Name: "test_webhook_failures_total"})
+	w := newWebhook(server.URL, "test event", failures)
+	w.drain = 100 * time.Millisecond
+	t.Cleanup(w.wait) // Before the server closes
+	return w, failures
+}
+
+func TestWebhookDelivers(t *testing.T) {
+	var mu sync.Mutex
+	var got []int64
+	w, failures := newTestWebhook(t, func(rw http.ResponseWriter, r *http.Request) {
+		var p struct{ ID int64 }
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		got = append(got, p.ID)
+		mu.Unlock()
+	})
+	for id := int64(1); id <= 3; id++ {
+		w.send(id, struct{ ID int64 }{id})
+	}
+	w.wait()
+
+	if len(got) != 3 || got[0] != 1 || got[2] != 3 {
+		t.Fatalf("delivered %v, want [1 2 3] in order", got)
+	}
+	if n := testutil.ToFloat64(failures); n != 0 {
+		t.Fatalf("%v failures", n)
+	}
+
+	// The webhook no longer accepts payloads once it waited
+	w.send(4, struct{ ID int64 }{4})
+	if n := testutil.ToFloat64(failures); n != 1 {
+		t.Fatalf("%v failures after sending to a stopped webhook, want 1", n)
+	}
+}
+
+func TestWebhookQueueIsBounded(t *testing.T) {
+	release := make(chan struct{})
+	w, failures := newTestWebhook(t, func(rw http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	})
+	defer close(release)
+
+	// One payload is being delivered, the queue holds the next ones and the
+	// rest are dropped
+	for id := int64(0); id < webhookQueueSize+11; id++ {
+		w.send(id, id)
+		if id == 0 {
+			for len(w.queue) > 0 {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}
+	if n := testutil.ToFloat64(failures); n != 10 {
+		t.Fatalf("%v failures, want the 10 payloads that did not fit", n)
+	}
+}
+
+func TestWebhookWaitCancelsPendingDeliveries(t *testing.T) {
+	w, failures := newTestWebhook(t, func(rw http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		<-r.Context().Done() // Never answers
+	})
+	w.drain = 50 * time.Millisecond
+	for id := int64(1); id <= 5; id++ {
+		w.send(id, id)
+	}
+
+	start := time.Now()
+	w.wait()
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("wait took %v", elapsed)
+	}
+	if n := testutil.ToFloat64(failures); n != 5 {
+		t.Fatalf("%v failures, want the 5 cancelled deliveries", n)
+	}
+}
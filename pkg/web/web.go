@@ -0,0 +1,299 @@
+// Package web serves the HTML interface for browsing and acting on duplicates
+package web
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/tendant/filededup/pkg/record/recorddb"
+)
+
+//go:embed templates/*.html
+var templateFS embed.FS
+
+//go:embed static
+var staticFS embed.FS
+
+// defaultPageSize is the number of duplicate sets shown per page
+const defaultPageSize = 50
+
+// UI renders the web interface
+type UI struct {
+	q         *recorddb.Queries
+	basePath  string
+	templates map[string]*template.Template
+	writeAuth func(http.Handler) http.Handler // Guards requests that change state (nil = none)
+}
+
+// filters are the list filters carried between pages
+type filters struct {
+	Machine string
+	Path    string
+}
+
+// query encodes the filters and page as a URL query string
+func (f filters) query(page int) string {
+	v := url.Values{}
+	if f.Machine != "" {
+		v.Set("machine", f.Machine)
+	}
+	if f.Path != "" {
+		v.Set("path", f.Path)
+	}
+	if page > 1 {
+		v.Set("page", strconv.Itoa(page))
+	}
+	if len(v) == 0 {
+		return ""
+	}
+	return "?" + v.Encode()
+}
+
+// New parses the embedded templates and creates the UI.
+// basePath is the prefix the UI is mounted under, e.g. "/ui".
+func New(q *recorddb.Queries, basePath string) (*UI, error) {
+	basePath = strings.TrimRight(basePath, "/")
+	funcs := template.FuncMap{
+		"url": func(path string) string { return basePath + path },
+		"setURL": func(hash string) string {
+			return basePath + "/sets/" + url.PathEscape(hash)
+		},
+		"bytes": formatBytes,
+		"time": func(t pgtype.Timestamp) string {
+			if !t.Valid {
+				return ""
+			}
+			return t.Time.Format(time.DateTime)
+		},
+		"uuid": formatUUID,
+	}
+
+	templates := make(map[string]*template.Template)
+	for _, page := range []string{"index.html", "set.html"} {
+		t, err := template.New("layout.html").Funcs(funcs).ParseFS(templateFS, "templates/layout.html", "templates/"+page)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse template %s: %w", page, err)
+		}
+		templates[page] = t
+	}
+
+	return &UI{q: q, basePath: basePath, templates: templates}, nil
+}
+
+// WithWriteAuth makes requests that change state, such as selecting a keeper,
+// pass through the given middleware, e.g. to require the admin token
+func (u *UI) WithWriteAuth(mw func(http.Handler) http.Handler) *UI {
+	u.writeAuth = mw
+	return u
+}
+
+// Routes returns a router serving the UI, intended to be mounted under a prefix
+func (u *UI) Routes() chi.Router {
+	r := chi.NewRouter()
+
+	static, _ := fs.Sub(staticFS, "static")
+	r.Handle("/static/*", http.StripPrefix("/static/", http.FileServer(http.FS(static))))
+
+	r.Get("/", u.index)
+	r.Get("/sets/{hash}", u.set)
+	r.Group(func(r chi.Router) {
+		if u.writeAuth != nil {
+			r.Use(u.writeAuth)
+		}
+		r.Post("/sets/{hash}/keeper", u.selectKeeper)
+	})
+	return r
+}
+
+func (u *UI) index(w http.ResponseWriter, r *http.Request) {
+	f := filters{
+		Machine: r.URL.Query().Get("machine"),
+		Path:    r.URL.Query().Get("path"),
+	}
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+
+	summary, err := u.q.GetDuplicateSummary(r.Context())
+	if err != nil {
+		u.fail(w, "Failed to load summary", err)
+		return
+	}
+
+	total, err := u.q.CountDuplicateSets(r.Context(), recorddb.CountDuplicateSetsParams{
+		MachineID:  f.Machine,
+		PathPrefix: f.Path,
+	})
+	if err != nil {
+		u.fail(w, "Failed to count duplicate sets", err)
+		return
+	}
+
+	sets, err := u.q.ListDuplicateSets(r.Context(), recorddb.ListDuplicateSetsParams{
+		MachineID:  f.Machine,
+		PathPrefix: f.Path,
+		PageSize:   defaultPageSize,
+		PageOffset: int32((page - 1) * defaultPageSize),
+	})
+	if err != nil {
+		u.fail(w, "Failed to list duplicate sets", err)
+		return
+	}
+
+	pages := int((total + defaultPageSize - 1) / defaultPageSize)
+	data := map[string]any{
+		"Summary": summary,
+		"Sets":    sets,
+		"Filters": f,
+		"Total":   total,
+		"Page":    page,
+		"Pages":   pages,
+	}
+	if page > 1 {
+		data["PrevURL"] = f.query(page - 1)
+	}
+	if page < pages {
+		data["NextURL"] = f.query(page + 1)
+	}
+
+	u.render(w, "index.html", data)
+}
+
+func (u *UI) set(w http.ResponseWriter, r *http.Request) {
+	hash := chi.URLParam(r, "hash")
+
+	files, err := u.q.ListFilesByHash(r.Context(), hash)
+	if err != nil {
+		u.fail(w, "Failed to load duplicate set", err)
+		return
+	}
+	if len(files) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	var active int64
+	for _, f := range files {
+		if f.QuarantineState == "active" {
+			active++
+		}
+	}
+	var wasted int64
+	if active > 1 {
+		wasted = files[0].Size * (active - 1)
+	}
+
+	u.render(w, "set.html", map[string]any{
+		"Hash":   hash,
+		"Files":  files,
+		"Size":   files[0].Size,
+		"Active": active,
+		"Wasted": wasted,
+	})
+}
+
+func (u *UI) selectKeeper(w http.ResponseWriter, r *http.Request) {
+	// Browsers resend cached credentials, so forms posted from other sites
+	// must not change the selection
+	if !sameOrigin(r) {
+		http.Error(w, "Cross-origin request rejected", http.StatusForbidden)
+		return
+	}
+	hash := chi.URLParam(r, "hash")
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form", http.StatusBadRequest)
+		return
+	}
+
+	fileID := r.PostForm.Get("file_id")
+	if fileID == "" || r.PostForm.Get("clear") != "" {
+		if err := u.q.ClearKeeper(r.Context(), hash); err != nil {
+			u.fail(w, "Failed to clear keeper", err)
+			return
+		}
+	} else {
+		var id pgtype.UUID
+		if err := id.Scan(fileID); err != nil {
+			http.Error(w, "Invalid file ID", http.StatusBadRequest)
+			return
+		}
+		n, err := u.q.SetKeeper(r.Context(), recorddb.SetKeeperParams{ID: id, Hash: hash})
+		if err != nil {
+			u.fail(w, "Failed to select keeper", err)
+			return
+		}
+		if n == 0 {
+			http.Error(w, "File is not an active copy of this set", http.StatusBadRequest)
+			return
+		}
+	}
+
+	slog.Info("Keeper selection updated", "hash", hash, "fileID", fileID)
+	http.Redirect(w, r, u.basePath+"/sets/"+url.PathEscape(hash), http.StatusSeeOther)
+}
+
+// sameOrigin reports whether a request comes from a page of this server.
+// Browsers send Sec-Fetch-Site or Origin with every form post; requests with
+// neither do not come from a browser and cannot be forged by another site.
+func sameOrigin(r *http.Request) bool {
+	if site := r.Header.Get("Sec-Fetch-Site"); site != "" {
+		return site == "same-origin" || site == "none"
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+// render executes a page template into a buffer so errors never produce half a page
+func (u *UI) render(w http.ResponseWriter, page string, data any) {
+	var buf bytes.Buffer
+	if err := u.templates[page].Execute(&buf, data); err != nil {
+		u.fail(w, "Failed to render page", err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	buf.WriteTo(w)
+}
+
+func (u *UI) fail(w http.ResponseWriter, msg string, err error) {
+	slog.Error(msg, "error", err)
+	http.Error(w, msg, http.StatusInternalServerError)
+}
+
+// formatBytes converts bytes to a human-readable string (KB, MB, GB, etc.)
+func formatBytes(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
+
+// formatUUID renders a UUID in its canonical string form
+func formatUUID(id pgtype.UUID) string {
+	if !id.Valid {
+		return ""
+	}
+	b := id.Bytes
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}